@@ -0,0 +1,429 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gomemcached"
+)
+
+// The largest value that an ASCII protocol store command may send.
+var maxASCIIValueBytes = uint64(20 * 1024 * 1024)
+
+const maxASCIIKeyLength = 250
+
+// Starts a listener for the classic memcached ASCII text protocol,
+// whose connections use the default bucket, as there's no SASL auth.
+func StartASCIIServer(addr string, maxConns int, buckets *Buckets,
+	defaultBucketName string) (net.Listener, error) {
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		asciiSessionLoop)
+	return ls, nil
+}
+
+type asciiSession struct {
+	rh *reqHandler
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func asciiSessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
+	doneFun func()) {
+	defer s.Close()
+	defer doneFun()
+
+	a := &asciiSession{rh: handler, r: bufio.NewReader(s), w: bufio.NewWriter(s)}
+
+	var err error
+	for err == nil {
+		err = a.handleCommand()
+		if a.r.Buffered() == 0 || err != nil { // Batch pipelined replies.
+			if ferr := a.w.Flush(); err == nil {
+				err = ferr
+			}
+		}
+	}
+	if err != io.EOF {
+		log.Printf("error: asciiSessionLoop, addr: %v, err: %v", addr, err)
+	}
+}
+
+func (a *asciiSession) reply(s string) error {
+	_, err := a.w.WriteString(s + "\r\n")
+	return err
+}
+
+func (a *asciiSession) handleCommand() error {
+	line, err := a.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return a.reply("ERROR")
+	}
+	for _, key := range asciiKeys(args) {
+		if len(key) > maxASCIIKeyLength {
+			return a.reply("CLIENT_ERROR bad command line format")
+		}
+	}
+
+	switch args[0] {
+	case "get", "gets":
+		return a.doGet(args)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return a.doStore(args)
+	case "incr", "decr":
+		return a.doArith(args)
+	case "delete":
+		return a.doDelete(args)
+	case "touch":
+		return a.doTouch(args)
+	case "stats":
+		return a.doStats(args)
+	case "version":
+		return a.reply("VERSION " + VERSION)
+	case "quit":
+		return io.EOF
+	}
+	return a.reply("ERROR")
+}
+
+// Returns the keys of a command line.
+func asciiKeys(args []string) []string {
+	switch args[0] {
+	case "get", "gets":
+		return args[1:]
+	case "set", "add", "replace", "append", "prepend", "cas",
+		"incr", "decr", "delete", "touch":
+		if len(args) > 1 {
+			return args[1:2]
+		}
+	}
+	return nil
+}
+
+// Strips an optional trailing noreply from a command line.
+func asciiNoreply(args []string) ([]string, bool) {
+	if len(args) > 1 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// Sends a request to the key's vbucket in the current bucket.
+func (a *asciiSession) dispatch(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if a.rh.currentBucket != nil {
+		req.VBucket = VBucketIdForKey(req.Key,
+			a.rh.currentBucket.GetBucketSettings().NumPartitions)
+	}
+	res := a.rh.HandleMessage(ioutil.Discard, nil, req)
+	if res == nil {
+		return &gomemcached.MCResponse{}
+	}
+	return res
+}
+
+// The reply for an error response that has no command specific
+// ASCII equivalent.
+func asciiServerError(res *gomemcached.MCResponse) string {
+	if len(res.Body) > 0 {
+		return "SERVER_ERROR " + string(res.Body)
+	}
+	return fmt.Sprintf("SERVER_ERROR %v", res.Status)
+}
+
+func (a *asciiSession) doGet(args []string) error {
+	if len(args) < 2 {
+		return a.reply("ERROR")
+	}
+	for _, key := range args[1:] {
+		res := a.dispatch(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(key),
+		})
+		if res.Fatal {
+			return io.EOF
+		}
+		if res.Status != gomemcached.SUCCESS {
+			continue
+		}
+		flag := uint32(0)
+		if len(res.Extras) >= 4 {
+			flag = binary.BigEndian.Uint32(res.Extras)
+		}
+		s := fmt.Sprintf("VALUE %s %d %d", key, flag, len(res.Body))
+		if args[0] == "gets" {
+			s = s + fmt.Sprintf(" %d", res.Cas)
+		}
+		if err := a.reply(s); err != nil {
+			return err
+		}
+		if _, err := a.w.Write(res.Body); err != nil {
+			return err
+		}
+		if err := a.reply(""); err != nil {
+			return err
+		}
+	}
+	return a.reply("END")
+}
+
+var asciiStoreOps = map[string]gomemcached.CommandCode{
+	"set":     gomemcached.SET,
+	"add":     gomemcached.ADD,
+	"replace": gomemcached.REPLACE,
+	"append":  gomemcached.APPEND,
+	"prepend": gomemcached.PREPEND,
+	"cas":     gomemcached.SET,
+}
+
+// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+func (a *asciiSession) doStore(args []string) error {
+	args, noreply := asciiNoreply(args)
+	nargs := 5
+	if args[0] == "cas" {
+		nargs = 6
+	}
+	if len(args) != nargs {
+		return a.reply("ERROR")
+	}
+	n, err := strconv.ParseUint(args[4], 10, 32)
+	if err != nil {
+		return a.reply("CLIENT_ERROR bad command line format")
+	}
+	if n > maxASCIIValueBytes {
+		// Swallow the data block, so the connection stays usable.
+		if _, err = io.CopyN(ioutil.Discard, a.r, int64(n+2)); err != nil {
+			return err
+		}
+		if noreply {
+			return nil
+		}
+		return a.reply("SERVER_ERROR object too large for cache")
+	}
+	data := make([]byte, n+2)
+	if _, err = io.ReadFull(a.r, data); err != nil {
+		return err
+	}
+	if string(data[n:]) != "\r\n" {
+		return a.reply("CLIENT_ERROR bad data chunk")
+	}
+
+	flag, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return a.reply("CLIENT_ERROR bad command line format")
+	}
+	exp, err := strconv.ParseUint(args[3], 10, 32)
+	if err != nil {
+		return a.reply("CLIENT_ERROR bad command line format")
+	}
+	req := &gomemcached.MCRequest{
+		Opcode: asciiStoreOps[args[0]],
+		Key:    []byte(args[1]),
+		Body:   data[:n],
+	}
+	if args[0] == "cas" {
+		if req.Cas, err = strconv.ParseUint(args[5], 10, 64); err != nil {
+			return a.reply("CLIENT_ERROR bad command line format")
+		}
+	}
+	if req.Opcode != gomemcached.APPEND && req.Opcode != gomemcached.PREPEND {
+		req.Extras = make([]byte, 8)
+		binary.BigEndian.PutUint32(req.Extras, uint32(flag))
+		binary.BigEndian.PutUint32(req.Extras[4:], uint32(exp))
+	}
+
+	res := a.dispatch(req)
+	if res.Fatal {
+		return io.EOF
+	}
+	s := "STORED"
+	switch res.Status {
+	case gomemcached.SUCCESS:
+	case gomemcached.KEY_EEXISTS:
+		s = "NOT_STORED"
+		if args[0] == "cas" {
+			s = "EXISTS"
+			// A CAS mismatch might be because the item is gone.
+			get := a.dispatch(&gomemcached.MCRequest{
+				Opcode: gomemcached.GET,
+				Key:    req.Key,
+			})
+			if get.Status == gomemcached.KEY_ENOENT {
+				s = "NOT_FOUND"
+			}
+		}
+	case gomemcached.KEY_ENOENT:
+		s = "NOT_STORED"
+		if args[0] == "cas" {
+			s = "NOT_FOUND"
+		}
+	case gomemcached.NOT_STORED:
+		s = "NOT_STORED"
+	default:
+		s = asciiServerError(res)
+	}
+	if noreply {
+		return nil
+	}
+	return a.reply(s)
+}
+
+// <incr|decr> <key> <value> [noreply]
+func (a *asciiSession) doArith(args []string) error {
+	args, noreply := asciiNoreply(args)
+	if len(args) != 3 {
+		return a.reply("ERROR")
+	}
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return a.reply("CLIENT_ERROR invalid numeric delta argument")
+	}
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.INCREMENT,
+		Key:    []byte(args[1]),
+		Extras: make([]byte, 8+8+4),
+	}
+	if args[0] == "decr" {
+		req.Opcode = gomemcached.DECREMENT
+	}
+	binary.BigEndian.PutUint64(req.Extras, delta)
+	binary.BigEndian.PutUint64(req.Extras[8:], ^uint64(0)) // Don't create.
+
+	res := a.dispatch(req)
+	if res.Fatal {
+		return io.EOF
+	}
+	var s string
+	switch res.Status {
+	case gomemcached.SUCCESS:
+		if len(res.Body) != 8 {
+			s = "SERVER_ERROR bad incr/decr response"
+		} else {
+			s = strconv.FormatUint(binary.BigEndian.Uint64(res.Body), 10)
+		}
+	case gomemcached.KEY_ENOENT:
+		s = "NOT_FOUND"
+	case gomemcached.EINVAL:
+		s = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	default:
+		s = asciiServerError(res)
+	}
+	if noreply {
+		return nil
+	}
+	return a.reply(s)
+}
+
+// delete <key> [0] [noreply]
+func (a *asciiSession) doDelete(args []string) error {
+	args, noreply := asciiNoreply(args)
+	if len(args) == 3 && args[2] == "0" { // Legacy clients send a time.
+		args = args[:2]
+	}
+	if len(args) != 2 {
+		return a.reply("CLIENT_ERROR bad command line format")
+	}
+	res := a.dispatch(&gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte(args[1]),
+	})
+	if res.Fatal {
+		return io.EOF
+	}
+	s := "DELETED"
+	switch res.Status {
+	case gomemcached.SUCCESS:
+	case gomemcached.KEY_ENOENT:
+		s = "NOT_FOUND"
+	default:
+		s = asciiServerError(res)
+	}
+	if noreply {
+		return nil
+	}
+	return a.reply(s)
+}
+
+// touch <key> <exptime> [noreply]
+func (a *asciiSession) doTouch(args []string) error {
+	args, noreply := asciiNoreply(args)
+	if len(args) != 3 {
+		return a.reply("ERROR")
+	}
+	exp, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return a.reply("CLIENT_ERROR invalid exptime argument")
+	}
+	req := &gomemcached.MCRequest{
+		Opcode: TOUCH,
+		Key:    []byte(args[1]),
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(exp))
+
+	res := a.dispatch(req)
+	if res.Fatal {
+		return io.EOF
+	}
+	s := "TOUCHED"
+	switch res.Status {
+	case gomemcached.SUCCESS:
+	case gomemcached.KEY_ENOENT:
+		s = "NOT_FOUND"
+	default:
+		s = asciiServerError(res)
+	}
+	if noreply {
+		return nil
+	}
+	return a.reply(s)
+}
+
+// stats [<key>]
+func (a *asciiSession) doStats(args []string) error {
+	b := a.rh.currentBucket
+	if b == nil {
+		return a.reply("SERVER_ERROR no bucket")
+	}
+	ch := make(chan statItem)
+	go func() {
+		sendStats(b, strings.Join(args[1:], " "), ch)
+		close(ch)
+	}()
+	var err error
+	for si := range ch {
+		if err == nil {
+			err = a.reply("STAT " + si.key + " " + si.val)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return a.reply("END")
+}
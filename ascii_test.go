@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testASCIIConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (testASCIIConn) Close() error { return nil }
+
+func testASCII(rh *reqHandler, in string) string {
+	out := &bytes.Buffer{}
+	asciiSessionLoop(testASCIIConn{strings.NewReader(in), out}, "test", rh,
+		func() {})
+	return out.String()
+}
+
+func TestASCIICommands(t *testing.T) {
+	d, buckets, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	rh := &reqHandler{
+		buckets:           buckets,
+		currentBucket:     bucket,
+		currentBucketName: "default",
+	}
+
+	tests := []struct {
+		in, exp string
+	}{
+		{"version\r\n", "VERSION " + VERSION + "\r\n"},
+		{"bogus\r\n", "ERROR\r\n"},
+		{"\r\n", "ERROR\r\n"},
+		{"get a\r\n", "END\r\n"},
+		{"set a 5 0 3\r\nabc\r\n", "STORED\r\n"},
+		{"get a\r\n", "VALUE a 5 3\r\nabc\r\nEND\r\n"},
+		{"get a nope a\n", "VALUE a 5 3\r\nabc\r\nVALUE a 5 3\r\nabc\r\nEND\r\n"},
+		{"add a 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"add b 0 0 1\r\nx\r\n", "STORED\r\n"},
+		{"replace nope 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace b 0 0 1\r\ny\r\nget b\r\n", "STORED\r\nVALUE b 0 1\r\ny\r\nEND\r\n"},
+		{"append b 0 0 2\r\nzz\r\nprepend b 0 0 1\r\nx\r\nget b\r\n",
+			"STORED\r\nSTORED\r\nVALUE b 0 4\r\nxyzz\r\nEND\r\n"},
+		{"set q 0 0 1 noreply\r\nq\r\nget q\r\n", "VALUE q 0 1\r\nq\r\nEND\r\n"},
+		{"set n 0 0 2\r\n10\r\nincr n 5\r\ndecr n 20\r\nincr nope 1\r\nincr a 1\r\n",
+			"STORED\r\n15\r\n0\r\nNOT_FOUND\r\n" +
+				"CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"incr n x\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"incr n 1 noreply\r\nget n\r\n", "VALUE n 0 1\r\n1\r\nEND\r\n"},
+		{"delete n\r\ndelete n\r\ndelete q 0 noreply\r\nget q\r\n",
+			"DELETED\r\nNOT_FOUND\r\nEND\r\n"},
+		{"touch a 1000\r\ntouch nope 1000\r\n", "TOUCHED\r\nNOT_FOUND\r\n"},
+		{"touch a x\r\n", "CLIENT_ERROR invalid exptime argument\r\n"},
+		{"set b 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\nERROR\r\n"},
+		{"set b 0 0 x\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"set b 0 0\r\n", "ERROR\r\n"},
+		{"get " + strings.Repeat("k", 251) + "\r\n",
+			"CLIENT_ERROR bad command line format\r\n"},
+		{"quit\r\nversion\r\n", ""},
+	}
+
+	for i, test := range tests {
+		got := testASCII(rh, test.in)
+		if got != test.exp {
+			t.Errorf("test #%v, expected %q for %q, got: %q",
+				i, test.exp, test.in, got)
+		}
+	}
+}
+
+func TestASCIITooLarge(t *testing.T) {
+	defer func(max uint64) { maxASCIIValueBytes = max }(maxASCIIValueBytes)
+	maxASCIIValueBytes = 4
+
+	got := testASCII(&reqHandler{},
+		"set a 0 0 5\r\nabcde\r\nset a 0 0 5 noreply\r\nabcde\r\nversion\r\n")
+	exp := "SERVER_ERROR object too large for cache\r\nVERSION " + VERSION + "\r\n"
+	if got != exp {
+		t.Errorf("expected %q, got: %q", exp, got)
+	}
+}
+
+func TestASCIICas(t *testing.T) {
+	d, buckets, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	rh := &reqHandler{
+		buckets:           buckets,
+		currentBucket:     bucket,
+		currentBucketName: "default",
+	}
+
+	testASCII(rh, "set a 0 0 1\r\nx\r\n")
+	got := testASCII(rh, "gets a\r\n")
+	var cas uint64
+	if _, err := fmt.Sscanf(got, "VALUE a 0 1 %d\r\n", &cas); err != nil || cas == 0 {
+		t.Fatalf("expected gets to return a cas, got: %q, %v", got, err)
+	}
+
+	tests := []struct {
+		in, exp string
+	}{
+		{fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", cas+1), "EXISTS\r\n"},
+		{fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", cas), "STORED\r\n"},
+		{fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", cas), "EXISTS\r\n"},
+		{"get a\r\n", "VALUE a 0 1\r\ny\r\nEND\r\n"},
+		{"cas nope 0 0 1 1\r\nz\r\n", "NOT_FOUND\r\n"},
+		{"cas a 0 0 1\r\nz\r\n", "ERROR\r\nERROR\r\n"},
+	}
+	for i, test := range tests {
+		got := testASCII(rh, test.in)
+		if got != test.exp {
+			t.Errorf("test #%v, expected %q for %q, got: %q",
+				i, test.exp, test.in, got)
+		}
+	}
+}
+
+func TestASCIIStats(t *testing.T) {
+	d, buckets, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	got := testASCII(&reqHandler{buckets: buckets}, "stats\r\n")
+	if got != "SERVER_ERROR no bucket\r\n" {
+		t.Errorf("expected stats without a bucket to fail, got: %q", got)
+	}
+	got = testASCII(&reqHandler{buckets: buckets, currentBucket: bucket},
+		"stats\r\n")
+	if !strings.HasPrefix(got, "STAT uptime ") ||
+		!strings.Contains(got, "\r\nSTAT version "+VERSION+"\r\n") ||
+		!strings.HasSuffix(got, "\r\nEND\r\n") {
+		t.Errorf("expected stats, got: %q", got)
+	}
+}
+
+func TestASCIIListener(t *testing.T) {
+	d, buckets, _ := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+
+	l, err := StartASCIIServer("127.0.0.1:0", 100, buckets, "default")
+	if err != nil {
+		t.Fatalf("Error starting ascii listener: %v", err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v", l.Addr(), err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("set a 0 0 1\r\nx\r\nget a\r\nquit\r\n")); err != nil {
+		t.Fatalf("Error sending commands: %v", err)
+	}
+	lines := []string{}
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if strings.Join(lines, ",") != "STORED,VALUE a 0 1,x,END" {
+		t.Errorf("expected ascii replies, got: %#v", lines)
+	}
+}
@@ -102,6 +102,11 @@ func (a authenticationFilter) ServeHTTP(w http.ResponseWriter, r *http.Request)
 				log.Printf("error: incorrect password, user: %v", u)
 			}
 		}
+	} else if u := tlsCertUser(r.TLS); u != "" {
+		// A client certificate only authenticates as a bucket.
+		if u != *adminUser && buckets.Get(u) != nil {
+			context.Set(r, authInfoKey, httpUser(u))
+		}
 	}
 }
 
@@ -0,0 +1,252 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steveyen/gkvlite"
+)
+
+const BACKUP_MANIFEST = "manifest.json"
+
+// A backupManifest describes a backup directory, which holds a copy
+// of each of a bucket's store files and its settings.  The manifest
+// is written last, so a backup without one is incomplete.
+type backupManifest struct {
+	Bucket string    `json:"bucket"`
+	Name   string    `json:"name"`
+	Time   time.Time `json:"time"`
+	Files  []string  `json:"files"`
+
+	// An incremental backup only has the changes after the Since
+	// backup's Cas, and no key indexes.
+	Since    string            `json:"since,omitempty"`
+	SinceCas map[uint16]uint64 `json:"sinceCas,omitempty"`
+
+	Cas     map[uint16]uint64 `json:"cas"` // The last change of each vbucket.
+	Changes int64             `json:"changes"`
+}
+
+func (m *backupManifest) incremental() bool {
+	return m.Since != ""
+}
+
+func readBackupManifest(dir string) (*backupManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, BACKUP_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	m := &backupManifest{}
+	if err = jsonUnmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *backupManifest) write(dir string) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	fnameNew := filepath.Join(dir, BACKUP_MANIFEST+".new")
+	if err = ioutil.WriteFile(fnameNew, j, 0666); err != nil {
+		return err
+	}
+	return os.Rename(fnameNew, filepath.Join(dir, BACKUP_MANIFEST))
+}
+
+// Backs up a bucket into a new dir, while writes continue.  With a
+// since manifest, only the changes after it are backed up.
+func backupBucket(b Bucket, dir, name string, since *backupManifest) (
+	m *backupManifest, err error) {
+	settings := b.GetBucketSettings()
+	if settings.MemoryOnly != MemoryOnly_LEVEL_PERSIST_EVERYTHING {
+		return nil, fmt.Errorf("bucket %v doesn't persist its items", b.Name())
+	}
+	if err = os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return nil, err
+	}
+	if err = os.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err = settings.save(dir); err != nil {
+		return nil, err
+	}
+
+	m = &backupManifest{
+		Bucket: b.Name(),
+		Name:   name,
+		Time:   time.Now(),
+		Cas:    map[uint16]uint64{},
+	}
+	if since != nil {
+		m.Since = since.Name
+		m.SinceCas = since.Cas
+	}
+	for i := 0; i < STORES_PER_BUCKET; i++ {
+		bs := b.GetBucketStore(i)
+		if bs == nil {
+			return nil, fmt.Errorf("bucket %v missing bucketstore: %v", b.Name(), i)
+		}
+		fname := makeStoreFileName(strconv.Itoa(i), 0, STORE_FILE_SUFFIX)
+		err = bs.backup(filepath.Join(dir, fname), m)
+		if err != nil {
+			return nil, err
+		}
+		m.Files = append(m.Files, fname)
+	}
+	return m, m.write(dir)
+}
+
+// Copies a point in time snapshot of the store into a new file at
+// path, noting the last change of each vbucket in the manifest.  Like
+// compaction, this holds the diskLock, so flushing waits, but
+// mutations continue.
+func (s *bucketstore) backup(path string, m *backupManifest) error {
+	s.diskLock.Lock()
+	defer s.diskLock.Unlock()
+
+	bsf := s.BSF()
+	if bsf.file == nil {
+		return fmt.Errorf("backup of a memory-only bucketstore: %v", s.name)
+	}
+	snapshot := s.snapshotPartitions(bsf)
+	if snapshot == nil {
+		return fmt.Errorf("backup snapshot failed: %v", bsf.path)
+	}
+	defer snapshot.Close()
+
+	file, err := s.openFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dst, err := gkvlite.NewStoreEx(file,
+		mkBucketStoreCallbacks(s.keyCompareForCollection))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// TODO: Parametrize writeEvery.
+	writeEvery := 1000
+
+	collNames := snapshot.GetCollectionNames()
+	sort.Strings(collNames)
+	for _, collName := range collNames {
+		src := snapshot.GetCollection(collName)
+		if src == nil {
+			return fmt.Errorf("backup coll missing: %v, collName: %v",
+				bsf.path, collName)
+		}
+		if strings.HasSuffix(collName, COLL_SUFFIX_KEYS) && m.incremental() {
+			continue // Restore rebuilds them from the changes.
+		}
+		dstColl := dst.SetCollection(collName, s.KeyCompareForCollection(collName))
+		if !strings.HasSuffix(collName, COLL_SUFFIX_CHANGES) {
+			if _, _, err = copyColl(src, dstColl, writeEvery, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		vbid, err := strconv.Atoi(collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)])
+		if err != nil {
+			return err
+		}
+		var n, lastCas uint64
+		if m.incremental() {
+			lastCas = m.SinceCas[uint16(vbid)]
+			n, err = copyChangesSince(src, dstColl, &lastCas, writeEvery)
+		} else {
+			var lastChange *gkvlite.Item
+			n, lastChange, err = copyColl(src, dstColl, writeEvery, nil)
+			if err == nil && lastChange != nil {
+				lastCas, err = casBytesParse(lastChange.Key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		m.Cas[uint16(vbid)] = lastCas
+		m.Changes += int64(n)
+	}
+	return dst.Flush()
+}
+
+// Returns a snapshot of the store, taken while holding all the
+// partition locks, so that every partition's keys and changes agree
+// at a single point in time.  Should be called while holding the
+// diskLock, which compaction holds while it takes partition locks.
+func (s *bucketstore) snapshotPartitions(bsf *bucketstorefile) *gkvlite.Store {
+	vbids := make([]int, 0, len(s.partitions))
+	for vbid := range s.partitions {
+		vbids = append(vbids, int(vbid))
+	}
+	sort.Ints(vbids)
+
+	var rv *gkvlite.Store
+	var lockRest func(i int)
+	lockRest = func(i int) {
+		if i >= len(vbids) {
+			rv = bsf.store.Snapshot()
+			return
+		}
+		s.partitions[uint16(vbids[i])].mutate(
+			func(keys, changes *gkvlite.Collection) {
+				lockRest(i + 1)
+			})
+	}
+	lockRest(0)
+	return rv
+}
+
+// Copies the changes with a CAS after lastCas, which is updated to
+// the last copied change's CAS, returning how many were copied.
+func copyChangesSince(src, dst *gkvlite.Collection, lastCas *uint64,
+	writeEvery int) (n uint64, err error) {
+	var errVisit error
+	err = src.VisitItemsAscend(casBytes(*lastCas+1), true,
+		func(i *gkvlite.Item) bool {
+			if *lastCas, errVisit = casBytesParse(i.Key); errVisit != nil {
+				return false
+			}
+			if errVisit = dst.SetItem(i.Copy()); errVisit != nil {
+				return false
+			}
+			n++
+			if writeEvery > 0 && n%uint64(writeEvery) == 0 {
+				if errVisit = dst.Write(); errVisit != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return 0, err
+	}
+	return n, errVisit
+}
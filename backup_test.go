@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
+)
+
+func TestBackupManifestRoundTrip(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+
+	if _, err := readBackupManifest(d); err == nil {
+		t.Errorf("expected a missing manifest to fail")
+	}
+	m := &backupManifest{
+		Bucket:   "b",
+		Name:     "n",
+		Files:    []string{"0-0.store"},
+		Since:    "s",
+		SinceCas: map[uint16]uint64{0: 5},
+		Cas:      map[uint16]uint64{0: 10, 1: 3},
+		Changes:  5,
+	}
+	if err := m.write(d); err != nil {
+		t.Fatalf("expected write to work, got: %v", err)
+	}
+	m2, err := readBackupManifest(d)
+	if err != nil {
+		t.Fatalf("expected read to work, got: %v", err)
+	}
+	if !m2.incremental() || m2.Cas[0] != 10 || m2.Cas[1] != 3 ||
+		m2.SinceCas[0] != 5 || m2.Changes != 5 || len(m2.Files) != 1 {
+		t.Errorf("expected manifest to round-trip, got: %#v", m2)
+	}
+}
+
+func TestBackupBucket(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	backupDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(backupDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	set := func(i int) {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(i)),
+			Body:   []byte(strconv.Itoa(i)),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		set(i)
+	}
+
+	full, err := backupBucket(b0, filepath.Join(backupDir, "full"), "full", nil)
+	if err != nil {
+		t.Fatalf("expected full backup to work, got: %v", err)
+	}
+	// The vbucket state change is also in the changes.
+	if full.incremental() || full.Changes < 10 || full.Cas[0] == 0 ||
+		len(full.Files) != STORES_PER_BUCKET {
+		t.Errorf("expected a full backup, got: %#v", full)
+	}
+	if _, err = backupBucket(b0, filepath.Join(backupDir, "full"), "full", nil); err == nil {
+		t.Errorf("expected a backup over an existing one to fail")
+	}
+	m, err := readBackupManifest(filepath.Join(backupDir, "full"))
+	if err != nil || m.Cas[0] != full.Cas[0] {
+		t.Errorf("expected a readable manifest, got: %#v, %v", m, err)
+	}
+
+	for i := 10; i < 15; i++ {
+		set(i)
+	}
+	incr, err := backupBucket(b0, filepath.Join(backupDir, "incr"), "incr", full)
+	if err != nil {
+		t.Fatalf("expected incremental backup to work, got: %v", err)
+	}
+	if !incr.incremental() || incr.Since != "full" || incr.Changes != 5 ||
+		incr.Cas[0] <= full.Cas[0] || incr.SinceCas[0] != full.Cas[0] {
+		t.Errorf("expected an incremental backup, got: %#v", incr)
+	}
+
+	incr2, err := backupBucket(b0, filepath.Join(backupDir, "incr2"), "incr2", incr)
+	if err != nil {
+		t.Fatalf("expected empty incremental backup to work, got: %v", err)
+	}
+	if incr2.Changes != 0 || incr2.Cas[0] != incr.Cas[0] {
+		t.Errorf("expected an empty incremental backup, got: %#v", incr2)
+	}
+
+	// The incremental backup file only has changes, no keys.
+	f, err := os.Open(filepath.Join(backupDir, "incr", incr.Files[0]))
+	if err != nil {
+		t.Fatalf("expected backup file, got: %v", err)
+	}
+	defer f.Close()
+	s, err := gkvlite.NewStore(f)
+	if err != nil {
+		t.Fatalf("expected backup store, got: %v", err)
+	}
+	defer s.Close()
+	if s.GetCollection("0"+COLL_SUFFIX_KEYS) != nil {
+		t.Errorf("expected no keys in an incremental backup")
+	}
+	if s.GetCollection("0"+COLL_SUFFIX_CHANGES) == nil {
+		t.Errorf("expected changes in an incremental backup")
+	}
+}
+
+func TestBackupMemoryOnlyBucket(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	dir := filepath.Join(testBucketDir, "backup")
+	if _, err = backupBucket(b0, dir, "backup", nil); err == nil {
+		t.Errorf("expected backup of a memory-only bucket to fail")
+	}
+	if _, err = os.Stat(dir); err == nil {
+		t.Errorf("expected no backup dir")
+	}
+}
+
+func TestRestPostBucketBackup(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	b, _ := buckets.New("foo", bucketSettings)
+	defer b.Close()
+	mr := testSetupMux(d)
+
+	defer func(s string) { *backupDir = s }(*backupDir)
+	*backupDir = filepath.Join(d, "backups")
+
+	post := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", url, nil)
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := post("http://127.0.0.1/_api/buckets/foo/backup?name=b0")
+	if rr.Code != 200 {
+		t.Fatalf("expected backup to work, got: %v, %v", rr.Code, rr.Body.String())
+	}
+	m := &backupManifest{}
+	if err := json.Unmarshal(rr.Body.Bytes(), m); err != nil ||
+		m.Bucket != "foo" || m.Name != "b0" {
+		t.Errorf("expected a manifest, got: %v, %v", rr.Body.String(), err)
+	}
+	if _, err := readBackupManifest(filepath.Join(d, "backups", "foo", "b0")); err != nil {
+		t.Errorf("expected a backup dir, got: %v", err)
+	}
+
+	rr = post("http://127.0.0.1/_api/buckets/foo/backup?name=b1&since=b0")
+	if rr.Code != 200 {
+		t.Fatalf("expected incremental backup to work, got: %v, %v",
+			rr.Code, rr.Body.String())
+	}
+
+	for _, url := range []string{
+		"http://127.0.0.1/_api/buckets/foo/backup?name=..",
+		"http://127.0.0.1/_api/buckets/foo/backup?name=a/b",
+		"http://127.0.0.1/_api/buckets/foo/backup?name=b2&since=missing",
+	} {
+		if rr = post(url); rr.Code != 400 {
+			t.Errorf("expected 400 for %v, got: %v", url, rr.Code)
+		}
+	}
+	if rr = post("http://127.0.0.1/_api/buckets/notabucket/backup"); rr.Code != 404 {
+		t.Errorf("expected 404 for a missing bucket, got: %v", rr.Code)
+	}
+}
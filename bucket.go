@@ -64,6 +64,7 @@ type Bucket interface {
 	SetDDocs(old, val *DDocs) bool
 
 	GetItemBytes() int64
+	Evict() (int, error)
 
 	PushErr(err error)
 	Errs() []error
@@ -83,8 +84,10 @@ type livebucket struct {
 	observer     broadcast.Broadcaster
 	observers    int64
 
-	bucketItemBytes int64
+	bucketItemBytes int64 // Bytes of items, less evicted values.
 	activity        int64 // To track quiescence opportunities.
+	evicting        int32 // Set while an eviction pass runs.
+	evictNext       int   // The vbucket where eviction resumes.
 
 	ddocs unsafe.Pointer // *DDocs, holding the json.Unmarshal'ed design docs.
 
@@ -138,6 +141,7 @@ func NewBucket(name, dirForBucket string, settings *BucketSettings) (
 			res.Close()
 			return nil, err
 		}
+		bs.pushLog = res.PushLog
 		res.bucketstores[i] = bs
 	}
 
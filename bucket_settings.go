@@ -2,10 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -27,6 +36,45 @@ type BucketSettings struct {
 	QuotaBytes       int64  `json:"quotaBytes"`
 	MemoryOnly       int    `json:"memoryOnly"`
 	UUID             string `json:"uuid"`
+
+	// Eviction, for buckets with a quota, of values in persisted
+	// buckets or of whole items in buckets that persist nothing.
+	// The watermarks are percentages of QuotaBytes, where 0 means
+	// the default.  Eviction starts above the high watermark and
+	// goes until under the low watermark.
+	EvictionPolicy   string `json:"evictionPolicy"`
+	LowWatermarkPct  int    `json:"lowWatermarkPct"`
+	HighWatermarkPct int    `json:"highWatermarkPct"`
+
+	// How values are compressed when persisted: "none" (or ""),
+	// "snappy", "deflate" or "dictionary", where compaction trains a
+	// dictionary for small values.
+	Compression string `json:"compression"`
+
+	// Activity triggers, where 0 means off, that flush once there are
+	// that many dirty items or bytes, and that compact once that
+	// percentage of the file isn't live data.  Periodic compactions
+	// only happen within the CompactWindow time of day, like
+	// "22:00-06:00", if there's one.
+	FlushDirtyItems         int64  `json:"flushDirtyItems"`
+	FlushDirtyBytes         int64  `json:"flushDirtyBytes"`
+	CompactFragmentationPct int    `json:"compactFragmentationPct"`
+	CompactWindow           string `json:"compactWindow"`
+
+	// Encryption at rest of the bucket's files, with the keys from
+	// the EncryptionKey source, like "file:/etc/cbgb/keys" or
+	// "env:CBGB_KEYS".  New keys are added to the end of the source,
+	// and compaction re-encrypts files with the last key.
+	Encrypted     bool   `json:"encrypted"`
+	EncryptionKey string `json:"encryptionKey"`
+
+	// How flushes are made durable: "none" (or ""), where flushed
+	// data may still be in the OS cache, "fsync", where every flush
+	// is fsync'ed, or "group", where flushes are also fsync'ed, and
+	// mutations that wait to be persisted share a flush that starts
+	// within GroupCommitMs (or a default) of the first of them.
+	Durability    string `json:"durability"`
+	GroupCommitMs int    `json:"groupCommitMs"`
 }
 
 type pwverifier func(salt string, bpass, input []byte) bool
@@ -38,6 +86,111 @@ var pwverifiers = map[string]pwverifier{
 		}
 		return bytes.Equal([]byte(bpass), input)
 	},
+	"sha256": func(salt string, bpass, input []byte) bool {
+		return hashEqual(bpass, pwhashSHA256(salt, input))
+	},
+	PBKDF2_SHA256: func(salt string, bpass, input []byte) bool {
+		return hashEqual(bpass, pwhashPBKDF2SHA256(salt, input))
+	},
+	SCRAM_SHA256: func(salt string, bpass, input []byte) bool {
+		storedKey, _, ok := scramKeysParse(string(bpass))
+		if !ok {
+			return false
+		}
+		h, _ := scramKeys(pbkdf2.Key(input, []byte(salt),
+			pbkdf2Iterations, sha256.Size, sha256.New))
+		return subtle.ConstantTimeCompare(storedKey, h) == 1
+	},
+}
+
+// An older hash func, whose hash is the SCRAM-SHA-256 SaltedPassword,
+// so it's upgraded to SCRAM_SHA256 on load.
+const PBKDF2_SHA256 = "pbkdf2-sha256"
+
+// The hash func for newly set passwords, which keeps the SCRAM-SHA-256
+// StoredKey and ServerKey (RFC 5802) as "<hex>:<hex>", so that the
+// settings alone aren't enough to authenticate as the bucket.
+const SCRAM_SHA256 = "scram-sha256"
+
+const pbkdf2Iterations = 4096
+
+func pwhashSHA256(salt string, input []byte) string {
+	h := sha256.New()
+	h.Write([]byte(salt))
+	h.Write(input)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func pwhashPBKDF2SHA256(salt string, input []byte) string {
+	return hex.EncodeToString(pbkdf2.Key(input, []byte(salt),
+		pbkdf2Iterations, sha256.Size, sha256.New))
+}
+
+// Returns the SCRAM StoredKey and ServerKey for a SaltedPassword.
+func scramKeys(saltedPassword []byte) (storedKey, serverKey []byte) {
+	clientKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+	return clientKey[:], scramHMAC(saltedPassword, "Server Key")
+}
+
+func scramKeysString(saltedPassword []byte) string {
+	storedKey, serverKey := scramKeys(saltedPassword)
+	return hex.EncodeToString(storedKey) + ":" + hex.EncodeToString(serverKey)
+}
+
+func scramKeysParse(s string) (storedKey, serverKey []byte, ok bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, nil, false
+	}
+	storedKey, err := hex.DecodeString(parts[0])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, nil, false
+	}
+	serverKey, err = hex.DecodeString(parts[1])
+	if err != nil || len(serverKey) != sha256.Size {
+		return nil, nil, false
+	}
+	return storedKey, serverKey, true
+}
+
+func hashEqual(bpass []byte, h string) bool {
+	return subtle.ConstantTimeCompare(bpass, []byte(h)) == 1
+}
+
+// Hashes and sets a password, with a fresh salt.  An empty password
+// stays in cleartext, meaning the bucket has no password.
+func (bs *BucketSettings) SetPassword(password string) error {
+	if password == "" {
+		bs.PasswordHashFunc, bs.PasswordSalt, bs.PasswordHash = "", "", ""
+		return nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	bs.PasswordHashFunc = SCRAM_SHA256
+	bs.PasswordSalt = base64.StdEncoding.EncodeToString(salt)
+	bs.PasswordHash = scramKeysString(pbkdf2.Key([]byte(password),
+		[]byte(bs.PasswordSalt), pbkdf2Iterations, sha256.Size, sha256.New))
+	return nil
+}
+
+// Replaces a PBKDF2_SHA256 hash, which is the SaltedPassword, with
+// the SCRAM keys derived from it, keeping the salt.
+func (bs *BucketSettings) upgradePBKDF2Password() error {
+	sp, err := hex.DecodeString(bs.PasswordHash)
+	if err != nil {
+		return err
+	}
+	bs.PasswordHashFunc = SCRAM_SHA256
+	bs.PasswordHash = scramKeysString(sp)
+	return nil
+}
+
+// Returns true when the password is stored in cleartext.
+func (bs *BucketSettings) hasCleartextPassword() bool {
+	return bs.PasswordHashFunc == "" && bs.PasswordSalt == "" &&
+		bs.PasswordHash != ""
 }
 
 func (bs *BucketSettings) Auth(input []byte) bool {
@@ -59,13 +212,64 @@ func (bs *BucketSettings) Copy() *BucketSettings {
 // Returns a safe subset (no passwords) useful for JSON-ification.
 func (bs *BucketSettings) SafeView() map[string]interface{} {
 	return map[string]interface{}{
-		"numPartitions": bs.NumPartitions,
-		"quotaBytes":    bs.QuotaBytes,
-		"memoryOnly":    bs.MemoryOnly,
-		"uuid":          bs.UUID,
+		"numPartitions":    bs.NumPartitions,
+		"quotaBytes":       bs.QuotaBytes,
+		"memoryOnly":       bs.MemoryOnly,
+		"uuid":             bs.UUID,
+		"evictionPolicy":   bs.EvictionPolicy,
+		"lowWatermarkPct":  bs.LowWatermarkPct,
+		"highWatermarkPct": bs.HighWatermarkPct,
+		"compression":      bs.Compression,
+
+		"flushDirtyItems":         bs.FlushDirtyItems,
+		"flushDirtyBytes":         bs.FlushDirtyBytes,
+		"compactFragmentationPct": bs.CompactFragmentationPct,
+		"compactWindow":           bs.CompactWindow,
+
+		"encrypted": bs.Encrypted,
+
+		"durability":    bs.Durability,
+		"groupCommitMs": bs.GroupCommitMs,
 	}
 }
 
+// Returns the encryption keys of the bucket, or nil if it has none.
+func (bs *BucketSettings) cryptKeys() (*cryptKeys, error) {
+	if bs.EncryptionKey == "" {
+		if bs.Encrypted {
+			return nil, fmt.Errorf("encrypted bucket has no encryptionKey")
+		}
+		return nil, nil
+	}
+	return loadCryptKeys(bs.EncryptionKey)
+}
+
+// Returns whether quota eviction removes whole items, as the bucket
+// has no file to fault values back in from.
+func (bs *BucketSettings) fullEviction() bool {
+	return bs.MemoryOnly >= MemoryOnly_LEVEL_PERSIST_NOTHING
+}
+
+// Returns the watermark percentages, with defaults filled in.
+func (bs *BucketSettings) watermarkPcts() (low, high int) {
+	low, high = bs.LowWatermarkPct, bs.HighWatermarkPct
+	if low <= 0 {
+		low = defaultLowWatermarkPct
+	}
+	if high <= 0 {
+		high = defaultHighWatermarkPct
+	}
+	return low, high
+}
+
+// Returns the resident item bytes that eviction goes under and that
+// start eviction.
+func (bs *BucketSettings) watermarks() (low, high int64) {
+	lowPct, highPct := bs.watermarkPcts()
+	return bs.QuotaBytes * int64(lowPct) / 100,
+		bs.QuotaBytes * int64(highPct) / 100
+}
+
 func (bs *BucketSettings) load(bucketDir string) (exists bool, err error) {
 	b, err := ioutil.ReadFile(filepath.Join(bucketDir, "settings.json"))
 	if err != nil {
@@ -74,7 +278,26 @@ func (bs *BucketSettings) load(bucketDir string) (exists bool, err error) {
 		}
 		return false, err
 	}
-	return true, jsonUnmarshal(b, bs)
+	if err = jsonUnmarshal(b, bs); err != nil {
+		return true, err
+	}
+	upgrade := bs.hasCleartextPassword() || bs.PasswordHashFunc == PBKDF2_SHA256
+	if bs.hasCleartextPassword() {
+		// Upgrade settings from before passwords were hashed.
+		if err = bs.SetPassword(bs.PasswordHash); err != nil {
+			return true, err
+		}
+	} else if bs.PasswordHashFunc == PBKDF2_SHA256 {
+		if err = bs.upgradePBKDF2Password(); err != nil {
+			return true, err
+		}
+	}
+	if upgrade {
+		if err = bs.save(bucketDir); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
 }
 
 func (bs *BucketSettings) save(bucketDir string) error {
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
+func testScramKeys(salt, password string) string {
+	return scramKeysString(pbkdf2.Key([]byte(password), []byte(salt),
+		pbkdf2Iterations, sha256.Size, sha256.New))
+}
+
 func TestNilBucketSettingsAuth(t *testing.T) {
 	var bs *BucketSettings
 	if bs.Auth([]byte{}) {
@@ -21,6 +32,16 @@ func TestBucketSettingsAuth(t *testing.T) {
 		{"", "", "good", "bad", false},
 		{"", "", "yay", "yay", true},
 		{"", "", "", "", true},
+		{"sha256", "salt", pwhashSHA256("salt", []byte("yay")), "yay", true},
+		{"sha256", "salt", pwhashSHA256("salt", []byte("yay")), "nay", false},
+		{"sha256", "pepper", pwhashSHA256("salt", []byte("yay")), "yay", false},
+		{PBKDF2_SHA256, "salt", pwhashPBKDF2SHA256("salt", []byte("yay")), "yay", true},
+		{PBKDF2_SHA256, "salt", pwhashPBKDF2SHA256("salt", []byte("yay")), "nay", false},
+		{PBKDF2_SHA256, "salt", "yay", "yay", false},
+		{SCRAM_SHA256, "salt", testScramKeys("salt", "yay"), "yay", true},
+		{SCRAM_SHA256, "salt", testScramKeys("salt", "yay"), "nay", false},
+		{SCRAM_SHA256, "pepper", testScramKeys("salt", "yay"), "yay", false},
+		{SCRAM_SHA256, "salt", "yay", "yay", false},
 	}
 
 	for _, test := range tests {
@@ -39,3 +60,89 @@ func TestBucketSettingsAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestBucketSettingsSetPassword(t *testing.T) {
+	bs := &BucketSettings{}
+	if err := bs.SetPassword("secret"); err != nil {
+		t.Fatalf("expected SetPassword to work, err: %v", err)
+	}
+	if bs.PasswordHashFunc != SCRAM_SHA256 || bs.PasswordHash == "secret" {
+		t.Errorf("expected a hashed password, got: %#v", bs)
+	}
+	if !bs.Auth([]byte("secret")) || bs.Auth([]byte("Secret")) {
+		t.Errorf("expected auth to check the hashed password")
+	}
+
+	bs2 := &BucketSettings{}
+	bs2.SetPassword("secret")
+	if bs.PasswordSalt == bs2.PasswordSalt || bs.PasswordHash == bs2.PasswordHash {
+		t.Errorf("expected fresh salts, got: %#v, %#v", bs, bs2)
+	}
+
+	if err := bs.SetPassword(""); err != nil {
+		t.Fatalf("expected SetPassword to work, err: %v", err)
+	}
+	if !bs.Auth([]byte("")) || bs.Auth([]byte("secret")) {
+		t.Errorf("expected an empty password, got: %#v", bs)
+	}
+}
+
+func TestBucketSettingsLoadUpgradesCleartext(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+
+	bs := &BucketSettings{NumPartitions: 1, PasswordHash: "secret"}
+	if err := bs.save(d); err != nil {
+		t.Fatalf("expected save to work, err: %v", err)
+	}
+
+	bs = &BucketSettings{}
+	exists, err := bs.load(d)
+	if !exists || err != nil {
+		t.Fatalf("expected load to work, exists: %v, err: %v", exists, err)
+	}
+	if bs.PasswordHashFunc != SCRAM_SHA256 || bs.PasswordHash == "secret" {
+		t.Errorf("expected an upgraded password, got: %#v", bs)
+	}
+	if !bs.Auth([]byte("secret")) || bs.NumPartitions != 1 {
+		t.Errorf("expected upgraded settings to work, got: %#v", bs)
+	}
+
+	j, err := ioutil.ReadFile(filepath.Join(d, "settings.json"))
+	if err != nil {
+		t.Fatalf("expected settings.json, err: %v", err)
+	}
+	saved := &BucketSettings{}
+	jsonUnmarshal(j, saved)
+	if *saved != *bs {
+		t.Errorf("expected upgraded settings to be saved, got: %#v", saved)
+	}
+
+	// An empty password has nothing to hash.
+	bs = &BucketSettings{NumPartitions: 1}
+	bs.save(d)
+	bs = &BucketSettings{}
+	bs.load(d)
+	if bs.PasswordHashFunc != "" || !bs.Auth([]byte("")) {
+		t.Errorf("expected empty password to stay as is, got: %#v", bs)
+	}
+
+	// A PBKDF2 hash is the SaltedPassword, so it's replaced by the
+	// SCRAM keys, keeping the salt.
+	bs = &BucketSettings{
+		NumPartitions:    1,
+		PasswordHashFunc: PBKDF2_SHA256,
+		PasswordSalt:     "salt",
+		PasswordHash:     pwhashPBKDF2SHA256("salt", []byte("secret")),
+	}
+	bs.save(d)
+	bs = &BucketSettings{}
+	bs.load(d)
+	if bs.PasswordHashFunc != SCRAM_SHA256 || bs.PasswordSalt != "salt" ||
+		bs.PasswordHash != testScramKeys("salt", "secret") {
+		t.Errorf("expected an upgraded PBKDF2 password, got: %#v", bs)
+	}
+	if !bs.Auth([]byte("secret")) || bs.Auth([]byte("Secret")) {
+		t.Errorf("expected upgraded PBKDF2 password to work, got: %#v", bs)
+	}
+}
@@ -65,6 +65,8 @@ type BucketStats struct {
 	Prepends    int64 `json:"prepends"`
 	Incrs       int64 `json:"incrs"`
 	Decrs       int64 `json:"decrs"`
+	Touches     int64 `json:"touches"`
+	Gats        int64 `json:"gats"`
 	Deletes     int64 `json:"deletes"`
 	Creates     int64 `json:"creates"`
 	Updates     int64 `json:"updates"`
@@ -77,7 +79,13 @@ type BucketStats struct {
 	OutgoingValueBytes int64 `json:"outgoingValueBytes"`
 	ItemBytes          int64 `json:"itemBytes"`
 
-	StoreErrors int64 `json:"storeErrors"`
+	ValueEvictions    int64 `json:"valueEvictions"`
+	ValueFaults       int64 `json:"valueFaults"`
+	EvictedValueBytes int64 `json:"evictedValueBytes"`
+	ItemEvictions     int64 `json:"itemEvictions"`
+
+	StoreErrors  int64 `json:"storeErrors"`
+	LockedErrors int64 `json:"lockedErrors"`
 }
 
 func (s *BucketStats) Add(in *BucketStats) {
@@ -101,6 +109,8 @@ func (s *BucketStats) Op(in *BucketStats, op func(int64, int64) int64) {
 	s.Prepends = op(s.Prepends, atomic.LoadInt64(&in.Prepends))
 	s.Incrs = op(s.Incrs, atomic.LoadInt64(&in.Incrs))
 	s.Decrs = op(s.Decrs, atomic.LoadInt64(&in.Decrs))
+	s.Touches = op(s.Touches, atomic.LoadInt64(&in.Touches))
+	s.Gats = op(s.Gats, atomic.LoadInt64(&in.Gats))
 	s.Deletes = op(s.Deletes, atomic.LoadInt64(&in.Deletes))
 	s.Creates = op(s.Creates, atomic.LoadInt64(&in.Creates))
 	s.Updates = op(s.Updates, atomic.LoadInt64(&in.Updates))
@@ -110,7 +120,12 @@ func (s *BucketStats) Op(in *BucketStats, op func(int64, int64) int64) {
 	s.IncomingValueBytes = op(s.IncomingValueBytes, atomic.LoadInt64(&in.IncomingValueBytes))
 	s.OutgoingValueBytes = op(s.OutgoingValueBytes, atomic.LoadInt64(&in.OutgoingValueBytes))
 	s.ItemBytes = int64(op(s.ItemBytes, atomic.LoadInt64(&in.ItemBytes)))
+	s.ValueEvictions = op(s.ValueEvictions, atomic.LoadInt64(&in.ValueEvictions))
+	s.ValueFaults = op(s.ValueFaults, atomic.LoadInt64(&in.ValueFaults))
+	s.EvictedValueBytes = op(s.EvictedValueBytes, atomic.LoadInt64(&in.EvictedValueBytes))
+	s.ItemEvictions = op(s.ItemEvictions, atomic.LoadInt64(&in.ItemEvictions))
 	s.StoreErrors = op(s.StoreErrors, atomic.LoadInt64(&in.StoreErrors))
+	s.LockedErrors = op(s.LockedErrors, atomic.LoadInt64(&in.LockedErrors))
 }
 
 func (s *BucketStats) Aggregate(in Aggregatable) {
@@ -133,6 +148,8 @@ func (s *BucketStats) Equal(in *BucketStats) bool {
 		s.Prepends == atomic.LoadInt64(&in.Prepends) &&
 		s.Incrs == atomic.LoadInt64(&in.Incrs) &&
 		s.Decrs == atomic.LoadInt64(&in.Decrs) &&
+		s.Touches == atomic.LoadInt64(&in.Touches) &&
+		s.Gats == atomic.LoadInt64(&in.Gats) &&
 		s.Deletes == atomic.LoadInt64(&in.Deletes) &&
 		s.Creates == atomic.LoadInt64(&in.Creates) &&
 		s.Updates == atomic.LoadInt64(&in.Updates) &&
@@ -142,7 +159,12 @@ func (s *BucketStats) Equal(in *BucketStats) bool {
 		s.IncomingValueBytes == atomic.LoadInt64(&in.IncomingValueBytes) &&
 		s.OutgoingValueBytes == atomic.LoadInt64(&in.OutgoingValueBytes) &&
 		s.ItemBytes == atomic.LoadInt64(&in.ItemBytes) &&
-		s.StoreErrors == atomic.LoadInt64(&in.StoreErrors)
+		s.ValueEvictions == atomic.LoadInt64(&in.ValueEvictions) &&
+		s.ValueFaults == atomic.LoadInt64(&in.ValueFaults) &&
+		s.EvictedValueBytes == atomic.LoadInt64(&in.EvictedValueBytes) &&
+		s.ItemEvictions == atomic.LoadInt64(&in.ItemEvictions) &&
+		s.StoreErrors == atomic.LoadInt64(&in.StoreErrors) &&
+		s.LockedErrors == atomic.LoadInt64(&in.LockedErrors)
 }
 
 func (s *BucketStats) Send(ch chan<- statItem) {
@@ -158,6 +180,8 @@ func (s *BucketStats) Send(ch chan<- statItem) {
 	ch <- statItem{"prepends", strconv.FormatInt(s.Prepends, 10)}
 	ch <- statItem{"incrs", strconv.FormatInt(s.Incrs, 10)}
 	ch <- statItem{"decrs", strconv.FormatInt(s.Decrs, 10)}
+	ch <- statItem{"touches", strconv.FormatInt(s.Touches, 10)}
+	ch <- statItem{"gats", strconv.FormatInt(s.Gats, 10)}
 	ch <- statItem{"deletes", strconv.FormatInt(s.Deletes, 10)}
 	ch <- statItem{"creates", strconv.FormatInt(s.Creates, 10)}
 	ch <- statItem{"updates", strconv.FormatInt(s.Updates, 10)}
@@ -167,7 +191,12 @@ func (s *BucketStats) Send(ch chan<- statItem) {
 	ch <- statItem{"incoming_value_bytes", strconv.FormatInt(s.IncomingValueBytes, 10)}
 	ch <- statItem{"outgoing_value_bytes", strconv.FormatInt(s.OutgoingValueBytes, 10)}
 	ch <- statItem{"item_bytes", strconv.FormatInt(s.ItemBytes, 10)}
+	ch <- statItem{"value_evictions", strconv.FormatInt(s.ValueEvictions, 10)}
+	ch <- statItem{"value_faults", strconv.FormatInt(s.ValueFaults, 10)}
+	ch <- statItem{"evicted_value_bytes", strconv.FormatInt(s.EvictedValueBytes, 10)}
+	ch <- statItem{"item_evictions", strconv.FormatInt(s.ItemEvictions, 10)}
 	ch <- statItem{"store_errors", strconv.FormatInt(s.StoreErrors, 10)}
+	ch <- statItem{"locked_errors", strconv.FormatInt(s.LockedErrors, 10)}
 }
 
 // This is slightly more complicated than it would generally need to
@@ -193,6 +222,12 @@ func transmitStats(w io.Writer) (chan<- statItem, <-chan error) {
 
 func doStats(b Bucket, w io.Writer, key string) error {
 	ch, errs := transmitStats(w)
+	sendStats(b, key, ch)
+	close(ch)
+	return <-errs
+}
+
+func sendStats(b Bucket, key string, ch chan<- statItem) {
 	ch <- statItem{"uptime", time.Since(serverStart).String()}
 	ch <- statItem{"version", VERSION}
 
@@ -206,9 +241,6 @@ func doStats(b Bucket, w io.Writer, key string) error {
 		agg := AggregateBucketStats(b, key)
 		agg.Send(ch)
 	}
-
-	close(ch)
-	return <-errs
 }
 
 func updateMutationStats(cmdIn gomemcached.CommandCode, stats *BucketStats) (cmd gomemcached.CommandCode) {
@@ -845,6 +845,160 @@ func TestBucketQuotaBytes(t *testing.T) {
 	}
 }
 
+func TestBucketFullEviction(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	quota := int64(10000)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			QuotaBytes:    quota,
+			MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	ch := make(chan interface{}, 1000)
+	vb0.observer.Register(ch)
+
+	for i := 0; i < 50; i++ {
+		res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: 2,
+			Key:     []byte(fmt.Sprintf("k%02d", i)),
+			Body:    make([]byte, 1000),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set %v to evict instead of fail, got: %v", i, res)
+		}
+	}
+
+	if vb0.stats.ItemEvictions == 0 ||
+		vb0.stats.Items != 50-vb0.stats.ItemEvictions {
+		t.Errorf("expected items to be evicted, got: %#v", vb0.stats)
+	}
+	if b0.GetItemBytes() >= quota {
+		t.Errorf("expected to be under quota, got: %v", b0.GetItemBytes())
+	}
+
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 2,
+		Key:     []byte("toobig"),
+		Body:    make([]byte, 20000),
+	})
+	if res.Status != gomemcached.E2BIG {
+		t.Errorf("expected an item over the quota to fail, got: %v", res)
+	}
+
+	evictions := int64(0)
+	for evictions < vb0.stats.ItemEvictions {
+		var m mutation
+		select {
+		case mi := <-ch:
+			m = mi.(mutation)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %v eviction events, got: %v",
+				vb0.stats.ItemEvictions, evictions)
+		}
+		if m.evicted {
+			if !m.deleted {
+				t.Errorf("expected an eviction to be a deletion, got: %v", m)
+			}
+			evictions++
+			res = r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+				Opcode:  gomemcached.GET,
+				VBucket: 2,
+				Key:     m.key,
+			})
+			if res.Status != gomemcached.KEY_ENOENT {
+				t.Errorf("expected evicted item %s to be gone, got: %v",
+					m.key, res)
+			}
+		}
+	}
+}
+
+func TestBucketFullEvictionSkipsLocked(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:    MAX_VBUCKETS,
+			QuotaBytes:       1000,
+			LowWatermarkPct:  1,
+			HighWatermarkPct: 100,
+			MemoryOnly:       MemoryOnly_LEVEL_PERSIST_NOTHING,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	vb0, _ := b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	testLoadInts(t, r0, 2, 5)
+	res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  GET_LOCKED,
+		VBucket: 2,
+		Key:     []byte("3"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected get locked to work, got: %v", res)
+	}
+
+	n, err := b0.Evict()
+	if err != nil || n != 4 || vb0.stats.Items != 1 {
+		t.Errorf("expected all but the locked item evicted, got: %v, %v, %#v",
+			n, err, vb0.stats)
+	}
+	testExpectInts(t, r0, 2, []int{3}, "after eviction")
+}
+
+func TestBucketFullEvictionNone(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:  MAX_VBUCKETS,
+			QuotaBytes:     1000,
+			MemoryOnly:     MemoryOnly_LEVEL_PERSIST_NOTHING,
+			EvictionPolicy: "none",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+
+	for i, exp := range []gomemcached.Status{gomemcached.SUCCESS, gomemcached.E2BIG} {
+		res := r0.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: 2,
+			Key:     []byte(fmt.Sprintf("k%v", i)),
+			Body:    make([]byte, 500),
+		})
+		if res.Status != exp {
+			t.Errorf("expected set %v status %v, got: %v", i, exp, res)
+		}
+	}
+}
+
 func TestReloadOnlyNewDirectory(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
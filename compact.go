@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -21,6 +22,15 @@ func (s *bucketstore) Compact() error {
 		return nil
 	}
 
+	// Values are recompressed with the retrained dictionary as
+	// they're copied.
+	if s.compression == DATATYPE_DICT && s.persistsData() {
+		if err := s.retrainValueDict(); err != nil {
+			atomic.AddInt64(&s.stats.CompactErrors, 1)
+			return err
+		}
+	}
+
 	compactPath := bsf.path + ".compact"
 	if err := s.compactGo(bsf, compactPath); err != nil {
 		atomic.AddInt64(&s.stats.CompactErrors, 1)
@@ -35,7 +45,7 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 	bsf.removeOldFiles()   // Clean up previous, successful compactions.
 	os.Remove(compactPath) // Clean up previous, aborted compaction attempts.
 
-	compactFile, err := fileService.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	compactFile, err := s.openFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		return err
 	}
@@ -89,14 +99,21 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 		vbids = append(vbids, uint16(vbid))
 	}
 
-	return s.copyBucketStoreDeltas(bsf, compactStore,
+	err = s.copyBucketStoreDeltas(bsf, compactStore,
 		vbids, 0, lastChanges, writeEvery, func() (err error) {
 			// Copy any remaining (simple) collections (like COLL_VBMETA).
 			err = s.copyRemainingColls(bsf, collRest, compactStore, writeEvery)
 			if err != nil {
 				return err
 			}
+			err = s.pruneValueDicts(compactStore)
+			if err != nil {
+				return err
+			}
 			err = compactStore.Flush()
+			if err == nil && s.policy.fsync {
+				err = compactFile.Sync()
+			}
 			if err != nil {
 				return err
 			}
@@ -105,6 +122,15 @@ func (s *bucketstore) compactGo(bsf *bucketstorefile, compactPath string) error
 
 			return s.compactSwapFile(bsf, compactPath) // The last step.
 		})
+	if err != nil {
+		return err
+	}
+	// The compaction is done, so the dictionaries are only leaked.
+	if err = s.releaseUnusedValueDicts(); err != nil {
+		log.Printf("compact: releasing value dictionaries: %v, err: %v",
+			bsf.path, err)
+	}
+	return nil
 }
 
 func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string) error {
@@ -125,7 +151,7 @@ func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string)
 		return err
 	}
 
-	nextFile, err := fileService.OpenFile(nextPath, os.O_RDWR|os.O_CREATE)
+	nextFile, err := s.openFile(nextPath, os.O_RDWR|os.O_CREATE)
 	if err != nil {
 		return err
 	}
@@ -149,8 +175,11 @@ func (s *bucketstore) compactSwapFile(bsf *bucketstorefile, compactPath string)
 	return nil
 }
 
+// The optional transform returns the copy of an item to write, or nil
+// to skip the item.
 func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
-	writeEvery int) (numItems uint64, lastItem *gkvlite.Item, err error) {
+	writeEvery int, transform func(*gkvlite.Item) (*gkvlite.Item, error)) (
+	numItems uint64, lastItem *gkvlite.Item, err error) {
 	minItem, err := srcColl.MinItem(true)
 	if err != nil {
 		return 0, nil, err
@@ -161,7 +190,16 @@ func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 
 	var errVisit error
 	err = srcColl.VisitItemsAscend(minItem.Key, true, func(i *gkvlite.Item) bool {
-		if errVisit = dstColl.SetItem(i.Copy()); errVisit != nil {
+		iCopy := i.Copy()
+		if transform != nil {
+			if iCopy, errVisit = transform(i); errVisit != nil {
+				return false
+			}
+			if iCopy == nil {
+				return true
+			}
+		}
+		if errVisit = dstColl.SetItem(iCopy); errVisit != nil {
 			return false
 		}
 		numItems++
@@ -184,8 +222,9 @@ func copyColl(srcColl *gkvlite.Collection, dstColl *gkvlite.Collection,
 }
 
 func copyDelta(lastChangeCAS []byte, cName string, kName string,
-	srcStore *gkvlite.Store, dstStore *gkvlite.Store,
-	writeEvery int) (numVisits uint64, err error) {
+	srcStore *gkvlite.Store, dstStore *gkvlite.Store, writeEvery int,
+	transform func(*gkvlite.Item) (*gkvlite.Item, error)) (
+	numVisits uint64, err error) {
 	cSrc := srcStore.GetCollection(cName)
 	cDst := dstStore.GetCollection(cName)
 	kDst := dstStore.GetCollection(kName)
@@ -200,7 +239,13 @@ func copyDelta(lastChangeCAS []byte, cName string, kName string,
 		if numVisits <= 1 {
 			return true
 		}
-		if errVisit = cDst.SetItem(cItem.Copy()); errVisit != nil {
+		cCopy := cItem.Copy()
+		if transform != nil {
+			if cCopy, errVisit = transform(cItem); errVisit != nil {
+				return false
+			}
+		}
+		if errVisit = cDst.SetItem(cCopy); errVisit != nil {
 			return false
 		}
 		i := &item{}
@@ -304,12 +349,13 @@ func (s *bucketstore) copyVBucketColls(bsf *bucketstorefile,
 			bsf.path, vbid)
 	}
 	// TODO: Record stats on # changes processed.
-	_, lastChange, err := copyColl(cCurrSnapshot, cDest, writeEvery)
+	_, lastChange, err := copyColl(cCurrSnapshot, cDest, writeEvery,
+		s.recompressor())
 	if err != nil {
 		return 0, nil, err
 	}
 	// TODO: Record stats on # keys processed.
-	_, _, err = copyColl(kCurrSnapshot, kDest, writeEvery)
+	_, _, err = copyColl(kCurrSnapshot, kDest, writeEvery, nil)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -334,7 +380,7 @@ func (s *bucketstore) copyRemainingColls(bsf *bucketstorefile,
 			return fmt.Errorf("compact rest dest missing: %v, collName: %v",
 				bsf.path, collName)
 		}
-		_, _, err := copyColl(collCurr, collNext, writeEvery)
+		_, _, err := copyColl(collCurr, collNext, writeEvery, nil)
 		if err != nil {
 			return err
 		}
@@ -363,7 +409,7 @@ func (s *bucketstore) copyBucketStoreDeltas(bsf *bucketstorefile,
 	}
 	ps.collsPauseSwap(func() (*gkvlite.Collection, *gkvlite.Collection) {
 		_, err = copyDelta(lastChanges[vbid].Key, cName, kName,
-			bsf.store.Snapshot(), compactStore, writeEvery)
+			bsf.store.Snapshot(), compactStore, writeEvery, s.recompressor())
 		if err != nil {
 			return s.coll(kName), s.coll(cName)
 		}
@@ -304,7 +304,7 @@ func testCopyDelta(t *testing.T, writeEvery int) {
 	b1.SetVBState(2, VBActive)
 
 	numVisits, err := copyDelta(nil, cName, kName,
-		v0.bs.BSF().store, v1.bs.BSF().store, writeEvery)
+		v0.bs.BSF().store, v1.bs.BSF().store, writeEvery, nil)
 	if err != nil {
 		t.Errorf("expected copyDelta to work, got: %v", err)
 	}
@@ -323,7 +323,7 @@ func TestCopyDeltaBadNames(t *testing.T) {
 		})
 	v0, _ := b0.CreateVBucket(2)
 
-	_, err = copyDelta(nil, "foo", "bar", v0.bs.BSF().store, v0.bs.BSF().store, 0)
+	_, err = copyDelta(nil, "foo", "bar", v0.bs.BSF().store, v0.bs.BSF().store, 0, nil)
 	if err == nil {
 		t.Errorf("expected copyDelta to fail on bad coll names")
 	}
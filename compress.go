@@ -0,0 +1,147 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+// The datatype of an item's data, which is persisted in the high byte
+// of the item header's key length, as keys are at most 250 bytes.
+// Files from before compression have a 0 there, so are raw.
+const (
+	DATATYPE_RAW     = uint8(0)
+	DATATYPE_SNAPPY  = uint8(1)
+	DATATYPE_DEFLATE = uint8(2)
+	DATATYPE_DICT    = uint8(3) // Deflate with a trained dictionary.
+)
+
+// The datatype bit of a snappy compressed value in the memcached
+// binary protocol header.
+const PROTOCOL_DATATYPE_SNAPPY = uint8(0x02)
+
+// The BucketSettings.Compression names of the datatypes.
+var compressions = map[string]uint8{
+	"":           DATATYPE_RAW,
+	"none":       DATATYPE_RAW,
+	"snappy":     DATATYPE_SNAPPY,
+	"deflate":    DATATYPE_DEFLATE,
+	"dictionary": DATATYPE_DICT,
+}
+
+// Values smaller than this aren't worth compressing.
+var minCompressBytes = 64
+
+func compressValue(datatype uint8, data []byte) ([]byte, error) {
+	switch datatype {
+	case DATATYPE_RAW:
+		return data, nil
+	case DATATYPE_SNAPPY:
+		return snappy.Encode(nil, data), nil
+	case DATATYPE_DEFLATE:
+		var b bytes.Buffer
+		w, err := flate.NewWriter(&b, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(data); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case DATATYPE_DICT:
+		return nil, fmt.Errorf("compressing to datatype %v needs a dictionary",
+			datatype)
+	}
+	return nil, fmt.Errorf("unknown datatype: %v", datatype)
+}
+
+func decompressValue(datatype uint8, data []byte) ([]byte, error) {
+	switch datatype {
+	case DATATYPE_RAW:
+		return data, nil
+	case DATATYPE_SNAPPY:
+		return snappy.Decode(nil, data)
+	case DATATYPE_DEFLATE:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case DATATYPE_DICT:
+		return decompressDictValue(data)
+	}
+	return nil, fmt.Errorf("unknown datatype: %v", datatype)
+}
+
+// Returns the item's data, decompressing it if needed.  Items are
+// decompressed lazily, as they're read, so that compressed values
+// may be sent as is to clients that accept them.
+func (i *item) value() ([]byte, error) {
+	if i.datatype == DATATYPE_RAW {
+		return i.data, nil
+	}
+	return decompressValue(i.datatype, i.data)
+}
+
+// Returns the item's bytes for the changes collection, where its data
+// is compressed if the bucketstore compresses values, and doing so
+// saves space.
+func (s *bucketstore) valueBytes(i *item) []byte {
+	if s.compression == DATATYPE_RAW || i.datatype != DATATYPE_RAW ||
+		!s.persistsData() {
+		return i.toValueBytes()
+	}
+	ci := s.compressItem(i, s.compression, s.valueDict())
+	if ci != i {
+		atomic.AddInt64(&s.stats.CompressedValues, 1)
+		atomic.AddInt64(&s.stats.CompressInBytes, int64(len(i.data)))
+		atomic.AddInt64(&s.stats.CompressOutBytes, int64(len(ci.data)))
+	}
+	return ci.toValueBytes()
+}
+
+// Returns a clone of a raw item with its data compressed to the
+// datatype, or the item itself when compressing doesn't save space.
+func (s *bucketstore) compressItem(i *item, datatype uint8,
+	dict *valueDict) *item {
+	if datatype == DATATYPE_DICT && dict == nil {
+		datatype = DATATYPE_DEFLATE // Until compaction trains a dictionary.
+	}
+	var c []byte
+	var err error
+	if datatype == DATATYPE_DICT {
+		if len(i.data) < minDictCompressBytes {
+			return i
+		}
+		c, err = dict.compress(i.data)
+	} else {
+		if len(i.data) < minCompressBytes {
+			return i
+		}
+		c, err = compressValue(datatype, i.data)
+	}
+	if err != nil || len(c) >= len(i.data) {
+		return i
+	}
+	ci := i.clone()
+	ci.datatype = datatype
+	ci.data = c
+	return ci
+}
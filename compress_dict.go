@@ -0,0 +1,409 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/steveyen/gkvlite"
+)
+
+// The collection of a bucketstore's value dictionaries, keyed by
+// their training sequence number, so the last is the current one.
+const COLL_DICTS = "dicts"
+
+// Dictionary training parameters.  Only smaller values are sampled,
+// as larger values compress well enough on their own.
+var (
+	dictSampleSize     = 256
+	dictMinSamples     = 16
+	dictMaxSampleBytes = 1024
+	dictMaxBytes       = 16 * 1024
+)
+
+// Values smaller than this aren't worth compressing, even with a
+// dictionary.
+var minDictCompressBytes = 16
+
+// A valueDict is a preset deflate dictionary, trained from a sample
+// of a bucketstore's values.  Values compressed with it are prefixed
+// by its id.
+type valueDict struct {
+	id   uint32 // The crc32 of data, so equal dictionaries share an id.
+	data []byte
+	refs int // Covered by the valueDicts lock.
+
+	writers sync.Pool // Of *flate.Writer, which are costly to create.
+	readers sync.Pool // Of io.ReadCloser, which are flate.Resetters.
+}
+
+// The loaded value dictionaries by id.  They're shared by all
+// bucketstores, as item.value() decompresses without knowing its
+// bucketstore.
+var valueDicts = struct {
+	sync.Mutex
+	m map[uint32]*valueDict
+}{m: map[uint32]*valueDict{}}
+
+// Returns the registered dictionary for the data, registering it if
+// needed.  Each acquire needs a release.
+func acquireValueDict(data []byte) (*valueDict, error) {
+	id := crc32.ChecksumIEEE(data)
+
+	valueDicts.Lock()
+	defer valueDicts.Unlock()
+
+	d := valueDicts.m[id]
+	if d == nil {
+		d = &valueDict{id: id, data: data}
+		valueDicts.m[id] = d
+	} else if !bytes.Equal(d.data, data) {
+		return nil, fmt.Errorf("value dictionary id collision: %x", id)
+	}
+	d.refs++
+	return d, nil
+}
+
+func releaseValueDict(d *valueDict) {
+	valueDicts.Lock()
+	defer valueDicts.Unlock()
+
+	d.refs--
+	if d.refs <= 0 {
+		delete(valueDicts.m, d.id)
+	}
+}
+
+func lookupValueDict(id uint32) *valueDict {
+	valueDicts.Lock()
+	defer valueDicts.Unlock()
+	return valueDicts.m[id]
+}
+
+// Returns the id of the dictionary that compressed the data.
+func valueDictId(data []byte) uint32 {
+	if len(data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(data)
+}
+
+func (d *valueDict) compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, d.id)
+	w, _ := d.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		// Lower levels skip the dictionary for small values.
+		w, err = flate.NewWriterDict(&b, flate.BestCompression, d.data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&b)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	d.writers.Put(w)
+	return b.Bytes(), nil
+}
+
+func decompressDictValue(data []byte) ([]byte, error) {
+	id := valueDictId(data)
+	d := lookupValueDict(id)
+	if d == nil {
+		return nil, fmt.Errorf("unknown value dictionary: %x", id)
+	}
+	src := bytes.NewReader(data[4:])
+	r, _ := d.readers.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReaderDict(src, d.data)
+	} else if err := r.(flate.Resetter).Reset(src, d.data); err != nil {
+		return nil, err
+	}
+	v, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d.readers.Put(r)
+	return v, nil
+}
+
+// Builds a dictionary from sample values, by concatenating them, as
+// the field names and values that small JSON docs share are what
+// deflate can then refer back to.  Returns nil when there are too few
+// samples for a useful dictionary.
+func buildValueDict(samples [][]byte) []byte {
+	if len(samples) < dictMinSamples {
+		return nil
+	}
+	var b bytes.Buffer
+	for _, s := range samples {
+		if b.Len()+len(s) > dictMaxBytes {
+			break
+		}
+		b.Write(s)
+	}
+	return b.Bytes()
+}
+
+// Returns the currently trained dictionary, or nil.
+func (s *bucketstore) valueDict() *valueDict {
+	return (*valueDict)(atomic.LoadPointer(&s.dict))
+}
+
+// Loads a bucketstore's persisted dictionaries, so that its values
+// may be decompressed.
+func (s *bucketstore) loadValueDicts() error {
+	c := s.BSF().store.GetCollection(COLL_DICTS)
+	if c == nil {
+		return nil
+	}
+	var errVisit error
+	err := c.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+		var d *valueDict
+		if d, errVisit = acquireValueDict(i.Val); errVisit != nil {
+			return false
+		}
+		s.dicts = append(s.dicts, d)
+		atomic.StorePointer(&s.dict, unsafe.Pointer(d))
+		s.dictSeq, errVisit = casBytesParse(i.Key)
+		return errVisit == nil
+	})
+	if err != nil {
+		return err
+	}
+	return errVisit
+}
+
+// Acquires the dictionaries of a store that's not a bucketstore's,
+// such as a backup, so its values may be decompressed.  Each of them
+// needs a release.
+func acquireStoreValueDicts(store *gkvlite.Store) (rv []*valueDict, err error) {
+	c := store.GetCollection(COLL_DICTS)
+	if c == nil {
+		return nil, nil
+	}
+	var errVisit error
+	err = c.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+		var d *valueDict
+		if d, errVisit = acquireValueDict(i.Val); errVisit != nil {
+			return false
+		}
+		rv = append(rv, d)
+		return true
+	})
+	if err == nil {
+		err = errVisit
+	}
+	if err != nil {
+		for _, d := range rv {
+			releaseValueDict(d)
+		}
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *bucketstore) releaseValueDicts() {
+	s.diskLock.Lock()
+	defer s.diskLock.Unlock()
+	for _, d := range s.dicts {
+		releaseValueDict(d)
+	}
+	s.dicts = nil
+}
+
+// Releases the dictionaries that a compaction pruned from the file,
+// unless resident items are still compressed with them, in which
+// case a later compaction releases them.  Should be called while
+// holding the diskLock, after the compacted file is swapped in.
+func (s *bucketstore) releaseUnusedValueDicts() error {
+	if s.recompressor() == nil {
+		return nil // The dictionaries weren't pruned.
+	}
+	used := map[uint32]bool{s.valueDict().id: true}
+	for _, p := range s.partitions {
+		keys, _ := p.colls()
+		err := keys.VisitItemsAscend(nil, false, func(kItem *gkvlite.Item) bool {
+			i := (*item)(atomic.LoadPointer(&kItem.Transient))
+			if i != nil && !i.evicted && i.datatype == DATATYPE_DICT {
+				used[valueDictId(i.data)] = true
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	dicts := s.dicts[:0]
+	for _, d := range s.dicts {
+		if used[d.id] {
+			dicts = append(dicts, d)
+		} else {
+			releaseValueDict(d)
+		}
+	}
+	s.dicts = dicts
+	return nil
+}
+
+// Trains a new dictionary from a reservoir sample of the partitions'
+// resident values, which becomes the one new values are compressed
+// with.  The sample is deterministic, so that unchanged values train
+// the same dictionary and needn't be recompressed.  Should be called
+// while holding the diskLock.
+func (s *bucketstore) retrainValueDict() error {
+	vbids := make([]int, 0, len(s.partitions))
+	for vbid := range s.partitions {
+		vbids = append(vbids, int(vbid))
+	}
+	sort.Ints(vbids)
+
+	rnd := rand.New(rand.NewSource(0))
+	samples := make([][]byte, 0, dictSampleSize)
+	seen := 0
+	for _, vbid := range vbids {
+		p := s.partitions[uint16(vbid)]
+		var errValue error
+		err := p.visitItems(nil, false, func(i *item) bool {
+			if i.evicted || i.isDeletion() {
+				return true
+			}
+			var v []byte
+			if v, errValue = i.value(); errValue != nil {
+				return false
+			}
+			if len(v) < minDictCompressBytes || len(v) > dictMaxSampleBytes {
+				return true
+			}
+			seen++
+			if len(samples) < dictSampleSize {
+				samples = append(samples, v)
+			} else if j := rnd.Intn(seen); j < dictSampleSize {
+				samples[j] = v
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if errValue != nil {
+			return errValue
+		}
+	}
+	data := buildValueDict(samples)
+	if data == nil {
+		return nil
+	}
+	d, err := acquireValueDict(data)
+	if err != nil {
+		return err
+	}
+	if d == s.valueDict() { // The values haven't changed.
+		releaseValueDict(d)
+		return nil
+	}
+	if err = s.collMeta(COLL_DICTS).Set(casBytes(s.dictSeq+1), data); err != nil {
+		releaseValueDict(d)
+		return err
+	}
+	s.dictSeq++
+	s.dicts = append(s.dicts, d)
+	atomic.StorePointer(&s.dict, unsafe.Pointer(d))
+	atomic.AddInt64(&s.stats.DictTrainings, 1)
+	return nil
+}
+
+// Returns a compaction transform of changes items, which recompresses
+// their values with the current dictionary, or nil when values aren't
+// compressed with a dictionary.
+func (s *bucketstore) recompressor() func(*gkvlite.Item) (*gkvlite.Item, error) {
+	d := s.valueDict()
+	if s.compression != DATATYPE_DICT || d == nil {
+		return nil
+	}
+	return func(cItem *gkvlite.Item) (*gkvlite.Item, error) {
+		i := &item{}
+		if err := i.fromValueBytes(cItem.Val); err != nil {
+			return nil, err
+		}
+		if len(i.key) <= 0 || i.isDeletion() ||
+			(i.datatype == DATATYPE_DICT && valueDictId(i.data) == d.id) {
+			return cItem.Copy(), nil
+		}
+		v, err := i.value()
+		if err != nil {
+			return nil, err
+		}
+		ri := i.clone()
+		ri.data = v
+		ri.datatype = DATATYPE_RAW
+		vBytes := s.compressItem(ri, DATATYPE_DICT, d).toValueBytes()
+		if len(vBytes) >= len(cItem.Val) && i.datatype != DATATYPE_DICT {
+			return cItem.Copy(), nil // Only old dictionaries must go.
+		}
+		atomic.AddInt64(&s.stats.RecompressedValues, 1)
+		atomic.AddInt64(&s.stats.RecompressInBytes, int64(len(cItem.Val)))
+		atomic.AddInt64(&s.stats.RecompressOutBytes, int64(len(vBytes)))
+		return &gkvlite.Item{
+			Key:      cItem.Key,
+			Val:      vBytes,
+			Priority: cItem.Priority,
+		}, nil
+	}
+}
+
+// Removes all but the current dictionary from a compacted store,
+// whose values were all recompressed with it.
+func (s *bucketstore) pruneValueDicts(compactStore *gkvlite.Store) error {
+	if s.recompressor() == nil {
+		return nil
+	}
+	c := compactStore.GetCollection(COLL_DICTS)
+	if c == nil {
+		return nil
+	}
+	curr := casBytes(s.dictSeq)
+	var old [][]byte
+	err := c.VisitItemsAscend(nil, false, func(i *gkvlite.Item) bool {
+		if !bytes.Equal(i.Key, curr) {
+			old = append(old, i.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if _, err = c.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testSmallDoc(i int) []byte {
+	return []byte(fmt.Sprintf(`{"type":"user","name":"user-%v",`+
+		`"email":"user-%v@example.com","active":true,"score":%v}`, i, i, i%7))
+}
+
+func TestValueDictRegistry(t *testing.T) {
+	d0, err := acquireValueDict([]byte("registry test dict"))
+	if err != nil {
+		t.Fatalf("expected acquire to work, got: %v", err)
+	}
+	d1, err := acquireValueDict([]byte("registry test dict"))
+	if err != nil || d1 != d0 {
+		t.Errorf("expected equal dictionaries to be shared, got: %v", err)
+	}
+	if lookupValueDict(d0.id) != d0 {
+		t.Errorf("expected lookup to find the dictionary")
+	}
+	releaseValueDict(d0)
+	if lookupValueDict(d0.id) != d0 {
+		t.Errorf("expected a referenced dictionary to stay")
+	}
+	releaseValueDict(d1)
+	if lookupValueDict(d0.id) != nil {
+		t.Errorf("expected an unreferenced dictionary to go")
+	}
+}
+
+func TestValueDictCompress(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < dictMinSamples-1; i++ {
+		samples = append(samples, testSmallDoc(i))
+	}
+	if buildValueDict(samples) != nil {
+		t.Errorf("expected too few samples to build no dictionary")
+	}
+	samples = append(samples, testSmallDoc(dictMinSamples))
+	data := buildValueDict(samples)
+	if len(data) <= 0 || len(data) > dictMaxBytes {
+		t.Fatalf("expected a dictionary, got: %v bytes", len(data))
+	}
+	d, err := acquireValueDict(data)
+	if err != nil {
+		t.Fatalf("expected acquire to work, got: %v", err)
+	}
+
+	doc := testSmallDoc(12345)
+	for n := 0; n < 3; n++ { // Exercises the pooled writers and readers.
+		c, err := d.compress(doc)
+		if err != nil || valueDictId(c) != d.id {
+			t.Fatalf("expected compress to work, got: %v", err)
+		}
+		plain, _ := compressValue(DATATYPE_DEFLATE, doc)
+		if len(c) >= len(plain) || len(c) >= len(doc)/2 {
+			t.Errorf("expected a dictionary to help, got: %v versus %v, %v",
+				len(c), len(plain), len(doc))
+		}
+		v, err := decompressValue(DATATYPE_DICT, c)
+		if err != nil || !bytes.Equal(v, doc) {
+			t.Errorf("expected decompress to round-trip, got: %s, %v", v, err)
+		}
+	}
+
+	c, _ := d.compress(doc)
+	releaseValueDict(d)
+	if _, err = decompressValue(DATATYPE_DICT, c); err == nil {
+		t.Errorf("expected decompress with an unknown dictionary to fail")
+	}
+	if _, err = compressValue(DATATYPE_DICT, doc); err == nil {
+		t.Errorf("expected compress without a dictionary to fail")
+	}
+	if _, err = decompressValue(DATATYPE_DICT, nil); err == nil {
+		t.Errorf("expected decompress of nothing to fail")
+	}
+}
+
+func TestBucketDictCompression(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			Compression:   "dictionary",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	set := func(i int) {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(i)),
+			Body:   testSmallDoc(i),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		set(i)
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	// Without a dictionary yet, small docs aren't worth compressing.
+	bss := AggregateBucketStoreStats(b0, "")
+	if bss.CompressedValues != 0 || bss.DictTrainings != 0 {
+		t.Errorf("expected no compression before training, got: %#v", bss)
+	}
+
+	if err = b0.Compact(); err != nil {
+		t.Fatalf("expected Compact to work, got: %v", err)
+	}
+	bss = AggregateBucketStoreStats(b0, "")
+	if bss.DictTrainings != 1 || bss.RecompressedValues != 100 ||
+		bss.RecompressOutBytes >= bss.RecompressInBytes/2 {
+		t.Errorf("expected compaction to recompress, got: %#v", bss)
+	}
+
+	// Compacting the same values keeps the dictionary.
+	if err = b0.Compact(); err != nil {
+		t.Fatalf("expected Compact to work, got: %v", err)
+	}
+	bss = AggregateBucketStoreStats(b0, "")
+	if bss.DictTrainings != 1 || bss.RecompressedValues != 100 {
+		t.Errorf("expected the same dictionary, got: %#v", bss)
+	}
+
+	// New values are compressed with the dictionary.
+	set(100)
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	bss = AggregateBucketStoreStats(b0, "")
+	if bss.CompressedValues != 1 {
+		t.Errorf("expected a compressed value, got: %#v", bss)
+	}
+	b0.Close()
+
+	b1, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket re-open to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	for i := 0; i <= 100; i++ {
+		res := r1.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(strconv.Itoa(i)),
+		})
+		if res.Status != gomemcached.SUCCESS ||
+			!bytes.Equal(res.Body, testSmallDoc(i)) {
+			t.Errorf("expected get %v to decompress, got: %v", i, res)
+		}
+	}
+}
+
+func TestBucketDictRelease(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			Compression:   "dictionary",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	setAll := func(n int) {
+		for i := 0; i < 100; i++ {
+			res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+				Opcode: gomemcached.SET,
+				Key:    []byte(strconv.Itoa(i)),
+				Body:   testSmallDoc(n + i),
+			})
+			if res.Status != gomemcached.SUCCESS {
+				t.Fatalf("expected set to work, got: %v", res)
+			}
+		}
+	}
+	compact := func() {
+		if err := b0.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+		if err := b0.Compact(); err != nil {
+			t.Fatalf("expected Compact to work, got: %v", err)
+		}
+	}
+	bs := b0.GetBucketStore(0)
+
+	setAll(1000)
+	compact()
+	d1 := bs.valueDict()
+	if d1 == nil {
+		t.Fatalf("expected a trained dictionary")
+	}
+
+	// The resident values are still compressed with the first
+	// dictionary after retraining, so it's kept.
+	setAll(2000)
+	compact()
+	d2 := bs.valueDict()
+	if d2 == d1 || lookupValueDict(d1.id) != d1 {
+		t.Errorf("expected a retrained dictionary and the first kept")
+	}
+
+	// Once no resident value needs it, it's released.
+	setAll(2000)
+	compact()
+	if bs.valueDict() != d2 || lookupValueDict(d1.id) != nil ||
+		lookupValueDict(d2.id) != d2 {
+		t.Errorf("expected only the first dictionary to be released")
+	}
+	for i := 0; i < 100; i++ {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(strconv.Itoa(i)),
+		})
+		if res.Status != gomemcached.SUCCESS ||
+			!bytes.Equal(res.Body, testSmallDoc(2000+i)) {
+			t.Errorf("expected get %v to decompress, got: %v", i, res)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+var testCompressibleValue = bytes.Repeat([]byte(`{"name":"cbgb","tags":["a","b"]}`), 100)
+
+func TestCompressValue(t *testing.T) {
+	for name, datatype := range compressions {
+		if datatype == DATATYPE_DICT {
+			continue // Needs a dictionary, so see compress_dict_test.go.
+		}
+		c, err := compressValue(datatype, testCompressibleValue)
+		if err != nil {
+			t.Errorf("expected %q compress to work, err: %v", name, err)
+		}
+		d, err := decompressValue(datatype, c)
+		if err != nil || !bytes.Equal(d, testCompressibleValue) {
+			t.Errorf("expected %q decompress to round-trip, err: %v", name, err)
+		}
+		i := &item{data: c, datatype: datatype}
+		if v, err := i.value(); err != nil || !bytes.Equal(v, testCompressibleValue) {
+			t.Errorf("expected %q item value to decompress, err: %v", name, err)
+		}
+	}
+	if _, err := compressValue(99, testCompressibleValue); err == nil {
+		t.Errorf("expected unknown datatype compress to fail")
+	}
+	if _, err := decompressValue(99, testCompressibleValue); err == nil {
+		t.Errorf("expected unknown datatype decompress to fail")
+	}
+	if _, err := decompressValue(DATATYPE_DEFLATE, []byte("not deflate")); err == nil {
+		t.Errorf("expected corrupt deflate decompress to fail")
+	}
+}
+
+func TestItemDatatypeSerialization(t *testing.T) {
+	c, _ := compressValue(DATATYPE_DEFLATE, testCompressibleValue)
+	i := &item{key: []byte("k"), cas: 1, data: c, datatype: DATATYPE_DEFLATE}
+	j := &item{}
+	if err := j.fromValueBytes(i.toValueBytes()); err != nil || !i.Equal(j) {
+		t.Errorf("expected datatype to round-trip, got: %#v, %v", j, err)
+	}
+	// Items from before compression have no datatype, so are raw.
+	k := &item{key: []byte("k"), cas: 1, data: []byte("v")}
+	b := k.toValueBytes()
+	if b[16] != 0 || b[17] != 1 {
+		t.Errorf("expected raw items to have the old header, got: %v", b)
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	bss := &BucketStoreStats{}
+	bss.Add(&BucketStoreStats{CompressInBytes: 1000, CompressOutBytes: 100})
+	bss.Add(&BucketStoreStats{CompressInBytes: 1000, CompressOutBytes: 300})
+	if bss.CompressionRatio != 5 {
+		t.Errorf("expected compression ratio of 5, got: %v", bss.CompressionRatio)
+	}
+	bss.Sub(&BucketStoreStats{CompressInBytes: 2000, CompressOutBytes: 400})
+	if bss.CompressionRatio != 0 {
+		t.Errorf("expected no compression ratio, got: %v", bss.CompressionRatio)
+	}
+}
+
+func TestUprItemPktCompressed(t *testing.T) {
+	c, _ := compressValue(DATATYPE_SNAPPY, testCompressibleValue)
+	s := &uprStream{vbid: 1}
+	now := time.Now()
+
+	i := &item{key: []byte("k"), cas: 1, data: c, datatype: DATATYPE_SNAPPY}
+	pkt, datatype, err := uprItemPkt(s, i, now, true)
+	if err != nil || datatype != PROTOCOL_DATATYPE_SNAPPY || !bytes.Equal(pkt.Body, c) {
+		t.Errorf("expected a compressed value, got: %v, %v", datatype, err)
+	}
+	pkt, datatype, err = uprItemPkt(s, i, now, false)
+	if err != nil || datatype != 0 || !bytes.Equal(pkt.Body, testCompressibleValue) {
+		t.Errorf("expected a decompressed value, got: %v, %v", datatype, err)
+	}
+
+	// Only snappy is a protocol datatype.
+	c, _ = compressValue(DATATYPE_DEFLATE, testCompressibleValue)
+	i = &item{key: []byte("k"), cas: 1, data: c, datatype: DATATYPE_DEFLATE}
+	pkt, datatype, err = uprItemPkt(s, i, now, true)
+	if err != nil || datatype != 0 || !bytes.Equal(pkt.Body, testCompressibleValue) {
+		t.Errorf("expected a decompressed value, got: %v, %v", datatype, err)
+	}
+}
+
+func TestBucketCompression(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			Compression:   "deflate",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	values := map[string][]byte{
+		"big":   testCompressibleValue,
+		"small": []byte("v"),
+	}
+	for k, v := range values {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   v,
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	bss := AggregateBucketStoreStats(b0, "")
+	if bss.CompressedValues != 1 || bss.CompressionRatio <= 5 {
+		t.Errorf("expected only the big value to be compressed, got: %#v", bss)
+	}
+
+	// The datatype is persisted, so reloading doesn't need the setting.
+	b1, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket re-open to work, got: %v", err)
+	}
+	defer b1.Close()
+	if err = b1.Load(); err != nil {
+		t.Fatalf("expected Load to work, got: %v", err)
+	}
+	vb1, _ := b1.GetVBucket(0)
+	i, err := vb1.getUnexpired([]byte("big"), time.Now())
+	if err != nil || i == nil || i.datatype != DATATYPE_DEFLATE ||
+		len(i.data) >= len(testCompressibleValue) {
+		t.Fatalf("expected a compressed item, got: %#v, %v", i, err)
+	}
+	r1 := &reqHandler{currentBucket: b1}
+	for k, v := range values {
+		res := r1.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(k),
+		})
+		if res.Status != gomemcached.SUCCESS || !bytes.Equal(res.Body, v) {
+			t.Errorf("expected get %v to decompress, got: %v", k, res)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultLowWatermarkPct  = 75
+	defaultHighWatermarkPct = 85
+)
+
+// The number of values or items evicted from a partition at a time.
+var evictBatchSize = 100
+
+// An evictionPolicy picks which items of a partition to evict, either
+// just their values or whole items.  Eviction runs one pass at a time
+// per bucket, so policies may keep per-partition state without
+// locking.
+type evictionPolicy interface {
+	// Returns up to n items, for which evictable is true, to evict.
+	victims(p *partitionstore, n int,
+		evictable func(*item) bool) ([]*item, error)
+}
+
+var evictionPolicies = map[string]evictionPolicy{
+	"":       randomEviction{}, // The default.
+	"random": randomEviction{},
+	"clock":  clockEviction{},
+	"lru":    clockEviction{}, // Clock is our approximation of LRU.
+	"none":   nil,
+}
+
+// Picks uniformly random victims, by reservoir sampling a scan of
+// the partition's keys.
+type randomEviction struct{}
+
+func (randomEviction) victims(p *partitionstore, n int,
+	evictable func(*item) bool) ([]*item, error) {
+	rv := make([]*item, 0, n)
+	seen := 0
+	err := p.visitItems(nil, false, func(i *item) bool {
+		if !evictable(i) {
+			return true
+		}
+		seen++
+		if len(rv) < n {
+			rv = append(rv, i)
+		} else if j := rand.Intn(seen); j < n {
+			rv[j] = i
+		}
+		return true
+	})
+	return rv, err
+}
+
+// Picks victims with the clock algorithm, where a hand sweeps over
+// the partition's keys, sparing (but clearing the bit of) items that
+// were read since the hand last passed.
+type clockEviction struct{}
+
+func (clockEviction) victims(p *partitionstore, n int,
+	evictable func(*item) bool) ([]*item, error) {
+	rv := make([]*item, 0, n)
+	sweep := func(start []byte) (wrapped bool, err error) {
+		wrapped = true
+		err = p.visitItems(start, false, func(i *item) bool {
+			p.evictHand = i.key
+			if len(rv) >= n {
+				wrapped = false
+				return false
+			}
+			if !evictable(i) {
+				return true
+			}
+			if atomic.SwapInt32(&i.ref, 0) == 0 {
+				rv = append(rv, i)
+			}
+			return true
+		})
+		return wrapped, err
+	}
+	// At most two revolutions, as the first may only clear bits.
+	for rev := 0; rev < 2 && len(rv) < n; rev++ {
+		wrapped, err := sweep(p.evictHand)
+		if err != nil {
+			return rv, err
+		}
+		if wrapped {
+			p.evictHand = nil
+			if _, err = sweep(nil); err != nil {
+				return rv, err
+			}
+		}
+	}
+	return rv, nil
+}
+
+// Returns whether a bucket evicts, for buckets with a quota and an
+// eviction policy.  Persisted buckets evict values, and buckets that
+// persist nothing evict whole items, like a cache.  Buckets that
+// persist only metadata can't do either.
+func evictionEnabled(bs *BucketSettings) bool {
+	return bs.QuotaBytes > 0 &&
+		(bs.MemoryOnly == MemoryOnly_LEVEL_PERSIST_EVERYTHING ||
+			bs.fullEviction()) &&
+		evictionPolicies[bs.EvictionPolicy] != nil
+}
+
+// Evicts values from the vbucket's partition, returning the number
+// of values evicted.
+func (v *VBucket) evictValues(policy evictionPolicy, n int) (int, error) {
+	victims, err := policy.victims(v.ps, n, v.ps.evictable)
+	if err != nil {
+		return 0, err
+	}
+	return v.ps.evictValues(victims), nil
+}
+
+// Returns whether an item may be evicted whole, which skips locked
+// items, as their lockers expect them to stay.
+func (v *VBucket) itemEvictable(i *item, now time.Time) bool {
+	if i.isDeletion() {
+		return false
+	}
+	_, locked := v.locks.lockedCas(i.key, now)
+	return !locked
+}
+
+// Evicts whole items from the vbucket through the delete path, so
+// observers see them as evictions.  Returns the number of items
+// evicted.
+func (v *VBucket) evictItems(policy evictionPolicy, n int) (int, error) {
+	now := time.Now()
+	victims, err := policy.victims(v.ps, n, func(i *item) bool {
+		return v.itemEvictable(i, now)
+	})
+	if err != nil {
+		return 0, err
+	}
+	evicted := 0
+	for _, victim := range victims {
+		var deltaItemBytes int64
+		var evictCas uint64
+		v.Apply(func() {
+			var i *item
+			i, err = v.ps.get(victim.key)
+			if err != nil || i == nil || i.cas != victim.cas ||
+				!v.itemEvictable(i, now) {
+				return // The item changed, so leave it be.
+			}
+			evictCas = atomic.AddUint64(&v.Meta().LastCas, 1)
+			deltaItemBytes, err = v.ps.del(i.key, evictCas, i)
+		})
+		if err != nil {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+			return evicted, err
+		}
+		if evictCas == 0 {
+			continue
+		}
+		atomic.AddInt64(&v.stats.Items, -1)
+		atomic.AddInt64(&v.stats.ItemEvictions, 1)
+		atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+		atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+		v.markStale()
+		v.observer.Submit(mutation{v.vbid, victim.key, evictCas, true, true})
+		evicted++
+	}
+	return evicted, nil
+}
+
+// Starts an eviction pass in the background if one isn't running.
+func (v *VBucket) kickEviction() {
+	go func() {
+		if _, err := v.parent.Evict(); err != nil {
+			v.parent.PushErr(fmt.Errorf("evict: %v", err))
+		}
+	}()
+}
+
+// Evicts until the bucket's resident item bytes are under the low
+// watermark, returning the number of values or items evicted.
+// Persisted buckets are first flushed, so their values are clean.
+// Eviction runs one pass at a time, so a concurrent invocation
+// returns right away.
+func (b *livebucket) Evict() (int, error) {
+	if !atomic.CompareAndSwapInt32(&b.evicting, 0, 1) {
+		return 0, nil
+	}
+	defer atomic.StoreInt32(&b.evicting, 0)
+
+	settings := b.GetBucketSettings()
+	if !b.Available() || !evictionEnabled(settings) {
+		return 0, nil
+	}
+	policy := evictionPolicies[settings.EvictionPolicy]
+	low, _ := settings.watermarks()
+
+	evict := (*VBucket).evictItems
+	if !settings.fullEviction() {
+		evict = (*VBucket).evictValues
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	evicted := 0
+	for atomic.LoadInt64(&b.bucketItemBytes) > low {
+		n := 0
+		for j := 0; j < MAX_VBUCKETS; j++ {
+			// Resume after the last vbucket evicted from, so that
+			// eviction spreads over all the vbuckets.
+			vbid := (b.evictNext + j) % MAX_VBUCKETS
+			vb, _ := b.GetVBucket(uint16(vbid))
+			if vb == nil {
+				continue
+			}
+			b.evictNext = vbid + 1
+			nvb, err := evict(vb, policy, evictBatchSize)
+			n += nvb
+			if err != nil {
+				return evicted + n, err
+			}
+			if atomic.LoadInt64(&b.bucketItemBytes) <= low {
+				break
+			}
+		}
+		evicted += n
+		if n == 0 { // Nothing else is evictable.
+			break
+		}
+	}
+	return evicted, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestWatermarks(t *testing.T) {
+	tests := []struct {
+		quota     int64
+		low, high int
+		expLow    int64
+		expHigh   int64
+	}{
+		{0, 0, 0, 0, 0},
+		{1000, 0, 0, 750, 850},
+		{1000, 10, 0, 100, 850},
+		{1000, 10, 20, 100, 200},
+	}
+	for i, test := range tests {
+		bs := &BucketSettings{
+			QuotaBytes:       test.quota,
+			LowWatermarkPct:  test.low,
+			HighWatermarkPct: test.high,
+		}
+		low, high := bs.watermarks()
+		if low != test.expLow || high != test.expHigh {
+			t.Errorf("test #%v, expected watermarks %v, %v, got: %v, %v",
+				i, test.expLow, test.expHigh, low, high)
+		}
+	}
+}
+
+func TestEvictionEnabled(t *testing.T) {
+	tests := []struct {
+		bs  BucketSettings
+		exp bool
+	}{
+		{BucketSettings{}, false},
+		{BucketSettings{QuotaBytes: 1}, true},
+		{BucketSettings{QuotaBytes: 1, EvictionPolicy: "clock"}, true},
+		{BucketSettings{QuotaBytes: 1, EvictionPolicy: "none"}, false},
+		{BucketSettings{QuotaBytes: 1, EvictionPolicy: "bogus"}, false},
+		{BucketSettings{QuotaBytes: 1, MemoryOnly: 1}, false},
+		{BucketSettings{QuotaBytes: 1, MemoryOnly: 2}, true},
+		{BucketSettings{MemoryOnly: 2}, false},
+	}
+	for i, test := range tests {
+		if got := evictionEnabled(&test.bs); got != test.exp {
+			t.Errorf("test #%v, expected %v for %#v, got: %v",
+				i, test.exp, test.bs, got)
+		}
+	}
+}
+
+func testSetupEvictionBucket(t *testing.T, policy string) (
+	string, Bucket, *VBucket, *reqHandler) {
+	d, _, b := testSetupDefaultBucketEx(t, &BucketSettings{
+		NumPartitions:   1,
+		QuotaBytes:      100000,
+		LowWatermarkPct: 1,
+		EvictionPolicy:  policy,
+	}, 0)
+	vb, _ := b.GetVBucket(0)
+	rh := &reqHandler{currentBucket: b}
+	for i := 0; i < 10; i++ {
+		res := rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(i)),
+			Body:   bytes.Repeat([]byte{byte('0' + i)}, 2000),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	return d, b, vb, rh
+}
+
+func TestEvictAndFault(t *testing.T) {
+	d, b, vb, rh := testSetupEvictionBucket(t, "")
+	defer os.RemoveAll(d)
+
+	before := b.GetItemBytes()
+	n, err := b.Evict()
+	if err != nil || n != 10 {
+		t.Fatalf("expected all values evicted, got: %v, %v", n, err)
+	}
+	if vb.stats.ValueEvictions != 10 ||
+		vb.stats.EvictedValueBytes != 20000 ||
+		b.GetItemBytes() != before-20000 {
+		t.Errorf("expected eviction stats, got: %#v, itemBytes: %v",
+			vb.stats, b.GetItemBytes())
+	}
+	if n, err = b.Evict(); err != nil || n != 0 {
+		t.Errorf("expected nothing left to evict, got: %v, %v", n, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		res := rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(strconv.Itoa(i)),
+		})
+		exp := bytes.Repeat([]byte{byte('0' + i)}, 2000)
+		if res.Status != gomemcached.SUCCESS || !bytes.Equal(res.Body, exp) {
+			t.Errorf("expected get %v to fault in the value, got: %v", i, res)
+		}
+	}
+	if vb.stats.ValueFaults != 10 || vb.stats.EvictedValueBytes != 0 ||
+		b.GetItemBytes() != before {
+		t.Errorf("expected fault stats, got: %#v, itemBytes: %v",
+			vb.stats, b.GetItemBytes())
+	}
+}
+
+func TestEvictRereadsValue(t *testing.T) {
+	d, b, vb, rh := testSetupEvictionBucket(t, "")
+	defer os.RemoveAll(d)
+
+	keys, changes := vb.ps.colls()
+	kItem, err := keys.GetItem([]byte("0"), true)
+	if err != nil || kItem == nil {
+		t.Fatalf("expected a key item, got: %v, %v", kItem, err)
+	}
+	before := (*item)(atomic.LoadPointer(&kItem.Transient))
+	if n, err := b.Evict(); err != nil || n != 10 {
+		t.Fatalf("expected all values evicted, got: %v, %v", n, err)
+	}
+	cItem, err := changes.GetItem(kItem.Val, true)
+	if err != nil || cItem == nil {
+		t.Fatalf("expected a change item, got: %v, %v", cItem, err)
+	}
+	if (*item)(atomic.LoadPointer(&cItem.Transient)) == before {
+		t.Errorf("expected the change item to not keep the evicted value")
+	}
+
+	res := rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("0"),
+	})
+	if res.Status != gomemcached.SUCCESS ||
+		!bytes.Equal(res.Body, bytes.Repeat([]byte("0"), 2000)) {
+		t.Errorf("expected get to fault in the value, got: %v", res)
+	}
+	after := (*item)(atomic.LoadPointer(&kItem.Transient))
+	if after == nil || after == before || after.evicted {
+		t.Errorf("expected the value to be read back, got: %#v", after)
+	}
+}
+
+func TestEvictOnlyCleanValues(t *testing.T) {
+	d, b, vb, rh := testSetupEvictionBucket(t, "random")
+	defer os.RemoveAll(d)
+
+	if err := b.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("dirty"),
+		Body:   []byte("x"),
+	})
+	victims, err := evictionPolicies["random"].victims(vb.ps, 100, vb.ps.evictable)
+	if err != nil || len(victims) != 10 {
+		t.Fatalf("expected 10 victims, got: %v, %v", len(victims), err)
+	}
+	for _, i := range victims {
+		if string(i.key) == "dirty" {
+			t.Errorf("expected unflushed item to not be a victim")
+		}
+	}
+	if victims, _ = evictionPolicies["random"].victims(vb.ps, 3, vb.ps.evictable); len(victims) != 3 {
+		t.Errorf("expected 3 victims, got: %v", len(victims))
+	}
+}
+
+func TestEvictClock(t *testing.T) {
+	d, b, vb, rh := testSetupEvictionBucket(t, "clock")
+	defer os.RemoveAll(d)
+
+	if err := b.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	// Recently read items are spared on the first revolution.
+	for i := 0; i < 5; i++ {
+		rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(strconv.Itoa(i)),
+		})
+	}
+	victims, err := evictionPolicies["clock"].victims(vb.ps, 5, vb.ps.evictable)
+	if err != nil || len(victims) != 5 {
+		t.Fatalf("expected 5 victims, got: %v, %v", len(victims), err)
+	}
+	for _, i := range victims {
+		if k, _ := strconv.Atoi(string(i.key)); k < 5 {
+			t.Errorf("expected read item %v to be spared", k)
+		}
+	}
+	// The hand then comes around to the others, whose bits were cleared.
+	victims, _ = evictionPolicies["clock"].victims(vb.ps, 5, vb.ps.evictable)
+	for _, i := range victims {
+		if k, _ := strconv.Atoi(string(i.key)); k >= 5 {
+			t.Errorf("expected item %v to not be a victim again", k)
+		}
+	}
+}
+
+func TestEvictNotPersisted(t *testing.T) {
+	d, _, b := testSetupDefaultBucketEx(t, &BucketSettings{
+		NumPartitions: 1,
+		QuotaBytes:    1000,
+		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_METADATA,
+	}, 0)
+	defer os.RemoveAll(d)
+
+	rh := &reqHandler{currentBucket: b}
+	for i, exp := range []gomemcached.Status{gomemcached.SUCCESS, gomemcached.E2BIG} {
+		res := rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(i)),
+			Body:   make([]byte, 500),
+		})
+		if res.Status != exp {
+			t.Errorf("expected set %v status %v, got: %v", i, exp, res)
+		}
+	}
+	if n, err := b.Evict(); err != nil || n != 0 {
+		t.Errorf("expected no eviction, got: %v, %v", n, err)
+	}
+}
+
+func TestEvictOnQuota(t *testing.T) {
+	d, _, b := testSetupDefaultBucketEx(t, &BucketSettings{
+		NumPartitions: 1,
+		QuotaBytes:    10000,
+	}, 0)
+	defer os.RemoveAll(d)
+	vb, _ := b.GetVBucket(0)
+
+	rh := &reqHandler{currentBucket: b}
+	set := func(k int) *gomemcached.MCResponse {
+		return rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(k)),
+			Body:   make([]byte, 1000),
+		})
+	}
+	for k := 0; k < 50; k++ {
+		res := set(k)
+		for retries := 0; res.Status == gomemcached.TMPFAIL && retries < 100; retries++ {
+			time.Sleep(10 * time.Millisecond)
+			res = set(k)
+		}
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set %v to work after eviction, got: %v", k, res)
+		}
+	}
+	if vb.stats.ValueEvictions == 0 || b.GetItemBytes() >= 10000 {
+		t.Errorf("expected values to be evicted, got: %#v", vb.stats)
+	}
+
+	res := rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("toobig"),
+		Body:   make([]byte, 10000),
+	})
+	if res.Status != gomemcached.E2BIG {
+		t.Errorf("expected an item over the quota to fail, got: %v", res)
+	}
+}
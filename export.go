@@ -0,0 +1,174 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// The number of exported items an import decodes before it applies
+// them.
+var importBatchSize = 1000
+
+// An exportItem is a line of an export.  Values that are compact JSON
+// are kept as is, with a type of "json", so exports can be read and
+// diffed; other values are "base64".
+type exportItem struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	Flags uint32          `json:"flags"`
+	Exp   uint32          `json:"exp"`
+	Cas   uint64          `json:"cas"`
+}
+
+func newExportItem(i *item, data []byte) *exportItem {
+	rv := &exportItem{
+		Key:   string(i.key),
+		Type:  "json",
+		Value: data,
+		Flags: i.flag,
+		Exp:   i.exp,
+		Cas:   i.cas,
+	}
+	// Only compact JSON round-trips byte for byte, as the encoder
+	// compacts raw messages.
+	var b bytes.Buffer
+	if json.Compact(&b, data) != nil || !bytes.Equal(b.Bytes(), data) {
+		rv.Type = "base64"
+		rv.Value, _ = json.Marshal(base64.StdEncoding.EncodeToString(data))
+	}
+	return rv
+}
+
+func (e *exportItem) toItem() (*item, error) {
+	if e.Key == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+	i := &item{
+		key:  []byte(e.Key),
+		flag: e.Flags,
+		exp:  e.Exp,
+		cas:  e.Cas,
+	}
+	switch e.Type {
+	case "json":
+		i.data = []byte(e.Value)
+	case "base64":
+		var s string
+		if err := json.Unmarshal(e.Value, &s); err != nil {
+			return nil, fmt.Errorf("key: %v, base64 value: %v", e.Key, err)
+		}
+		var err error
+		if i.data, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("key: %v, base64 value: %v", e.Key, err)
+		}
+	default:
+		return nil, fmt.Errorf("key: %v, unknown type: %q", e.Key, e.Type)
+	}
+	if i.isDeletion() {
+		return nil, fmt.Errorf("key: %v, flags and exp of a deletion", e.Key)
+	}
+	return i, nil
+}
+
+// Writes each unexpired item of the bucket as a line of JSON, by
+// vbucket and then key.
+func exportBucket(b Bucket, w io.Writer) (n int64, err error) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // Which would change json values.
+	now := time.Now()
+	for vbid := 0; vbid < MAX_VBUCKETS; vbid++ {
+		vb, _ := b.GetVBucket(uint16(vbid))
+		if vb == nil {
+			continue
+		}
+		var errEncode error
+		err = vb.VisitItems(nil, func(i *item, data []byte) bool {
+			if i.isDeletion() || i.isExpired(now) {
+				return true
+			}
+			if !utf8.Valid(i.key) {
+				errEncode = fmt.Errorf("can't export non-UTF-8 key: %q", i.key)
+				return false
+			}
+			if errEncode = enc.Encode(newExportItem(i, data)); errEncode != nil {
+				return false
+			}
+			n++
+			return true
+		})
+		if err == nil {
+			err = errEncode
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Applies the lines of an export to a bucket, a batch at a time, so a
+// batch with a bad line isn't applied.  The items get new CAS's, like
+// client mutations, so the bucket's incremental backups, UPR streams
+// and _changes feed see them.  The bucket's vbuckets must exist.
+func importBucket(b Bucket, r io.Reader) (*restoreResult, error) {
+	settings := b.GetBucketSettings()
+	res := &restoreResult{
+		Bucket:        b.Name(),
+		NumPartitions: settings.NumPartitions,
+	}
+	rs := &restorer{
+		b:                b,
+		freshCas:         true,
+		srcNumPartitions: settings.NumPartitions,
+		now:              time.Now(),
+		res:              res,
+	}
+	dec := json.NewDecoder(r)
+	line := 0
+	batch := make([]*item, 0, importBatchSize)
+	for done := false; !done; {
+		batch = batch[0:0]
+		for len(batch) < importBatchSize {
+			e := &exportItem{}
+			if err := dec.Decode(e); err != nil {
+				if err == io.EOF {
+					done = true
+					break
+				}
+				return res, fmt.Errorf("import line: %v, err: %v", line+1, err)
+			}
+			line++
+			i, err := e.toItem()
+			if err != nil {
+				return res, fmt.Errorf("import line: %v, err: %v", line, err)
+			}
+			batch = append(batch, i)
+		}
+		for j, i := range batch {
+			vbid := VBucketIdForKey(i.key, settings.NumPartitions)
+			if err := rs.apply(vbid, i); err != nil {
+				return res, fmt.Errorf("import line: %v, err: %v",
+					line-len(batch)+j+1, err)
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestExportItemRoundTrip(t *testing.T) {
+	tests := []struct {
+		data []byte
+		typ  string
+	}{
+		{[]byte(`{"a":1,"b":"<&>"}`), "json"},
+		{[]byte(`123`), "json"},
+		{[]byte(`{"a": 1}`), "base64"}, // Not compact.
+		{[]byte(`hello`), "base64"},
+		{[]byte{0, 1, 0xff}, "base64"},
+		{[]byte{}, "base64"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		e := newExportItem(&item{key: []byte("k"), flag: 1, exp: 2, cas: 3},
+			test.data)
+		if e.Type != test.typ {
+			t.Errorf("expected type %v for %q, got: %v", test.typ, test.data, e.Type)
+		}
+		if err := enc.Encode(e); err != nil {
+			t.Fatalf("expected encode to work, got: %v", err)
+		}
+		e2 := &exportItem{}
+		if err := json.NewDecoder(&b).Decode(e2); err != nil {
+			t.Fatalf("expected decode to work, got: %v", err)
+		}
+		i, err := e2.toItem()
+		if err != nil || string(i.key) != "k" || i.flag != 1 || i.exp != 2 ||
+			i.cas != 3 || !bytes.Equal(i.data, test.data) {
+			t.Errorf("expected %q to round-trip, got: %#v, %v", test.data, i, err)
+		}
+	}
+
+	for _, line := range []string{
+		`{"type":"json","value":1}`,
+		`{"key":"k","type":"xml","value":1}`,
+		`{"key":"k","type":"base64","value":"!!"}`,
+		`{"key":"k","type":"base64","value":1}`,
+	} {
+		e := &exportItem{}
+		json.Unmarshal([]byte(line), e)
+		if _, err := e.toItem(); err == nil {
+			t.Errorf("expected toItem to fail for %v", line)
+		}
+	}
+}
+
+func TestExportImportBucket(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+
+	src, err := createBucket("src", &BucketSettings{NumPartitions: 2})
+	if err != nil {
+		t.Fatalf("expected createBucket to work, got: %v", err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for n, key := range keys {
+		req := &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: VBucketIdForKey([]byte(key), 2),
+			Key:     []byte(key),
+			Body:    []byte(`{"n":"` + key + `"}`),
+			Extras:  make([]byte, 8),
+		}
+		if n%2 == 0 {
+			req.Body = []byte("plain-" + key)
+		}
+		binary.BigEndian.PutUint32(req.Extras, uint32(n))
+		res := (&reqHandler{currentBucket: src}).HandleMessage(nil, nil, req)
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+
+	var b bytes.Buffer
+	n, err := exportBucket(src, &b)
+	if err != nil || n != int64(len(keys)) {
+		t.Fatalf("expected export of 4 items, got: %v, %v", n, err)
+	}
+	export := b.String()
+	if strings.Count(export, "\n") != len(keys) {
+		t.Errorf("expected a line per item, got: %v", export)
+	}
+
+	dst, err := createBucket("dst", &BucketSettings{NumPartitions: 4})
+	if err != nil {
+		t.Fatalf("expected createBucket to work, got: %v", err)
+	}
+	res, err := importBucket(dst, strings.NewReader(export))
+	if err != nil || res.Items != int64(len(keys)) {
+		t.Fatalf("expected import of 4 items, got: %#v, %v", res, err)
+	}
+	get := func(b Bucket, numPartitions int, key string) *gomemcached.MCResponse {
+		return (&reqHandler{currentBucket: b}).HandleMessage(nil, nil,
+			&gomemcached.MCRequest{
+				Opcode:  gomemcached.GET,
+				VBucket: VBucketIdForKey([]byte(key), numPartitions),
+				Key:     []byte(key),
+			})
+	}
+	for _, key := range keys {
+		exp := get(src, 2, key)
+		res := get(dst, 4, key)
+		if res.Status != gomemcached.SUCCESS || !bytes.Equal(res.Body, exp.Body) ||
+			res.Cas == 0 || !bytes.Equal(res.Extras, exp.Extras) {
+			t.Errorf("expected %v imported with its flags, got: %v, want: %v",
+				key, res, exp)
+		}
+	}
+
+	// Importing again makes new changes, after those the bucket's
+	// change streams have already seen.
+	lastCas := map[uint16]uint64{}
+	for vbid := uint16(0); vbid < 4; vbid++ {
+		vb, _ := dst.GetVBucket(vbid)
+		lastCas[vbid] = atomic.LoadUint64(&vb.ps.lastCas)
+	}
+	res, err = importBucket(dst, strings.NewReader(export))
+	if err != nil || res.Items != int64(len(keys)) || res.Stale != 0 {
+		t.Errorf("expected a re-import, got: %#v, %v", res, err)
+	}
+	for _, key := range keys {
+		vbid := VBucketIdForKey([]byte(key), 4)
+		if res := get(dst, 4, key); res.Status != gomemcached.SUCCESS ||
+			res.Cas <= lastCas[vbid] {
+			t.Errorf("expected %v re-imported with a new cas, got: %v", key, res)
+		}
+	}
+
+	// Without a CAS, the bucket makes one.
+	res, err = importBucket(dst, strings.NewReader(
+		`{"key":"e","type":"json","value":{"x":1}}`+"\n"+
+			`{"key":"f","type":"json","value":[]}`))
+	if err != nil || res.Items != 2 {
+		t.Errorf("expected an import without CAS, got: %#v, %v", res, err)
+	}
+	if res := get(dst, 4, "e"); res.Status != gomemcached.SUCCESS ||
+		string(res.Body) != `{"x":1}` || res.Cas == 0 {
+		t.Errorf("expected e imported, got: %v", res)
+	}
+
+	res, err = importBucket(dst, strings.NewReader(`{"key":"g","type":"json","value":1}
+		not json`))
+	if err == nil || res.Items != 0 || !strings.Contains(err.Error(), "line: 2") {
+		t.Errorf("expected an import error on line 2, and the batch not"+
+			" applied, got: %#v, %v", res, err)
+	}
+}
+
+func TestRestBucketExportImport(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	if _, err := createBucket("foo", &BucketSettings{NumPartitions: 1}); err != nil {
+		t.Fatalf("expected createBucket to work, got: %v", err)
+	}
+	mr := testSetupMux(d)
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "http://127.0.0.1/_api/buckets/foo/import",
+		strings.NewReader(`{"key":"k","type":"json","value":"v"}`))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		t.Errorf("expected import to work, got: %v, %v", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://127.0.0.1/_api/buckets/foo/export", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 || !strings.HasPrefix(rr.Body.String(),
+		`{"key":"k","type":"json","value":"v","flags":0,"exp":0,"cas":`) {
+		t.Errorf("expected an export, got: %v, %v", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "http://127.0.0.1/_api/buckets/foo/import",
+		strings.NewReader(`{"key":"k"}`))
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 400 {
+		t.Errorf("expected a bad import to fail, got: %v", rr.Code)
+	}
+}
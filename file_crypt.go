@@ -0,0 +1,577 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// An encrypted file starts with a header of the magic, the id of the
+// key it's encrypted with and a random file id.  Then come records,
+// each being a nonce, the length of its plaintext and its flags, and
+// the AES-256-GCM sealed plaintext with its tag.  Records are only
+// ever appended, so a record that's been synced is never rewritten
+// by later writes: the plaintext after the last record stays in
+// memory until it fills a record or it's flushed.  The last record of
+// each Flush or Sync is marked, so that on open only the records of
+// the last write need authenticating to find a torn tail.
+const (
+	CRYPT_MAGIC = "cbgbenc1"
+
+	cryptKeyIdLen  = 8
+	cryptFileIdLen = 16
+	cryptHdrLen    = len(CRYPT_MAGIC) + cryptKeyIdLen + cryptFileIdLen
+
+	cryptNonceLen  = 12
+	cryptTagLen    = 16
+	cryptBlockSize = 4096 // The most plaintext in a record.
+
+	cryptRecHdrLen     = cryptNonceLen + 4
+	cryptDiskBlockSize = cryptRecHdrLen + cryptBlockSize + cryptTagLen
+
+	// Marks the last record written by a Sync.
+	cryptRecSync = 0x01
+	// Marks the last record written by a Flush or Close.
+	cryptRecFlush = 0x02
+)
+
+// The keys of an encryption key source, by their id.  New files are
+// encrypted with the current key, the last one in the source, while
+// files encrypted with older keys stay readable.  So a key is
+// rotated by appending a new key, after which compaction rewrites
+// the bucket's files with it.
+type cryptKeys struct {
+	aeads   map[uint64]cipher.AEAD
+	current uint64
+}
+
+// Reads a secret from a source of "file:PATH" or "env:NAME", so the
+// secret itself isn't kept in the settings that refer to it.
+func readSecretSource(source string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		b, err := ioutil.ReadFile(source[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case strings.HasPrefix(source, "env:"):
+		return os.Getenv(source[len("env:"):]), nil
+	}
+	return "", fmt.Errorf("unknown secret source: %q", source)
+}
+
+// Loads keys from a source of "file:PATH" or "env:NAME", holding
+// hex-encoded 32 byte keys, separated by whitespace or commas.  In a
+// key file, text after a '#' is a comment.
+func loadCryptKeys(source string) (*cryptKeys, error) {
+	s, err := readSecretSource(source)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key source: %q, err: %v", source, err)
+	}
+	keys, err := parseCryptKeys(s)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key source: %q, err: %v", source, err)
+	}
+	return keys, nil
+}
+
+func parseCryptKeys(s string) (*cryptKeys, error) {
+	rv := &cryptKeys{aeads: map[uint64]cipher.AEAD{}}
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, h := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			key, err := hex.DecodeString(h)
+			if err != nil || len(key) != 32 {
+				return nil, fmt.Errorf("keys must be 64 hex characters")
+			}
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, err
+			}
+			rv.current = cryptKeyId(key)
+			rv.aeads[rv.current] = aead
+		}
+	}
+	if len(rv.aeads) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return rv, nil
+}
+
+// A key's id doesn't reveal the key, but tells which key a file needs.
+func cryptKeyId(key []byte) uint64 {
+	h := sha256.Sum256(key)
+	return binary.BigEndian.Uint64(h[:cryptKeyIdLen])
+}
+
+// Opens a store file, which is encrypted if it's a new file and
+// encrypt is set, or if it already has an encryption header.
+// Otherwise, the file is plaintext, so a bucket's existing files
+// become encrypted as compaction rewrites them.
+func openStoreFile(path string, mode int, keys *cryptKeys,
+	encrypt bool) (FileLike, error) {
+	f, err := fileService.OpenFile(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := newCryptFileLike(f, keys, encrypt)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rv, nil
+}
+
+func newCryptFileLike(f FileLike, keys *cryptKeys,
+	encrypt bool) (FileLike, error) {
+	return newCryptFileLikeEx(f, keys, encrypt, false)
+}
+
+// Like newCryptFileLike, but with salvage, an encrypted file's
+// records that fail authentication are dropped along with all the
+// records after them, instead of failing the open, so fsck can
+// repair the file from what's left.
+func newCryptFileLikeEx(f FileLike, keys *cryptKeys,
+	encrypt, salvage bool) (FileLike, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		if !encrypt {
+			return f, nil
+		}
+		if keys == nil {
+			return nil, fmt.Errorf("no encryption keys")
+		}
+		return newCryptFile(f, keys)
+	}
+	hdr := make([]byte, cryptHdrLen)
+	if _, err = f.ReadAt(hdr, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(hdr[:len(CRYPT_MAGIC)]) != CRYPT_MAGIC {
+		return f, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("file is encrypted, but there are no keys")
+	}
+	return openCryptFile(f, keys, hdr, salvage)
+}
+
+// A cryptFile is a FileLike that encrypts and authenticates the
+// ranges written to an underlying FileLike, a record at a time.
+type cryptFile struct {
+	file   FileLike
+	aead   cipher.AEAD
+	fileId []byte
+
+	m        sync.RWMutex // Protects the fields below.
+	recs     []cryptRec   // The sealed records, in plaintext order.
+	sealed   int64        // The plaintext size of the records.
+	diskSize int64        // Where the next record goes.
+	tail     []byte       // The plaintext after the records.
+	unsynced bool         // Records were written since the last Sync.
+	unmarked bool         // Records were written since the last mark.
+	torn     bool         // There are torn records past diskSize.
+}
+
+type cryptRec struct {
+	off   int64 // Of its plaintext.
+	pos   int64 // In the underlying file.
+	n     int   // Plaintext length.
+	flags byte
+}
+
+func newCryptFile(f FileLike, keys *cryptKeys) (*cryptFile, error) {
+	hdr := make([]byte, cryptHdrLen)
+	copy(hdr, CRYPT_MAGIC)
+	binary.BigEndian.PutUint64(hdr[len(CRYPT_MAGIC):], keys.current)
+	if _, err := rand.Read(hdr[len(CRYPT_MAGIC)+cryptKeyIdLen:]); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(hdr, 0); err != nil {
+		return nil, err
+	}
+	return openCryptFile(f, keys, hdr, false)
+}
+
+func openCryptFile(f FileLike, keys *cryptKeys, hdr []byte,
+	salvage bool) (*cryptFile, error) {
+	keyId := binary.BigEndian.Uint64(hdr[len(CRYPT_MAGIC):])
+	aead := keys.aeads[keyId]
+	if aead == nil {
+		return nil, fmt.Errorf("no key for encrypted file, key id: %016x", keyId)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptFile{
+		file:     f,
+		aead:     aead,
+		fileId:   hdr[len(CRYPT_MAGIC)+cryptKeyIdLen:],
+		diskSize: int64(cryptHdrLen),
+	}
+	if err = c.loadRecs(fi.Size(), salvage); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Finds the records, dropping any torn by a crash.  Only the records
+// after the next to last marked record are authenticated, as earlier
+// ones were authenticated when the file was last opened, or written
+// since.  The records up to the last marked record were completely
+// written, so one failing is an error, which fsck's repair salvages.
+// Past it, a crash may have torn the write that was in progress, so
+// the file ends before its first record that fails.  The torn records
+// are only removed by the next write, and a failing open leaves the
+// file as is.
+func (c *cryptFile) loadRecs(diskSize int64, salvage bool) error {
+	hdr := make([]byte, cryptRecHdrLen)
+	for c.diskSize+int64(cryptRecHdrLen+cryptTagLen) <= diskSize {
+		if m, err := c.file.ReadAt(hdr, c.diskSize); m < len(hdr) {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+		n := int(binary.BigEndian.Uint16(hdr[cryptNonceLen:]))
+		end := c.diskSize + int64(cryptRecHdrLen+n+cryptTagLen)
+		if n > cryptBlockSize || end > diskSize {
+			break
+		}
+		c.recs = append(c.recs, cryptRec{
+			off: c.sealed, pos: c.diskSize, n: n, flags: hdr[cryptNonceLen+2],
+		})
+		c.sealed += int64(n)
+		c.diskSize = end
+	}
+	check, last := 0, -1
+	for r := len(c.recs) - 1; r >= 0; r-- {
+		if c.recs[r].flags&(cryptRecSync|cryptRecFlush) != 0 {
+			if last < 0 {
+				last = r
+			} else {
+				check = r + 1
+				break
+			}
+		}
+	}
+	torn := -1
+	for r := check; r < len(c.recs); r++ {
+		_, err := c.readRec(r)
+		switch {
+		case err != nil && salvage:
+			log.Printf("encrypted file: salvaging records before %v of %v,"+
+				" err: %v", r, len(c.recs), err)
+			c.truncateRecs(r)
+			c.torn = true
+			return nil
+		case err != nil && r <= last:
+			return fmt.Errorf("%v, in a completed write,"+
+				" which fsck -repair can salvage", err)
+		case err != nil && torn < 0:
+			// Without a sync, a torn write's later records may
+			// have reached the disk without its earlier ones.
+			torn = r
+		}
+	}
+	if torn >= 0 {
+		log.Printf("encrypted file: dropping torn records from %v of %v",
+			torn, len(c.recs))
+		c.truncateRecs(torn)
+	}
+	c.torn = c.diskSize < diskSize
+	return nil
+}
+
+// Forgets the records from r on, which are overwritten by the next
+// records written.
+func (c *cryptFile) truncateRecs(r int) {
+	c.sealed = c.recs[r].off
+	c.diskSize = c.recs[r].pos
+	c.recs = c.recs[:r]
+}
+
+func (c *cryptFile) Close() error {
+	c.m.Lock()
+	err := c.mark(cryptRecFlush)
+	c.m.Unlock()
+	if err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *cryptFileInfo) Size() int64 {
+	return fi.size
+}
+
+// Stat the underlying file, but with the size of the plaintext.
+func (c *cryptFile) Stat() (os.FileInfo, error) {
+	fi, err := c.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return &cryptFileInfo{fi, c.sealed + int64(len(c.tail))}, nil
+}
+
+// The additional data of a record binds it to its file, position and
+// header.
+func (c *cryptFile) recAD(r int, hdr []byte) []byte {
+	ad := make([]byte, cryptFileIdLen+8, cryptFileIdLen+8+len(hdr))
+	copy(ad, c.fileId)
+	binary.BigEndian.PutUint64(ad[cryptFileIdLen:], uint64(r))
+	return append(ad, hdr...)
+}
+
+// Returns the plaintext of a record.
+func (c *cryptFile) readRec(r int) ([]byte, error) {
+	rec := c.recs[r]
+	buf := make([]byte, cryptRecHdrLen+rec.n+cryptTagLen)
+	if m, err := c.file.ReadAt(buf, rec.pos); m < len(buf) {
+		return nil, fmt.Errorf("encrypted record %v is truncated, err: %v", r, err)
+	}
+	rv, err := c.aead.Open(nil, buf[:cryptNonceLen], buf[cryptRecHdrLen:],
+		c.recAD(r, buf[cryptNonceLen:cryptRecHdrLen]))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted record %v fails authentication", r)
+	}
+	return rv, nil
+}
+
+// Seals a record at its position under a fresh nonce, as the nonce
+// of a rewritten record must never be reused.
+func (c *cryptFile) writeRec(r int, plain []byte) error {
+	rec := c.recs[r]
+	buf := make([]byte, cryptRecHdrLen, cryptDiskBlockSize)
+	if _, err := rand.Read(buf[:cryptNonceLen]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf[cryptNonceLen:], uint16(len(plain)))
+	buf[cryptNonceLen+2] = rec.flags
+	buf = c.aead.Seal(buf, buf[:cryptNonceLen], plain,
+		c.recAD(r, buf[cryptNonceLen:cryptRecHdrLen]))
+	if _, err := c.file.WriteAt(buf, rec.pos); err != nil {
+		return err
+	}
+	c.unsynced = true
+	c.unmarked = true
+	return nil
+}
+
+// Appends a record of plaintext that follows the other records.
+func (c *cryptFile) appendRec(plain []byte, flags byte) error {
+	if c.torn {
+		if err := c.file.Truncate(c.diskSize); err != nil {
+			return err
+		}
+		c.torn = false
+	}
+	c.recs = append(c.recs, cryptRec{
+		off: c.sealed, pos: c.diskSize, n: len(plain), flags: flags,
+	})
+	if err := c.writeRec(len(c.recs)-1, plain); err != nil {
+		c.recs = c.recs[:len(c.recs)-1]
+		return err
+	}
+	c.sealed += int64(len(plain))
+	c.diskSize += int64(cryptRecHdrLen + len(plain) + cryptTagLen)
+	return nil
+}
+
+// Returns the record holding a plaintext offset before c.sealed.
+func (c *cryptFile) findRec(off int64) int {
+	return sort.Search(len(c.recs), func(r int) bool {
+		return c.recs[r].off+int64(c.recs[r].n) > off
+	})
+}
+
+func (c *cryptFile) ReadAt(p []byte, off int64) (n int, err error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.sealed {
+			if pos-c.sealed >= int64(len(c.tail)) {
+				return n, io.EOF
+			}
+			n += copy(p[n:], c.tail[pos-c.sealed:])
+			continue
+		}
+		r := c.findRec(pos)
+		plain, err := c.readRec(r)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], plain[pos-c.recs[r].off:])
+	}
+	return n, nil
+}
+
+func (c *cryptFile) WriteAt(p []byte, off int64) (n int, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err = c.extend(off); err != nil {
+		return 0, err
+	}
+	for n < len(p) && off+int64(n) < c.sealed {
+		// Rewriting earlier plaintext, which gkvlite never does, as
+		// it only appends, is the one case where a record's rewritten.
+		pos := off + int64(n)
+		r := c.findRec(pos)
+		plain, err := c.readRec(r)
+		if err != nil {
+			return n, err
+		}
+		m := copy(plain[pos-c.recs[r].off:], p[n:])
+		if err = c.writeRec(r, plain); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	if n < len(p) {
+		t := off + int64(n) - c.sealed
+		m := copy(c.tail[t:], p[n:])
+		c.tail = append(c.tail, p[n+m:]...)
+		n = len(p)
+	}
+	return n, c.sealFull()
+}
+
+// Seals the full records at the start of the tail.
+func (c *cryptFile) sealFull() error {
+	for len(c.tail) >= cryptBlockSize {
+		if err := c.appendRec(c.tail[:cryptBlockSize], 0); err != nil {
+			return err
+		}
+		c.tail = append([]byte(nil), c.tail[cryptBlockSize:]...)
+	}
+	return nil
+}
+
+// Fills the plaintext with zeros up to a size.
+func (c *cryptFile) extend(size int64) error {
+	for end := c.sealed + int64(len(c.tail)); end < size; {
+		gap := size - end
+		if gap > cryptBlockSize {
+			gap = cryptBlockSize
+		}
+		c.tail = append(c.tail, make([]byte, gap)...)
+		end += gap
+		if err := c.sealFull(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seals the tail, so it's in the underlying file, as a record marked
+// with the flags, which ends the records written since the last mark.
+func (c *cryptFile) mark(flags byte) error {
+	if !c.unmarked && len(c.tail) == 0 {
+		return nil
+	}
+	if err := c.appendRec(c.tail, flags); err != nil {
+		return err
+	}
+	c.tail = nil
+	c.unmarked = false
+	return nil
+}
+
+// Hands the tail to the underlying file without syncing it, for the
+// flushes of a store that doesn't fsync.
+func (c *cryptFile) Flush() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.mark(cryptRecFlush)
+}
+
+func (c *cryptFile) Sync() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.unsynced || len(c.tail) > 0 {
+		if err := c.appendRec(c.tail, cryptRecSync); err != nil {
+			return err
+		}
+		c.tail = nil
+		c.unmarked = false
+	}
+	if err := c.file.Sync(); err != nil {
+		return err
+	}
+	c.unsynced = false
+	return nil
+}
+
+func (c *cryptFile) Truncate(size int64) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	switch {
+	case size >= c.sealed+int64(len(c.tail)):
+		return c.extend(size)
+	case size >= c.sealed:
+		c.tail = c.tail[:size-c.sealed]
+		return nil
+	}
+	r := c.findRec(size)
+	var plain []byte
+	if size > c.recs[r].off {
+		var err error
+		if plain, err = c.readRec(r); err != nil {
+			return err
+		}
+	}
+	if err := c.file.Truncate(c.recs[r].pos); err != nil {
+		return err
+	}
+	c.tail = plain[:size-c.recs[r].off]
+	c.truncateRecs(r)
+	c.torn = false
+	c.unsynced = true
+	c.unmarked = true
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testCryptKey0 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testCryptKey1 = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func testCryptKeys(t *testing.T, s string) *cryptKeys {
+	keys, err := parseCryptKeys(s)
+	if err != nil {
+		t.Fatalf("expected keys to parse, got: %v", err)
+	}
+	return keys
+}
+
+func testCryptOpen(t *testing.T, path string, keys *cryptKeys,
+	encrypt bool) FileLike {
+	osf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatalf("expected open to work, got: %v", err)
+	}
+	f, err := newCryptFileLike(osf, keys, encrypt)
+	if err != nil {
+		osf.Close()
+		t.Fatalf("expected crypt open to work, got: %v", err)
+	}
+	return f
+}
+
+func TestParseCryptKeys(t *testing.T) {
+	keys := testCryptKeys(t, "# old\n"+testCryptKey0+"\n"+testCryptKey1+" # new\n")
+	if len(keys.aeads) != 2 {
+		t.Errorf("expected 2 keys, got: %v", len(keys.aeads))
+	}
+	k1, _ := parseCryptKeys(testCryptKey1)
+	if keys.current != k1.current {
+		t.Errorf("expected the last key to be current")
+	}
+	keys = testCryptKeys(t, testCryptKey0+","+testCryptKey1)
+	if len(keys.aeads) != 2 {
+		t.Errorf("expected comma separated keys, got: %v", len(keys.aeads))
+	}
+	for _, s := range []string{"", "# none", "abc", testCryptKey0[2:],
+		strings.Replace(testCryptKey0, "00", "zz", 1)} {
+		if _, err := parseCryptKeys(s); err == nil {
+			t.Errorf("expected keys %q to fail", s)
+		}
+	}
+
+	os.Setenv("CBGB_TEST_CRYPT_KEYS", testCryptKey0)
+	defer os.Unsetenv("CBGB_TEST_CRYPT_KEYS")
+	if _, err := loadCryptKeys("env:CBGB_TEST_CRYPT_KEYS"); err != nil {
+		t.Errorf("expected env keys to load, got: %v", err)
+	}
+	if _, err := loadCryptKeys("env:CBGB_TEST_CRYPT_KEYS_MISSING"); err == nil {
+		t.Errorf("expected missing env keys to fail")
+	}
+	if _, err := loadCryptKeys("file:./tmp/no-such-keys"); err == nil {
+		t.Errorf("expected missing key file to fail")
+	}
+	if _, err := loadCryptKeys(testCryptKey0); err == nil {
+		t.Errorf("expected an unknown source to fail")
+	}
+}
+
+func TestReadSecretSource(t *testing.T) {
+	os.Setenv("CBGB_TEST_SECRET", "shh")
+	defer os.Unsetenv("CBGB_TEST_SECRET")
+	if s, err := readSecretSource("env:CBGB_TEST_SECRET"); err != nil || s != "shh" {
+		t.Errorf("expected env secret, got: %q, err: %v", s, err)
+	}
+	os.MkdirAll("./tmp", 0777)
+	fname := "./tmp/test-secret"
+	ioutil.WriteFile(fname, []byte("shh\n"), 0600)
+	defer os.Remove(fname)
+	if s, err := readSecretSource("file:" + fname); err != nil || s != "shh\n" {
+		t.Errorf("expected file secret, got: %q, err: %v", s, err)
+	}
+	for _, source := range []string{"shh", "file:./tmp/no-such-secret"} {
+		if _, err := readSecretSource(source); err == nil {
+			t.Errorf("expected source %q to fail", source)
+		}
+	}
+}
+
+func TestCryptFileRoundTrip(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "f")
+	keys := testCryptKeys(t, testCryptKey0)
+
+	f := testCryptOpen(t, path, keys, true)
+	if _, ok := f.(*cryptFile); !ok {
+		t.Fatalf("expected a new file to be encrypted, got: %#v", f)
+	}
+	exp := []byte{}
+	write := func(s string, off int64) {
+		if n, err := f.WriteAt([]byte(s), off); err != nil || n != len(s) {
+			t.Fatalf("expected write at %v to work, got: %v, %v", off, n, err)
+		}
+		if end := off + int64(len(s)); end > int64(len(exp)) {
+			exp = append(exp, make([]byte, end-int64(len(exp)))...)
+		}
+		copy(exp[off:], s)
+	}
+	write("hello", 0)
+	write(strings.Repeat("a", 5000), 3)    // Across a block boundary.
+	write("gap", 3*cryptBlockSize+10)      // Past the end.
+	write("x", cryptBlockSize-1)           // Read-modify-write.
+	write(strings.Repeat("b", 4096), 8192) // A whole block.
+
+	check := func(f FileLike) {
+		fi, err := f.Stat()
+		if err != nil || fi.Size() != int64(len(exp)) {
+			t.Fatalf("expected size %v, got: %v, %v", len(exp), fi, err)
+		}
+		got := make([]byte, len(exp))
+		if n, err := f.ReadAt(got, 0); err != nil || n != len(exp) ||
+			!bytes.Equal(got, exp) {
+			t.Fatalf("expected to read back the writes, got: %v, %v", n, err)
+		}
+		got = make([]byte, 10)
+		n, err := f.ReadAt(got, int64(len(exp))-4)
+		if err != io.EOF || n != 4 || !bytes.Equal(got[:n], exp[len(exp)-4:]) {
+			t.Errorf("expected a short read at the end, got: %v, %v", n, err)
+		}
+	}
+	check(f)
+	f.Close()
+
+	raw, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(raw, []byte(CRYPT_MAGIC)) ||
+		bytes.Contains(raw, []byte("hello")) {
+		t.Errorf("expected an encrypted file")
+	}
+
+	f = testCryptOpen(t, path, keys, false)
+	check(f)
+
+	if err := f.Truncate(5000); err != nil {
+		t.Fatalf("expected truncate to work, got: %v", err)
+	}
+	exp = exp[:5000]
+	check(f)
+	f.Close()
+	f = testCryptOpen(t, path, keys, false)
+	check(f)
+	f.Close()
+}
+
+func TestCryptFileTampering(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "f")
+	keys := testCryptKeys(t, testCryptKey0)
+
+	// Records followed by two syncs are durable, so damage to them
+	// isn't mistaken for a torn write.
+	f := testCryptOpen(t, path, keys, true)
+	f.WriteAt(bytes.Repeat([]byte("z"), 2*cryptBlockSize), 0)
+	f.Sync()
+	f.WriteAt([]byte("more"), 2*cryptBlockSize)
+	f.Sync()
+	f.Close()
+
+	osf, _ := os.OpenFile(path, os.O_RDWR, 0666)
+	osf.WriteAt([]byte{0xff}, int64(cryptHdrLen+cryptDiskBlockSize+100))
+	osf.Close()
+
+	f = testCryptOpen(t, path, keys, false)
+	defer f.Close()
+	buf := make([]byte, 10)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Errorf("expected the first block to read, got: %v", err)
+	}
+	if _, err := f.ReadAt(buf, cryptBlockSize); err == nil ||
+		!strings.Contains(err.Error(), "authentication") {
+		t.Errorf("expected the tampered block to fail, got: %v", err)
+	}
+
+	// Blocks can't be swapped around, either.
+	raw, _ := ioutil.ReadFile(path)
+	blk0 := append([]byte{}, raw[cryptHdrLen:cryptHdrLen+cryptDiskBlockSize]...)
+	osf, _ = os.OpenFile(path, os.O_RDWR, 0666)
+	osf.WriteAt(blk0, int64(cryptHdrLen+cryptDiskBlockSize))
+	osf.Close()
+	if _, err := f.ReadAt(buf, cryptBlockSize); err == nil {
+		t.Errorf("expected a moved block to fail")
+	}
+}
+
+func TestCryptFileTornTail(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "f")
+	keys := testCryptKeys(t, testCryptKey0)
+
+	exp := bytes.Repeat([]byte("a"), 10000)
+	f := testCryptOpen(t, path, keys, true)
+	f.WriteAt(exp, 0)
+	if err := f.Sync(); err != nil {
+		t.Fatalf("expected sync to work, got: %v", err)
+	}
+	synced, _ := ioutil.ReadFile(path)
+
+	f.WriteAt(bytes.Repeat([]byte("b"), 5000), 10000)
+	exp = append(exp, bytes.Repeat([]byte("b"), 5000)...)
+	f.Sync()
+	raw, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(raw, synced) {
+		t.Errorf("expected synced records to never be rewritten")
+	}
+
+	// Appends after the last sync are torn by a crash: one of their
+	// records is garbage and the last is cut short.
+	f.WriteAt(bytes.Repeat([]byte("c"), 9000), 15000)
+	f.Close()
+	raw, _ = ioutil.ReadFile(path)
+	osf, _ := os.OpenFile(path, os.O_RDWR, 0666)
+	osf.WriteAt(bytes.Repeat([]byte{0xee}, 10), int64(len(raw)-2*cryptDiskBlockSize))
+	osf.Truncate(int64(len(raw) - 10))
+	osf.Close()
+
+	check := func(f FileLike) {
+		fi, err := f.Stat()
+		if err != nil || fi.Size() != int64(len(exp)) {
+			t.Fatalf("expected the synced size %v, got: %v, %v", len(exp), fi, err)
+		}
+		got := make([]byte, len(exp))
+		if n, err := f.ReadAt(got, 0); err != nil || n != len(exp) ||
+			!bytes.Equal(got, exp) {
+			t.Fatalf("expected to read the synced writes, got: %v, %v", n, err)
+		}
+	}
+	f = testCryptOpen(t, path, keys, false)
+	check(f)
+
+	// Later writes replace the torn records.
+	f.WriteAt([]byte("d"), int64(len(exp)))
+	exp = append(exp, 'd')
+	f.Sync()
+	f.Close()
+	f = testCryptOpen(t, path, keys, false)
+	check(f)
+	f.Close()
+}
+
+func TestCryptFileCompletedWrite(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "f")
+	keys := testCryptKeys(t, testCryptKey0)
+
+	// Flushes without syncs, like a store that doesn't fsync.
+	f := testCryptOpen(t, path, keys, true)
+	f.WriteAt(bytes.Repeat([]byte("z"), 2*cryptBlockSize), 0)
+	f.(*cryptFile).Flush()
+	f.WriteAt([]byte("more"), 2*cryptBlockSize)
+	f.(*cryptFile).Flush()
+	f.Close()
+
+	// Damage to the last flush's record isn't a torn write.
+	raw, _ := ioutil.ReadFile(path)
+	osf, _ := os.OpenFile(path, os.O_RDWR, 0666)
+	osf.WriteAt([]byte{0xff}, int64(len(raw)-cryptTagLen-2))
+	osf.Close()
+
+	osf, _ = os.OpenFile(path, os.O_RDWR, 0666)
+	defer osf.Close()
+	if _, err := newCryptFileLike(osf, keys, false); err == nil ||
+		!strings.Contains(err.Error(), "fsck") {
+		t.Errorf("expected damage to a completed write to fail the open, got: %v", err)
+	}
+	if fi, _ := osf.Stat(); fi.Size() != int64(len(raw)) {
+		t.Errorf("expected a failed open to leave the file as is, got: %v", fi.Size())
+	}
+
+	// Salvaging keeps the records before the damage.
+	sf, err := newCryptFileLikeEx(osf, keys, false, true)
+	if err != nil {
+		t.Fatalf("expected a salvaging open to work, got: %v", err)
+	}
+	if fi, err := sf.Stat(); err != nil || fi.Size() != 2*cryptBlockSize {
+		t.Errorf("expected the records before the damage, got: %v, %v", fi, err)
+	}
+}
+
+func TestCryptFileKeys(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "f")
+
+	f := testCryptOpen(t, path, testCryptKeys(t, testCryptKey0), true)
+	f.WriteAt([]byte("secret"), 0)
+	f.Close()
+
+	osf, _ := os.Open(path)
+	defer osf.Close()
+	if _, err := newCryptFileLike(osf, nil, false); err == nil {
+		t.Errorf("expected an encrypted file without keys to fail")
+	}
+	if _, err := newCryptFileLike(osf,
+		testCryptKeys(t, testCryptKey1), false); err == nil {
+		t.Errorf("expected an encrypted file with the wrong key to fail")
+	}
+
+	// After a rotation, the old key still reads, and new files get
+	// the new key.
+	rotated := testCryptKeys(t, testCryptKey0+"\n"+testCryptKey1)
+	f = testCryptOpen(t, path, rotated, true)
+	buf := make([]byte, 6)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "secret" {
+		t.Errorf("expected the old key to read, got: %q, %v", buf, err)
+	}
+	f.Close()
+
+	path2 := filepath.Join(d, "f2")
+	testCryptOpen(t, path2, rotated, true).Close()
+	osf2, _ := os.Open(path2)
+	defer osf2.Close()
+	if _, err := newCryptFileLike(osf2,
+		testCryptKeys(t, testCryptKey1), false); err != nil {
+		t.Errorf("expected a new file to use the new key, got: %v", err)
+	}
+
+	// Plaintext files stay plaintext until they're rewritten.
+	path3 := filepath.Join(d, "f3")
+	ioutil.WriteFile(path3, []byte("plain"), 0666)
+	f = testCryptOpen(t, path3, rotated, true)
+	if _, ok := f.(*cryptFile); ok {
+		t.Errorf("expected a plaintext file to stay plaintext")
+	}
+	f.Close()
+}
+
+func TestEncryptedBucketCompaction(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	keyPath := filepath.Join(testBucketDir, "keys")
+	ioutil.WriteFile(keyPath, []byte(testCryptKey0+"\n"), 0600)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+			Encrypted:     true,
+			EncryptionKey: "file:" + keyPath,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+
+	r0 := &reqHandler{currentBucket: b0}
+	b0.CreateVBucket(2)
+	b0.SetVBState(2, VBActive)
+	testLoadInts(t, r0, 2, 5)
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+
+	// Returns the id of the key that the latest store file uses.
+	keyId := func() uint64 {
+		fnames, err := latestStoreFileNames(testBucketDir,
+			STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+		if err != nil {
+			t.Fatalf("expected store files, got: %v", err)
+		}
+		raw, _ := ioutil.ReadFile(filepath.Join(testBucketDir, fnames[0]))
+		if len(raw) < cryptHdrLen ||
+			!bytes.HasPrefix(raw, []byte(CRYPT_MAGIC)) {
+			t.Fatalf("expected an encrypted store file: %v", fnames[0])
+		}
+		return binary.BigEndian.Uint64(raw[len(CRYPT_MAGIC):])
+	}
+	if keyId() != testCryptKeys(t, testCryptKey0).current {
+		t.Errorf("expected the store file to use the first key")
+	}
+
+	ioutil.WriteFile(keyPath, []byte(testCryptKey0+"\n"+testCryptKey1+"\n"), 0600)
+	if err = b0.Compact(); err != nil {
+		t.Fatalf("expected Compact to work, got: %v", err)
+	}
+	if keyId() != testCryptKeys(t, testCryptKey1).current {
+		t.Errorf("expected compaction to rotate to the new key")
+	}
+	testExpectInts(t, r0, 2, []int{0, 1, 2, 3, 4}, "after rotation")
+}
@@ -16,6 +16,7 @@ type FileLike interface {
 	io.WriterAt
 	Stat() (os.FileInfo, error)
 	Truncate(size int64) error
+	Sync() error
 }
 
 type fileLike struct {
@@ -55,6 +56,14 @@ func (f *fileLike) WriteAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// Sync the underlying path, which flushes its writes from any file
+// descriptor to stable storage.
+func (f *fileLike) Sync() error {
+	return f.fs.Do(f.path, f.mode, func(file *os.File) error {
+		return file.Sync()
+	})
+}
+
 func (f *fileLike) Truncate(size int64) (err error) {
 	if f.mode&(os.O_WRONLY|os.O_RDWR) == 0 {
 		return unWritable
@@ -0,0 +1,409 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/steveyen/gkvlite"
+)
+
+// Only the first problems of a store file are listed, though all of
+// them are counted.
+var fsckMaxProblems = 100
+
+type fsckReport struct {
+	Files       []*fsckFileReport `json:"files"`
+	NumProblems int               `json:"numProblems"`
+}
+
+type fsckFileReport struct {
+	Path        string   `json:"path"`
+	VBuckets    int      `json:"vbuckets"`
+	Keys        int64    `json:"keys"`
+	Changes     int64    `json:"changes"`
+	Problems    []string `json:"problems"`
+	NumProblems int      `json:"numProblems"`
+
+	Repaired string `json:"repaired,omitempty"` // The salvaged store file.
+	Salvaged int64  `json:"salvaged,omitempty"` // Changes salvaged.
+}
+
+func (r *fsckFileReport) problem(format string, args ...interface{}) {
+	if len(r.Problems) < fsckMaxProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+	r.NumProblems++
+}
+
+// Checks the latest store files of a bucket directory, which mustn't
+// be in use, and with repair, salvages the readable items of files
+// with problems into new store files, which the bucket then loads
+// instead.
+func fsckBucketDir(dir string, repair bool) (*fsckReport, error) {
+	fnames, err := latestStoreFileNames(dir, STORES_PER_BUCKET, STORE_FILE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	settings := &BucketSettings{}
+	if _, err = settings.load(dir); err != nil {
+		return nil, err
+	}
+	keys, err := settings.cryptKeys()
+	if err != nil {
+		return nil, err
+	}
+	rv := &fsckReport{}
+	for _, fname := range fnames {
+		r := fsckStoreFile(filepath.Join(dir, fname), keys)
+		if r.NumProblems > 0 && repair {
+			if err = fsckRepairStoreFile(r, keys, settings.Encrypted); err != nil {
+				r.problem("repair failed: %v", err)
+			}
+		}
+		rv.Files = append(rv.Files, r)
+		rv.NumProblems += r.NumProblems
+	}
+	return rv, nil
+}
+
+// Opens a store file that's not in use, decrypting it with the keys
+// if it's encrypted.  With salvage, an encrypted file opens with just
+// its records before the first that fails authentication.
+func openStoreReadOnly(path string, keys *cryptKeys, salvage bool) (
+	FileLike, *gkvlite.Store, error) {
+	osf, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := newCryptFileLikeEx(osf, keys, false, salvage)
+	if err != nil {
+		osf.Close()
+		return nil, nil, err
+	}
+	store, err := gkvlite.NewStoreEx(f, mkBucketStoreCallbacks(nil))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, store, nil
+}
+
+func fsckStoreFile(path string, keys *cryptKeys) *fsckFileReport {
+	r := &fsckFileReport{Path: path, Problems: []string{}}
+	f, store, err := openStoreReadOnly(path, keys, false)
+	if err != nil {
+		r.problem("could not open store: %v", err)
+		return r
+	}
+	defer f.Close()
+	defer store.Close()
+
+	dicts, err := acquireStoreValueDicts(store)
+	if err != nil {
+		r.problem("could not read dicts: %v", err)
+	}
+	defer func() {
+		for _, d := range dicts {
+			releaseValueDict(d)
+		}
+	}()
+
+	vbmetas := map[string]bool{}
+	if c := store.GetCollection(COLL_VBMETA); c != nil {
+		err = c.VisitItemsAscend(nil, true, func(i *gkvlite.Item) bool {
+			meta := &VBMeta{}
+			if err := jsonUnmarshal(i.Val, meta); err != nil {
+				r.problem("vbucket: %s, bad vbmeta: %v", i.Key, err)
+			} else if strconv.Itoa(int(meta.Id)) != string(i.Key) {
+				r.problem("vbucket: %s, vbmeta of vbucket: %v", i.Key, meta.Id)
+			}
+			vbmetas[string(i.Key)] = true
+			return true
+		})
+		if err != nil {
+			r.problem("could not read vbmetas: %v", err)
+		}
+	}
+
+	collNames := store.GetCollectionNames()
+	sort.Strings(collNames)
+	for _, collName := range collNames {
+		if strings.HasSuffix(collName, COLL_SUFFIX_KEYS) {
+			vbidStr := collName[0 : len(collName)-len(COLL_SUFFIX_KEYS)]
+			if store.GetCollection(vbidStr+COLL_SUFFIX_CHANGES) == nil {
+				r.problem("vbucket: %v, keys without changes", vbidStr)
+			}
+			continue
+		}
+		if !strings.HasSuffix(collName, COLL_SUFFIX_CHANGES) {
+			continue
+		}
+		vbidStr := collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)]
+		if _, err = strconv.Atoi(vbidStr); err != nil {
+			r.problem("bad changes collection: %v", collName)
+			continue
+		}
+		if !vbmetas[vbidStr] {
+			r.problem("vbucket: %v, missing vbmeta", vbidStr)
+		}
+		r.VBuckets++
+		fsckVBucket(store, vbidStr, r)
+	}
+	return r
+}
+
+// Checks that a vbucket's keys and changes agree, so each key has the
+// CAS of its latest change, and that the changes are valid items.
+func fsckVBucket(store *gkvlite.Store, vbidStr string, r *fsckFileReport) {
+	// The CAS of the latest change of each key, if not a deletion.
+	live := map[string]uint64{}
+	latest := map[string]uint64{}
+
+	changes := store.GetCollection(vbidStr + COLL_SUFFIX_CHANGES)
+	err := changes.VisitItemsAscend(nil, true, func(cItem *gkvlite.Item) bool {
+		r.Changes++
+		cas, err := casBytesParse(cItem.Key)
+		if err != nil {
+			r.problem("vbucket: %v, bad change cas: %x", vbidStr, cItem.Key)
+			return true
+		}
+		i := &item{}
+		if err = i.fromValueBytes(cItem.Val); err != nil {
+			r.problem("vbucket: %v, cas: %v, bad item: %v", vbidStr, cas, err)
+			return true
+		}
+		if i.cas != cas {
+			r.problem("vbucket: %v, cas: %v, item has cas: %v", vbidStr, cas, i.cas)
+		}
+		if len(i.key) == 0 {
+			return true // A vbucket metadata change.
+		}
+		if prev, ok := latest[string(i.key)]; ok {
+			r.problem("vbucket: %v, key: %q, changes at cas: %v and %v",
+				vbidStr, i.key, prev, cas)
+		}
+		latest[string(i.key)] = cas
+		delete(live, string(i.key))
+		if i.isDeletion() {
+			return true
+		}
+		if _, err = i.value(); err != nil {
+			r.problem("vbucket: %v, key: %q, bad value: %v", vbidStr, i.key, err)
+		}
+		live[string(i.key)] = cas
+		return true
+	})
+	if err != nil {
+		r.problem("vbucket: %v, could not read changes: %v", vbidStr, err)
+	}
+
+	keys := store.GetCollection(vbidStr + COLL_SUFFIX_KEYS)
+	if keys == nil {
+		r.problem("vbucket: %v, changes without keys", vbidStr)
+		return
+	}
+	err = keys.VisitItemsAscend(nil, true, func(kItem *gkvlite.Item) bool {
+		r.Keys++
+		cas, err := casBytesParse(kItem.Val)
+		if err != nil {
+			r.problem("vbucket: %v, key: %q, bad cas: %x", vbidStr, kItem.Key, kItem.Val)
+			return true
+		}
+		changeCas, ok := live[string(kItem.Key)]
+		if !ok {
+			r.problem("vbucket: %v, key: %q, orphaned, no change at cas: %v",
+				vbidStr, kItem.Key, cas)
+		} else if changeCas != cas {
+			r.problem("vbucket: %v, key: %q, has cas: %v, but its change has cas: %v",
+				vbidStr, kItem.Key, cas, changeCas)
+		}
+		delete(live, string(kItem.Key))
+		return true
+	})
+	if err != nil {
+		r.problem("vbucket: %v, could not read keys: %v", vbidStr, err)
+	}
+
+	orphans := make([]string, 0, len(live))
+	for key := range live {
+		orphans = append(orphans, key)
+	}
+	sort.Strings(orphans)
+	for _, key := range orphans {
+		r.problem("vbucket: %v, key: %q, orphaned change at cas: %v",
+			vbidStr, key, live[key])
+	}
+}
+
+// Copies what's readable of a store file into the file's next
+// version.  Only valid changes are copied, and the keys are rebuilt
+// from them, rather than trusting the old keys.
+func fsckRepairStoreFile(r *fsckFileReport, keys *cryptKeys,
+	encrypt bool) error {
+	f, src, err := openStoreReadOnly(r.Path, keys, true)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer src.Close()
+
+	dicts, _ := acquireStoreValueDicts(src)
+	defer func() {
+		for _, d := range dicts {
+			releaseValueDict(d)
+		}
+	}()
+
+	dir, fname := filepath.Split(r.Path)
+	prefix, ver, err := parseStoreFileName(fname, STORE_FILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	nextPath := filepath.Join(dir, makeStoreFileName(prefix, ver+1, STORE_FILE_SUFFIX))
+	osf, err := os.OpenFile(nextPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer osf.Close()
+	nextFile, err := newCryptFileLike(osf, keys, encrypt)
+	if err != nil {
+		return err
+	}
+	dst, err := gkvlite.NewStoreEx(nextFile, mkBucketStoreCallbacks(nil))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	writeEvery := 1000
+	for _, collName := range src.GetCollectionNames() {
+		if strings.HasSuffix(collName, COLL_SUFFIX_KEYS) {
+			continue
+		}
+		srcColl := src.GetCollection(collName)
+		dstColl := dst.SetCollection(collName, nil)
+		if !strings.HasSuffix(collName, COLL_SUFFIX_CHANGES) {
+			if _, _, err = copyColl(srcColl, dstColl, writeEvery, nil); err != nil {
+				r.problem("salvage of %v stopped: %v", collName, err)
+			}
+			continue
+		}
+		_, _, err = copyColl(srcColl, dstColl, writeEvery,
+			func(cItem *gkvlite.Item) (*gkvlite.Item, error) {
+				i := &item{}
+				if i.fromValueBytes(cItem.Val) != nil ||
+					!bytes.Equal(casBytes(i.cas), cItem.Key) {
+					return nil, nil
+				}
+				if len(i.key) > 0 && !i.isDeletion() {
+					if _, err := i.value(); err != nil {
+						return nil, nil
+					}
+				}
+				return cItem.Copy(), nil
+			})
+		if err != nil {
+			r.problem("salvage of %v stopped: %v", collName, err)
+		}
+		vbidStr := collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)]
+		n, err := rebuildKeys(dstColl, dst.SetCollection(vbidStr+COLL_SUFFIX_KEYS, nil))
+		if err != nil {
+			return err
+		}
+		r.Salvaged += n
+	}
+	if err = dst.Flush(); err != nil {
+		return err
+	}
+	r.Repaired = nextPath
+	return nil
+}
+
+// Rebuilds the keys of a vbucket from its changes, removing all but
+// the latest change of each key, and returns the remaining changes.
+func rebuildKeys(changes, keys *gkvlite.Collection) (n int64, err error) {
+	latest := map[string][]byte{}
+	var stale [][]byte
+	var errVisit error
+	err = changes.VisitItemsAscend(nil, true, func(cItem *gkvlite.Item) bool {
+		i := &item{}
+		if errVisit = i.fromValueBytes(cItem.Val); errVisit != nil {
+			return false
+		}
+		if len(i.key) == 0 {
+			return true
+		}
+		if prev, ok := latest[string(i.key)]; ok {
+			stale = append(stale, prev)
+		}
+		latest[string(i.key)] = cItem.Key
+		if i.isDeletion() {
+			_, errVisit = keys.Delete(i.key)
+		} else {
+			errVisit = keys.Set(i.key, cItem.Key)
+		}
+		return errVisit == nil
+	})
+	if err == nil {
+		err = errVisit
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, cas := range stale {
+		if _, err = changes.Delete(cas); err != nil {
+			return 0, err
+		}
+	}
+	numItems, _, err := changes.GetTotals()
+	return int64(numItems), err
+}
+
+// The fsck subcommand, which checks a bucket directory while the
+// server isn't running.
+func mainFsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false,
+		"Salvage readable items of store files with problems into new store files")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "\nusage: %s fsck <fsck flags> BUCKET_DIR\n",
+			os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nfsck flags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	res, err := fsckBucketDir(fs.Arg(0), *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: fsck failed: %v\n", err)
+		return 2
+	}
+	j, _ := json.MarshalIndent(res, "", "  ")
+	fmt.Printf("%s\n", j)
+	if res.NumProblems > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
+)
+
+func TestFsckCleanBucket(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 2,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	b0.CreateVBucket(1)
+	b0.SetVBState(1, VBActive)
+	r0 := &reqHandler{currentBucket: b0}
+	for i := 0; i < 10; i++ {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: 1,
+			Key:     []byte(strconv.Itoa(i)),
+			Body:    []byte(strconv.Itoa(i)),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: 1,
+		Key:     []byte("0"),
+	})
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	b0.Close()
+
+	res, err := fsckBucketDir(testBucketDir, false)
+	if err != nil {
+		t.Fatalf("expected fsck to work, got: %v", err)
+	}
+	if res.NumProblems != 0 || len(res.Files) != STORES_PER_BUCKET ||
+		res.Files[0].VBuckets != 1 || res.Files[0].Keys != 9 {
+		t.Errorf("expected a clean bucket, got: %#v, %#v", res, res.Files[0])
+	}
+}
+
+func TestFsckRepair(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	path := filepath.Join(testBucketDir, makeStoreFileName("0", 0, STORE_FILE_SUFFIX))
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("expected create to work, got: %v", err)
+	}
+	s, err := gkvlite.NewStoreEx(f, mkBucketStoreCallbacks(nil))
+	if err != nil {
+		t.Fatalf("expected store to work, got: %v", err)
+	}
+	meta, _ := json.Marshal(&VBMeta{Id: 0, State: "active"})
+	s.SetCollection(COLL_VBMETA, nil).Set([]byte("0"), meta)
+	keys := s.SetCollection("0"+COLL_SUFFIX_KEYS, nil)
+	changes := s.SetCollection("0"+COLL_SUFFIX_CHANGES, nil)
+	change := func(key string, cas uint64) {
+		i := &item{key: []byte(key), cas: cas, data: []byte("v")}
+		changes.Set(casBytes(cas), i.toValueBytes())
+	}
+	change("a", 1)
+	keys.Set([]byte("a"), casBytes(1))
+	keys.Set([]byte("b"), casBytes(5)) // Orphaned key.
+	change("c", 3)                     // Orphaned change.
+	change("d", 9)
+	keys.Set([]byte("d"), casBytes(8)) // Wrong cas.
+	changes.Set(casBytes(7), []byte("garbage"))
+	if err = s.Flush(); err != nil {
+		t.Fatalf("expected flush to work, got: %v", err)
+	}
+	s.Close()
+	f.Close()
+
+	res, err := fsckBucketDir(testBucketDir, false)
+	if err != nil {
+		t.Fatalf("expected fsck to work, got: %v", err)
+	}
+	problems := strings.Join(res.Files[0].Problems, "\n")
+	for _, exp := range []string{
+		`key: "b", orphaned, no change at cas: 5`,
+		`key: "c", orphaned change at cas: 3`,
+		`key: "d", has cas: 8, but its change has cas: 9`,
+		`cas: 7, bad item`,
+	} {
+		if !strings.Contains(problems, exp) {
+			t.Errorf("expected problem %q, got: %v", exp, problems)
+		}
+	}
+	if res.NumProblems != 4 || res.Files[0].Repaired != "" {
+		t.Errorf("expected 4 problems and no repair, got: %#v", res.Files[0])
+	}
+
+	res, err = fsckBucketDir(testBucketDir, true)
+	if err != nil {
+		t.Fatalf("expected fsck repair to work, got: %v", err)
+	}
+	if res.Files[0].Repaired != filepath.Join(testBucketDir, "0-1.store") ||
+		res.Files[0].Salvaged != 3 {
+		t.Errorf("expected a repair, got: %#v", res.Files[0])
+	}
+
+	res, err = fsckBucketDir(testBucketDir, false)
+	if err != nil {
+		t.Fatalf("expected fsck to work, got: %v", err)
+	}
+	if res.NumProblems != 0 || res.Files[0].Keys != 3 ||
+		!strings.HasSuffix(res.Files[0].Path, "0-1.store") {
+		t.Errorf("expected a repaired file, got: %#v", res.Files[0])
+	}
+}
+
+func TestFsckMissingFile(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	res, err := fsckBucketDir(testBucketDir, true)
+	if err != nil {
+		t.Fatalf("expected fsck to work, got: %v", err)
+	}
+	if res.NumProblems < 1 || res.Files[0].Repaired != "" {
+		t.Errorf("expected a problem without repair, got: %#v", res.Files[0])
+	}
+}
@@ -21,6 +21,10 @@ type item struct {
 	exp, flag uint32
 	cas       uint64
 	data      []byte
+	datatype  uint8 // How data is encoded, as in DATATYPE_RAW.
+
+	evicted bool  // The value was evicted from memory, so data is nil.
+	ref     int32 // Set when read, for the clock eviction policy.
 }
 
 func (i item) String() string {
@@ -29,11 +33,12 @@ func (i item) String() string {
 
 func (i *item) clone() *item {
 	return &item{
-		key:  i.key,
-		exp:  i.exp,
-		flag: i.flag,
-		cas:  i.cas,
-		data: i.data,
+		key:      i.key,
+		exp:      i.exp,
+		flag:     i.flag,
+		cas:      i.cas,
+		data:     i.data,
+		datatype: i.datatype,
 	}
 }
 
@@ -41,6 +46,7 @@ func (i *item) markAsDeletion() *item {
 	i.exp = DELETION_EXP
 	i.flag = DELETION_FLAG
 	i.data = nil
+	i.datatype = DATATYPE_RAW
 	return i
 }
 
@@ -52,7 +58,7 @@ func (i *item) isDeletion() bool {
 func (i *item) Equal(j *item) bool {
 	return bytes.Equal(i.key, j.key) &&
 		i.exp == j.exp && i.flag == j.flag && i.cas == j.cas &&
-		bytes.Equal(i.data, j.data)
+		i.datatype == j.datatype && bytes.Equal(i.data, j.data)
 }
 
 func (i *item) isExpired(t time.Time) bool {
@@ -76,7 +82,7 @@ func (i *item) toValueBytes() []byte {
 	off += 4
 	binary.BigEndian.PutUint64(rv[off:], i.cas)
 	off += 8
-	binary.BigEndian.PutUint16(rv[off:], uint16(len(i.key)))
+	binary.BigEndian.PutUint16(rv[off:], uint16(i.datatype)<<8|uint16(len(i.key)))
 	off += 2
 	binary.BigEndian.PutUint32(rv[off:], uint32(len(i.data)))
 	off += 4
@@ -97,6 +103,8 @@ func (i *item) fromValueBytes(b []byte) (err error) {
 	must(binary.Read(buf, binary.BigEndian, &i.cas))
 	var keylen uint16
 	must(binary.Read(buf, binary.BigEndian, &keylen))
+	i.datatype = uint8(keylen >> 8)
+	keylen &= 0xff
 	var datalen uint32
 	must(binary.Read(buf, binary.BigEndian, &datalen))
 	if len(b) < itemHdrLen+int(keylen)+int(datalen) {
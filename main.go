@@ -13,6 +13,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -41,6 +42,20 @@ var restCouch = flag.String("rest-couch", ":8092",
 	"REST couch protocol listen address")
 var restNS = flag.String("rest-ns", ":8091",
 	"REST NS protocol listen address")
+var addrTLS = flag.String("addr-tls", "",
+	"Data protocol TLS listen address")
+var addrASCII = flag.String("addr-ascii", "",
+	"Memcached ASCII text protocol listen address")
+var restCouchTLS = flag.String("rest-couch-tls", "",
+	"REST couch protocol HTTPS listen address")
+var restNSTLS = flag.String("rest-ns-tls", "",
+	"REST NS protocol HTTPS listen address")
+var tlsCert = flag.String("tls-cert", "",
+	"TLS certificate file")
+var tlsKey = flag.String("tls-key", "",
+	"TLS private key file")
+var tlsClientCA = flag.String("tls-client-ca", "",
+	"TLS client CA file, for client certificate auth")
 var staticPath = flag.String("static-path", "http://cbgb.io/static.zip",
 	"Path to static web UI content")
 var defaultBucketName = flag.String("default-bucket-name", DEFAULT_BUCKET_NAME,
@@ -69,6 +84,8 @@ var fileServiceWorkers = flag.Int("file-service-workers", 32,
 	"Number of file service workers")
 var compactEvery = flag.Int("compact-every", 10000,
 	"Compact file after this many writes")
+var backupDir = flag.String("backup-dir", "",
+	"Directory for bucket backups; defaults to _backups in the data directory")
 var logSyslog = flag.Bool("syslog", false, "Log to syslog")
 var logPlain = flag.Bool("log-no-ts", false, "Log without timestamps")
 
@@ -78,6 +95,9 @@ var bucketSettings *BucketSettings
 func usage() {
 	fmt.Fprintf(os.Stderr, "cbgb - version %s\n", VERSION)
 	fmt.Fprintf(os.Stderr, "\nusage: %s <flags>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <flags> restore <restore flags> BACKUP_DIR\n",
+		os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s fsck <fsck flags> BUCKET_DIR\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nflags:\n")
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\npersistence levels:\n")
@@ -112,6 +132,13 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	switch flag.Arg(0) {
+	case "restore":
+		os.Exit(mainRestore(flag.Args()[1:]))
+	case "fsck":
+		os.Exit(mainFsck(flag.Args()[1:]))
+	}
+
 	log.Printf("cbgb - version %v", VERSION)
 
 	if *adminUser == "" && *adminPass == "" {
@@ -135,17 +162,31 @@ func main() {
 	buckets = bs
 	bucketSettings = bss
 
+	if err = replications.Load(bs); err != nil {
+		log.Printf("error: could not restart replications: %v", err)
+	}
+
+	var tlsConfig *tls.Config
+	if *addrTLS != "" || *restCouchTLS != "" || *restNSTLS != "" {
+		tlsConfig, err = LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("error: could not load tls config: %v", err)
+		}
+	}
+
 	go deliverEvents()
 
-	mainServer(*defaultBucketName, *addr, *maxConns, *restCouch, *restNS,
+	mainServer(*defaultBucketName, *addr, *addrTLS, *addrASCII, *maxConns,
+		*restCouch, *restCouchTLS, *restNS, *restNSTLS, tlsConfig,
 		*staticPath, filepath.Join(*data, ".staticCache"))
 
 	// Let goroutines do their work.
 	select {}
 }
 
-func mainServer(defaultBucketName string, addr string, maxConns int,
-	restCouch string, restNS string,
+func mainServer(defaultBucketName string, addr string, addrTLS string,
+	addrASCII string, maxConns int, restCouch string, restCouchTLS string,
+	restNS string, restNSTLS string, tlsConfig *tls.Config,
 	staticPath string, staticCachePath string) {
 	if buckets.Get(defaultBucketName) == nil && defaultBucketName != "" {
 		_, err := createBucket(defaultBucketName, bucketSettings)
@@ -162,25 +203,73 @@ func mainServer(defaultBucketName string, addr string, maxConns int,
 			os.Exit(1)
 		}
 	}
+	if addrTLS != "" {
+		_, err := StartTLSServer(addrTLS, maxConns, buckets, defaultBucketName,
+			tlsConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not start tls server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if addrASCII != "" {
+		_, err := StartASCIIServer(addrASCII, maxConns, buckets, defaultBucketName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not start ascii server: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	log.Printf("primary connections...")
+	if restNS != "" || restNSTLS != "" {
+		go func() {
+			h := restNSHandler(staticPath, staticCachePath)
+			if restNSTLS != "" {
+				go func() { log.Fatal(restServe(restNSTLS, tlsConfig, h)) }()
+			}
+			if restNS != "" {
+				log.Fatal(restServe(restNS, nil, h))
+			}
+		}()
+	}
 	if restNS != "" {
-		go restNSServe(restNS, staticPath, staticCachePath)
 		hp := strings.Split(restNS, ":")
 		log.Printf("  connect your couchbase client to: http://HOST:%s/pools/default",
 			hp[len(hp)-1])
 		log.Printf("  web admin U/I available on: http://HOST:%s",
 			hp[len(hp)-1])
 	}
+	if restNSTLS != "" {
+		hp := strings.Split(restNSTLS, ":")
+		log.Printf("  web admin U/I available on: https://HOST:%s",
+			hp[len(hp)-1])
+	}
 	log.Printf("secondary connections...")
 	if restCouch != "" {
-		go restCouchServe(restCouch, staticPath)
+		go func() { log.Fatal(restServe(restCouch, nil, restCouchHandler())) }()
 		log.Printf("  view listening: %s", restCouch)
 	}
+	if restCouchTLS != "" {
+		go func() {
+			log.Fatal(restServe(restCouchTLS, tlsConfig, restCouchHandler()))
+		}()
+		log.Printf("  view tls listening: %s", restCouchTLS)
+	}
 	log.Printf("  data listening: %s", addr)
+	if addrTLS != "" {
+		log.Printf("  data tls listening: %s", addrTLS)
+	}
+	if addrASCII != "" {
+		log.Printf("  data ascii listening: %s", addrASCII)
+	}
 }
 
 func createBucket(bucketName string, bucketSettings *BucketSettings) (
 	Bucket, error) {
+	return createBucketVBState(bucketName, bucketSettings, VBActive)
+}
+
+// Creates a bucket whose vbuckets all start in the given state.
+func createBucketVBState(bucketName string, bucketSettings *BucketSettings,
+	vbs VBState) (Bucket, error) {
 	log.Printf("creating bucket: %v, numPartitions: %v",
 		bucketName, bucketSettings.NumPartitions)
 
@@ -191,7 +280,7 @@ func createBucket(bucketName string, bucketSettings *BucketSettings) (
 
 	for vbid := 0; vbid < bucketSettings.NumPartitions; vbid++ {
 		bucket.CreateVBucket(uint16(vbid))
-		bucket.SetVBState(uint16(vbid), VBActive)
+		bucket.SetVBState(uint16(vbid), vbs)
 	}
 
 	if err = bucket.Flush(); err != nil {
@@ -15,10 +15,18 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
 )
 
 const minObsReq = 4
 
+// The key states of an OBSERVE, where obsDeleted is a logically
+// deleted key, whose deletion isn't yet persisted.
 const (
 	obsNotPersisted = 0
 	obsPersisted    = 1
@@ -83,3 +91,97 @@ func encodeObserveBody(r []obsStatus) []byte {
 
 	return rv
 }
+
+// Returns the state and CAS of a key for an OBSERVE.  An item is
+// persisted once a flush has written its change, and a deletion is
+// only reported until it's persisted, after which the key is simply
+// not found.
+func observeKey(v *VBucket, key []byte, now time.Time) (byte, uint64, error) {
+	persisted := func(cas uint64) bool {
+		return v.bs.persistsData() && v.ps.casPersisted(cas)
+	}
+	i, err := v.ps.get(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if i != nil && !i.isExpired(now) {
+		if persisted(i.cas) {
+			return obsPersisted, i.cas, nil
+		}
+		return obsNotPersisted, i.cas, nil
+	}
+	if cas, ok := v.ps.unpersistedDeletion(key); ok {
+		return obsDeleted, cas, nil
+	}
+	return obsNotFound, 0, nil
+}
+
+// The OBSERVE_SEQNO response body is a format type of 0, the vbucket
+// id (2), vbucket uuid (8), persisted seqno (8) and current seqno (8),
+// where cbgb's seqnos are CAS's.  As cbgb vbuckets have no failover
+// log, their uuid is 0.
+const obsSeqnoBodyLen = 1 + 2 + 8 + 8 + 8
+
+func vbObserveSeqno(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Body) != 8 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("body must be a vbucket uuid"),
+		}
+	}
+	var persistedCas uint64
+	if v.bs.persistsData() {
+		persistedCas = v.ps.persistedSeqno()
+	}
+	body := make([]byte, obsSeqnoBodyLen)
+	binary.BigEndian.PutUint16(body[1:], v.vbid)
+	binary.BigEndian.PutUint64(body[11:], persistedCas)
+	binary.BigEndian.PutUint64(body[19:], atomic.LoadUint64(&v.ps.lastCas))
+	return &gomemcached.MCResponse{Body: body}
+}
+
+// Notes that a replica acknowledged receiving every change up to the
+// cas.  Replicas are told apart by their TAP or UPR stream names.
+func (v *VBucket) noteReplicaCas(replica string, cas uint64) {
+	v.replicaLock.Lock()
+	defer v.replicaLock.Unlock()
+	if v.replicaCas == nil {
+		v.replicaCas = map[string]uint64{}
+	}
+	if cas > v.replicaCas[replica] {
+		v.replicaCas[replica] = cas
+	}
+}
+
+// Returns the CAS's acknowledged by each replica, highest first.
+func (v *VBucket) replicaSeqnos() []uint64 {
+	v.replicaLock.Lock()
+	defer v.replicaLock.Unlock()
+	rv := make([]uint64, 0, len(v.replicaCas))
+	for _, cas := range v.replicaCas {
+		rv = append(rv, cas)
+	}
+	sort.Sort(sort.Reverse(uint64Slice(rv)))
+	return rv
+}
+
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+
+// GET_REPLICA_SEQNOS is cbgb's own.  Its response body has the seqno
+// (8) acknowledged by each of the vbucket's replicas, highest first,
+// so a change with a CAS at or below the Nth seqno has reached N
+// replicas, for replicateTo.
+func vbGetReplicaSeqnos(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	seqnos := v.replicaSeqnos()
+	body := make([]byte, 8*len(seqnos))
+	for i, seqno := range seqnos {
+		binary.BigEndian.PutUint64(body[8*i:], seqno)
+	}
+	return &gomemcached.MCResponse{Body: body}
+}
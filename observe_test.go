@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
 	"testing"
+
+	"github.com/dustin/gomemcached"
 )
 
 func TestObserveParse(t *testing.T) {
@@ -77,3 +82,186 @@ func TestObserveEncode(t *testing.T) {
 		t.Fatalf("Encoding failed:\n%x\n%x", got, exp)
 	}
 }
+
+func TestObserveKeys(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+	r0 := &reqHandler{currentBucket: b0}
+
+	observe := func(vbid uint16, key string) (*gomemcached.MCResponse, obsStatus) {
+		body := make([]byte, 4+len(key))
+		binary.BigEndian.PutUint16(body, vbid)
+		binary.BigEndian.PutUint16(body[2:], uint16(len(key)))
+		copy(body[4:], key)
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.OBSERVE,
+			Body:   body,
+		})
+		var st obsStatus
+		if res.Status == gomemcached.SUCCESS {
+			b := res.Body
+			if len(b) != 4+len(key)+1+8 ||
+				binary.BigEndian.Uint16(b) != vbid ||
+				string(b[4:4+len(key)]) != key {
+				t.Fatalf("expected an observe of %v, got: %v", key, b)
+			}
+			st = obsStatus{obsKey{vbid, []byte(key)}, b[4+len(key)],
+				binary.BigEndian.Uint64(b[5+len(key):])}
+		}
+		return res, st
+	}
+	expect := func(key string, state byte, cas uint64) {
+		res, st := observe(0, key)
+		if res.Status != gomemcached.SUCCESS || st.state != state || st.cas != cas {
+			t.Errorf("expected %v to be in state %x with cas %v, got: %v, %#v",
+				key, state, cas, res, st)
+		}
+	}
+
+	res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("a"),
+		Body:   []byte("v"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	cas := res.Cas
+	expect("a", obsNotPersisted, cas)
+	expect("missing", obsNotFound, 0)
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	expect("a", obsPersisted, cas)
+
+	res = r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+	_, st := observe(0, "a")
+	if st.state != obsDeleted || st.cas <= cas {
+		t.Errorf("expected a logically deleted key, got: %#v", st)
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	expect("a", obsNotFound, 0)
+
+	// A with-meta change can have an older CAS than what's persisted,
+	// but isn't persisted until the next flush.
+	req := &gomemcached.MCRequest{
+		Opcode: SET_WITH_META,
+		Key:    []byte("old"),
+		Body:   []byte("v"),
+		Extras: make([]byte, withMetaExtrasLen),
+	}
+	binary.BigEndian.PutUint64(req.Extras[16:], 1)
+	if res = r0.HandleMessage(nil, nil, req); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set with meta to work, got: %v", res)
+	}
+	expect("old", obsNotPersisted, 1)
+	vb, _ := b0.GetVBucket(0)
+	if vb.ps.persistedSeqno() != 0 || vb.ps.evictable(&item{data: []byte("v"), cas: 1}) {
+		t.Errorf("expected the old cas to hold back the persisted seqno")
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	expect("old", obsPersisted, 1)
+	if vb.ps.persistedSeqno() <= cas {
+		t.Errorf("expected the persisted seqno to catch up, got: %v",
+			vb.ps.persistedSeqno())
+	}
+
+	if res, _ = observe(1, "a"); res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("expected a missing vbucket to fail, got: %v", res)
+	}
+}
+
+func TestObserveSeqno(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+	r0 := &reqHandler{currentBucket: b0}
+
+	observeSeqno := func() (persisted, current uint64) {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: OBSERVE_SEQNO,
+			Body:   make([]byte, 8),
+		})
+		if res.Status != gomemcached.SUCCESS || len(res.Body) != obsSeqnoBodyLen ||
+			res.Body[0] != 0 || binary.BigEndian.Uint16(res.Body[1:]) != 0 {
+			t.Fatalf("expected an observe seqno, got: %v", res)
+		}
+		return binary.BigEndian.Uint64(res.Body[11:]),
+			binary.BigEndian.Uint64(res.Body[19:])
+	}
+
+	res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("a"),
+		Body:   []byte("v"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	if persisted, current := observeSeqno(); persisted >= res.Cas ||
+		current != res.Cas {
+		t.Errorf("expected an unpersisted seqno, got: %v, %v", persisted, current)
+	}
+	if err = b0.Flush(); err != nil {
+		t.Fatalf("expected Flush to work, got: %v", err)
+	}
+	if persisted, current := observeSeqno(); persisted != res.Cas ||
+		current != res.Cas {
+		t.Errorf("expected a persisted seqno, got: %v, %v", persisted, current)
+	}
+
+	res = r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: OBSERVE_SEQNO,
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected a missing vbucket uuid to fail, got: %v", res)
+	}
+}
+
+func TestReplicaSeqnos(t *testing.T) {
+	v := &VBucket{}
+	if seqnos := v.replicaSeqnos(); len(seqnos) != 0 {
+		t.Errorf("expected no replicas, got: %v", seqnos)
+	}
+	v.noteReplicaCas("a", 10)
+	v.noteReplicaCas("b", 30)
+	v.noteReplicaCas("a", 20)
+	v.noteReplicaCas("b", 5)
+	res := vbGetReplicaSeqnos(v, nil, &gomemcached.MCRequest{})
+	if res.Status != gomemcached.SUCCESS || len(res.Body) != 16 ||
+		binary.BigEndian.Uint64(res.Body) != 30 ||
+		binary.BigEndian.Uint64(res.Body[8:]) != 20 {
+		t.Errorf("expected replica seqnos 30 and 20, got: %v", res)
+	}
+}
@@ -342,6 +342,65 @@ func TestCASSet(t *testing.T) {
 	}
 }
 
+func TestWithMetaOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	mkReq := func(op gomemcached.CommandCode, cas uint64) *gomemcached.MCRequest {
+		req := &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte("x"),
+			Body:    []byte("meta"),
+			Extras:  make([]byte, withMetaExtrasLen),
+		}
+		binary.BigEndian.PutUint32(req.Extras, 0xf1a9)
+		binary.BigEndian.PutUint64(req.Extras[16:], cas)
+		return req
+	}
+
+	res := rh.HandleMessage(nil, nil, mkReq(SET_WITH_META, 0))
+	if res.Status != gomemcached.EINVAL {
+		t.Fatalf("expected EINVAL for missing meta CAS, got: %v", res)
+	}
+	res = rh.HandleMessage(nil, nil, mkReq(SET_WITH_META, 5000))
+	if res.Status != gomemcached.SUCCESS || res.Cas != 5000 {
+		t.Fatalf("expected SET_WITH_META to keep CAS, got: %v", res)
+	}
+	res = testGet(&rh, 3, "x")
+	if res.Cas != 5000 || binary.BigEndian.Uint32(res.Extras) != 0xf1a9 {
+		t.Fatalf("expected preserved meta, got: %v", res)
+	}
+	res = rh.HandleMessage(nil, nil, mkReq(SET_WITH_META, 4000))
+	if res.Status != gomemcached.KEY_EEXISTS {
+		t.Fatalf("expected KEY_EEXISTS for stale meta CAS, got: %v", res)
+	}
+	res = rh.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("x"),
+	})
+	if res.Status != gomemcached.SUCCESS || res.Cas <= 5000 {
+		t.Fatalf("expected local CAS after meta CAS, got: %v", res)
+	}
+	res = rh.HandleMessage(nil, nil, mkReq(DELETE_WITH_META, res.Cas+100))
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected DELETE_WITH_META to work, got: %v", res)
+	}
+	res = testGet(&rh, 3, "x")
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Fatalf("expected deleted item, got: %v", res)
+	}
+}
+
 func TestVersionCommand(t *testing.T) {
 	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
 	defer os.RemoveAll(testBucketDir)
@@ -1327,3 +1386,249 @@ func TestArithOps(t *testing.T) {
 		}
 	}
 }
+
+func TestTouchOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	ch := make(chan interface{}, 16)
+	vb.observer.Register(ch)
+	defer vb.observer.Unregister(ch)
+
+	touch := func(op gomemcached.CommandCode, key string,
+		exp uint32) *gomemcached.MCResponse {
+		req := &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte(key),
+			Extras:  make([]byte, 4),
+		}
+		binary.BigEndian.PutUint32(req.Extras, exp)
+		return rh.HandleMessage(ioutil.Discard, nil, req)
+	}
+
+	set := &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("a"),
+		Body:    []byte("aye"),
+		Extras:  make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(set.Extras, 0xdeadbeef)
+	res := rh.HandleMessage(ioutil.Discard, nil, set)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set to work, got: %v", res)
+	}
+	<-ch
+	lastCas := res.Cas
+
+	res = touch(TOUCH, "a", 100)
+	if res.Status != gomemcached.SUCCESS || len(res.Body) != 0 ||
+		res.Cas <= lastCas {
+		t.Errorf("Expected touch to work with a new cas, got: %v", res)
+	}
+	lastCas = res.Cas
+	m := (<-ch).(mutation)
+	if string(m.key) != "a" || m.cas != lastCas || m.deleted {
+		t.Errorf("Expected touch mutation broadcast, got: %#v", m)
+	}
+
+	for _, op := range []gomemcached.CommandCode{GAT, GATQ} {
+		res = touch(op, "a", 0)
+		if res == nil || res.Status != gomemcached.SUCCESS ||
+			string(res.Body) != "aye" || res.Cas <= lastCas {
+			t.Errorf("Expected %v to return the item, got: %v", op, res)
+		}
+		if res != nil && (len(res.Extras) != 4 ||
+			binary.BigEndian.Uint32(res.Extras) != 0xdeadbeef) {
+			t.Errorf("Expected %v to return the flags, got: %v", op, res)
+		}
+		lastCas = res.Cas
+		<-ch
+	}
+
+	if res = touch(GATQ, "b", 0); res != nil {
+		t.Errorf("Expected quiet GATQ miss, got: %v", res)
+	}
+	for _, op := range []gomemcached.CommandCode{TOUCH, GAT} {
+		if res = touch(op, "b", 0); res.Status != gomemcached.KEY_ENOENT {
+			t.Errorf("Expected %v miss, got: %v", op, res)
+		}
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  TOUCH,
+		VBucket: 3,
+		Key:     []byte("a"),
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected EINVAL for missing touch extras, got: %v", res)
+	}
+
+	if vb.stats.Touches != 3 || vb.stats.Gats != 4 ||
+		vb.stats.GetMisses != 2 || vb.stats.Updates != 3 ||
+		vb.stats.Mutations != 8 || vb.stats.OutgoingValueBytes != 6 {
+		t.Errorf("Expected touch stats, got: %#v", vb.stats)
+	}
+
+	// Touching with an absolute time in the past expires the item.
+	res = touch(TOUCH, "a", uint32(time.Now().Add(-time.Hour).Unix()))
+	if res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected touch to work, got: %v", res)
+	}
+	<-ch
+	if res = vb.get([]byte("a")); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected touched item to expire, got: %v", res)
+	}
+}
+
+func TestGetLockedOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	vb, _ := testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	do := func(op gomemcached.CommandCode, key string,
+		cas uint64) *gomemcached.MCResponse {
+		req := &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte(key),
+			Cas:     cas,
+		}
+		switch op {
+		case gomemcached.SET:
+			req.Extras = make([]byte, 8)
+			req.Body = []byte("aye")
+		case TOUCH, GAT:
+			req.Extras = make([]byte, 4)
+		}
+		return rh.HandleMessage(ioutil.Discard, nil, req)
+	}
+
+	if res := do(GET_LOCKED, "a", 0); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected getl miss, got: %v", res)
+	}
+	res := do(gomemcached.SET, "a", 0)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected set to work, got: %v", res)
+	}
+	itemCas := res.Cas
+
+	res = do(GET_LOCKED, "a", 0)
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "aye" ||
+		res.Cas == itemCas {
+		t.Fatalf("Expected getl to work with a lock cas, got: %v", res)
+	}
+	lockCas := res.Cas
+
+	if res = do(gomemcached.GET, "a", 0); res.Status != gomemcached.SUCCESS ||
+		res.Cas != LOCKED_CAS {
+		t.Errorf("Expected get of a locked item to hide the cas, got: %v", res)
+	}
+	if res = do(GET_LOCKED, "a", 0); res.Status != LOCKED {
+		t.Errorf("Expected 2nd getl to fail, got: %v", res)
+	}
+
+	tests := []struct {
+		op  gomemcached.CommandCode
+		cas uint64
+	}{
+		{gomemcached.SET, 0},
+		{gomemcached.SET, itemCas},
+		{gomemcached.DELETE, 0},
+		{gomemcached.DELETE, itemCas},
+		{TOUCH, 0},
+		{UNLOCK_KEY, itemCas},
+	}
+	for _, x := range tests {
+		if res = do(x.op, "a", x.cas); res.Status != LOCKED {
+			t.Errorf("Expected %v, cas %v to be LOCKED, got: %v",
+				x.op, x.cas, res)
+		}
+	}
+
+	// A GAT of a locked item is a locked error, not a miss.
+	misses, lockedErrors := vb.stats.GetMisses, vb.stats.LockedErrors
+	if res = do(GAT, "a", 0); res.Status != LOCKED {
+		t.Errorf("Expected gat to be LOCKED, got: %v", res)
+	}
+	if vb.stats.GetMisses != misses || vb.stats.LockedErrors != lockedErrors+1 {
+		t.Errorf("Expected a locked error and no miss, got: %#v", vb.stats)
+	}
+
+	if res = do(UNLOCK_KEY, "a", lockCas); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected unlock to work, got: %v", res)
+	}
+	if res = do(UNLOCK_KEY, "a", lockCas); res.Status != gomemcached.TMPFAIL {
+		t.Errorf("Expected unlock of an unlocked item to fail, got: %v", res)
+	}
+	if res = do(gomemcached.GET, "a", 0); res.Cas != itemCas {
+		t.Errorf("Expected get of an unlocked item to have its cas, got: %v", res)
+	}
+
+	// A mutation with the lock's CAS unlocks.
+	lockCas = do(GET_LOCKED, "a", 0).Cas
+	if res = do(gomemcached.SET, "a", lockCas); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected set with the lock cas to work, got: %v", res)
+	}
+	if res = do(gomemcached.SET, "a", 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected set after unlocking to work, got: %v", res)
+	}
+
+	// A vbucket state change unlocks.
+	do(GET_LOCKED, "a", 0)
+	testBucket.SetVBState(3, VBReplica)
+	if res = do(GET_LOCKED, "a", 0); res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("Expected getl on a replica to fail, got: %v", res)
+	}
+	testBucket.SetVBState(3, VBActive)
+	if res = do(gomemcached.SET, "a", 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected set after a state change to work, got: %v", res)
+	}
+
+	// Locks time out.
+	origLockTime := defaultLockTime
+	defaultLockTime = 10 * time.Millisecond
+	defer func() { defaultLockTime = origLockTime }()
+	do(GET_LOCKED, "a", 0)
+	if res = do(gomemcached.SET, "a", 0); res.Status != LOCKED {
+		t.Errorf("Expected set on a locked item to fail, got: %v", res)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if res = do(gomemcached.SET, "a", 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected set after lock timeout to work, got: %v", res)
+	}
+	defaultLockTime = origLockTime
+
+	// Locked items don't expire until unlocked.
+	lockCas = do(GET_LOCKED, "a", 0).Cas
+	vb.Apply(func() {
+		i, _ := vb.ps.get([]byte("a"))
+		e := *i
+		e.exp = uint32(time.Now().Add(-time.Hour).Unix())
+		vb.ps.set(&e, i)
+	})
+	vb.expirationScan()
+	if res = do(gomemcached.GET, "a", 0); res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected locked item to not expire, got: %v", res)
+	}
+	do(UNLOCK_KEY, "a", lockCas)
+	if res = do(gomemcached.GET, "a", 0); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected unlocked item to expire, got: %v", res)
+	}
+}
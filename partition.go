@@ -23,11 +23,28 @@ import (
 )
 
 type partitionstore struct {
-	vbid    uint16
-	parent  *bucketstore
-	lock    sync.Mutex     // Properties below here are covered by this lock.
-	keys    unsafe.Pointer // *gkvlite.Collection
-	changes unsafe.Pointer // *gkvlite.Collection
+	vbid   uint16
+	parent *bucketstore
+
+	// Value eviction accounting, into the owning vbucket and bucket.
+	stats           *BucketStats
+	bucketItemBytes *int64
+
+	lastCas      uint64 // Highest CAS of a keyed change that's been made.
+	persistedCas uint64 // Keyed items up to this CAS have been flushed, but see stale.
+	evictHand    []byte // Where the clock eviction policy resumes.
+
+	// Keyed changes made with a CAS that's not above lastCas, like
+	// with-meta changes from elsewhere, which persistedCas can't
+	// cover until a flush that started after them succeeds.
+	staleLock     sync.Mutex
+	stale         map[uint64]bool
+	staleFlushing map[uint64]bool // The stale changes a flush is writing.
+
+	lock      sync.Mutex        // Properties below here are covered by this lock.
+	keys      unsafe.Pointer    // *gkvlite.Collection
+	changes   unsafe.Pointer    // *gkvlite.Collection
+	deletions map[string]uint64 // CAS's of deleted keys, until flushed.
 }
 
 // Should only be used by readers.
@@ -49,11 +66,20 @@ func (p *partitionstore) collsPauseSwap(
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	prevKeys := atomic.LoadPointer(&p.keys)
+
 	k, c := cb()
 
 	// Update the changes first, so that readers see a key index that's older.
 	atomic.StorePointer(&p.changes, unsafe.Pointer(c))
 	atomic.StorePointer(&p.keys, unsafe.Pointer(k))
+
+	// A swapped in key index doesn't link to evicted values, so they
+	// count as resident again until they're next evicted.
+	if unsafe.Pointer(k) != prevKeys && p.stats != nil {
+		n := atomic.SwapInt64(&p.stats.EvictedValueBytes, 0)
+		atomic.AddInt64(p.bucketItemBytes, n)
+	}
 }
 
 func (p *partitionstore) get(key []byte) (*item, error) {
@@ -74,32 +100,49 @@ func (p *partitionstore) getItem(key []byte, withValue bool) (
 		// TODO: What if a compaction happens in between the lookups,
 		// and the changes-feed no longer has the item?  Answer: compaction
 		// must not remove items that the key-index references.
-		i := (*item)(atomic.LoadPointer(&kItem.Transient))
-		if i != nil {
-			return i, nil
+		i, err := p.keyItem(kItem, changes, withValue)
+		if err != nil || i != nil {
+			return i, err
 		}
-		cItem, err := changes.GetItem(kItem.Val, true)
-		if err != nil {
+		// If there's no change item, perhaps a concurrent set() happened
+		// after the keys.GetItem() and de-duped the old change.  So, retry.
+	}
+	return nil, fmt.Errorf("max getItem retries for key: %v", key)
+}
+
+// Returns the item that a key-index item links to, which is loaded
+// from the changes collection when it's not linked yet.  An item
+// whose value was evicted is faulted back in, unless withValue is
+// false, where the resident metadata suffices.  Returns nil when the
+// changes collection doesn't have the item.
+func (p *partitionstore) keyItem(kItem *gkvlite.Item,
+	changes *gkvlite.Collection, withValue bool) (*item, error) {
+	kt := atomic.LoadPointer(&kItem.Transient)
+	ki := (*item)(kt)
+	if ki != nil && (!ki.evicted || !withValue) {
+		return ki, nil
+	}
+	// Reads the value from the file when gkvlite has evicted it.
+	cItem, err := changes.GetItem(kItem.Val, true)
+	if err != nil || cItem == nil {
+		return nil, err
+	}
+	i := (*item)(atomic.LoadPointer(&cItem.Transient))
+	if i == nil {
+		i = &item{key: kItem.Key}
+		if err = i.fromValueBytes(cItem.Val); err != nil {
 			return nil, err
 		}
-		if cItem != nil {
-			i = (*item)(atomic.LoadPointer(&cItem.Transient))
-			if i != nil {
-				atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
-				return i, nil
-			}
-			i := &item{key: key}
-			if err = i.fromValueBytes(cItem.Val); err != nil {
-				return nil, err
-			}
-			atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
-			atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
-			return i, nil
-		}
-		// If cItem is nil, perhaps a concurrent set() happened after
-		// the keys.GetItem() and de-duped the old change.  So, retry.
+		atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
 	}
-	return nil, fmt.Errorf("max getItem retries for key: %v", key)
+	if atomic.CompareAndSwapPointer(&kItem.Transient, kt, unsafe.Pointer(i)) &&
+		ki != nil && p.stats != nil {
+		n := int64(len(i.data))
+		atomic.AddInt64(&p.stats.ValueFaults, 1)
+		atomic.AddInt64(&p.stats.EvictedValueBytes, -n)
+		atomic.AddInt64(p.bucketItemBytes, n)
+	}
+	return i, nil
 }
 
 func (p *partitionstore) getTotals() (
@@ -117,29 +160,14 @@ func (p *partitionstore) visitItems(start []byte, withValue bool,
 	keys, changes := p.colls()
 	var vErr error
 	v := func(kItem *gkvlite.Item) bool {
-		i := (*item)(atomic.LoadPointer(&kItem.Transient))
-		if i != nil {
-			return visitor(i)
-		}
-		var cItem *gkvlite.Item
-		cItem, vErr = changes.GetItem(kItem.Val, true)
+		var i *item
+		i, vErr = p.keyItem(kItem, changes, withValue)
 		if vErr != nil {
 			return false
 		}
-		if cItem == nil {
+		if i == nil {
 			return true // TODO: track this case; might have been compacted away.
 		}
-		i = (*item)(atomic.LoadPointer(&cItem.Transient))
-		if i != nil {
-			atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
-			return visitor(i)
-		}
-		i = &item{key: kItem.Key}
-		if vErr = i.fromValueBytes(cItem.Val); vErr != nil {
-			return false
-		}
-		atomic.StorePointer(&cItem.Transient, unsafe.Pointer(i))
-		atomic.StorePointer(&kItem.Transient, unsafe.Pointer(i))
 		return visitor(i)
 	}
 	if err := p.visit(keys, start, true, v); err != nil {
@@ -165,6 +193,29 @@ func (p *partitionstore) visitChanges(start []byte, withValue bool,
 	return vErr
 }
 
+// Returns the CAS of the latest item change, skipping metadata
+// changes, which for a replica is the latest change it received.
+func (p *partitionstore) lastItemCas() (cas uint64, err error) {
+	_, changes := p.colls()
+	var vErr error
+	err = changes.VisitItemsDescend(casBytes(^uint64(0)), true,
+		func(cItem *gkvlite.Item) bool {
+			i := &item{}
+			if vErr = i.fromValueBytes(cItem.Val); vErr != nil {
+				return false
+			}
+			if len(i.key) == 0 { // An empty key == metadata change.
+				return true
+			}
+			cas = i.cas
+			return false
+		})
+	if err == nil {
+		err = vErr
+	}
+	return cas, err
+}
+
 func (p *partitionstore) visit(coll *gkvlite.Collection,
 	start []byte, withValue bool,
 	v func(*gkvlite.Item) bool) (err error) {
@@ -196,7 +247,7 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 	cBytes := casBytes(newItem.cas)
 	cItem := &gkvlite.Item{
 		Key:       cBytes,
-		Val:       newItem.toValueBytes(),
+		Val:       p.parent.valueBytes(newItem),
 		Priority:  rand.Int31(),
 		Transient: unsafe.Pointer(newItem),
 	}
@@ -234,6 +285,9 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 			if err = keys.SetItem(kItem); err != nil {
 				return
 			}
+			delete(p.deletions, string(newItem.key))
+			p.noteStale(newItem.cas)
+			p.noteCas(newItem.cas)
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
@@ -243,7 +297,7 @@ func (p *partitionstore) setWithCallback(newItem *item, oldItem *item,
 			changes.Delete(oldItemCasBytes)
 		}
 
-		p.parent.dirty(dirtyForce)
+		p.parent.dirty(dirtyForce, int64(len(cItem.Val)))
 
 		if cb != nil {
 			cb()
@@ -286,6 +340,14 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 			if _, err = keys.Delete(key); err != nil {
 				return
 			}
+			if p.parent.persistsData() {
+				if p.deletions == nil {
+					p.deletions = map[string]uint64{}
+				}
+				p.deletions[string(key)] = cas
+			}
+			p.noteStale(cas)
+			p.noteCas(cas)
 		} else {
 			dirtyForce = true // An nil/empty key means this is a metadata change.
 		}
@@ -295,7 +357,160 @@ func (p *partitionstore) del(key []byte, cas uint64, oldItem *item) (
 			changes.Delete(oldItemCasBytes)
 		}
 
-		p.parent.dirty(dirtyForce)
+		p.parent.dirty(dirtyForce, int64(len(vBytes)))
 	})
 	return deltaItemBytes, err
 }
+
+func (p *partitionstore) noteCas(cas uint64) {
+	for {
+		lastCas := atomic.LoadUint64(&p.lastCas)
+		if lastCas >= cas ||
+			atomic.CompareAndSwapUint64(&p.lastCas, lastCas, cas) {
+			return
+		}
+	}
+}
+
+// Notes a keyed change that persistedCas doesn't tell apart from the
+// changes before it, as its CAS isn't above theirs.  Called while
+// holding the mutate() lock, before noteCas.
+func (p *partitionstore) noteStale(cas uint64) {
+	if cas > atomic.LoadUint64(&p.lastCas) || !p.parent.persistsData() {
+		return
+	}
+	p.staleLock.Lock()
+	if p.stale == nil {
+		p.stale = map[uint64]bool{}
+	}
+	p.stale[cas] = true
+	p.staleLock.Unlock()
+}
+
+// Returns whether the keyed change of a CAS has been persisted.
+func (p *partitionstore) casPersisted(cas uint64) bool {
+	if cas > atomic.LoadUint64(&p.persistedCas) {
+		return false
+	}
+	p.staleLock.Lock()
+	defer p.staleLock.Unlock()
+	return !p.stale[cas] && !p.staleFlushing[cas]
+}
+
+// Returns the CAS up to which every keyed change has been persisted.
+func (p *partitionstore) persistedSeqno() uint64 {
+	rv := atomic.LoadUint64(&p.persistedCas)
+	p.staleLock.Lock()
+	defer p.staleLock.Unlock()
+	for _, m := range []map[uint64]bool{p.stale, p.staleFlushing} {
+		for cas := range m {
+			if cas <= rv {
+				rv = cas - 1
+			}
+		}
+	}
+	return rv
+}
+
+// Returns the CAS that a flush that's about to start persists the
+// keyed changes up to, and has the flush take the stale changes.
+func (p *partitionstore) startFlush() uint64 {
+	p.staleLock.Lock()
+	defer p.staleLock.Unlock()
+	for cas := range p.stale {
+		if p.staleFlushing == nil {
+			p.staleFlushing = map[uint64]bool{}
+		}
+		p.staleFlushing[cas] = true
+	}
+	p.stale = nil
+	return atomic.LoadUint64(&p.lastCas)
+}
+
+// Returns the stale changes of a failed flush, for the next flush.
+func (p *partitionstore) flushFailed() {
+	p.staleLock.Lock()
+	defer p.staleLock.Unlock()
+	for cas := range p.staleFlushing {
+		if p.stale == nil {
+			p.stale = map[uint64]bool{}
+		}
+		p.stale[cas] = true
+	}
+	p.staleFlushing = nil
+}
+
+// Returns the CAS of a key's deletion that's not yet persisted.
+func (p *partitionstore) unpersistedDeletion(key []byte) (uint64, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	cas, ok := p.deletions[string(key)]
+	return cas, ok && !p.casPersisted(cas)
+}
+
+// Marks the keyed changes up to a CAS, and the stale changes taken by
+// startFlush, as persisted, forgetting the deletions that no longer
+// need tracking.
+func (p *partitionstore) notePersisted(cas uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.staleLock.Lock()
+	p.staleFlushing = nil
+	p.staleLock.Unlock()
+	atomic.StoreUint64(&p.persistedCas, cas)
+	for key, dcas := range p.deletions {
+		if p.casPersisted(dcas) {
+			delete(p.deletions, key)
+		}
+	}
+}
+
+// Returns whether an item's value may be evicted from memory, which
+// needs the value to have been flushed to the file.
+func (p *partitionstore) evictable(i *item) bool {
+	return !i.evicted && len(i.data) > 0 && !i.isDeletion() &&
+		p.parent.persistsData() && p.casPersisted(i.cas)
+}
+
+// Evicts the values of the given items from memory, leaving their
+// keys and metadata resident in the key index.  The victims are also
+// unlinked from their changes collection items, whose clean values
+// are evicted by gkvlite, so a later fault reads the value back from
+// the file instead of finding the victim still resident.  Returns the
+// number of values evicted.
+func (p *partitionstore) evictValues(victims []*item) (n int) {
+	p.mutate(func(keys, changes *gkvlite.Collection) {
+		for _, i := range victims {
+			if !p.evictable(i) {
+				continue
+			}
+			kItem, err := keys.GetItem(i.key, true)
+			if err != nil || kItem == nil {
+				continue
+			}
+			cItem, err := changes.GetItem(kItem.Val, true)
+			if err != nil || cItem == nil {
+				continue
+			}
+			atomic.CompareAndSwapPointer(&cItem.Transient, unsafe.Pointer(i), nil)
+			stub := &item{
+				key:     i.key,
+				exp:     i.exp,
+				flag:    i.flag,
+				cas:     i.cas,
+				evicted: true,
+			}
+			if !atomic.CompareAndSwapPointer(&kItem.Transient,
+				unsafe.Pointer(i), unsafe.Pointer(stub)) {
+				continue // The item changed or isn't linked.
+			}
+			nb := int64(len(i.data))
+			atomic.AddInt64(&p.stats.ValueEvictions, 1)
+			atomic.AddInt64(&p.stats.EvictedValueBytes, nb)
+			atomic.AddInt64(p.bucketItemBytes, -nb)
+			changes.EvictSomeItems()
+			n++
+		}
+	})
+	return n
+}
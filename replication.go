@@ -0,0 +1,819 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	mcclient "github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/server"
+)
+
+// How long to wait, doubling up to the max, before reconnecting a
+// broken replication stream.
+var replicationBackoffMin = 100 * time.Millisecond
+var replicationBackoffMax = 30 * time.Second
+
+// We send a UPR_NOOP every tapTickFreq, so a much longer silence
+// means the upstream or network has gone away.
+var replicationReadTimeout = 30 * time.Second
+var replicationDialTimeout = 10 * time.Second
+
+// How often to ask the upstream for its partition CAS's to compute lag.
+var replicationLagFreq = 5 * time.Second
+
+var replications = NewReplications()
+
+// Replications tracks the outbound replications, keyed by local
+// bucket name and then by replication id.
+type Replications struct {
+	lock  sync.Mutex
+	repls map[string]map[string]*Replication
+	next  uint64
+}
+
+func NewReplications() *Replications {
+	return &Replications{repls: map[string]map[string]*Replication{}}
+}
+
+// The file in a bucket's directory that remembers its replications,
+// so they restart with the server.
+const REPLICATIONS_FILE = "replications.json"
+
+type replicationConfig struct {
+	Id                   string `json:"id"`
+	RemoteAddr           string `json:"remoteAddr"`
+	RemoteBucket         string `json:"remoteBucket"`
+	RemotePasswordSource string `json:"remotePasswordSource,omitempty"`
+
+	// A cleartext password, from before password sources, which is
+	// still read, but dropped from the file when it's loaded.
+	RemotePassword string `json:"remotePassword,omitempty"`
+}
+
+// Starts pulling items from a remote bucket into a local bucket,
+// whose partitions all become replicas.  As that throws away the
+// bucket's own changes, a bucket with active partitions that have
+// items is refused unless force is set.  The remote bucket's password
+// is read from its source, "file:PATH" or "env:NAME", when connecting,
+// so only the source is saved.  An empty source means no password.
+func (rs *Replications) Add(bs *Buckets, bucketName string,
+	remoteAddr, remoteBucket, remotePasswordSource string,
+	force bool) (*Replication, error) {
+	b := bs.Get(bucketName)
+	if b == nil {
+		return nil, fmt.Errorf("no bucket named: %v", bucketName)
+	}
+	if remotePasswordSource != "" {
+		if _, err := readSecretSource(remotePasswordSource); err != nil {
+			return nil, err
+		}
+	}
+	if !force {
+		if err := checkReplicaVBuckets(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := setReplicaVBuckets(b); err != nil {
+		return nil, err
+	}
+
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rs.next++
+	r := rs.startLOCKED(bs, b, bucketName, replicationConfig{
+		Id:                   strconv.FormatUint(rs.next, 10),
+		RemoteAddr:           remoteAddr,
+		RemoteBucket:         remoteBucket,
+		RemotePasswordSource: remotePasswordSource,
+	})
+	if err := rs.saveLOCKED(bs, bucketName); err != nil {
+		rs.removeLOCKED(bucketName, r.Id)
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (rs *Replications) startLOCKED(bs *Buckets, b Bucket,
+	bucketName string, c replicationConfig) *Replication {
+	r := &Replication{
+		Id:           c.Id,
+		BucketName:   bucketName,
+		RemoteAddr:   c.RemoteAddr,
+		RemoteBucket: c.RemoteBucket,
+		buckets:      bs,
+		bucket:       b,
+		donech:       make(chan bool),
+
+		remotePasswordSource: c.RemotePasswordSource,
+		remotePassword:       c.RemotePassword,
+	}
+	if rs.repls[bucketName] == nil {
+		rs.repls[bucketName] = map[string]*Replication{}
+	}
+	rs.repls[bucketName][r.Id] = r
+
+	go r.run()
+	go r.pollLag()
+
+	return r
+}
+
+// Saves a bucket's replications, with the sources of their remote
+// passwords, but not the passwords, and only readable by us.
+func (rs *Replications) saveLOCKED(bs *Buckets, bucketName string) error {
+	dir, err := bs.Path(bucketName)
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(dir, REPLICATIONS_FILE)
+	cs := []replicationConfig{}
+	for _, r := range rs.repls[bucketName] {
+		cs = append(cs, replicationConfig{
+			Id:                   r.Id,
+			RemoteAddr:           r.RemoteAddr,
+			RemoteBucket:         r.RemoteBucket,
+			RemotePasswordSource: r.remotePasswordSource,
+		})
+	}
+	if len(cs) == 0 {
+		if err = os.Remove(fname); os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	j, err := json.Marshal(cs)
+	if err != nil {
+		return err
+	}
+	fnameNew := fname + ".new"
+	if err = ioutil.WriteFile(fnameNew, j, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fnameNew, fname)
+}
+
+// Restarts the replications that were saved in the buckets' directories.
+func (rs *Replications) Load(bs *Buckets) error {
+	fnames, err := filepath.Glob(filepath.Join(bs.dir, "*", "*",
+		"*"+BUCKET_DIR_SUFFIX, REPLICATIONS_FILE))
+	if err != nil {
+		return err
+	}
+	for _, fname := range fnames {
+		dir := filepath.Base(filepath.Dir(fname))
+		bucketName := dir[0 : len(dir)-len(BUCKET_DIR_SUFFIX)]
+		j, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		cs := []replicationConfig{}
+		if err = jsonUnmarshal(j, &cs); err != nil {
+			return fmt.Errorf("bad replications file: %v, err: %v", fname, err)
+		}
+		b := bs.Get(bucketName)
+		if b == nil {
+			log.Printf("not restarting replications of missing bucket: %v",
+				bucketName)
+			continue
+		}
+		if err = setReplicaVBuckets(b); err != nil {
+			return err
+		}
+		rs.lock.Lock()
+		cleartext := false
+		for _, c := range cs {
+			if n, err := strconv.ParseUint(c.Id, 10, 64); err == nil && n > rs.next {
+				rs.next = n
+			}
+			if c.RemotePassword != "" {
+				log.Printf("replication %v of bucket %v has a cleartext"+
+					" remote password, which is only kept until restart;"+
+					" recreate it with a remotePasswordSource", c.Id, bucketName)
+				cleartext = true
+			}
+			rs.startLOCKED(bs, b, bucketName, c)
+			log.Printf("restarted replication %v of bucket %v from %v/%v",
+				c.Id, bucketName, c.RemoteAddr, c.RemoteBucket)
+		}
+		if cleartext {
+			err = rs.saveLOCKED(bs, bucketName)
+		}
+		rs.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *Replications) Get(bucketName, id string) *Replication {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	return rs.repls[bucketName][id]
+}
+
+func (rs *Replications) List(bucketName string) []*Replication {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	ids := make([]string, 0, len(rs.repls[bucketName]))
+	for id := range rs.repls[bucketName] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rv := make([]*Replication, 0, len(ids))
+	for _, id := range ids {
+		rv = append(rv, rs.repls[bucketName][id])
+	}
+	return rv
+}
+
+// Stops and forgets a replication.  The local partitions stay replicas.
+func (rs *Replications) Remove(bucketName, id string) error {
+	rs.lock.Lock()
+	r := rs.removeLOCKED(bucketName, id)
+	var err error
+	if r != nil {
+		err = rs.saveLOCKED(r.buckets, bucketName)
+	}
+	rs.lock.Unlock()
+
+	if r == nil {
+		return fmt.Errorf("no replication %v for bucket %v", id, bucketName)
+	}
+	r.Close()
+	return err
+}
+
+func (rs *Replications) removeLOCKED(bucketName, id string) *Replication {
+	r := rs.repls[bucketName][id]
+	if r != nil {
+		delete(rs.repls[bucketName], id)
+		if len(rs.repls[bucketName]) == 0 {
+			delete(rs.repls, bucketName)
+		}
+	}
+	return r
+}
+
+func (rs *Replications) CloseAll(bucketName string) {
+	rs.lock.Lock()
+	m := rs.repls[bucketName]
+	delete(rs.repls, bucketName)
+	rs.lock.Unlock()
+
+	for _, r := range m {
+		r.Close()
+	}
+}
+
+// Returns an error if a bucket has active partitions with items.
+func checkReplicaVBuckets(b Bucket) error {
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		vb, _ := b.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBActive {
+			continue
+		}
+		numItems, _, err := vb.ps.getTotals()
+		if err != nil {
+			return err
+		}
+		if numItems > 0 {
+			return fmt.Errorf("partition %v is active with %v items,"+
+				" so making it a replica needs force", vbid, numItems)
+		}
+	}
+	return nil
+}
+
+func setReplicaVBuckets(b Bucket) error {
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		vb, _ := b.GetVBucket(vbid)
+		if vb == nil {
+			if _, err := b.CreateVBucket(vbid); err != nil {
+				return err
+			}
+		} else if vb.GetVBState() == VBReplica {
+			continue
+		}
+		if err := b.SetVBState(vbid, VBReplica); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Replication pulls a remote bucket's UPR streams into the replica
+// partitions of a local bucket, reconnecting with backoff when the
+// streams break.  Each stream resumes after the latest change its
+// partition has, so deletions made while disconnected are replicated,
+// too.
+//
+// It uses UPR rather than TAP, as a TAP_CONNECT with BACKFILL always
+// backfills every partition from its first change, so each reconnect
+// would resend the whole bucket, while a UPR stream starts from the
+// replica's own latest change.  UPR also has seqno acks, which tell
+// the upstream what its replicas have, for OBSERVE's replicateTo.
+type Replication struct {
+	Id           string `json:"id"`
+	BucketName   string `json:"bucketName"`
+	RemoteAddr   string `json:"remoteAddr"`
+	RemoteBucket string `json:"remoteBucket"`
+
+	remotePasswordSource string
+	remotePassword       string // Only from a replication saved before sources.
+	buckets              *Buckets
+	stats                ReplicationStats
+
+	lock    sync.Mutex
+	bucket  Bucket
+	conn    net.Conn
+	lastErr error
+	closed  bool
+	donech  chan bool
+}
+
+type ReplicationStats struct {
+	Connects        int64 `json:"connects"`
+	Reconnects      int64 `json:"reconnects"`
+	ItemsReceived   int64 `json:"itemsReceived"`
+	DeletesReceived int64 `json:"deletesReceived"`
+	ApplyErrors     int64 `json:"applyErrors"`
+
+	// The max CAS seen from the upstream.
+	LastCas uint64 `json:"lastCas"`
+
+	// The largest difference, across partitions, between the
+	// upstream's latest CAS and ours, as of the last lag poll.
+	CasLag uint64 `json:"casLag"`
+}
+
+func (r *Replication) Stats() *ReplicationStats {
+	return &ReplicationStats{
+		Connects:        atomic.LoadInt64(&r.stats.Connects),
+		Reconnects:      atomic.LoadInt64(&r.stats.Reconnects),
+		ItemsReceived:   atomic.LoadInt64(&r.stats.ItemsReceived),
+		DeletesReceived: atomic.LoadInt64(&r.stats.DeletesReceived),
+		ApplyErrors:     atomic.LoadInt64(&r.stats.ApplyErrors),
+		LastCas:         atomic.LoadUint64(&r.stats.LastCas),
+		CasLag:          atomic.LoadUint64(&r.stats.CasLag),
+	}
+}
+
+func (r *Replication) ToMap() map[string]interface{} {
+	r.lock.Lock()
+	lastErr := ""
+	if r.lastErr != nil {
+		lastErr = r.lastErr.Error()
+	}
+	r.lock.Unlock()
+	return map[string]interface{}{
+		"id":           r.Id,
+		"bucketName":   r.BucketName,
+		"remoteAddr":   r.RemoteAddr,
+		"remoteBucket": r.RemoteBucket,
+		"lastErr":      lastErr,
+		"stats":        r.Stats(),
+	}
+}
+
+func (r *Replication) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.donech)
+	if r.conn != nil {
+		r.conn.Close() // Unblocks any reader.
+	}
+}
+
+func (r *Replication) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Returns false if the replication was closed, so the conn is unwanted.
+func (r *Replication) setConn(conn net.Conn) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return false
+	}
+	r.conn = conn
+	return true
+}
+
+func (r *Replication) setLastErr(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastErr = err
+}
+
+// Returns the local bucket, reopening it if it was quiesced.
+func (r *Replication) getBucket() Bucket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.bucket == nil || !r.bucket.Available() {
+		r.bucket = r.buckets.Get(r.BucketName)
+	}
+	return r.bucket
+}
+
+func (r *Replication) run() {
+	backoff := replicationBackoffMin
+	for {
+		received, err := r.runOnce()
+		if r.isClosed() {
+			return
+		}
+		r.setLastErr(err)
+		if received {
+			backoff = replicationBackoffMin
+		}
+		log.Printf("replication %v of bucket %v from %v/%v broke,"+
+			" reconnecting in %v, err: %v",
+			r.Id, r.BucketName, r.RemoteAddr, r.RemoteBucket, backoff, err)
+		select {
+		case <-r.donech:
+			return
+		case <-time.After(backoff):
+		}
+		atomic.AddInt64(&r.stats.Reconnects, 1)
+		backoff = backoff * 2
+		if backoff > replicationBackoffMax {
+			backoff = replicationBackoffMax
+		}
+	}
+}
+
+func (r *Replication) connect() (net.Conn, *mcclient.Client, error) {
+	conn, err := net.DialTimeout("tcp", r.RemoteAddr, replicationDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := mcclient.Wrap(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	password := r.remotePassword
+	if r.remotePasswordSource != "" {
+		if password, err = readSecretSource(r.remotePasswordSource); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		password = strings.TrimRight(password, "\r\n")
+	}
+	res, err := client.Auth(r.RemoteBucket, password)
+	if err == nil && res != nil && res.Status != gomemcached.SUCCESS {
+		err = res
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("replication auth failed, err: %v", err)
+	}
+	return conn, client, nil
+}
+
+// Runs a single connection's worth of the replication streams,
+// returning whether any packets were received.
+func (r *Replication) runOnce() (bool, error) {
+	b := r.getBucket()
+	if b == nil {
+		return false, fmt.Errorf("replication lost bucket: %v", r.BucketName)
+	}
+	conn, _, err := r.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if !r.setConn(conn) {
+		return false, nil
+	}
+	atomic.AddInt64(&r.stats.Connects, 1)
+
+	// The reader and the noop ticker both send.
+	var wlock sync.Mutex
+	send := func(pkt transmissible) error {
+		wlock.Lock()
+		defer wlock.Unlock()
+		return pkt.Transmit(conn)
+	}
+
+	br := bufio.NewReader(conn)
+	openReq := &gomemcached.MCRequest{
+		Opcode: UPR_OPEN,
+		Key:    []byte("cbgb-replication-" + r.Id),
+		Extras: make([]byte, 8), // Seqno (4) and flags (4).
+	}
+	if err = send(openReq); err != nil {
+		return false, err
+	}
+	conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+	res, err := readTapAck(br)
+	if err != nil {
+		return false, err
+	}
+	if res.Opcode != UPR_OPEN || res.Status != gomemcached.SUCCESS {
+		return true, fmt.Errorf("upr open failed: %v", res)
+	}
+
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		vb, _ := b.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBReplica {
+			continue
+		}
+		start, err := vb.ps.lastItemCas()
+		if err != nil {
+			return true, err
+		}
+		if err = send(uprStreamReqPkt(vbid, start)); err != nil {
+			return true, err
+		}
+	}
+
+	// Per-vbucket CAS up to which every change has been applied,
+	// which is acknowledged upstream with each noop.
+	var alock sync.Mutex
+	applied := map[uint16]uint64{}
+	acked := map[uint16]uint64{}
+	noteApplied := func(vbid uint16, cas uint64) {
+		alock.Lock()
+		if cas > applied[vbid] {
+			applied[vbid] = cas
+		}
+		alock.Unlock()
+	}
+
+	donech := make(chan bool)
+	defer close(donech)
+	go func() {
+		ticker := time.NewTicker(tapTickFreq)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-donech:
+				return
+			case <-ticker.C:
+				var acks []*gomemcached.MCRequest
+				alock.Lock()
+				for vbid, cas := range applied {
+					if cas > acked[vbid] {
+						acks = append(acks, uprSeqnoAckPkt(vbid, cas))
+						acked[vbid] = cas
+					}
+				}
+				alock.Unlock()
+				for _, pkt := range acks {
+					if send(pkt) != nil {
+						return
+					}
+				}
+				if send(&gomemcached.MCRequest{Opcode: UPR_NOOP}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationReadTimeout))
+		magic, err := br.Peek(1)
+		if err != nil {
+			return true, err
+		}
+		if magic[0] == gomemcached.RES_MAGIC {
+			res, err := readTapAck(br)
+			if err != nil {
+				return true, err
+			}
+			if pkt, err := r.streamRes(res); err != nil {
+				return true, err
+			} else if pkt != nil {
+				if err = send(pkt); err != nil {
+					return true, err
+				}
+			}
+			continue
+		}
+		req, err := memcached.ReadPacket(br)
+		if err != nil {
+			return true, err
+		}
+		res, err = r.receive(&req)
+		if err != nil {
+			return true, err
+		}
+		switch req.Opcode {
+		case UPR_MUTATION, UPR_DELETION, UPR_EXPIRATION:
+			noteApplied(req.VBucket, req.Cas)
+		case UPR_SNAPSHOT_MARKER:
+			// Every change before the snapshot has been applied,
+			// though the upstream only takes acks of what it sent
+			// us, so not of a first snapshot's start.
+			if len(req.Extras) >= 8 {
+				alock.Lock()
+				_, streamed := applied[req.VBucket]
+				alock.Unlock()
+				if start := binary.BigEndian.Uint64(req.Extras); start > 0 && streamed {
+					noteApplied(req.VBucket, start-1)
+				}
+			}
+		}
+		if res != nil {
+			res.Opcode = req.Opcode
+			res.Opaque = req.Opaque
+			if err = send(res); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// Asks for a vbucket's changes after a CAS, and all later changes.
+// The opaque is the vbucket id, to match up the response.
+func uprStreamReqPkt(vbid uint16, start uint64) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_REQ,
+		VBucket: vbid,
+		Opaque:  uint32(vbid),
+		Extras:  make([]byte, uprStreamReqExtrasLen),
+	}
+	binary.BigEndian.PutUint64(pkt.Extras[8:], start)
+	binary.BigEndian.PutUint64(pkt.Extras[16:], ^uint64(0))
+	return pkt
+}
+
+// Acknowledges that every change of a vbucket up to a CAS has been
+// applied.
+func uprSeqnoAckPkt(vbid uint16, cas uint64) *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_SEQNO_ACK,
+		VBucket: vbid,
+		Extras:  make([]byte, 8),
+	}
+	binary.BigEndian.PutUint64(pkt.Extras, cas)
+	return pkt
+}
+
+// Handles a response from the upstream, returning any request to
+// send in turn.
+func (r *Replication) streamRes(res *gomemcached.MCResponse) (
+	*gomemcached.MCRequest, error) {
+	if res.Opcode != UPR_STREAM_REQ {
+		return nil, nil // Like our noops' responses.
+	}
+	vbid := uint16(res.Opaque)
+	switch res.Status {
+	case gomemcached.SUCCESS:
+		return nil, nil
+	case gomemcached.NOT_MY_VBUCKET:
+		log.Printf("replication %v: upstream partition %v isn't active,"+
+			" not replicating it until the next reconnect", r.Id, vbid)
+		return nil, nil
+	case UPR_ROLLBACK:
+		// The upstream is behind us, so take what it has from its
+		// latest change onwards.
+		if len(res.Body) < 8 {
+			return nil, fmt.Errorf("bad upr rollback: %v", res)
+		}
+		high := binary.BigEndian.Uint64(res.Body)
+		log.Printf("replication %v: upstream partition %v is behind us,"+
+			" resuming from its cas: %v", r.Id, vbid, high)
+		return uprStreamReqPkt(vbid, high), nil
+	}
+	return nil, fmt.Errorf("upr stream req of partition %v failed: %v", vbid, res)
+}
+
+// Applies a packet from the upstream, returning any response.
+func (r *Replication) receive(req *gomemcached.MCRequest) (
+	*gomemcached.MCResponse, error) {
+	b := r.getBucket()
+	if b == nil {
+		return nil, fmt.Errorf("replication lost bucket: %v", r.BucketName)
+	}
+
+	tapReq := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: req.VBucket,
+		Key:     req.Key,
+		Cas:     req.Cas,
+		Extras:  make([]byte, 16),
+		Body:    req.Body,
+	}
+	switch req.Opcode {
+	case UPR_MUTATION:
+		if len(req.Extras) >= 24 {
+			copy(tapReq.Extras[8:16], req.Extras[16:24]) // Flags & exp.
+		}
+		atomic.AddInt64(&r.stats.ItemsReceived, 1)
+	case UPR_DELETION, UPR_EXPIRATION:
+		tapReq.Opcode = gomemcached.TAP_DELETE
+		tapReq.Body = nil
+		atomic.AddInt64(&r.stats.DeletesReceived, 1)
+	case UPR_STREAM_END:
+		return nil, fmt.Errorf("upstream ended the stream of partition %v",
+			req.VBucket)
+	case UPR_NOOP:
+		return &gomemcached.MCResponse{}, nil
+	default: // Like UPR_SNAPSHOT_MARKER.
+		return nil, nil
+	}
+
+	res := doTapReceiveItem(b, ioutil.Discard, tapReq, 0)
+	if res != nil && res.Status != gomemcached.SUCCESS {
+		atomic.AddInt64(&r.stats.ApplyErrors, 1)
+		log.Printf("replication %v apply err, opcode: %v, key: %s, res: %v",
+			r.Id, req.Opcode, req.Key, res)
+	}
+	for {
+		lastCas := atomic.LoadUint64(&r.stats.LastCas)
+		if req.Cas <= lastCas ||
+			atomic.CompareAndSwapUint64(&r.stats.LastCas, lastCas, req.Cas) {
+			break
+		}
+	}
+	return nil, nil
+}
+
+func (r *Replication) pollLag() {
+	ticker := time.NewTicker(replicationLagFreq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.donech:
+			return
+		case <-ticker.C:
+			if err := r.updateLag(); err != nil {
+				log.Printf("replication %v lag poll err: %v", r.Id, err)
+			}
+		}
+	}
+}
+
+// Compares the upstream's partition CAS's against our replicas.
+func (r *Replication) updateLag() error {
+	b := r.getBucket()
+	if b == nil {
+		return fmt.Errorf("replication lost bucket: %v", r.BucketName)
+	}
+	conn, client, err := r.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var lag uint64
+	np := b.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		vb, _ := b.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBReplica {
+			continue
+		}
+		res, err := client.Send(&gomemcached.MCRequest{
+			Opcode:  GET_VBMETA,
+			VBucket: vbid,
+		})
+		if err != nil {
+			if _, ok := err.(*gomemcached.MCResponse); ok {
+				continue // Like NOT_MY_VBUCKET.
+			}
+			return err
+		}
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			continue
+		}
+		remote := VBMeta{}
+		if err = json.Unmarshal(res.Body, &remote); err != nil {
+			return err
+		}
+		local := atomic.LoadUint64(&vb.Meta().LastCas)
+		if remote.LastCas > local && remote.LastCas-local > lag {
+			lag = remote.LastCas - local
+		}
+	}
+	atomic.StoreUint64(&r.stats.CasLag, lag)
+	return nil
+}
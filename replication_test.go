@@ -0,0 +1,294 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func testReplicationBuckets(t *testing.T) (string, *Buckets, Bucket) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	bs := &BucketSettings{NumPartitions: 1}
+	b, err := NewBuckets(d, bs)
+	if err != nil {
+		t.Fatalf("Error with NewBuckets: %v", err)
+	}
+	bucket, err := b.New(DEFAULT_BUCKET_NAME, bs)
+	if err != nil {
+		t.Fatalf("Error with New bucket: %v", err)
+	}
+	return d, b, bucket
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	for i := 0; i < 200; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+func TestReplication(t *testing.T) {
+	srcDir, srcBuckets, src := testReplicationBuckets(t)
+	defer os.RemoveAll(srcDir)
+	defer srcBuckets.CloseAll()
+	src.CreateVBucket(0)
+	src.SetVBState(0, VBActive)
+
+	dstDir, dstBuckets, dst := testReplicationBuckets(t)
+	defer os.RemoveAll(dstDir)
+	defer dstBuckets.CloseAll()
+
+	l, err := StartServer("127.0.0.1:0", 100, srcBuckets, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	defer l.Close()
+
+	res := SetItem(src, []byte("a"), []byte("aaa"), VBActive)
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected SetItem to work, got: %v", res)
+	}
+
+	rs := NewReplications()
+	if _, err = rs.Add(dstBuckets, DEFAULT_BUCKET_NAME, l.Addr().String(),
+		DEFAULT_BUCKET_NAME, "secret", false); err == nil {
+		t.Errorf("expected a literal password to be refused")
+	}
+	r, err := rs.Add(dstBuckets, DEFAULT_BUCKET_NAME, l.Addr().String(),
+		DEFAULT_BUCKET_NAME, "env:CBGB_TEST_REPL_PASSWORD", false)
+	if err != nil {
+		t.Fatalf("expected replication Add to work, err: %v", err)
+	}
+	defer rs.CloseAll(DEFAULT_BUCKET_NAME)
+
+	// Only the password's source is saved.
+	dir, _ := dstBuckets.Path(DEFAULT_BUCKET_NAME)
+	saved, err := ioutil.ReadFile(filepath.Join(dir, REPLICATIONS_FILE))
+	if err != nil || !strings.Contains(string(saved), "env:CBGB_TEST_REPL_PASSWORD") ||
+		strings.Contains(string(saved), `"remotePassword"`) {
+		t.Errorf("expected only a password source to be saved, got: %s, err: %v",
+			saved, err)
+	}
+
+	if rs.Get(DEFAULT_BUCKET_NAME, r.Id) != r {
+		t.Errorf("expected to Get the replication")
+	}
+	if len(rs.List(DEFAULT_BUCKET_NAME)) != 1 {
+		t.Errorf("expected 1 replication")
+	}
+
+	// Replications are restarted from their bucket's directory.
+	rs2 := NewReplications()
+	if err = rs2.Load(dstBuckets); err != nil {
+		t.Fatalf("expected replications to load, err: %v", err)
+	}
+	r2 := rs2.Get(DEFAULT_BUCKET_NAME, r.Id)
+	rs2.CloseAll(DEFAULT_BUCKET_NAME)
+	if r2 == nil || r2.RemoteAddr != r.RemoteAddr {
+		t.Errorf("expected the replication to be loaded, got: %#v", r2)
+	}
+	vb, _ := dst.GetVBucket(0)
+	if vb == nil || vb.GetVBState() != VBReplica {
+		t.Fatalf("expected replica partition, got: %v", vb)
+	}
+
+	getDst := func(key string) *gomemcached.MCResponse {
+		return vb.get([]byte(key))
+	}
+
+	waitFor(t, "backfill", func() bool {
+		return getDst("a").Status == gomemcached.SUCCESS
+	})
+	srcRes := GetItem(src, []byte("a"), VBActive)
+	if dstRes := getDst("a"); string(dstRes.Body) != "aaa" ||
+		dstRes.Cas != srcRes.Cas {
+		t.Errorf("expected replicated item to match, got: %v vs %v",
+			dstRes, srcRes)
+	}
+
+	SetItem(src, []byte("b"), []byte("bbb"), VBActive)
+	waitFor(t, "forwarded set", func() bool {
+		return string(getDst("b").Body) == "bbb"
+	})
+
+	vbSrc, _ := src.GetVBucket(0)
+	res = vbSrc.Dispatch(nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+	waitFor(t, "forwarded delete", func() bool {
+		return getDst("a").Status == gomemcached.KEY_ENOENT
+	})
+
+	st := r.Stats()
+	if st.ItemsReceived < 2 || st.DeletesReceived < 1 || st.Connects != 1 {
+		t.Errorf("expected replication stats, got: %#v", st)
+	}
+	if st.ApplyErrors != 0 {
+		t.Errorf("expected no apply errors, got: %#v", st)
+	}
+	if st.LastCas < srcRes.Cas {
+		t.Errorf("expected lastCas >= %v, got: %#v", srcRes.Cas, st)
+	}
+
+	if err = r.updateLag(); err != nil {
+		t.Errorf("expected updateLag to work, err: %v", err)
+	}
+	if r.Stats().CasLag != 0 {
+		t.Errorf("expected caught-up replica, got: %#v", r.Stats())
+	}
+
+	if err = rs.Remove(DEFAULT_BUCKET_NAME, r.Id); err != nil {
+		t.Errorf("expected Remove to work, err: %v", err)
+	}
+	if err = rs.Remove(DEFAULT_BUCKET_NAME, r.Id); err == nil {
+		t.Errorf("expected 2nd Remove to fail")
+	}
+	rs2 = NewReplications()
+	rs2.Load(dstBuckets)
+	if len(rs2.List(DEFAULT_BUCKET_NAME)) != 0 {
+		t.Errorf("expected no replications to load after Remove")
+	}
+
+	// No more changes after removal.
+	SetItem(src, []byte("c"), []byte("ccc"), VBActive)
+	time.Sleep(50 * time.Millisecond)
+	if getDst("c").Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected no replication after Remove")
+	}
+}
+
+func TestReplicationReconnect(t *testing.T) {
+	origMin, origMax := replicationBackoffMin, replicationBackoffMax
+	replicationBackoffMin = time.Millisecond
+	replicationBackoffMax = 10 * time.Millisecond
+	defer func() {
+		replicationBackoffMin, replicationBackoffMax = origMin, origMax
+	}()
+
+	srcDir, srcBuckets, src := testReplicationBuckets(t)
+	defer os.RemoveAll(srcDir)
+	defer srcBuckets.CloseAll()
+	src.CreateVBucket(0)
+	src.SetVBState(0, VBActive)
+	SetItem(src, []byte("a"), []byte("aaa"), VBActive)
+
+	dstDir, dstBuckets, dst := testReplicationBuckets(t)
+	defer os.RemoveAll(dstDir)
+	defer dstBuckets.CloseAll()
+
+	// Find a free port, and leave nothing listening on it.
+	l, err := StartServer("127.0.0.1:0", 100, srcBuckets, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	rs := NewReplications()
+	r, err := rs.Add(dstBuckets, DEFAULT_BUCKET_NAME, addr,
+		DEFAULT_BUCKET_NAME, "", false)
+	if err != nil {
+		t.Fatalf("expected replication Add to work, err: %v", err)
+	}
+	defer rs.CloseAll(DEFAULT_BUCKET_NAME)
+
+	waitFor(t, "reconnect attempts", func() bool {
+		return r.Stats().Reconnects > 2
+	})
+	if r.ToMap()["lastErr"] == "" {
+		t.Errorf("expected a lastErr, got: %#v", r.ToMap())
+	}
+
+	l, err = StartServer(addr, 100, srcBuckets, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("Error restarting listener: %v", err)
+	}
+	defer l.Close()
+
+	vb, _ := dst.GetVBucket(0)
+	waitFor(t, "backfill after reconnect", func() bool {
+		return string(vb.get([]byte("a")).Body) == "aaa"
+	})
+
+	// Changes while disconnected, including deletions, are picked up
+	// from where the replica left off, without resending the rest.
+	l.Close()
+	r.lock.Lock()
+	r.conn.Close()
+	r.lock.Unlock()
+	vbSrc, _ := src.GetVBucket(0)
+	res := vbSrc.Dispatch(nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+	SetItem(src, []byte("b"), []byte("bbb"), VBActive)
+	l, err = StartServer(addr, 100, srcBuckets, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("Error restarting listener: %v", err)
+	}
+	defer l.Close()
+	waitFor(t, "resume after reconnect", func() bool {
+		return vb.get([]byte("a")).Status == gomemcached.KEY_ENOENT &&
+			string(vb.get([]byte("b")).Body) == "bbb"
+	})
+	if st := r.Stats(); st.ItemsReceived != 2 || st.DeletesReceived != 1 {
+		t.Errorf("expected only the new changes, got: %#v", st)
+	}
+}
+
+func TestReplicationForce(t *testing.T) {
+	d, b, bucket := testReplicationBuckets(t)
+	defer os.RemoveAll(d)
+	defer b.CloseAll()
+	bucket.CreateVBucket(0)
+	bucket.SetVBState(0, VBActive)
+	SetItem(bucket, []byte("a"), []byte("aaa"), VBActive)
+
+	rs := NewReplications()
+	defer rs.CloseAll(DEFAULT_BUCKET_NAME)
+	if _, err := rs.Add(b, DEFAULT_BUCKET_NAME, "127.0.0.1:1",
+		DEFAULT_BUCKET_NAME, "", false); err == nil {
+		t.Errorf("expected Add over items to need force")
+	}
+	vb, _ := bucket.GetVBucket(0)
+	if vb.GetVBState() != VBActive {
+		t.Errorf("expected a refused Add to leave the partition active")
+	}
+	if _, err := rs.Add(b, DEFAULT_BUCKET_NAME, "127.0.0.1:1",
+		DEFAULT_BUCKET_NAME, "", true); err != nil {
+		t.Errorf("expected a forced Add to work, err: %v", err)
+	}
+	if vb.GetVBState() != VBReplica {
+		t.Errorf("expected a forced Add to make a replica")
+	}
+}
+
+func TestReplicationNoBucket(t *testing.T) {
+	d, b, _ := testReplicationBuckets(t)
+	defer os.RemoveAll(d)
+	defer b.CloseAll()
+
+	rs := NewReplications()
+	_, err := rs.Add(b, "notABucket", "127.0.0.1:1", "default", "", false)
+	if err == nil {
+		t.Errorf("expected Add on a missing bucket to fail")
+	}
+	if len(rs.List("notABucket")) != 0 {
+		t.Errorf("expected no replications")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
@@ -43,6 +44,10 @@ func restAPI(r *mux.Router) {
 		withBucketAccess(restPostBucketCompact)).Methods("POST")
 	sr.HandleFunc("/buckets/{bucketname}/flushDirty",
 		withBucketAccess(restPostBucketFlushDirty)).Methods("POST")
+	sr.HandleFunc("/buckets/{bucketname}/export",
+		withBucketAccess(restGetBucketExport)).Methods("GET")
+	sr.HandleFunc("/buckets/{bucketname}/import",
+		withBucketAccess(restPostBucketImport)).Methods("POST")
 	sr.HandleFunc("/buckets/{bucketname}/stats",
 		withBucketAccess(restGetBucketStats)).Methods("GET")
 	sr.HandleFunc("/buckets/{bucketname}/errs",
@@ -52,6 +57,18 @@ func restAPI(r *mux.Router) {
 
 	sra := r.PathPrefix("/_api/").MatcherFunc(adminRequired).Subrouter()
 	sra.HandleFunc("/buckets", restPostBucket).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/backup",
+		restPostBucketBackup).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/restore",
+		restPostBucketRestore).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/replications",
+		restGetBucketReplications).Methods("GET")
+	sra.HandleFunc("/buckets/{bucketname}/replications",
+		restPostBucketReplication).Methods("POST")
+	sra.HandleFunc("/buckets/{bucketname}/replications/{replicationid}",
+		restGetBucketReplication).Methods("GET")
+	sra.HandleFunc("/buckets/{bucketname}/replications/{replicationid}",
+		restDeleteBucketReplication).Methods("DELETE")
 	sra.HandleFunc("/bucketPath", restGetBucketPath).Methods("GET")
 	sra.HandleFunc("/profile/cpu", restProfileCPU).Methods("POST")
 	sra.HandleFunc("/profile/memory", restProfileMemory).Methods("POST")
@@ -169,12 +186,77 @@ func restPostBucket(w http.ResponseWriter, r *http.Request) {
 	bSettings := bucketSettings.Copy()
 	bucketPassword := r.FormValue("password")
 	if bucketPassword != "" {
-		bSettings.PasswordHash = bucketPassword
+		if err = bSettings.SetPassword(bucketPassword); err != nil {
+			http.Error(w,
+				fmt.Sprintf("could not hash password, err: %v", err), 500)
+			return
+		}
 	}
 	bSettings.QuotaBytes = getIntValue(r.Form, "quotaBytes",
 		bucketSettings.QuotaBytes)
 	bSettings.MemoryOnly = int(getIntValue(r.Form, "memoryOnly",
 		int64(bucketSettings.MemoryOnly)))
+	if _, ok := r.Form["evictionPolicy"]; ok {
+		bSettings.EvictionPolicy = r.FormValue("evictionPolicy")
+		if _, ok = evictionPolicies[bSettings.EvictionPolicy]; !ok {
+			http.Error(w, fmt.Sprintf("unknown evictionPolicy: %v",
+				bSettings.EvictionPolicy), 400)
+			return
+		}
+	}
+	if _, ok := r.Form["compression"]; ok {
+		bSettings.Compression = r.FormValue("compression")
+		if _, ok = compressions[bSettings.Compression]; !ok {
+			http.Error(w, fmt.Sprintf("unknown compression: %v",
+				bSettings.Compression), 400)
+			return
+		}
+	}
+	bSettings.LowWatermarkPct = int(getIntValue(r.Form, "lowWatermarkPct",
+		int64(bucketSettings.LowWatermarkPct)))
+	bSettings.HighWatermarkPct = int(getIntValue(r.Form, "highWatermarkPct",
+		int64(bucketSettings.HighWatermarkPct)))
+	if low, high := bSettings.watermarkPcts(); low > high || high > 100 {
+		http.Error(w, fmt.Sprintf("bad watermarks, low: %v, high: %v",
+			low, high), 400)
+		return
+	}
+	bSettings.FlushDirtyItems = getIntValue(r.Form, "flushDirtyItems",
+		bucketSettings.FlushDirtyItems)
+	bSettings.FlushDirtyBytes = getIntValue(r.Form, "flushDirtyBytes",
+		bucketSettings.FlushDirtyBytes)
+	bSettings.CompactFragmentationPct = int(getIntValue(r.Form,
+		"compactFragmentationPct", int64(bucketSettings.CompactFragmentationPct)))
+	if pct := bSettings.CompactFragmentationPct; pct < 0 || pct >= 100 {
+		http.Error(w, fmt.Sprintf("bad compactFragmentationPct: %v", pct), 400)
+		return
+	}
+	if _, ok := r.Form["compactWindow"]; ok {
+		bSettings.CompactWindow = r.FormValue("compactWindow")
+		if _, err = parseCompactWindow(bSettings.CompactWindow); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if _, ok := r.Form["encryptionKey"]; ok {
+		bSettings.EncryptionKey = r.FormValue("encryptionKey")
+	}
+	if _, ok := r.Form["encrypted"]; ok {
+		bSettings.Encrypted = r.FormValue("encrypted") == "true"
+	}
+	if _, err = bSettings.cryptKeys(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, ok := r.Form["durability"]; ok {
+		bSettings.Durability = r.FormValue("durability")
+	}
+	bSettings.GroupCommitMs = int(getIntValue(r.Form, "groupCommitMs",
+		int64(bucketSettings.GroupCommitMs)))
+	if _, err = newStorePolicy(bSettings); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 
 	_, err = createBucket(bucketName, bSettings)
 	if err != nil {
@@ -224,6 +306,7 @@ func restDeleteBucket(w http.ResponseWriter, r *http.Request) {
 	if bucket == nil {
 		return
 	}
+	replications.CloseAll(bucketName)
 	err := buckets.Close(bucketName, true)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("error deleting bucket: %v, err: %v",
@@ -248,6 +331,132 @@ func restPostBucketCompact(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(202)
 }
 
+// Streams the bucket's items as lines of JSON...
+//    curl http://127.0.0.1:8091/_api/buckets/default/export > default.json
+func restGetBucketExport(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	n, err := exportBucket(bucket, w)
+	if err != nil {
+		// Too late for an error status, so the export is cut short.
+		log.Printf("error exporting bucket: %v, after %v items, err: %v",
+			bucketName, n, err)
+	}
+}
+
+// Applies the items of an export to an existing bucket...
+//    curl -X POST http://127.0.0.1:8091/_api/buckets/default/import \
+//      --data-binary @default.json
+func restPostBucketImport(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	res, err := importBucket(bucket, r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error importing bucket: %v, after %v items,"+
+			" err: %v", bucketName, res.Items, err), 400)
+		return
+	}
+	mustEncode(w, res)
+}
+
+// Backs up a bucket into <backup-dir>/<bucketname>/<name>, where
+// name defaults to a timestamp.  With a since parameter, naming an
+// earlier backup, only the changes after that backup are copied.
+func restPostBucketBackup(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = time.Now().UTC().Format("20060102-150405.000")
+	}
+	since := r.FormValue("since")
+	for _, s := range []string{name, since} {
+		match, err := regexp.MatchString("^[A-Za-z0-9\\-_.]*$", s)
+		if err != nil || !match || s == "." || s == ".." {
+			http.Error(w,
+				fmt.Sprintf("illegal backup name: %v, err: %v", s, err), 400)
+			return
+		}
+	}
+	dir := filepath.Join(bucketBackupDir(), bucketName)
+	var sinceManifest *backupManifest
+	if since != "" {
+		var err error
+		sinceManifest, err = readBackupManifest(filepath.Join(dir, since))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read backup: %v, err: %v",
+				since, err), 400)
+			return
+		}
+	}
+	m, err := backupBucket(bucket, filepath.Join(dir, name), name, sinceManifest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error backing up bucket: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	log.Printf("%v backed up bucket %v to %v", currentUser(r), bucketName, name)
+	mustEncode(w, m)
+}
+
+// Restores a bucket from <backup-dir>/<from>/<backup>, where from
+// defaults to the bucket's name, along with the backups that it's an
+// increment of.  An existing bucket is only replaced with overwrite.
+func restPostBucketRestore(w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucketname"]
+	from := r.FormValue("from")
+	if from == "" {
+		from = bucketName
+	}
+	backup := r.FormValue("backup")
+	for _, s := range []string{bucketName, from, backup} {
+		match, err := regexp.MatchString("^[A-Za-z0-9\\-_.]+$", s)
+		if err != nil || !match || s == "." || s == ".." {
+			http.Error(w,
+				fmt.Sprintf("illegal bucket or backup name: %v, err: %v", s, err), 400)
+			return
+		}
+	}
+	numPartitions, err := strconv.Atoi(r.FormValue("numPartitions"))
+	if err != nil && r.FormValue("numPartitions") != "" || numPartitions < 0 {
+		http.Error(w, fmt.Sprintf("illegal numPartitions: %v",
+			r.FormValue("numPartitions")), 400)
+		return
+	}
+	opts := restoreOptions{
+		KeyPrefix:     r.FormValue("keyPrefix"),
+		NumPartitions: numPartitions,
+		DryRun:        r.FormValue("dryRun") == "true",
+		Overwrite:     r.FormValue("overwrite") == "true",
+	}
+	res, err := restoreBucket(bucketName,
+		filepath.Join(bucketBackupDir(), from, backup), opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error restoring bucket: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	if !opts.DryRun {
+		log.Printf("%v restored bucket %v from %v/%v",
+			currentUser(r), bucketName, from, backup)
+	}
+	mustEncode(w, res)
+}
+
+func bucketBackupDir() string {
+	if *backupDir != "" {
+		return *backupDir
+	}
+	return filepath.Join(*data, "_backups")
+}
+
 func restPostBucketFlushDirty(w http.ResponseWriter, r *http.Request) {
 	bucketName, bucket := parseBucketName(w, mux.Vars(r))
 	if bucket == nil {
@@ -292,6 +501,91 @@ func restGetBucketLogs(w http.ResponseWriter, r *http.Request) {
 	mustEncode(w, bucket.Logs())
 }
 
+func restGetBucketReplications(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	rv := []interface{}{}
+	for _, repl := range replications.List(bucketName) {
+		rv = append(rv, repl.ToMap())
+	}
+	mustEncode(w, rv)
+}
+
+// To make a bucket into a replica of another cbgb's bucket...
+//    curl -X POST http://127.0.0.1:8091/_api/buckets/default/replications \
+//      -d remoteAddr=otherhost:11211 -d remoteBucket=default
+// A bucket that has active partitions with items also needs force=true.
+func restPostBucketReplication(w http.ResponseWriter, r *http.Request) {
+	bucketName, bucket := parseBucketName(w, mux.Vars(r))
+	if bucket == nil {
+		return
+	}
+	remoteAddr := r.FormValue("remoteAddr")
+	if remoteAddr == "" {
+		http.Error(w, "missing remoteAddr parameter", 400)
+		return
+	}
+	remoteBucket := r.FormValue("remoteBucket")
+	if remoteBucket == "" {
+		remoteBucket = bucketName
+	}
+	if r.FormValue("remotePassword") != "" {
+		http.Error(w, "remotePassword isn't kept, please use a"+
+			" remotePasswordSource of file:PATH or env:NAME", 400)
+		return
+	}
+	repl, err := replications.Add(buckets, bucketName,
+		remoteAddr, remoteBucket, r.FormValue("remotePasswordSource"),
+		r.FormValue("force") == "true")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error creating replication: %v, err: %v",
+			bucketName, err), 500)
+		return
+	}
+	log.Printf("%v created replication %v of bucket %v from %v/%v",
+		currentUser(r), repl.Id, bucketName, remoteAddr, remoteBucket)
+	http.Redirect(w, r,
+		"/_api/buckets/"+bucketName+"/replications/"+repl.Id, 303)
+}
+
+func parseReplication(w http.ResponseWriter, vars map[string]string) (
+	string, *Replication) {
+	bucketName, bucket := parseBucketName(w, vars)
+	if bucket == nil {
+		return bucketName, nil
+	}
+	repl := replications.Get(bucketName, vars["replicationid"])
+	if repl == nil {
+		http.Error(w, "no replication with that replicationid", 404)
+		return bucketName, nil
+	}
+	return bucketName, repl
+}
+
+func restGetBucketReplication(w http.ResponseWriter, r *http.Request) {
+	_, repl := parseReplication(w, mux.Vars(r))
+	if repl == nil {
+		return
+	}
+	mustEncode(w, repl.ToMap())
+}
+
+func restDeleteBucketReplication(w http.ResponseWriter, r *http.Request) {
+	bucketName, repl := parseReplication(w, mux.Vars(r))
+	if repl == nil {
+		return
+	}
+	if err := replications.Remove(bucketName, repl.Id); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	log.Printf("%v deleted replication %v of bucket %v",
+		currentUser(r), repl.Id, bucketName)
+	w.WriteHeader(204)
+}
+
 // To start a cpu profiling...
 //    curl -X POST http://127.0.0.1:8091/_api/profile/cpu -d secs=5
 // To analyze a profiling...
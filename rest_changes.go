@@ -0,0 +1,499 @@
+//  Copyright (c) 2013 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default for how long an idle longpoll or continuous feed stays
+// open, when there's no timeout or heartbeat param.
+var couchChangesTimeout = 60 * time.Second
+
+// How often an idle feed rescans, to pick up vbuckets that were
+// created or activated after the feed started.
+var couchChangesTickFreq = time.Second
+
+// From http://wiki.apache.org/couchdb/HTTP_database_API#Changes
+type ChangesParams struct {
+	Since       uint64
+	SinceSeqs   map[uint16]uint64 // From a last_seq, overriding Since.
+	Limit       uint64
+	IncludeDocs bool
+	Feed        string
+	Heartbeat   time.Duration
+	Timeout     time.Duration
+}
+
+type ChangesRow struct {
+	Seq     uint64              `json:"seq"`
+	Id      string              `json:"id"`
+	Changes []map[string]string `json:"changes"`
+	Deleted bool                `json:"deleted,omitempty"`
+	Doc     *ViewDocValue       `json:"doc,omitempty"`
+
+	vbid uint16
+}
+
+type ChangesRows []*ChangesRow
+
+func (rows ChangesRows) Len() int {
+	return len(rows)
+}
+
+func (rows ChangesRows) Swap(i, j int) {
+	rows[i], rows[j] = rows[j], rows[i]
+}
+
+func (rows ChangesRows) Less(i, j int) bool {
+	if rows[i].Seq == rows[j].Seq {
+		return rows[i].vbid < rows[j].vbid
+	}
+	return rows[i].Seq < rows[j].Seq
+}
+
+func ParseChangesParams(params Form) (*ChangesParams, error) {
+	p := &ChangesParams{Feed: "normal", Timeout: couchChangesTimeout}
+
+	parseUint := func(name string) (uint64, error) {
+		s := params.FormValue(name)
+		if s == "" {
+			return 0, nil
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %v: %v", name, s)
+		}
+		return v, nil
+	}
+
+	var err error
+	if since := params.FormValue("since"); strings.Contains(since, "-") {
+		if p.SinceSeqs, err = decodeChangesSeq(since); err != nil {
+			return nil, err
+		}
+	} else if p.Since, err = parseUint("since"); err != nil {
+		return nil, err
+	}
+	if p.Limit, err = parseUint("limit"); err != nil {
+		return nil, err
+	}
+	p.IncludeDocs = params.FormValue("include_docs") == "true"
+
+	if feed := params.FormValue("feed"); feed != "" {
+		switch feed {
+		case "normal", "longpoll", "continuous":
+			p.Feed = feed
+		default:
+			return nil, fmt.Errorf("bad feed: %v", feed)
+		}
+	}
+
+	ms, err := parseUint("heartbeat")
+	if err != nil {
+		return nil, err
+	}
+	p.Heartbeat = time.Duration(ms) * time.Millisecond
+
+	if params.FormValue("timeout") != "" {
+		if ms, err = parseUint("timeout"); err != nil {
+			return nil, err
+		}
+		p.Timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	return p, nil
+}
+
+// A changes feed tracks its own position per vbucket, since CAS
+// numbers are only ordered within a vbucket, and reports them all as
+// its last_seq, so a client resumes exactly where it left off.
+type changesFeed struct {
+	bucket  Bucket
+	p       *ChangesParams
+	lastSeq map[uint16]uint64
+	sent    uint64
+
+	mch    chan interface{}
+	vbs    map[uint16]*VBucket // The vbuckets that mch is registered with.
+	wakech chan bool
+	donech chan bool
+
+	heartbeat *time.Ticker
+	deadline  time.Time // When an idle feed times out.
+}
+
+func newChangesFeed(bucket Bucket, p *ChangesParams) *changesFeed {
+	f := &changesFeed{
+		bucket:  bucket,
+		p:       p,
+		lastSeq: map[uint16]uint64{},
+		vbs:     map[uint16]*VBucket{},
+	}
+	for vbid, seq := range p.SinceSeqs {
+		f.lastSeq[vbid] = seq
+	}
+	return f
+}
+
+// A last_seq is the highest seq, then the base64 of the vbucket id
+// and seq of every vbucket that's past zero.  Clients should treat it
+// as opaque, only passing it back as a since param.
+func encodeChangesSeq(seqs map[uint16]uint64) string {
+	vbids := make([]int, 0, len(seqs))
+	max := uint64(0)
+	for vbid, seq := range seqs {
+		if seq > 0 {
+			vbids = append(vbids, int(vbid))
+		}
+		if seq > max {
+			max = seq
+		}
+	}
+	sort.Ints(vbids)
+	buf := make([]byte, 10*len(vbids))
+	for i, vbid := range vbids {
+		binary.BigEndian.PutUint16(buf[i*10:], uint16(vbid))
+		binary.BigEndian.PutUint64(buf[i*10+2:], seqs[uint16(vbid)])
+	}
+	return fmt.Sprintf("%v-%s", max, base64.URLEncoding.EncodeToString(buf))
+}
+
+func decodeChangesSeq(s string) (map[uint16]uint64, error) {
+	buf, err := base64.URLEncoding.DecodeString(s[strings.Index(s, "-")+1:])
+	if err != nil || len(buf)%10 != 0 {
+		return nil, fmt.Errorf("bad since: %v", s)
+	}
+	rv := map[uint16]uint64{}
+	for ; len(buf) > 0; buf = buf[10:] {
+		rv[binary.BigEndian.Uint16(buf)] = binary.BigEndian.Uint64(buf[2:])
+	}
+	return rv, nil
+}
+
+// Returns where the feed is up to in a vbucket.
+func (f *changesFeed) from(vbid uint16) uint64 {
+	if seq, ok := f.lastSeq[vbid]; ok {
+		return seq
+	}
+	if f.p.SinceSeqs != nil {
+		return 0
+	}
+	return f.p.Since
+}
+
+// Returns the feed's position as a last_seq.
+func (f *changesFeed) lastSeqString() string {
+	seqs := map[uint16]uint64{}
+	np := f.bucket.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		seqs[vbid] = f.from(vbid)
+	}
+	return encodeChangesSeq(seqs)
+}
+
+// Starts relaying the vbucket observers' mutations into coalesced
+// wakeups, so a slow http client never blocks a vbucket's observer.
+func (f *changesFeed) listen() {
+	f.mch = make(chan interface{}, 100)
+	f.wakech = make(chan bool, 1)
+	f.donech = make(chan bool)
+	f.deadline = time.Now().Add(f.p.Timeout)
+	if f.p.Heartbeat > 0 {
+		f.heartbeat = time.NewTicker(f.p.Heartbeat)
+	}
+	go func() {
+		for {
+			select {
+			case <-f.mch:
+				select {
+				case f.wakech <- true:
+				default:
+				}
+			case <-f.donech:
+				return
+			}
+		}
+	}()
+}
+
+func (f *changesFeed) close() {
+	for _, vb := range f.vbs {
+		vb.observer.Unregister(f.mch)
+	}
+	if f.heartbeat != nil {
+		f.heartbeat.Stop()
+	}
+	if f.donech != nil {
+		close(f.donech)
+	}
+}
+
+func (f *changesFeed) remaining() uint64 {
+	if f.p.Limit == 0 {
+		return ^uint64(0)
+	}
+	if f.sent >= f.p.Limit {
+		return 0
+	}
+	return f.p.Limit - f.sent
+}
+
+// Returns the next changes, merged across all active vbuckets and
+// ordered by seq, and advances the feed past them, but no further,
+// so changes cut off by the limit are returned by a later call.
+func (f *changesFeed) next() (ChangesRows, error) {
+	remaining := f.remaining()
+	rows := ChangesRows{}
+	ends := map[uint16]uint64{} // How far each vbucket's rows go.
+	now := time.Now()
+	np := f.bucket.GetBucketSettings().NumPartitions
+	for vbid := uint16(0); int(vbid) < np; vbid++ {
+		vb, _ := f.bucket.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBActive {
+			continue
+		}
+		if f.mch != nil && f.vbs[vbid] != vb {
+			if old := f.vbs[vbid]; old != nil {
+				old.observer.Unregister(f.mch)
+			}
+			// Registered before reading the high seqno, so we
+			// can't miss a wakeup for anything past it.
+			vb.observer.Register(f.mch)
+			f.vbs[vbid] = vb
+		}
+		from := f.from(vbid)
+		high := uprHighSeqno(vb)
+		if high <= from {
+			continue
+		}
+		n, end := uint64(0), high
+		var rowErr error
+		err := vb.ps.visitChanges(casBytes(from+1), true, func(i *item) bool {
+			if i.cas > high {
+				return false
+			}
+			if len(i.key) == 0 { // An empty key == metadata change.
+				return true
+			}
+			if n >= remaining {
+				end = from
+				if n > 0 {
+					end = rows[len(rows)-1].Seq
+				}
+				return false
+			}
+			var row *ChangesRow
+			if row, rowErr = f.row(vbid, i, now); rowErr != nil {
+				return false
+			}
+			rows = append(rows, row)
+			n++
+			return true
+		})
+		if err == nil {
+			err = rowErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		ends[vbid] = end
+	}
+	sort.Sort(rows)
+	if uint64(len(rows)) > remaining {
+		for _, row := range rows[remaining:] {
+			if row.Seq-1 < ends[row.vbid] {
+				ends[row.vbid] = row.Seq - 1
+			}
+		}
+		rows = rows[:remaining]
+	}
+	for vbid, end := range ends {
+		if end > f.from(vbid) {
+			f.lastSeq[vbid] = end
+		}
+	}
+	if len(rows) > 0 {
+		f.deadline = now.Add(f.p.Timeout)
+	}
+	f.sent += uint64(len(rows))
+	return rows, nil
+}
+
+func (f *changesFeed) row(vbid uint16, i *item, now time.Time) (
+	*ChangesRow, error) {
+	docId := string(i.key)
+	rev := fmt.Sprintf("1-%016x", i.cas)
+	row := &ChangesRow{
+		Seq:     i.cas,
+		Id:      docId,
+		Changes: []map[string]string{{"rev": rev}},
+		Deleted: i.isDeletion() || i.isExpired(now),
+		vbid:    vbid,
+	}
+	if f.p.IncludeDocs && !row.Deleted {
+		data, err := i.value()
+		if err != nil {
+			return nil, err
+		}
+		docType := "json"
+		var doc interface{}
+		err = jsonUnmarshal(data, &doc)
+		if err != nil {
+			doc = base64.StdEncoding.EncodeToString(data)
+			docType = "base64"
+		}
+		row.Doc = &ViewDocValue{
+			Meta: map[string]interface{}{
+				"id":   docId,
+				"rev":  rev,
+				"type": docType,
+			},
+			Json: doc,
+		}
+	}
+	return row, nil
+}
+
+// Waits until there might be more changes.  Returns false when the
+// feed should end, either from an idle timeout or a closed
+// connection.  Heartbeats, when asked for, replace the timeout.
+func (f *changesFeed) wait(w http.ResponseWriter, closech <-chan bool) bool {
+	var timeoutch, heartbeatch <-chan time.Time
+	if f.heartbeat != nil {
+		heartbeatch = f.heartbeat.C
+	} else {
+		idle := f.deadline.Sub(time.Now())
+		if idle <= 0 {
+			return false
+		}
+		timeout := time.NewTimer(idle)
+		defer timeout.Stop()
+		timeoutch = timeout.C
+	}
+	tick := time.NewTimer(couchChangesTickFreq)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-f.wakech:
+			return true
+		case <-tick.C:
+			return true
+		case <-heartbeatch:
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return false
+			}
+			flushResponse(w)
+		case <-timeoutch:
+			return false
+		case <-closech:
+			return false
+		}
+	}
+}
+
+func flushResponse(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func couchDbChanges(w http.ResponseWriter, r *http.Request) {
+	_, _, bucket := checkDb(w, r)
+	if bucket == nil {
+		return
+	}
+	p, err := ParseChangesParams(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("param parsing err: %v", err), 400)
+		return
+	}
+
+	f := newChangesFeed(bucket, p)
+	defer f.close()
+	if p.Feed != "normal" {
+		f.listen()
+	}
+
+	var closech <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closech = cn.CloseNotify()
+	}
+
+	rows, err := f.next()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("changes err: %v", err), 500)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-type", "application/json")
+
+	if p.Feed == "continuous" {
+		for {
+			for _, row := range rows {
+				j, err := json.Marshal(row)
+				if err != nil {
+					return
+				}
+				if _, err = w.Write(append(j, '\n')); err != nil {
+					return
+				}
+			}
+			flushResponse(w)
+			if f.remaining() == 0 || !f.wait(w, closech) {
+				break
+			}
+			if rows, err = f.next(); err != nil {
+				return
+			}
+		}
+		j, _ := json.Marshal(f.lastSeqString())
+		w.Write([]byte(fmt.Sprintf(`{"last_seq":%s}`+"\n", j)))
+		return
+	}
+
+	if p.Feed == "longpoll" {
+		for len(rows) == 0 && f.wait(w, closech) {
+			if rows, err = f.next(); err != nil {
+				return
+			}
+		}
+	}
+
+	w.Write([]byte(`{"results":[`))
+	for i, row := range rows {
+		j, err := json.Marshal(row)
+		if err != nil {
+			return
+		}
+		if i > 0 {
+			w.Write([]byte(",\n"))
+		} else {
+			w.Write([]byte("\n"))
+		}
+		if _, err = w.Write(j); err != nil {
+			return
+		}
+	}
+	j, _ := json.Marshal(f.lastSeqString())
+	w.Write([]byte(fmt.Sprintf("\n],\n"+`"last_seq":%s}`+"\n", j)))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/gorilla/mux"
+)
+
+type testChangesResult struct {
+	Results []*ChangesRow `json:"results"`
+	LastSeq string        `json:"last_seq"`
+}
+
+func testGetChanges(t *testing.T, mr *mux.Router,
+	params string) (*httptest.ResponseRecorder, *testChangesResult) {
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/default/_changes"+params, nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 200 {
+		return rr, nil
+	}
+	cr := &testChangesResult{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), cr); err != nil {
+		t.Fatalf("expected good changes result, got: %v, %v",
+			err, rr.Body.String())
+	}
+	return rr, cr
+}
+
+func testChangesIds(cr *testChangesResult) string {
+	ids := []string{}
+	for _, row := range cr.Results {
+		ids = append(ids, row.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestCouchChanges(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	_, cr := testGetChanges(t, mr, "")
+	if cr == nil || len(cr.Results) != 0 {
+		t.Fatalf("expected no changes, got: %#v", cr)
+	}
+
+	SetItem(bucket, []byte("a"), []byte(`{"x":1}`), VBActive)
+	SetItem(bucket, []byte("b"), []byte("not json"), VBActive)
+	SetItem(bucket, []byte("c"), []byte(`{"x":3}`), VBActive)
+	vb, _ := bucket.GetVBucket(0)
+	res := vb.Dispatch(nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("a"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+
+	_, cr = testGetChanges(t, mr, "")
+	if cr == nil || testChangesIds(cr) != "b,c,a" {
+		t.Fatalf("expected changes b,c,a, got: %#v", cr)
+	}
+	if !cr.Results[2].Deleted || cr.Results[0].Deleted {
+		t.Errorf("expected only a deleted, got: %#v", cr.Results)
+	}
+	if cr.LastSeq != encodeChangesSeq(map[uint16]uint64{0: cr.Results[2].Seq}) {
+		t.Errorf("expected last_seq of %v, got: %v",
+			cr.Results[2].Seq, cr.LastSeq)
+	}
+	if len(cr.Results[0].Changes) != 1 ||
+		cr.Results[0].Changes[0]["rev"] == "" {
+		t.Errorf("expected a rev, got: %#v", cr.Results[0])
+	}
+	if cr.Results[0].Doc != nil {
+		t.Errorf("expected no docs without include_docs")
+	}
+
+	_, cr2 := testGetChanges(t, mr, fmt.Sprintf("?since=%v", cr.Results[0].Seq))
+	if cr2 == nil || testChangesIds(cr2) != "c,a" {
+		t.Errorf("expected changes c,a after since, got: %#v", cr2)
+	}
+
+	_, cr2 = testGetChanges(t, mr, "?limit=2")
+	if cr2 == nil || testChangesIds(cr2) != "b,c" {
+		t.Errorf("expected changes b,c with limit, got: %#v", cr2)
+	}
+	if cr2.LastSeq != encodeChangesSeq(map[uint16]uint64{0: cr.Results[1].Seq}) {
+		t.Errorf("expected limited last_seq of %v, got: %v",
+			cr.Results[1].Seq, cr2.LastSeq)
+	}
+	_, cr2 = testGetChanges(t, mr, "?since="+cr2.LastSeq)
+	if cr2 == nil || testChangesIds(cr2) != "a" {
+		t.Errorf("expected change a after the limited last_seq, got: %#v", cr2)
+	}
+
+	_, cr2 = testGetChanges(t, mr, "?include_docs=true")
+	if cr2 == nil || len(cr2.Results) != 3 {
+		t.Fatalf("expected 3 changes, got: %#v", cr2)
+	}
+	if cr2.Results[0].Doc == nil ||
+		cr2.Results[0].Doc.Meta["type"] != "base64" {
+		t.Errorf("expected base64 doc, got: %#v", cr2.Results[0].Doc)
+	}
+	if cr2.Results[1].Doc == nil ||
+		cr2.Results[1].Doc.Meta["id"] != "c" ||
+		cr2.Results[1].Doc.Json.(map[string]interface{})["x"] != 3.0 {
+		t.Errorf("expected json doc, got: %#v", cr2.Results[1].Doc)
+	}
+	if cr2.Results[2].Doc != nil {
+		t.Errorf("expected no doc for a deletion, got: %#v", cr2.Results[2])
+	}
+
+	for _, params := range []string{"?since=x", "?since=1-x", "?limit=-1", "?feed=wrong",
+		"?heartbeat=y", "?timeout=z"} {
+		rr, _ := testGetChanges(t, mr, params)
+		if rr.Code != 400 {
+			t.Errorf("expected 400 for %v, got: %v", params, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://127.0.0.1/notabucket/_changes", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 404 {
+		t.Errorf("expected 404 for a missing db, got: %v", rr.Code)
+	}
+}
+
+func TestCouchChangesMultiplePartitions(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, MAX_VBUCKETS, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	keys := []string{"hello", "world", "x", "y", "z"}
+	for _, k := range keys {
+		vbid := VBucketIdForKey([]byte(k), MAX_VBUCKETS)
+		bucket.CreateVBucket(vbid)
+		bucket.SetVBState(vbid, VBActive)
+		res := SetItem(bucket, []byte(k), []byte(`{}`), VBActive)
+		if res == nil || res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected SetItem to work, got: %v", res)
+		}
+	}
+
+	_, cr := testGetChanges(t, mr, "")
+	if cr == nil || len(cr.Results) != len(keys) {
+		t.Fatalf("expected %v changes, got: %#v", len(keys), cr)
+	}
+	for i := 1; i < len(cr.Results); i++ {
+		if cr.Results[i-1].Seq > cr.Results[i].Seq {
+			t.Errorf("expected changes ordered by seq, got: %#v", cr.Results)
+		}
+	}
+
+	// Resuming from a limited last_seq neither skips nor repeats
+	// changes in other vbuckets.
+	_, cr2 := testGetChanges(t, mr, "?limit=2")
+	if cr2 == nil || testChangesIds(cr2) != testChangesIds(&testChangesResult{
+		Results: cr.Results[:2]}) {
+		t.Fatalf("expected the first 2 changes, got: %#v", cr2)
+	}
+	_, cr2 = testGetChanges(t, mr, "?since="+cr2.LastSeq)
+	if cr2 == nil || testChangesIds(cr2) != testChangesIds(&testChangesResult{
+		Results: cr.Results[2:]}) {
+		t.Errorf("expected the other changes, got: %#v", cr2)
+	}
+	_, cr2 = testGetChanges(t, mr, "?since="+cr.LastSeq)
+	if cr2 == nil || len(cr2.Results) != 0 {
+		t.Errorf("expected no changes after last_seq, got: %#v", cr2)
+	}
+}
+
+func TestCouchChangesLongpoll(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	SetItem(bucket, []byte("a"), []byte("aaa"), VBActive)
+	_, cr := testGetChanges(t, mr, "")
+	if cr == nil || len(cr.Results) != 1 {
+		t.Fatalf("expected 1 change, got: %#v", cr)
+	}
+
+	donech := make(chan *testChangesResult)
+	go func() {
+		_, cr := testGetChanges(t, mr,
+			fmt.Sprintf("?feed=longpoll&heartbeat=10&since=%v", cr.LastSeq))
+		donech <- cr
+	}()
+
+	select {
+	case cr := <-donech:
+		t.Fatalf("expected longpoll to wait, got: %#v", cr)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	SetItem(bucket, []byte("b"), []byte("bbb"), VBActive)
+
+	select {
+	case cr := <-donech:
+		if cr == nil || testChangesIds(cr) != "b" {
+			t.Errorf("expected longpoll change b, got: %#v", cr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected longpoll to finish")
+	}
+
+	// Already available changes return right away.
+	_, cr = testGetChanges(t, mr, "?feed=longpoll")
+	if cr == nil || testChangesIds(cr) != "a,b" {
+		t.Errorf("expected longpoll changes a,b, got: %#v", cr)
+	}
+
+	_, cr = testGetChanges(t, mr,
+		fmt.Sprintf("?feed=longpoll&timeout=10&since=%v", cr.LastSeq))
+	if cr == nil || len(cr.Results) != 0 {
+		t.Errorf("expected timed out longpoll with no changes, got: %#v", cr)
+	}
+}
+
+func TestCouchChangesContinuous(t *testing.T) {
+	d, _, bucket := testSetupDefaultBucket(t, 1, uint16(0))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	SetItem(bucket, []byte("a"), []byte("aaa"), VBActive)
+
+	donech := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET",
+			"http://127.0.0.1/default/_changes?feed=continuous&timeout=200", nil)
+		mr.ServeHTTP(rr, r)
+		donech <- rr
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	SetItem(bucket, []byte("b"), []byte("bbb"), VBActive)
+
+	var rr *httptest.ResponseRecorder
+	select {
+	case rr = <-donech:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected continuous feed to time out")
+	}
+
+	lines := []string{}
+	s := bufio.NewScanner(bytes.NewReader(rr.Body.Bytes()))
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 2 changes and a last_seq, got: %#v", lines)
+	}
+	ids := []string{}
+	for _, line := range lines[:2] {
+		row := &ChangesRow{}
+		if err := jsonUnmarshal([]byte(line), row); err != nil {
+			t.Fatalf("expected a json change, got: %v, %v", line, err)
+		}
+		ids = append(ids, row.Id)
+	}
+	if strings.Join(ids, ",") != "a,b" {
+		t.Errorf("expected continuous changes a,b, got: %v", ids)
+	}
+	last := &testChangesResult{}
+	if err := jsonUnmarshal([]byte(lines[2]), last); err != nil ||
+		last.LastSeq == "" {
+		t.Errorf("expected a last_seq line, got: %v, %v", lines[2], err)
+	}
+
+	// A limit ends the continuous feed without waiting.
+	rr = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET",
+		"http://127.0.0.1/default/_changes?feed=continuous&limit=1", nil)
+	mr.ServeHTTP(rr, r)
+	if n := strings.Count(rr.Body.String(), "\n"); n != 2 {
+		t.Errorf("expected 1 change and a last_seq, got: %v",
+			rr.Body.String())
+	}
+}
@@ -27,10 +27,10 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func restCouchServe(rest string, staticPath string) {
+func restCouchHandler() http.Handler {
 	r := mux.NewRouter()
 	restCouchAPI(r)
-	log.Fatal(http.ListenAndServe(rest, authenticationFilter{r}))
+	return authenticationFilter{r}
 }
 
 func referencesVBucket(r *http.Request, rm *mux.RouteMatch) bool {
@@ -62,6 +62,9 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbAllDocs))).
 		Methods("GET")
 
+	dbr.Handle("/_changes",
+		http.HandlerFunc(couchDbChanges)).Methods("GET")
+
 	dbr.Handle("/_design/{docId}/_view/{viewId}",
 		http.HandlerFunc(deadlinedHandler(time.Second, couchDbGetView))).
 		Methods("GET")
@@ -83,6 +86,13 @@ func restCouchAPI(r *mux.Router) *mux.Router {
 		http.HandlerFunc(couchDbDelDoc)).Methods("DELETE").
 		MatcherFunc(doesNotReferenceVBucket)
 
+	dbr.Handle("/{docId}/_subdoc/lookup",
+		http.HandlerFunc(couchDbSubdocLookup)).Methods("POST").
+		MatcherFunc(doesNotReferenceVBucket)
+	dbr.Handle("/{docId}/_subdoc/mutate",
+		http.HandlerFunc(couchDbSubdocMutate)).Methods("POST").
+		MatcherFunc(doesNotReferenceVBucket)
+
 	dbr.Handle("/{vbucket};{bucketUUID}",
 		http.HandlerFunc(couchDbGetDb)).Methods("GET", "HEAD").
 		MatcherFunc(referencesVBucket).
@@ -358,6 +368,167 @@ func couchDbDelDoc(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "unimplemented", 501)
 }
 
+type SubdocSpec struct {
+	Op            string          `json:"op"`
+	Path          string          `json:"path"`
+	Value         json.RawMessage `json:"value,omitempty"`
+	CreateParents bool            `json:"createParents,omitempty"`
+}
+
+type SubdocRequest struct {
+	Cas    uint64       `json:"cas,omitempty"`
+	Expiry *uint32      `json:"expiry,omitempty"`
+	Specs  []SubdocSpec `json:"specs"`
+}
+
+type SubdocResult struct {
+	Status string          `json:"status"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// Looks up paths of a JSON document, with a body like
+// {"specs":[{"op":"get","path":"a.b[0]"},{"op":"exists","path":"c"}]},
+// responding with the document's cas and each spec's result.
+func couchDbSubdocLookup(w http.ResponseWriter, r *http.Request) {
+	vb, req, specs, _ := checkSubdoc(w, r, SUBDOC_MULTI_LOOKUP)
+	if vb == nil {
+		return
+	}
+	res, results := subdocLookup(vb, req, specs)
+	if res.Status != gomemcached.SUCCESS {
+		subdocHttpError(w, res.Status, string(res.Body), -1)
+		return
+	}
+	mustEncode(w, map[string]interface{}{
+		"cas":     res.Cas,
+		"results": subdocHttpResults(results),
+	})
+}
+
+// Mutates paths of a JSON document atomically, with a body like
+// {"cas":123,"specs":[{"op":"counter","path":"n","value":1}]}, where
+// cas and expiry are optional, responding with the document's new
+// cas and each spec's result.
+func couchDbSubdocMutate(w http.ResponseWriter, r *http.Request) {
+	vb, req, specs, exp := checkSubdoc(w, r, SUBDOC_MULTI_MUTATION)
+	if vb == nil {
+		return
+	}
+	var results []subdocResult
+	var serr *subdocError
+	res := vb.clientMutation(VBActive, func() (res *gomemcached.MCResponse) {
+		res, results, serr = subdocMutate(vb, req, specs, exp)
+		return res
+	})
+	if serr != nil {
+		subdocHttpError(w, serr.status, serr.msg, serr.index)
+		return
+	}
+	if res.Status != gomemcached.SUCCESS {
+		subdocHttpError(w, res.Status, string(res.Body), -1)
+		return
+	}
+	mustEncode(w, map[string]interface{}{
+		"cas":     res.Cas,
+		"results": subdocHttpResults(results),
+	})
+}
+
+// Parses a sub-document request body into a request, specs and
+// optional expiration for the document's active vbucket, or writes an
+// error and returns a nil vbucket.
+func checkSubdoc(w http.ResponseWriter, r *http.Request,
+	op gomemcached.CommandCode) (*VBucket, *gomemcached.MCRequest,
+	[]subdocSpec, *uint32) {
+	_, _, bucket, docId := checkDocId(w, r)
+	if bucket == nil || docId == "" {
+		return nil, nil, nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
+		return nil, nil, nil, nil
+	}
+	var subdocReq SubdocRequest
+	if err = jsonUnmarshal(body, &subdocReq); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request, err: %v", err), 400)
+		return nil, nil, nil, nil
+	}
+	if len(subdocReq.Specs) == 0 || len(subdocReq.Specs) > SUBDOC_MAX_SPECS {
+		http.Error(w, fmt.Sprintf("Bad Request, wrong number of specs: %v",
+			len(subdocReq.Specs)), 400)
+		return nil, nil, nil, nil
+	}
+	specs := make([]subdocSpec, len(subdocReq.Specs))
+	for i, s := range subdocReq.Specs {
+		specOp, ok := subdocOpNames[s.Op]
+		if !ok || (op == SUBDOC_MULTI_LOOKUP && !isSubdocLookup(specOp)) ||
+			(op == SUBDOC_MULTI_MUTATION && !isSubdocMutation(specOp)) {
+			http.Error(w, fmt.Sprintf("Bad Request, op not allowed: %q", s.Op), 400)
+			return nil, nil, nil, nil
+		}
+		specs[i] = subdocSpec{op: specOp, path: s.Path, value: s.Value}
+		if s.CreateParents {
+			specs[i].flags = SUBDOC_FLAG_MKDIR_P
+		}
+	}
+	vb, _ := GetVBucket(bucket, []byte(docId), VBActive)
+	if vb == nil {
+		http.Error(w, `{"error": "not_found", "reason": "missing"}`, 404)
+		return nil, nil, nil, nil
+	}
+	return vb, &gomemcached.MCRequest{
+		Opcode:  op,
+		VBucket: vb.vbid,
+		Key:     []byte(docId),
+		Cas:     subdocReq.Cas,
+		Body:    body,
+	}, specs, subdocReq.Expiry
+}
+
+func subdocHttpResults(results []subdocResult) []SubdocResult {
+	rv := make([]SubdocResult, len(results))
+	for i, r := range results {
+		rv[i].Status = subdocStatusNames[r.status]
+		if r.status == gomemcached.SUCCESS {
+			rv[i].Value = r.value
+		} else {
+			rv[i].Reason = string(r.value)
+		}
+	}
+	return rv
+}
+
+// Writes a failed sub-document request, with the index of the spec
+// that failed, if any.
+func subdocHttpError(w http.ResponseWriter, status gomemcached.Status,
+	reason string, index int) {
+	code, name := 400, subdocStatusNames[status]
+	switch status {
+	case gomemcached.KEY_ENOENT:
+		code, name, reason = 404, "not_found", "missing"
+	case gomemcached.KEY_EEXISTS:
+		code, name = 409, "conflict"
+	case LOCKED:
+		code, name = 409, "locked"
+	case gomemcached.E2BIG:
+		code, name = 413, "too_large"
+	case gomemcached.TMPFAIL:
+		code, name = 503, "temporary_failure"
+	}
+	if name == "" {
+		name = "bad_request"
+	}
+	rv := map[string]interface{}{"error": name, "reason": reason}
+	if index >= 0 {
+		rv["index"] = index
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	mustEncode(w, rv)
+}
+
 func checkDb(w http.ResponseWriter, r *http.Request) (
 	vars map[string]string, bucketName string, bucket Bucket) {
 
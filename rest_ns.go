@@ -272,8 +272,26 @@ func restNSSettingsStats(w http.ResponseWriter, r *http.Request) {
 	mustEncode(w, map[string]interface{}{"sendStats": false})
 }
 
+// Lists the latest flush and compaction that each open bucket's
+// storePolicy started.
 func restNSPoolsDefaultTasks(w http.ResponseWriter, r *http.Request) {
-	mustEncode(w, map[string]interface{}{})
+	u := currentUser(r)
+	rv := []storeTask{}
+	for _, bn := range buckets.GetNames() {
+		if !u.canAccess(bn) {
+			continue
+		}
+		b := buckets.Get(bn)
+		if b == nil {
+			continue
+		}
+		for i := 0; i < STORES_PER_BUCKET; i++ {
+			if bs := b.GetBucketStore(i); bs != nil {
+				rv = append(rv, bs.Tasks()...)
+			}
+		}
+	}
+	mustEncode(w, rv)
 }
 
 func restNSLocalRandomKey(w http.ResponseWriter, r *http.Request) {
@@ -318,7 +336,7 @@ func restNSAPI(r *mux.Router) {
 	r.HandleFunc("/settings/stats", restNSSettingsStats)
 }
 
-func restNSServe(restNS string, staticPath string, staticCachePath string) {
+func restNSHandler(staticPath string, staticCachePath string) http.Handler {
 	r := mux.NewRouter()
 	if err := initStatic(r, "/_static/", staticPath, staticCachePath); err != nil {
 		log.Fatalf("error initializing static resources: %v", err)
@@ -328,5 +346,5 @@ func restNSServe(restNS string, staticPath string, staticCachePath string) {
 	cbr := r.PathPrefix("/couchBase/").Subrouter()
 	restCouchAPI(cbr)
 	r.Handle("/", http.RedirectHandler("/_static/app.html", 302))
-	log.Fatal(http.ListenAndServe(restNS, authenticationFilter{r}))
+	return authenticationFilter{r}
 }
@@ -665,9 +665,9 @@ func TestRestNSSettingsStats(t *testing.T) {
 
 func TestRestNSPoolsDefaultTasks(t *testing.T) {
 	j := testRestGetJson(t, "http://127.0.0.1/pools/default/tasks")
-	m := j.(map[string]interface{})
-	if len(m) != 0 {
-		t.Errorf("expected empty pools/default/tasks, got: %#v", m)
+	a := j.([]interface{})
+	if len(a) != 0 {
+		t.Errorf("expected empty pools/default/tasks, got: %#v", a)
 	}
 }
 
@@ -831,6 +831,70 @@ func TestRestDeleteBucket(t *testing.T) {
 	}
 }
 
+func TestRestBucketReplications(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	b, _ := buckets.New("foo", bucketSettings)
+	defer b.Close()
+	defer replications.CloseAll("foo")
+	mr := testSetupMux(d)
+
+	doReq := func(method, url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "http://127.0.0.1"+url, nil)
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := doReq("GET", "/_api/buckets/foo/replications")
+	if rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("expected no replications, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	rr = doReq("POST", "/_api/buckets/foo/replications")
+	if rr.Code != 400 {
+		t.Errorf("expected missing remoteAddr err, got: %#v", rr)
+	}
+	rr = doReq("POST", "/_api/buckets/notABucket/replications?remoteAddr=x")
+	if rr.Code != 404 {
+		t.Errorf("expected notABucket err, got: %#v", rr)
+	}
+	rr = doReq("POST", "/_api/buckets/foo/replications?remoteAddr=127.0.0.1:1")
+	if rr.Code != 303 {
+		t.Errorf("expected replication creating to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	loc := rr.Header().Get("Location")
+
+	rr = doReq("GET", loc)
+	if rr.Code != 200 {
+		t.Errorf("expected replication GET to work, got: %#v", rr)
+	}
+	m := map[string]interface{}{}
+	if err := jsonUnmarshal(rr.Body.Bytes(), &m); err != nil {
+		t.Errorf("expected replication json, got: %v", rr.Body.String())
+	}
+	if m["remoteBucket"] != "foo" || m["stats"] == nil {
+		t.Errorf("expected replication details, got: %#v", m)
+	}
+
+	rr = doReq("GET", "/_api/buckets/foo/replications")
+	a := []interface{}{}
+	jsonUnmarshal(rr.Body.Bytes(), &a)
+	if len(a) != 1 {
+		t.Errorf("expected 1 replication, got: %v", rr.Body.String())
+	}
+
+	rr = doReq("DELETE", loc)
+	if rr.Code != 204 {
+		t.Errorf("expected replication delete to work, got: %#v", rr)
+	}
+	rr = doReq("DELETE", loc)
+	if rr.Code != 404 {
+		t.Errorf("expected 2nd replication delete to fail, got: %#v", rr)
+	}
+}
+
 func TestRestPostRuntimeGC(t *testing.T) {
 	rr := testRestPost(t, "http://127.0.0.1/_api/runtime/gc")
 	if len(rr.Body.Bytes()) != 0 {
@@ -852,6 +916,33 @@ func TestRestPostBucket(t *testing.T) {
 	}
 }
 
+func TestRestPostBucketPassword(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+	rr := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST",
+		"http://127.0.0.1/_api/buckets?name=pw&password=secret", nil)
+	mr.ServeHTTP(rr, r)
+	if rr.Code != 303 {
+		t.Fatalf("expected bucket creating to work, got: %#v, %v",
+			rr, rr.Body.String())
+	}
+	b := buckets.Get("pw")
+	if b == nil {
+		t.Fatalf("expected bucket pw")
+	}
+	defer b.Close()
+	bs := b.GetBucketSettings()
+	if bs.PasswordHashFunc != SCRAM_SHA256 || bs.PasswordSalt == "" ||
+		bs.PasswordHash == "secret" {
+		t.Errorf("expected a hashed password, got: %#v", bs)
+	}
+	if !b.Auth([]byte("secret")) || b.Auth([]byte("wrong")) {
+		t.Errorf("expected auth to work against the hashed password")
+	}
+}
+
 func TestRestPostBucketCompact(t *testing.T) {
 	rr := testRestPost(t, "http://127.0.0.1/_api/buckets/foo/compact")
 	if len(rr.Body.Bytes()) != 0 {
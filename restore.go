@@ -0,0 +1,395 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/steveyen/gkvlite"
+)
+
+type restoreOptions struct {
+	KeyPrefix     string // Only restore keys with this prefix.
+	NumPartitions int    // Re-hash into this many vbuckets; 0 keeps the source's.
+	DryRun        bool   // Only verify what would be restored.
+	Overwrite     bool   // Replace an existing bucket.
+}
+
+type restoreResult struct {
+	Bucket        string   `json:"bucket"`
+	Backups       []string `json:"backups,omitempty"` // In the order they're applied.
+	NumPartitions int      `json:"numPartitions"`
+	DryRun        bool     `json:"dryRun"`
+	Items         int64    `json:"items"`
+	Deletions     int64    `json:"deletions"`
+	Filtered      int64    `json:"filtered"` // Not matching the key prefix.
+	Expired       int64    `json:"expired"`
+	Stale         int64    `json:"stale"` // Superseded by a newer CAS.
+}
+
+// Returns the backups that a restore from dir applies, which is the
+// full backup that dir's incremental chain starts with, through dir.
+// The links are checked, so a missing or foreign backup is an error.
+func readBackupChain(dir string) (dirs []string, ms []*backupManifest, err error) {
+	for {
+		m, err := readBackupManifest(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ms) > 0 {
+			next := ms[0]
+			if m.Bucket != next.Bucket {
+				return nil, nil, fmt.Errorf("backup %v is of bucket %v, not %v",
+					m.Name, m.Bucket, next.Bucket)
+			}
+			for vbid, cas := range next.SinceCas {
+				if m.Cas[vbid] != cas {
+					return nil, nil, fmt.Errorf("backup %v doesn't follow %v,"+
+						" vbucket: %v", next.Name, m.Name, vbid)
+				}
+			}
+		}
+		dirs = append([]string{dir}, dirs...)
+		ms = append([]*backupManifest{m}, ms...)
+		if !m.incremental() {
+			return dirs, ms, nil
+		}
+		if len(ms) > 1000 {
+			return nil, nil, fmt.Errorf("backup chain too long: %v", dir)
+		}
+		dir = filepath.Join(filepath.Dir(dir), m.Since)
+	}
+}
+
+// A restorer applies items from elsewhere to a bucket, with
+// SET_WITH_META semantics, so their CAS, flags and exp are kept.
+// With freshCas, such as for a live bucket, whose change streams
+// would miss changes with older CAS's, only the flags and exp are
+// kept, and the bucket gives the changes new CAS's.
+type restorer struct {
+	b                Bucket // Nil for a dry-run.
+	freshCas         bool
+	opts             restoreOptions
+	srcNumPartitions int
+	now              time.Time
+	res              *restoreResult
+}
+
+func (r *restorer) apply(srcVBid uint16, i *item) error {
+	if len(i.key) == 0 { // A vbucket metadata change.
+		return nil
+	}
+	if !bytes.HasPrefix(i.key, []byte(r.opts.KeyPrefix)) {
+		r.res.Filtered++
+		return nil
+	}
+	if !i.isDeletion() && i.isExpired(r.now) {
+		r.res.Expired++
+		return nil
+	}
+	v, err := i.value()
+	if err != nil {
+		return fmt.Errorf("value of key: %s, err: %v", i.key, err)
+	}
+
+	vbid := srcVBid
+	if r.res.NumPartitions != r.srcNumPartitions {
+		vbid = VBucketIdForKey(i.key, r.res.NumPartitions)
+	}
+	if int(vbid) >= r.res.NumPartitions {
+		return fmt.Errorf("key: %s, vbucket: %v out of range", i.key, vbid)
+	}
+	if r.b == nil {
+		if i.isDeletion() {
+			r.res.Deletions++
+		} else {
+			r.res.Items++
+		}
+		return nil
+	}
+
+	vb, _ := r.b.GetVBucket(vbid)
+	if vb == nil {
+		return fmt.Errorf("no vbucket: %v", vbid)
+	}
+	req := &gomemcached.MCRequest{
+		Opcode:  SET_WITH_META,
+		VBucket: vbid,
+		Key:     i.key,
+		Body:    v,
+		Extras:  make([]byte, withMetaExtrasLen),
+	}
+	if i.isDeletion() {
+		req.Opcode = DELETE_WITH_META
+		req.Body = nil
+	} else {
+		binary.BigEndian.PutUint32(req.Extras, i.flag)
+		binary.BigEndian.PutUint32(req.Extras[4:], i.exp)
+	}
+	binary.BigEndian.PutUint64(req.Extras[16:], i.cas)
+	if i.cas == 0 || r.freshCas {
+		// Such as a hand-written import, so generate a local CAS.
+		req.Opcode = gomemcached.SET
+		if i.isDeletion() {
+			req.Opcode = gomemcached.DELETE
+		}
+		req.Extras = req.Extras[0:8]
+	}
+
+	res := vb.Dispatch(nil, req)
+	switch {
+	case res == nil || res.Status == gomemcached.SUCCESS:
+		if i.isDeletion() {
+			r.res.Deletions++
+		} else {
+			r.res.Items++
+		}
+	case res.Status == gomemcached.KEY_EEXISTS:
+		r.res.Stale++
+	case res.Status == gomemcached.KEY_ENOENT && i.isDeletion():
+		r.res.Deletions++ // It was never restored.
+	default:
+		return fmt.Errorf("restore key: %s, status: %v, %s",
+			i.key, res.Status, res.Body)
+	}
+	return nil
+}
+
+// Applies the changes in a backup's store file, in CAS order within
+// each vbucket.  The keys decrypt the file, if it's encrypted.
+func (r *restorer) applyBackupFile(path string, keys *cryptKeys) error {
+	f, store, err := openStoreReadOnly(path, keys, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer store.Close()
+
+	// The dictionaries must be registered for their values to be
+	// decompressed.
+	dicts, err := acquireStoreValueDicts(store)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, d := range dicts {
+			releaseValueDict(d)
+		}
+	}()
+
+	collNames := store.GetCollectionNames()
+	sort.Strings(collNames)
+	for _, collName := range collNames {
+		if !strings.HasSuffix(collName, COLL_SUFFIX_CHANGES) {
+			continue
+		}
+		vbid, err := strconv.Atoi(collName[0 : len(collName)-len(COLL_SUFFIX_CHANGES)])
+		if err != nil {
+			return err
+		}
+		var errVisit error
+		err = store.GetCollection(collName).VisitItemsAscend(nil, true,
+			func(cItem *gkvlite.Item) bool {
+				i := &item{}
+				if errVisit = i.fromValueBytes(cItem.Val); errVisit != nil {
+					return false
+				}
+				errVisit = r.apply(uint16(vbid), i)
+				return errVisit == nil
+			})
+		if err == nil {
+			err = errVisit
+		}
+		if err != nil {
+			return fmt.Errorf("restore %v, coll: %v, err: %v", path, collName, err)
+		}
+	}
+	return nil
+}
+
+// Applies every file of a backup chain.
+func (r *restorer) applyChain(dirs []string, ms []*backupManifest) error {
+	for i, m := range ms {
+		// Each backup has the settings, and so the keys, of its time.
+		bs := &BucketSettings{}
+		if _, err := bs.load(dirs[i]); err != nil {
+			return err
+		}
+		keys, err := bs.cryptKeys()
+		if err != nil {
+			return err
+		}
+		for _, fname := range m.Files {
+			if err = r.applyBackupFile(filepath.Join(dirs[i], fname), keys); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restores the backup in dir, and the backups it's an increment of,
+// into the named bucket, which is created, or replaced when
+// opts.Overwrite is set.  The whole chain is verified, as in a
+// dry-run, before an existing bucket is touched, and a bucket that
+// fails to restore is deleted rather than left partly restored.
+func restoreBucket(bucketName, dir string, opts restoreOptions) (
+	*restoreResult, error) {
+	dirs, ms, err := readBackupChain(dir)
+	if err != nil {
+		return nil, err
+	}
+	settings := &BucketSettings{}
+	if _, err = settings.load(dirs[0]); err != nil {
+		return nil, err
+	}
+	if settings.NumPartitions <= 0 {
+		return nil, fmt.Errorf("backup %v has no numPartitions", dirs[0])
+	}
+	newRestorer := func(dryRun bool) *restorer {
+		r := &restorer{
+			opts:             opts,
+			srcNumPartitions: settings.NumPartitions,
+			now:              time.Now(),
+			res: &restoreResult{
+				Bucket:        bucketName,
+				NumPartitions: settings.NumPartitions,
+				DryRun:        dryRun,
+			},
+		}
+		if opts.NumPartitions > 0 {
+			r.res.NumPartitions = opts.NumPartitions
+		}
+		for _, m := range ms {
+			r.res.Backups = append(r.res.Backups, m.Name)
+		}
+		return r
+	}
+
+	exists := buckets.Get(bucketName) != nil
+	if exists && !opts.Overwrite {
+		return nil, fmt.Errorf("bucket already exists: %v", bucketName)
+	}
+	r := newRestorer(true)
+	if err = r.applyChain(dirs, ms); err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return r.res, nil
+	}
+
+	if exists {
+		replications.CloseAll(bucketName)
+		if err = buckets.Close(bucketName, true); err != nil {
+			return nil, err
+		}
+	}
+	// The vbuckets stay dead, so clients don't see a partly restored
+	// bucket, until everything's applied and flushed.
+	r = newRestorer(false)
+	settings.NumPartitions = r.res.NumPartitions
+	if r.b, err = createBucketVBState(bucketName, settings, VBDead); err != nil {
+		return nil, err
+	}
+	if err = r.applyChain(dirs, ms); err == nil {
+		err = r.b.Flush()
+	}
+	for vbid := 0; err == nil && vbid < settings.NumPartitions; vbid++ {
+		err = r.b.SetVBState(uint16(vbid), VBActive)
+	}
+	if err == nil {
+		err = r.b.Flush()
+	}
+	if err != nil {
+		if errClose := buckets.Close(bucketName, true); errClose != nil {
+			log.Printf("restore: could not delete partly restored bucket: %v,"+
+				" err: %v", bucketName, errClose)
+		}
+		return nil, err
+	}
+	return r.res, nil
+}
+
+// The restore subcommand, which restores into the -data directory
+// while the server isn't running.
+func mainRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	bucketName := fs.String("bucket", "",
+		"Bucket to restore into; defaults to the backup's bucket")
+	keyPrefix := fs.String("key-prefix", "", "Only restore keys with this prefix")
+	numPartitions := fs.Int("num-partitions", 0,
+		"Number of vbuckets to re-hash keys into; defaults to the backup's")
+	dryRun := fs.Bool("dry-run", false, "Only verify the backup")
+	overwrite := fs.Bool("overwrite", false, "Replace an existing bucket")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "\nusage: %s <flags> restore <restore flags> BACKUP_DIR\n",
+			os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nrestore flags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	dir := fs.Arg(0)
+	if *bucketName == "" {
+		m, err := readBackupManifest(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not read backup: %v\n", err)
+			return 1
+		}
+		*bucketName = m.Bucket
+	}
+
+	bss := &BucketSettings{
+		NumPartitions: *defaultNumPartitions,
+		QuotaBytes:    int64(*defaultQuotaBytes),
+		MemoryOnly:    MemoryOnly_LEVEL_PERSIST_NOTHING - *defaultPersistence,
+	}
+	bs, err := NewBuckets(*data, bss)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: could not make buckets: %v\n", err)
+		return 1
+	}
+	buckets = bs
+	bucketSettings = bss
+	defer buckets.CloseAll()
+
+	res, err := restoreBucket(*bucketName, dir, restoreOptions{
+		KeyPrefix:     *keyPrefix,
+		NumPartitions: *numPartitions,
+		DryRun:        *dryRun,
+		Overwrite:     *overwrite,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: restore failed: %v\n", err)
+		return 1
+	}
+	log.Printf("restored bucket %v from %v", *bucketName, dir)
+	j, _ := json.MarshalIndent(res, "", "  ")
+	fmt.Printf("%s\n", j)
+	return 0
+}
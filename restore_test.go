@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestReadBackupChain(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+
+	write := func(m *backupManifest) {
+		dir := filepath.Join(d, m.Name)
+		os.Mkdir(dir, 0777)
+		if err := m.write(dir); err != nil {
+			t.Fatalf("expected manifest write to work, got: %v", err)
+		}
+	}
+	write(&backupManifest{Bucket: "b", Name: "full",
+		Cas: map[uint16]uint64{0: 10}})
+	write(&backupManifest{Bucket: "b", Name: "incr", Since: "full",
+		SinceCas: map[uint16]uint64{0: 10}, Cas: map[uint16]uint64{0: 20}})
+	write(&backupManifest{Bucket: "b", Name: "incr2", Since: "incr",
+		SinceCas: map[uint16]uint64{0: 20}, Cas: map[uint16]uint64{0: 20}})
+	write(&backupManifest{Bucket: "b", Name: "gap", Since: "full",
+		SinceCas: map[uint16]uint64{0: 5}, Cas: map[uint16]uint64{0: 20}})
+	write(&backupManifest{Bucket: "other", Name: "foreign", Since: "full",
+		SinceCas: map[uint16]uint64{0: 10}, Cas: map[uint16]uint64{0: 20}})
+	write(&backupManifest{Bucket: "b", Name: "orphan", Since: "missing"})
+
+	dirs, ms, err := readBackupChain(filepath.Join(d, "incr2"))
+	if err != nil {
+		t.Fatalf("expected chain to work, got: %v", err)
+	}
+	if len(ms) != 3 || ms[0].Name != "full" || ms[1].Name != "incr" ||
+		ms[2].Name != "incr2" || dirs[0] != filepath.Join(d, "full") {
+		t.Errorf("expected full, incr, incr2, got: %v, %#v", dirs, ms)
+	}
+	if _, ms, err = readBackupChain(filepath.Join(d, "full")); err != nil || len(ms) != 1 {
+		t.Errorf("expected a full backup chain, got: %#v, %v", ms, err)
+	}
+	for _, name := range []string{"gap", "foreign", "orphan", "missing"} {
+		if _, _, err = readBackupChain(filepath.Join(d, name)); err == nil {
+			t.Errorf("expected chain of %v to fail", name)
+		}
+	}
+}
+
+func TestRestoreBucket(t *testing.T) {
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	backupDir := filepath.Join(d, "backups")
+
+	src, err := createBucket("src", &BucketSettings{NumPartitions: 2})
+	if err != nil {
+		t.Fatalf("expected createBucket to work, got: %v", err)
+	}
+	rh := &reqHandler{currentBucket: src}
+	do := func(op gomemcached.CommandCode, key string, flag uint32) {
+		req := &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: VBucketIdForKey([]byte(key), 2),
+			Key:     []byte(key),
+		}
+		if op == gomemcached.SET {
+			req.Body = []byte("v-" + key)
+			req.Extras = make([]byte, 8)
+			binary.BigEndian.PutUint32(req.Extras, flag)
+		}
+		res := rh.HandleMessage(nil, nil, req)
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected %v %v to work, got: %v", op, key, res)
+		}
+	}
+	do(gomemcached.SET, "a1", 1)
+	do(gomemcached.SET, "a2", 2)
+	do(gomemcached.SET, "b1", 3)
+	full, err := backupBucket(src, filepath.Join(backupDir, "full"), "full", nil)
+	if err != nil {
+		t.Fatalf("expected backup to work, got: %v", err)
+	}
+	do(gomemcached.SET, "a3", 4)
+	do(gomemcached.DELETE, "a1", 0)
+	do(gomemcached.SET, "a2", 5)
+	if _, err = backupBucket(src, filepath.Join(backupDir, "incr"), "incr", full); err != nil {
+		t.Fatalf("expected incremental backup to work, got: %v", err)
+	}
+
+	opts := restoreOptions{NumPartitions: 4, DryRun: true}
+	res, err := restoreBucket("dst", filepath.Join(backupDir, "incr"), opts)
+	if err != nil {
+		t.Fatalf("expected dry-run to work, got: %v", err)
+	}
+	if res.Items != 5 || res.Deletions != 1 || len(res.Backups) != 2 ||
+		res.NumPartitions != 4 || !res.DryRun {
+		t.Errorf("expected dry-run counts, got: %#v", res)
+	}
+	if buckets.Get("dst") != nil {
+		t.Errorf("expected dry-run to not create a bucket")
+	}
+
+	opts = restoreOptions{NumPartitions: 4, KeyPrefix: "a"}
+	res, err = restoreBucket("dst", filepath.Join(backupDir, "incr"), opts)
+	if err != nil {
+		t.Fatalf("expected restore to work, got: %v", err)
+	}
+	if res.Filtered != 1 || res.Deletions != 1 || res.Stale != 0 {
+		t.Errorf("expected restore counts, got: %#v", res)
+	}
+	dst := buckets.Get("dst")
+	if dst == nil || dst.GetBucketSettings().NumPartitions != 4 {
+		t.Fatalf("expected a restored bucket with 4 partitions")
+	}
+
+	get := func(b Bucket, numPartitions int, key string) *gomemcached.MCResponse {
+		return (&reqHandler{currentBucket: b}).HandleMessage(nil, nil,
+			&gomemcached.MCRequest{
+				Opcode:  gomemcached.GET,
+				VBucket: VBucketIdForKey([]byte(key), numPartitions),
+				Key:     []byte(key),
+			})
+	}
+	for _, key := range []string{"a2", "a3"} {
+		exp := get(src, 2, key)
+		res := get(dst, 4, key)
+		if res.Status != gomemcached.SUCCESS || string(res.Body) != "v-"+key ||
+			res.Cas != exp.Cas || string(res.Extras) != string(exp.Extras) {
+			t.Errorf("expected %v restored with its meta, got: %v, want: %v",
+				key, res, exp)
+		}
+	}
+	for _, key := range []string{"a1", "b1"} {
+		if res := get(dst, 4, key); res.Status != gomemcached.KEY_ENOENT {
+			t.Errorf("expected %v to not be restored, got: %v", key, res)
+		}
+	}
+
+	if _, err = restoreBucket("dst", filepath.Join(backupDir, "full"),
+		restoreOptions{}); err == nil {
+		t.Errorf("expected restore over an existing bucket to fail")
+	}
+	if _, err = replications.Add(buckets, "dst", "127.0.0.1:1", "src",
+		"", true); err != nil {
+		t.Fatalf("expected a replication into dst, got: %v", err)
+	}
+	res, err = restoreBucket("dst", filepath.Join(backupDir, "full"),
+		restoreOptions{Overwrite: true})
+	if err != nil {
+		t.Fatalf("expected restore with overwrite to work, got: %v", err)
+	}
+	if len(replications.List("dst")) != 0 {
+		t.Errorf("expected the overwritten bucket's replications to be closed")
+	}
+	dst = buckets.Get("dst")
+	if res.NumPartitions != 2 || dst.GetBucketSettings().NumPartitions != 2 {
+		t.Errorf("expected the source's partitions, got: %#v", res)
+	}
+	for vbid := uint16(0); vbid < 2; vbid++ {
+		if vb, _ := dst.GetVBucket(vbid); vb == nil || vb.GetVBState() != VBActive {
+			t.Errorf("expected restored vbucket %v to be active, got: %v", vbid, vb)
+		}
+	}
+	if res := get(dst, 2, "a1"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected a1 from the full backup, got: %v", res)
+	}
+	if res := get(dst, 2, "a3"); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected no a3 from the full backup, got: %v", res)
+	}
+
+	// A damaged backup is found before the existing bucket is purged.
+	m, err := readBackupManifest(filepath.Join(backupDir, "incr"))
+	if err != nil || len(m.Files) == 0 {
+		t.Fatalf("expected the incremental backup's manifest, got: %v, %v", m, err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(backupDir, "incr", m.Files[0]),
+		[]byte("garbage"), 0666); err != nil {
+		t.Fatalf("expected to damage the backup, got: %v", err)
+	}
+	if _, err = restoreBucket("dst", filepath.Join(backupDir, "incr"),
+		restoreOptions{Overwrite: true}); err == nil {
+		t.Errorf("expected restore from a damaged backup to fail")
+	}
+	if dst2 := buckets.Get("dst"); dst2 != dst {
+		t.Errorf("expected the existing bucket to be kept")
+	}
+	if res := get(dst, 2, "a1"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected the existing bucket's a1, got: %v", res)
+	}
+	if _, err = restoreBucket("dst3", filepath.Join(backupDir, "incr"),
+		restoreOptions{}); err == nil || buckets.Get("dst3") != nil {
+		t.Errorf("expected no bucket from a damaged backup, got: %v", err)
+	}
+}
+
+func TestRestPostBucketRestore(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		code int
+	}{
+		{"http://127.0.0.1/_api/buckets/foo/restore", 400},
+		{"http://127.0.0.1/_api/buckets/foo/restore?backup=..", 400},
+		{"http://127.0.0.1/_api/buckets/foo/restore?backup=b&numPartitions=x", 400},
+		{"http://127.0.0.1/_api/buckets/foo/restore?backup=missing", 500},
+	} {
+		rr := testRestPost(t, test.url)
+		if rr.Code != test.code {
+			t.Errorf("expected %v for %v, got: %v, %v",
+				test.code, test.url, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// TODO: Graduate these to gomemcached one day.
+	AUTH_ERROR    = gomemcached.Status(0x20)
+	AUTH_CONTINUE = gomemcached.Status(0x21)
+)
+
+// CRAM-MD5 isn't advertised, as it only works for buckets whose
+// passwords aren't hashed, but it's still accepted for them.
+var saslMechs = "PLAIN SCRAM-SHA-256"
+
+// The server side of a challenge/response SASL mechanism.  Each
+// step takes the client's response and returns the next challenge,
+// until the exchange is done and the user is authenticated.
+type saslMech interface {
+	step(in []byte) (out []byte, user string, done bool, err error)
+}
+
+var saslMechMakers = map[string]func(bs *Buckets) saslMech{
+	"CRAM-MD5":      newSaslCramMD5,
+	"SCRAM-SHA-256": newSaslScramSHA256,
+}
+
+// Per-connection SASL state, which is independent of the bucket
+// that the connection has selected, so a connection that never
+// authenticated isn't treated as the default bucket's user.
+type saslAuth struct {
+	user string // The authenticated user, if any.
+
+	mechName string // The in-progress exchange, if any.
+	mech     saslMech
+}
+
+// Returns true when the connection has authenticated as the bucket
+// it has selected, which is needed to feed it replicated changes.
+func (rh *reqHandler) authedAsCurrentBucket() bool {
+	return rh.sasl.user != "" && rh.sasl.user == rh.currentBucketName
+}
+
+func (rh *reqHandler) doSaslAuth(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.VBucket != 0 || req.Cas != 0 || len(req.Extras) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+		}
+	}
+	mechName := string(req.Key)
+	if mechName == "PLAIN" {
+		return rh.doSaslPlain(req)
+	}
+	mk := saslMechMakers[mechName]
+	if mk == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("unsupported SASL auth mech: %v", req.Key)),
+		}
+	}
+	rh.sasl.mechName = mechName
+	rh.sasl.mech = mk(rh.buckets)
+	return rh.doSaslMechStep(req.Body)
+}
+
+func (rh *reqHandler) doSaslStep(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.VBucket != 0 || req.Cas != 0 || len(req.Extras) != 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+		}
+	}
+	if rh.sasl.mech == nil || rh.sasl.mechName != string(req.Key) {
+		rh.sasl.mech = nil
+		return &gomemcached.MCResponse{
+			Status: AUTH_ERROR,
+			Body:   []byte("no SASL auth in progress for mech"),
+		}
+	}
+	return rh.doSaslMechStep(req.Body)
+}
+
+func (rh *reqHandler) doSaslMechStep(in []byte) *gomemcached.MCResponse {
+	out, user, done, err := rh.sasl.mech.step(in)
+	if err != nil {
+		rh.sasl.mech = nil
+		return &gomemcached.MCResponse{
+			Status: AUTH_ERROR,
+			Body:   []byte(err.Error()),
+		}
+	}
+	if !done {
+		return &gomemcached.MCResponse{
+			Status: AUTH_CONTINUE,
+			Body:   out,
+		}
+	}
+	rh.sasl.mech = nil
+	targetBucket := rh.buckets.Get(user)
+	if targetBucket == nil {
+		return &gomemcached.MCResponse{
+			Status: AUTH_ERROR,
+			Body:   []byte("not a bucket"),
+		}
+	}
+	rh.sasl.user = user
+	rh.currentBucket = targetBucket
+	rh.currentBucketName = user
+	return &gomemcached.MCResponse{Body: out}
+}
+
+func (rh *reqHandler) doSaslPlain(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Body) < 2 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+		}
+	}
+	targetUserPswd := bytes.Split(req.Body, []byte("\x00"))
+	if len(targetUserPswd) != 3 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("invalid SASL auth body"),
+		}
+	}
+	targetBucketName := string(targetUserPswd[1])
+	targetBucket := rh.buckets.Get(targetBucketName)
+	if targetBucket == nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("not a bucket"),
+		}
+	}
+	if !targetBucket.Auth(targetUserPswd[2]) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("failed auth"),
+		}
+	}
+	rh.sasl.user = targetBucketName
+	rh.currentBucket = targetBucket
+	rh.currentBucketName = targetBucketName
+	return &gomemcached.MCResponse{}
+}
+
+func saslNonce() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+var errSaslFailed = errors.New("failed auth")
+
+// CRAM-MD5, from RFC 2195, which needs the cleartext password, so
+// it only works for buckets whose passwords aren't hashed.
+type saslCramMD5 struct {
+	buckets   *Buckets
+	challenge []byte
+}
+
+func newSaslCramMD5(bs *Buckets) saslMech {
+	return &saslCramMD5{buckets: bs}
+}
+
+func (m *saslCramMD5) step(in []byte) ([]byte, string, bool, error) {
+	if m.challenge == nil {
+		m.challenge = []byte(fmt.Sprintf("<%v.%v@cbgb>",
+			saslNonce(), time.Now().Unix()))
+		return m.challenge, "", false, nil
+	}
+	sp := bytes.LastIndex(in, []byte(" "))
+	if sp < 0 {
+		return nil, "", false, errors.New("invalid CRAM-MD5 response")
+	}
+	user, digest := string(in[:sp]), in[sp+1:]
+	b := m.buckets.Get(user)
+	if b == nil {
+		return nil, "", false, errSaslFailed
+	}
+	bs := b.GetBucketSettings()
+	if bs.PasswordHashFunc != "" || bs.PasswordSalt != "" {
+		return nil, "", false, errors.New("CRAM-MD5 needs a cleartext password")
+	}
+	h := hmac.New(md5.New, []byte(bs.PasswordHash))
+	h.Write(m.challenge)
+	exp := []byte(hex.EncodeToString(h.Sum(nil)))
+	if !hmac.Equal(exp, digest) {
+		return nil, "", false, errSaslFailed
+	}
+	return nil, user, true, nil
+}
+
+// SCRAM-SHA-256, from RFC 5802 and RFC 7677, without channel
+// binding.  Buckets with SCRAM-SHA256 hashed passwords keep their
+// salt, and only the StoredKey and ServerKey are known to the server.
+type saslScramSHA256 struct {
+	buckets *Buckets
+
+	user            string
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	storedKey       []byte
+	serverKey       []byte
+}
+
+func newSaslScramSHA256(bs *Buckets) saslMech {
+	return &saslScramSHA256{buckets: bs}
+}
+
+func scramHMAC(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// Parses a SCRAM message's comma separated attribute=value pairs.
+func scramAttrs(s string) map[byte]string {
+	rv := map[byte]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) >= 2 && kv[1] == '=' {
+			rv[kv[0]] = kv[2:]
+		}
+	}
+	return rv
+}
+
+func (m *saslScramSHA256) step(in []byte) ([]byte, string, bool, error) {
+	if m.serverFirst == "" {
+		return m.stepFirst(string(in))
+	}
+	return m.stepFinal(string(in))
+}
+
+func (m *saslScramSHA256) stepFirst(in string) ([]byte, string, bool, error) {
+	// The gs2 header is "n,," or "y,,", as we don't do channel binding.
+	if !strings.HasPrefix(in, "n,,") && !strings.HasPrefix(in, "y,,") {
+		return nil, "", false, errors.New("unsupported SCRAM gs2 header")
+	}
+	m.gs2Header, m.clientFirstBare = in[:3], in[3:]
+	attrs := scramAttrs(m.clientFirstBare)
+	user, cnonce := attrs['n'], attrs['r']
+	if user == "" || cnonce == "" {
+		return nil, "", false, errors.New("invalid SCRAM client-first-message")
+	}
+	m.user = strings.Replace(strings.Replace(user, "=2C", ",", -1), "=3D", "=", -1)
+
+	b := m.buckets.Get(m.user)
+	if b == nil {
+		return nil, "", false, errSaslFailed
+	}
+	bs := b.GetBucketSettings()
+	var salt []byte
+	switch {
+	case bs.PasswordHashFunc == SCRAM_SHA256:
+		storedKey, serverKey, ok := scramKeysParse(bs.PasswordHash)
+		if !ok {
+			return nil, "", false, errSaslFailed
+		}
+		salt, m.storedKey, m.serverKey = []byte(bs.PasswordSalt), storedKey, serverKey
+	case bs.PasswordHashFunc == "" && bs.PasswordSalt == "":
+		salt = []byte(saslNonce())
+		m.storedKey, m.serverKey = scramKeys(pbkdf2.Key([]byte(bs.PasswordHash),
+			salt, pbkdf2Iterations, sha256.Size, sha256.New))
+	default:
+		return nil, "", false, errors.New("SCRAM-SHA-256 unsupported for password")
+	}
+
+	m.nonce = cnonce + saslNonce()
+	m.serverFirst = fmt.Sprintf("r=%v,s=%v,i=%v", m.nonce,
+		base64.StdEncoding.EncodeToString(salt), pbkdf2Iterations)
+	return []byte(m.serverFirst), "", false, nil
+}
+
+func (m *saslScramSHA256) stepFinal(in string) ([]byte, string, bool, error) {
+	i := strings.LastIndex(in, ",p=")
+	if i < 0 {
+		return nil, "", false, errors.New("invalid SCRAM client-final-message")
+	}
+	withoutProof := in[:i]
+	attrs := scramAttrs(withoutProof)
+	if attrs['c'] != base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) {
+		return nil, "", false, errors.New("SCRAM channel binding mismatch")
+	}
+	if attrs['r'] != m.nonce {
+		return nil, "", false, errors.New("SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(in[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, "", false, errors.New("invalid SCRAM client proof")
+	}
+
+	authMessage := m.clientFirstBare + "," + m.serverFirst + "," + withoutProof
+
+	// The ClientKey is recovered from the proof, and its hash must
+	// be the StoredKey.
+	clientSignature := scramHMAC(m.storedKey, authMessage)
+	for j := range proof {
+		proof[j] ^= clientSignature[j]
+	}
+	clientKeyHash := sha256.Sum256(proof)
+	if !hmac.Equal(clientKeyHash[:], m.storedKey) {
+		return nil, "", false, errSaslFailed
+	}
+
+	serverSignature := scramHMAC(m.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)),
+		m.user, true, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Drives SASL exchanges through handleMessage, like a client would.
+type saslTestConn struct {
+	t  *testing.T
+	rh *reqHandler
+}
+
+func (c *saslTestConn) send(op gomemcached.CommandCode, mech string,
+	body string) *gomemcached.MCResponse {
+	req := &gomemcached.MCRequest{
+		Opcode: op,
+		Key:    []byte(mech),
+		Body:   []byte(body),
+		Opaque: 123,
+	}
+	out := &bytes.Buffer{}
+	if err := handleMessage(out, bytes.NewReader(req.Bytes()), c.rh); err != nil {
+		c.t.Fatalf("expected handleMessage to work, err: %v", err)
+	}
+	res, err := readTapAck(out)
+	if err != nil {
+		c.t.Fatalf("expected a response, err: %v", err)
+	}
+	if res.Opcode != op || res.Opaque != 123 {
+		c.t.Errorf("expected response to match request, got: %v", res)
+	}
+	return res
+}
+
+func (c *saslTestConn) cramMD5(user, password string) *gomemcached.MCResponse {
+	res := c.send(gomemcached.SASL_AUTH, "CRAM-MD5", "")
+	if res.Status != AUTH_CONTINUE || len(res.Body) == 0 {
+		c.t.Fatalf("expected a CRAM-MD5 challenge, got: %v", res)
+	}
+	h := hmac.New(md5.New, []byte(password))
+	h.Write(res.Body)
+	return c.send(gomemcached.SASL_STEP, "CRAM-MD5",
+		user+" "+hex.EncodeToString(h.Sum(nil)))
+}
+
+// Returns the final response and the server signature it should have.
+func (c *saslTestConn) scramSHA256(user, password string) (
+	*gomemcached.MCResponse, string) {
+	cnonce := "fyko+d2lbbFgONRv9qkxdawL"
+	clientFirstBare := "n=" + user + ",r=" + cnonce
+	res := c.send(gomemcached.SASL_AUTH, "SCRAM-SHA-256", "n,,"+clientFirstBare)
+	if res.Status != AUTH_CONTINUE {
+		return res, ""
+	}
+	serverFirst := string(res.Body)
+	attrs := scramAttrs(serverFirst)
+	nonce := attrs['r']
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	iter, err2 := strconv.Atoi(attrs['i'])
+	if !strings.HasPrefix(nonce, cnonce) || len(nonce) == len(cnonce) ||
+		err != nil || err2 != nil {
+		c.t.Fatalf("expected a server-first-message, got: %v", serverFirst)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iter, sha256.Size, sha256.New)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverSignature := scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+
+	return c.send(gomemcached.SASL_STEP, "SCRAM-SHA-256",
+			withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)),
+		"v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func testSaslBuckets(t *testing.T) (string, *Buckets, map[string]Bucket) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	buckets, err := NewBuckets(d, &BucketSettings{NumPartitions: 1})
+	if err != nil {
+		t.Fatalf("Expected NewBuckets to succeed: %v", err)
+	}
+	hashed := &BucketSettings{NumPartitions: 1}
+	hashed.SetPassword("pencil")
+	settings := map[string]*BucketSettings{
+		"hashed": hashed,
+		"clear":  &BucketSettings{NumPartitions: 1, PasswordHash: "pencil"},
+		"nopwd":  &BucketSettings{NumPartitions: 1},
+	}
+	rv := map[string]Bucket{}
+	for name, bs := range settings {
+		if rv[name], err = buckets.New(name, bs); err != nil {
+			t.Fatalf("Expected New bucket to succeed: %v", err)
+		}
+	}
+	return d, buckets, rv
+}
+
+func TestSaslScramSHA256(t *testing.T) {
+	d, buckets, bs := testSaslBuckets(t)
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+
+	tests := []struct {
+		user, password string
+		exp            gomemcached.Status
+	}{
+		{"hashed", "pencil", gomemcached.SUCCESS},
+		{"hashed", "wrong", AUTH_ERROR},
+		{"clear", "pencil", gomemcached.SUCCESS},
+		{"clear", "wrong", AUTH_ERROR},
+		{"nopwd", "", gomemcached.SUCCESS},
+		{"nopwd", "pencil", AUTH_ERROR},
+		{"notabucket", "pencil", AUTH_ERROR},
+	}
+
+	for _, test := range tests {
+		c := &saslTestConn{t, &reqHandler{buckets: buckets}}
+		res, serverFinal := c.scramSHA256(test.user, test.password)
+		if res.Status != test.exp {
+			t.Errorf("expected %v for %v/%v, got: %v",
+				test.exp, test.user, test.password, res)
+		}
+		if test.exp != gomemcached.SUCCESS {
+			if c.rh.currentBucket != nil {
+				t.Errorf("expected no auth for %v/%v, got: %#v",
+					test.user, test.password, c.rh)
+			}
+			continue
+		}
+		if string(res.Body) != serverFinal {
+			t.Errorf("expected server-final %v, got: %s", serverFinal, res.Body)
+		}
+		if c.rh.currentBucket != bs[test.user] ||
+			c.rh.currentBucketName != test.user {
+			t.Errorf("expected auth as %v, got: %#v", test.user, c.rh)
+		}
+	}
+}
+
+func TestSaslScramSHA256RFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	m := &saslScramSHA256{
+		user:            "user",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+			"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	}
+	m.storedKey, m.serverKey = scramKeys(pbkdf2.Key([]byte("pencil"),
+		salt, 4096, sha256.Size, sha256.New))
+	out, user, done, err := m.step([]byte(
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+			"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	if err != nil || !done || user != "user" {
+		t.Fatalf("expected RFC 7677 exchange to work, got: %v, %v, %v",
+			user, done, err)
+	}
+	if string(out) != "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Errorf("expected RFC 7677 server-final-message, got: %s", out)
+	}
+}
+
+func TestSaslCramMD5(t *testing.T) {
+	d, buckets, bs := testSaslBuckets(t)
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+
+	c := &saslTestConn{t, &reqHandler{buckets: buckets}}
+	if res := c.cramMD5("clear", "wrong"); res.Status != AUTH_ERROR {
+		t.Errorf("expected CRAM-MD5 with wrong password to fail, got: %v", res)
+	}
+	// CRAM-MD5 needs the cleartext password.
+	if res := c.cramMD5("hashed", "pencil"); res.Status != AUTH_ERROR {
+		t.Errorf("expected CRAM-MD5 with hashed password to fail, got: %v", res)
+	}
+	if c.rh.currentBucket != nil {
+		t.Errorf("expected no auth, got: %#v", c.rh)
+	}
+	if res := c.cramMD5("clear", "pencil"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected CRAM-MD5 to work, got: %v", res)
+	}
+	if c.rh.currentBucket != bs["clear"] || c.rh.currentBucketName != "clear" {
+		t.Errorf("expected auth as clear, got: %#v", c.rh)
+	}
+
+	// A failed auth leaves the connection's auth and bucket as is.
+	if res := c.cramMD5("nopwd", "wrong"); res.Status != AUTH_ERROR {
+		t.Errorf("expected CRAM-MD5 to fail, got: %v", res)
+	}
+	if c.rh.currentBucket != bs["clear"] || c.rh.currentBucketName != "clear" ||
+		c.rh.sasl.user != "clear" {
+		t.Errorf("expected auth to still be clear, got: %#v", c.rh)
+	}
+}
+
+func TestSaslUser(t *testing.T) {
+	d, buckets, bs := testSaslBuckets(t)
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+
+	// Selecting a bucket, like the default bucket, isn't authenticating.
+	c := &saslTestConn{t, &reqHandler{buckets: buckets,
+		currentBucket: bs["nopwd"], currentBucketName: "nopwd"}}
+	if c.rh.authedAsCurrentBucket() {
+		t.Errorf("expected no authenticated user, got: %#v", c.rh)
+	}
+	if res := c.send(gomemcached.SASL_AUTH, "PLAIN", "\x00nopwd\x00"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected PLAIN to work, got: %v", res)
+	}
+	if c.rh.sasl.user != "nopwd" || !c.rh.authedAsCurrentBucket() {
+		t.Errorf("expected auth as nopwd, got: %#v", c.rh)
+	}
+	if res := c.send(gomemcached.SASL_AUTH, "PLAIN", "\x00hashed\x00wrong"); res.Status == gomemcached.SUCCESS {
+		t.Errorf("expected PLAIN with wrong password to fail, got: %v", res)
+	}
+	if c.rh.sasl.user != "nopwd" || !c.rh.authedAsCurrentBucket() {
+		t.Errorf("expected auth to still be nopwd, got: %#v", c.rh)
+	}
+}
+
+func TestSaslStep(t *testing.T) {
+	d, buckets, _ := testSaslBuckets(t)
+	defer os.RemoveAll(d)
+	defer buckets.CloseAll()
+
+	c := &saslTestConn{t, &reqHandler{buckets: buckets}}
+	if res := c.send(gomemcached.SASL_LIST_MECHS, "", ""); string(res.Body) != "PLAIN SCRAM-SHA-256" {
+		t.Errorf("expected only mechs that work for every bucket, got: %v", res)
+	}
+	if res := c.send(gomemcached.SASL_STEP, "CRAM-MD5", "x y"); res.Status != AUTH_ERROR {
+		t.Errorf("expected SASL_STEP without SASL_AUTH to fail, got: %v", res)
+	}
+	res := c.send(gomemcached.SASL_AUTH, "CRAM-MD5", "")
+	if res.Status != AUTH_CONTINUE {
+		t.Fatalf("expected a CRAM-MD5 challenge, got: %v", res)
+	}
+	if res = c.send(gomemcached.SASL_STEP, "SCRAM-SHA-256", "x"); res.Status != AUTH_ERROR {
+		t.Errorf("expected SASL_STEP for another mech to fail, got: %v", res)
+	}
+	if res = c.send(gomemcached.SASL_AUTH, "SCRAM-SHA-256", "p=tls-unique,,n=clear,r=abc"); res.Status != AUTH_ERROR {
+		t.Errorf("expected SCRAM channel binding to fail, got: %v", res)
+	}
+	if res = c.send(gomemcached.SASL_AUTH, "DIGEST-MD5", ""); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected unknown mech to fail, got: %v", res)
+	}
+}
@@ -13,8 +13,6 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
 	"io"
 	"log"
 	"net"
@@ -33,6 +31,7 @@ type reqHandler struct {
 	buckets           *Buckets
 	currentBucket     Bucket
 	currentBucketName string
+	sasl              saslAuth
 }
 
 func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
@@ -56,45 +55,12 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 			}
 		}
 		return &gomemcached.MCResponse{
-			Body: []byte("PLAIN"),
+			Body: []byte(saslMechs),
 		}
 	case gomemcached.SASL_AUTH:
-		if req.VBucket != 0 || req.Cas != 0 ||
-			len(req.Extras) != 0 || len(req.Body) < 2 {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-			}
-		}
-		if !bytes.Equal(req.Key, []byte("PLAIN")) {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte(fmt.Sprintf("unsupported SASL auth mech: %v", req.Key)),
-			}
-		}
-		targetUserPswd := bytes.Split(req.Body, []byte("\x00"))
-		if len(targetUserPswd) != 3 {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("invalid SASL auth body"),
-			}
-		}
-		targetBucketName := string(targetUserPswd[1])
-		targetBucket := rh.buckets.Get(targetBucketName)
-		if targetBucket == nil {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("not a bucket"),
-			}
-		}
-		if !targetBucket.Auth(targetUserPswd[2]) {
-			return &gomemcached.MCResponse{
-				Status: gomemcached.EINVAL,
-				Body:   []byte("failed auth"),
-			}
-		}
-		rh.currentBucket = targetBucket
-		rh.currentBucketName = targetBucketName
-		return &gomemcached.MCResponse{}
+		return rh.doSaslAuth(req)
+	case gomemcached.SASL_STEP:
+		return rh.doSaslStep(req)
 	}
 
 	if rh.currentBucket == nil {
@@ -118,6 +84,24 @@ func (rh *reqHandler) HandleMessage(w io.Writer, r io.Reader,
 	case gomemcached.TAP_CONNECT:
 		chpkt, cherr := transmitPackets(w)
 		return doTap(rh.currentBucket, req, r, chpkt, cherr)
+	case UPR_OPEN:
+		if !rh.authedAsCurrentBucket() {
+			return &gomemcached.MCResponse{
+				Status: AUTH_ERROR,
+				Body:   []byte("upr needs SASL auth as the bucket"),
+			}
+		}
+		chpkt, cherr := transmitPackets(w)
+		return doUpr(rh.currentBucket, req, r, chpkt, cherr)
+	case gomemcached.TAP_MUTATION, gomemcached.TAP_DELETE,
+		gomemcached.TAP_VBUCKET_SET, gomemcached.TAP_OPAQUE:
+		if !rh.authedAsCurrentBucket() {
+			return &gomemcached.MCResponse{
+				Status: AUTH_ERROR,
+				Body:   []byte("tap receive needs SASL auth as the bucket"),
+			}
+		}
+		return doTapReceive(rh.currentBucket, w, req)
 	case gomemcached.STAT:
 		err := doStats(rh.currentBucket, w, string(req.Key))
 		if err != nil {
@@ -148,10 +132,21 @@ func doObserve(b Bucket, req *gomemcached.MCRequest) *gomemcached.MCResponse {
 		return &gomemcached.MCResponse{Status: gomemcached.EINVAL,
 			Body: []byte(err.Error())}
 	}
-	// XXX:  Fake observe
+	now := time.Now()
 	res := []obsStatus{}
 	for _, k := range keys {
-		res = append(res, obsStatus{k, obsPersisted, 0})
+		vb, _ := b.GetVBucket(k.vbid)
+		if vb == nil || vb.GetVBState() == VBDead {
+			return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+		}
+		state, cas, err := observeKey(vb, k.key, now)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(err.Error()),
+			}
+		}
+		res = append(res, obsStatus{k, state, cas})
 	}
 
 	return &gomemcached.MCResponse{Body: encodeObserveBody(res)}
@@ -162,6 +157,11 @@ func sessionLoop(s io.ReadWriteCloser, addr string, handler *reqHandler,
 	defer s.Close()
 	defer doneFun()
 
+	if err := handler.doTLSAuth(s); err != nil {
+		log.Printf("error: sessionLoop tls, addr: %v, err: %v", addr, err)
+		return
+	}
+
 	var err error
 	for err == nil {
 		err = handleMessage(s, s, handler)
@@ -189,7 +189,8 @@ func handleMessage(w io.Writer, r io.Reader, handler *reqHandler) error {
 }
 
 func waitForConnections(ls net.Listener, maxConns int, buckets *Buckets,
-	defaultBucketName string) {
+	defaultBucketName string, session func(s io.ReadWriteCloser,
+		addr string, handler *reqHandler, doneFun func())) {
 	closech := make(chan bool)
 
 	for {
@@ -208,7 +209,7 @@ func waitForConnections(ls net.Listener, maxConns int, buckets *Buckets,
 				currentBucket:     buckets.Get(defaultBucketName),
 				currentBucketName: defaultBucketName,
 			}
-			go sessionLoop(s, s.RemoteAddr().String(), handler,
+			go session(s, s.RemoteAddr().String(), handler,
 				func() {
 					atomic.AddInt64(&serverStats.ClosedConns, 1)
 					open := atomic.AddInt64(&serverStats.OpenConns, -1)
@@ -233,7 +234,8 @@ func StartServer(addr string, maxConns int, buckets *Buckets,
 		return nil, err
 	}
 
-	go waitForConnections(ls, maxConns, buckets, defaultBucketName)
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		sessionLoop)
 	return ls, nil
 }
 
@@ -270,10 +272,12 @@ func SetItem(b Bucket, key []byte, val []byte,
 	if vb == nil {
 		return nil
 	}
-	return vbMutate(vb, nil, &gomemcached.MCRequest{
-		Opcode:  gomemcached.SET,
-		VBucket: vb.vbid,
-		Key:     key,
-		Body:    val,
+	return vb.clientMutation(vbs, func() *gomemcached.MCResponse {
+		return vbMutate(vb, nil, &gomemcached.MCRequest{
+			Opcode:  gomemcached.SET,
+			VBucket: vb.vbid,
+			Key:     key,
+			Body:    val,
+		})
 	})
 }
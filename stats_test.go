@@ -329,7 +329,8 @@ func TestStatsSub(t *testing.T) {
 		IncomingValueBytes: 1,
 		OutgoingValueBytes: 1,
 
-		StoreErrors: 1,
+		StoreErrors:  1,
+		LockedErrors: 1,
 	}
 
 	s2 := &BucketStats{}
@@ -19,23 +19,75 @@ var persistPeriodic *periodically
 type bucketstore struct {
 	name          string
 	dirtiness     int64          // To track when we need flush to storage.
+	dirtyBytes    int64          // The bytes of the dirty changes.
+	flushing      int32          // Set while a policy flush runs.
+	persisting    int32          // Set while a flush for waiters is pending.
 	bsf           unsafe.Pointer // *bucketstorefile
 	bsfMemoryOnly *bucketstorefile
 	endch         chan bool
 	partitions    map[uint16]*partitionstore
 	stats         *BucketStoreStats
+	compression   uint8 // The datatype that values are compressed to.
+
+	encrypted     bool   // Whether new files are encrypted.
+	encryptionKey string // The source of the encryption keys.
+
+	dict    unsafe.Pointer // *valueDict that values are compressed with.
+	dicts   []*valueDict   // Acquired dictionaries, released on Close.
+	dictSeq uint64         // The COLL_DICTS key of the current dict.
+
+	policy  storePolicy
+	pushLog func(msg string) // Where policy decisions are logged, if set.
+
+	taskLock sync.Mutex
+	tasks    map[string]*storeTask // The latest policy task of each type.
 
 	keyCompareForCollection func(collName string) gkvlite.KeyCompare
 
+	flushLock sync.Mutex
+	flush     *flushSignal // Signaled by the next flush.
+
 	diskLock sync.Mutex
 }
 
+// A flushSignal is done when a flush ends, with the flush's error.
+type flushSignal struct {
+	done chan struct{}
+	err  error
+}
+
+// Returns the signal of the next flush to end.
+func (s *bucketstore) nextFlush() *flushSignal {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	return s.flush
+}
+
+func (s *bucketstore) signalFlush(err error) {
+	s.flushLock.Lock()
+	f := s.flush
+	s.flush = &flushSignal{done: make(chan struct{})}
+	s.flushLock.Unlock()
+	f.err = err
+	close(f.done)
+}
+
 func newBucketStore(name, path string, settings BucketSettings,
 	keyCompareForCollection func(collName string) gkvlite.KeyCompare) (
 	res *bucketstore, err error) {
+	policy, err := newStorePolicy(&settings)
+	if err != nil {
+		return nil, err
+	}
+
 	var file FileLike
 	if settings.MemoryOnly < MemoryOnly_LEVEL_PERSIST_NOTHING {
-		file, err = fileService.OpenFile(path, os.O_RDWR|os.O_CREATE)
+		keys, err := settings.cryptKeys()
+		if err != nil {
+			return nil, err
+		}
+		file, err = openStoreFile(path, os.O_RDWR|os.O_CREATE, keys,
+			settings.Encrypted)
 		if err != nil {
 			fmt.Printf("!!!! %v\n", err)
 			return nil, err
@@ -63,15 +115,42 @@ func newBucketStore(name, path string, settings BucketSettings,
 		}
 	}
 
-	return &bucketstore{
+	rv := &bucketstore{
 		name:          name,
 		bsf:           unsafe.Pointer(bsf),
 		bsfMemoryOnly: bsfMemoryOnly,
 		endch:         make(chan bool),
 		partitions:    make(map[uint16]*partitionstore),
 		stats:         bsf.stats,
+		compression:   compressions[settings.Compression],
+		encrypted:     settings.Encrypted,
+		encryptionKey: settings.EncryptionKey,
+		policy:        policy,
+		tasks:         make(map[string]*storeTask),
+		flush:         &flushSignal{done: make(chan struct{})},
 		keyCompareForCollection: keyCompareForCollection,
-	}, nil
+	}
+	if file != nil {
+		if err = rv.loadValueDicts(); err != nil {
+			rv.releaseValueDicts()
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// Opens a file of the store, encrypted with the current key if the
+// store is encrypted.  The keys are reloaded on each open, so that a
+// rotated key is used by the next compaction.
+func (s *bucketstore) openFile(path string, mode int) (FileLike, error) {
+	var keys *cryptKeys
+	if s.encryptionKey != "" {
+		var err error
+		if keys, err = loadCryptKeys(s.encryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	return openStoreFile(path, mode, keys, s.encrypted)
 }
 
 func (s *bucketstore) BSF() *bucketstorefile {
@@ -88,11 +167,18 @@ func (s *bucketstore) BSFData() *bucketstorefile {
 	return (*bucketstorefile)(atomic.LoadPointer(&s.bsf))
 }
 
+// Returns whether item values are flushed to a file, so that they may
+// be evicted from memory.
+func (s *bucketstore) persistsData() bool {
+	return s.bsfMemoryOnly == nil && s.BSF().file != nil
+}
+
 func (s *bucketstore) Close() {
 	select {
 	case <-s.endch:
 	default:
 		close(s.endch)
+		s.releaseValueDicts()
 	}
 }
 
@@ -121,27 +207,45 @@ func (s *bucketstore) Flush() (int64, error) {
 
 func (s *bucketstore) flush_unlocked() (int64, error) {
 	d := atomic.LoadInt64(&s.dirtiness)
+	db := atomic.LoadInt64(&s.dirtyBytes)
 	bsf := s.BSF()
 	if bsf.file != nil {
-		if err := bsf.store.Flush(); err != nil {
+		// Items set before the flush are clean once it succeeds.
+		flushCas := make(map[*partitionstore]uint64, len(s.partitions))
+		for _, p := range s.partitions {
+			flushCas[p] = p.startFlush()
+		}
+		err := bsf.store.Flush()
+		if err == nil {
+			if s.policy.fsync {
+				err = bsf.Sync()
+			} else {
+				err = bsf.flushFile()
+			}
+		}
+		if err != nil {
+			for p := range flushCas {
+				p.flushFailed()
+			}
 			atomic.AddInt64(&s.stats.FlushErrors, 1)
+			s.signalFlush(err)
 			return atomic.LoadInt64(&s.dirtiness), err
 		}
+		for p, cas := range flushCas {
+			p.notePersisted(cas)
+		}
 	} // else, we're in memory-only mode.
 	atomic.AddInt64(&s.stats.Flushes, 1)
+	s.signalFlush(nil)
 
 	sendEvent(s.name, "stats", s.Stats())
+	atomic.AddInt64(&s.dirtyBytes, -db)
 	return atomic.AddInt64(&s.dirtiness, -d), nil
 }
 
-func (s *bucketstore) periodicPersist(time.Time) bool {
+func (s *bucketstore) periodicPersist(t time.Time) bool {
 	d, _ := s.Flush()
-	if s.stats.Writes-s.stats.LastCompactAt > int64(*compactEvery) {
-		s.stats.LastCompactAt = s.stats.Writes
-		if err := s.Compact(); err != nil {
-			log.Printf("compact err: %v", err)
-		}
-	}
+	s.maybeCompact(t)
 	if d > 0 {
 		log.Printf("flushed all but %v items (retrying)", d)
 	}
@@ -154,14 +258,20 @@ func (s *bucketstore) mkPersistFun() func(time.Time) bool {
 	}
 }
 
-func (s *bucketstore) dirty(force bool) {
+// Notes a dirty change of n bytes, which is flushed periodically, or
+// sooner when the policy says there's too much dirty data, or within
+// the group commit delay under "group" durability.
+func (s *bucketstore) dirty(force bool, n int64) {
 	if force || s.bsfMemoryOnly == nil {
+		atomic.AddInt64(&s.dirtyBytes, n)
 		newval := atomic.AddInt64(&s.dirtiness, 1)
 		if newval == 1 {
-			// TODO: Might want to kick off a persistence right now
-			// rather than only schedule a periodic persistence.
 			persistPeriodic.Register(s.endch, s.mkPersistFun())
 		}
+		s.maybeKickFlush()
+		if s.policy.groupCommit > 0 {
+			s.kickPersist()
+		}
 	}
 }
 
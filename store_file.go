@@ -95,6 +95,30 @@ func (bsf *bucketstorefile) Truncate(size int64) (err error) {
 	return err
 }
 
+func (bsf *bucketstorefile) Sync() (err error) {
+	bsf.apply(func() {
+		atomic.AddInt64(&bsf.stats.Syncs, 1)
+		err = bsf.file.Sync()
+		if err != nil {
+			atomic.AddInt64(&bsf.stats.SyncErrors, 1)
+		}
+	})
+	return err
+}
+
+// Hands writes the file buffers, like an encrypted file's tail, to
+// the OS, for flushes that don't sync.
+func (bsf *bucketstorefile) flushFile() (err error) {
+	if f, ok := bsf.file.(interface {
+		Flush() error
+	}); ok {
+		bsf.apply(func() {
+			err = f.Flush()
+		})
+	}
+	return err
+}
+
 // Remove previous version files.
 func (bsf *bucketstorefile) removeOldFiles() error {
 	fname := filepath.Base(bsf.path)
@@ -0,0 +1,319 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Files smaller than this aren't compacted for fragmentation, as
+// their tree nodes alone are a large part of them.
+var minCompactFileSize = int64(1024 * 1024)
+
+// A storePolicy decides when a bucketstore flushes and compacts based
+// on its activity, beyond the persistPeriodic timer and the
+// -compact-every write count.
+type storePolicy struct {
+	flushDirtyItems         int64
+	flushDirtyBytes         int64
+	compactFragmentationPct int
+	window                  compactWindow
+
+	fsync       bool          // Whether flushes are fsync'ed.
+	groupCommit time.Duration // How long persistence waiters are batched.
+}
+
+// The BucketSettings.Durability modes.
+const (
+	DURABILITY_NONE  = "none"
+	DURABILITY_FSYNC = "fsync"
+	DURABILITY_GROUP = "group"
+)
+
+// The group commit delay of "group" durability when GroupCommitMs
+// isn't set.
+var defaultGroupCommit = 10 * time.Millisecond
+
+func newStorePolicy(settings *BucketSettings) (storePolicy, error) {
+	window, err := parseCompactWindow(settings.CompactWindow)
+	p := storePolicy{
+		flushDirtyItems:         settings.FlushDirtyItems,
+		flushDirtyBytes:         settings.FlushDirtyBytes,
+		compactFragmentationPct: settings.CompactFragmentationPct,
+		window:                  window,
+	}
+	switch settings.Durability {
+	case "", DURABILITY_NONE:
+	case DURABILITY_FSYNC:
+		p.fsync = true
+	case DURABILITY_GROUP:
+		p.fsync = true
+		p.groupCommit = defaultGroupCommit
+		if settings.GroupCommitMs > 0 {
+			p.groupCommit = time.Duration(settings.GroupCommitMs) * time.Millisecond
+		}
+	default:
+		return p, fmt.Errorf("unknown durability: %q", settings.Durability)
+	}
+	if settings.GroupCommitMs < 0 {
+		return p, fmt.Errorf("bad groupCommitMs: %v", settings.GroupCommitMs)
+	}
+	return p, err
+}
+
+// Returns why a bucketstore with the given dirty items and bytes
+// should be flushed now, or "" when it needn't be.
+func (p storePolicy) flushReason(dirtyItems, dirtyBytes int64) string {
+	if p.flushDirtyItems > 0 && dirtyItems >= p.flushDirtyItems {
+		return fmt.Sprintf("%v dirty items", dirtyItems)
+	}
+	if p.flushDirtyBytes > 0 && dirtyBytes >= p.flushDirtyBytes {
+		return fmt.Sprintf("%v dirty bytes", dirtyBytes)
+	}
+	return ""
+}
+
+// Returns why a bucketstore should be compacted now, or "" when it
+// needn't be, given its writes since the last compaction and its
+// file and live data sizes.
+func (p storePolicy) compactReason(now time.Time, writes int64,
+	fileSize, liveSize int64) string {
+	if !p.window.contains(now) {
+		return ""
+	}
+	if writes > int64(*compactEvery) {
+		return fmt.Sprintf("%v writes", writes)
+	}
+	if p.compactFragmentationPct > 0 && fileSize >= minCompactFileSize {
+		if pct := fragmentationPct(fileSize, liveSize); pct >= p.compactFragmentationPct {
+			return fmt.Sprintf("%v%% fragmentation", pct)
+		}
+	}
+	return ""
+}
+
+// Returns the percentage of a file that's not live data, so 75 means
+// the file is 4 times the size of its live data.
+func fragmentationPct(fileSize, liveSize int64) int {
+	if fileSize <= 0 || liveSize >= fileSize {
+		return 0
+	}
+	return int((fileSize - liveSize) * 100 / fileSize)
+}
+
+// A compactWindow is a time of day range, in minutes after midnight,
+// which wraps past midnight when end is before start.  The zero
+// compactWindow is always open.
+type compactWindow struct {
+	start, end int
+}
+
+// Parses a window like "22:00-06:00", where "" means always.
+func parseCompactWindow(s string) (compactWindow, error) {
+	if s == "" {
+		return compactWindow{}, nil
+	}
+	var sh, sm, eh, em int
+	n, err := fmt.Sscanf(s, "%d:%d-%d:%d", &sh, &sm, &eh, &em)
+	if err != nil || n != 4 ||
+		sh < 0 || sh > 23 || sm < 0 || sm > 59 ||
+		eh < 0 || eh > 23 || em < 0 || em > 59 {
+		return compactWindow{}, fmt.Errorf("bad compact window: %q", s)
+	}
+	return compactWindow{sh*60 + sm, eh*60 + em}, nil
+}
+
+func (w compactWindow) contains(t time.Time) bool {
+	if w.start == w.end {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// A storeTask is a flush or compaction that a storePolicy started, as
+// listed by /pools/default/tasks.
+type storeTask struct {
+	Type      string    `json:"type"` // "flush" or "bucket_compaction".
+	Bucket    string    `json:"bucket"`
+	Status    string    `json:"status"` // "running", "completed" or "failed".
+	Reason    string    `json:"reason"`
+	StartedAt time.Time `json:"startedAt"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Records the status of the bucketstore's latest task of a type.
+func (s *bucketstore) setTask(typ, status, reason string,
+	startedAt time.Time, err error) {
+	t := &storeTask{
+		Type:      typ,
+		Bucket:    s.name,
+		Status:    status,
+		Reason:    reason,
+		StartedAt: startedAt,
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	s.taskLock.Lock()
+	s.tasks[typ] = t
+	s.taskLock.Unlock()
+}
+
+// Returns the latest policy task of each type, ordered by type.
+func (s *bucketstore) Tasks() []storeTask {
+	s.taskLock.Lock()
+	defer s.taskLock.Unlock()
+	rv := make([]storeTask, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		rv = append(rv, *t)
+	}
+	sort.Sort(storeTasksByType(rv))
+	return rv
+}
+
+type storeTasksByType []storeTask
+
+func (a storeTasksByType) Len() int           { return len(a) }
+func (a storeTasksByType) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a storeTasksByType) Less(i, j int) bool { return a[i].Type < a[j].Type }
+
+// Logs a policy decision, which also goes to the bucket's Logs().
+func (s *bucketstore) logPolicy(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("%v: %v", s.name, msg)
+	if s.pushLog != nil {
+		s.pushLog(msg)
+	}
+}
+
+// Flushes in the background, if a flush isn't already running,
+// when the policy says there's too much dirty data.
+func (s *bucketstore) maybeKickFlush() {
+	reason := s.policy.flushReason(atomic.LoadInt64(&s.dirtiness),
+		atomic.LoadInt64(&s.dirtyBytes))
+	if reason == "" || !atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.flushing, 0)
+		s.logPolicy("flushing, due to %v", reason)
+		startedAt := time.Now()
+		s.setTask("flush", "running", reason, startedAt, nil)
+		_, err := s.Flush()
+		if err != nil {
+			s.logPolicy("flush error: %v", err)
+			s.setTask("flush", "failed", reason, startedAt, err)
+			return
+		}
+		s.setTask("flush", "completed", reason, startedAt, nil)
+		s.maybeCompact(time.Now())
+	}()
+}
+
+// Flushes in the background after the group commit delay, so that
+// the mutations and persistence waiters in the meantime share a flush.
+func (s *bucketstore) kickPersist() {
+	if !atomic.CompareAndSwapInt32(&s.persisting, 0, 1) {
+		return // A flush is already coming.
+	}
+	go func() {
+		select {
+		case <-time.After(s.policy.groupCommit):
+		case <-s.endch:
+			return // Closed, so no mutation or waiter needs the flush.
+		}
+		// Waiters that come after this need the next flush.
+		atomic.StoreInt32(&s.persisting, 0)
+		s.Flush()
+	}()
+}
+
+// Blocks until a partition's keyed items up to the cas are persisted,
+// including those with older CAS's made after later ones, returning
+// the persisted cas, or an error when a flush fails or the timeout
+// passes first.
+func (s *bucketstore) waitPersisted(p *partitionstore, cas uint64,
+	timeout time.Duration) (uint64, error) {
+	deadline := time.After(timeout)
+	for {
+		f := s.nextFlush() // Before the check, so no flush is missed.
+		persistedCas := p.persistedSeqno()
+		if persistedCas >= cas {
+			return persistedCas, nil
+		}
+		s.kickPersist()
+		select {
+		case <-f.done:
+			if f.err != nil {
+				return persistedCas, f.err
+			}
+		case <-deadline:
+			return persistedCas, fmt.Errorf("persistence timeout, cas: %v", cas)
+		case <-s.endch:
+			return persistedCas, fmt.Errorf("bucketstore closed: %v", s.name)
+		}
+	}
+}
+
+// Compacts when the policy says it's time, returning whether it did.
+func (s *bucketstore) maybeCompact(now time.Time) bool {
+	if s.BSF().file == nil {
+		return false
+	}
+	writes := atomic.LoadInt64(&s.stats.Writes) -
+		atomic.LoadInt64(&s.stats.LastCompactAt)
+	bss := s.Stats()
+	reason := s.policy.compactReason(now, writes, bss.FileSize, s.liveSize())
+	if reason == "" {
+		return false
+	}
+	atomic.StoreInt64(&s.stats.LastCompactAt, atomic.LoadInt64(&s.stats.Writes))
+	s.logPolicy("compacting, due to %v", reason)
+	s.setTask("bucket_compaction", "running", reason, now, nil)
+	if err := s.Compact(); err != nil {
+		s.logPolicy("compact error: %v", err)
+		s.setTask("bucket_compaction", "failed", reason, now, err)
+		return true
+	}
+	s.setTask("bucket_compaction", "completed", reason, now, nil)
+	return true
+}
+
+// Returns the bytes of the items and keys of the partitions, which a
+// compacted file would need.
+func (s *bucketstore) liveSize() (rv int64) {
+	s.diskLock.Lock()
+	partitions := make([]*partitionstore, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		partitions = append(partitions, p)
+	}
+	s.diskLock.Unlock()
+	for _, p := range partitions {
+		keys, changes := p.colls()
+		if _, n, err := keys.GetTotals(); err == nil {
+			rv += int64(n)
+		}
+		if _, n, err := changes.GetTotals(); err == nil {
+			rv += int64(n)
+		}
+	}
+	return rv
+}
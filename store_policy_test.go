@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestParseCompactWindow(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp compactWindow
+		err bool
+	}{
+		{"", compactWindow{}, false},
+		{"22:00-06:30", compactWindow{22 * 60, 6*60 + 30}, false},
+		{"01:15-02:00", compactWindow{75, 120}, false},
+		{"24:00-01:00", compactWindow{}, true},
+		{"01:60-02:00", compactWindow{}, true},
+		{"01:00", compactWindow{}, true},
+		{"bogus", compactWindow{}, true},
+	}
+	for i, test := range tests {
+		w, err := parseCompactWindow(test.s)
+		if (err != nil) != test.err || w != test.exp {
+			t.Errorf("test #%v, expected %v, %v for %q, got: %v, %v",
+				i, test.exp, test.err, test.s, w, err)
+		}
+	}
+}
+
+func TestCompactWindowContains(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2013, 5, 1, h, m, 0, 0, time.Local)
+	}
+	tests := []struct {
+		w   string
+		t   time.Time
+		exp bool
+	}{
+		{"", at(12, 0), true},
+		{"01:00-02:00", at(1, 0), true},
+		{"01:00-02:00", at(1, 59), true},
+		{"01:00-02:00", at(2, 0), false},
+		{"01:00-02:00", at(0, 59), false},
+		{"22:00-06:00", at(23, 0), true},
+		{"22:00-06:00", at(5, 59), true},
+		{"22:00-06:00", at(6, 0), false},
+		{"22:00-06:00", at(12, 0), false},
+	}
+	for i, test := range tests {
+		w, _ := parseCompactWindow(test.w)
+		if got := w.contains(test.t); got != test.exp {
+			t.Errorf("test #%v, expected %v for %v at %v, got: %v",
+				i, test.exp, test.w, test.t, got)
+		}
+	}
+}
+
+func TestStorePolicyFlushReason(t *testing.T) {
+	p := storePolicy{flushDirtyItems: 10, flushDirtyBytes: 1000}
+	if r := p.flushReason(9, 999); r != "" {
+		t.Errorf("expected no flush, got: %v", r)
+	}
+	if r := p.flushReason(10, 0); r != "10 dirty items" {
+		t.Errorf("expected a dirty items flush, got: %v", r)
+	}
+	if r := p.flushReason(1, 1000); r != "1000 dirty bytes" {
+		t.Errorf("expected a dirty bytes flush, got: %v", r)
+	}
+	if r := (storePolicy{}).flushReason(1000000, 1000000); r != "" {
+		t.Errorf("expected no flush when off, got: %v", r)
+	}
+}
+
+func TestStorePolicyCompactReason(t *testing.T) {
+	if fragmentationPct(0, 0) != 0 || fragmentationPct(100, 200) != 0 ||
+		fragmentationPct(400, 100) != 75 {
+		t.Errorf("expected fragmentation percentages")
+	}
+
+	now := time.Date(2013, 5, 1, 12, 0, 0, 0, time.Local)
+	size := minCompactFileSize
+	p := storePolicy{compactFragmentationPct: 50}
+	if r := p.compactReason(now, 0, size, size/2+1); r != "" {
+		t.Errorf("expected no compaction, got: %v", r)
+	}
+	if r := p.compactReason(now, 0, size, size/2); r != "50% fragmentation" {
+		t.Errorf("expected a fragmentation compaction, got: %v", r)
+	}
+	if r := p.compactReason(now, 0, size-1, 0); r != "" {
+		t.Errorf("expected no compaction of a small file, got: %v", r)
+	}
+	writes := int64(*compactEvery) + 1
+	if r := p.compactReason(now, writes, 0, 0); r != strconv.FormatInt(writes, 10)+" writes" {
+		t.Errorf("expected a writes compaction, got: %v", r)
+	}
+	p.window, _ = parseCompactWindow("01:00-02:00")
+	if r := p.compactReason(now, writes, size, 0); r != "" {
+		t.Errorf("expected no compaction outside the window, got: %v", r)
+	}
+}
+
+func TestStorePolicyDurability(t *testing.T) {
+	tests := []struct {
+		durability    string
+		groupCommitMs int
+		fsync         bool
+		groupCommit   time.Duration
+	}{
+		{"", 0, false, 0},
+		{DURABILITY_NONE, 0, false, 0},
+		{DURABILITY_FSYNC, 0, true, 0},
+		{DURABILITY_GROUP, 0, true, defaultGroupCommit},
+		{DURABILITY_GROUP, 5, true, 5 * time.Millisecond},
+	}
+	for _, test := range tests {
+		p, err := newStorePolicy(&BucketSettings{
+			Durability:    test.durability,
+			GroupCommitMs: test.groupCommitMs,
+		})
+		if err != nil || p.fsync != test.fsync || p.groupCommit != test.groupCommit {
+			t.Errorf("expected policy for %#v, got: %#v, %v", test, p, err)
+		}
+	}
+	for _, bs := range []*BucketSettings{
+		{Durability: "always"},
+		{Durability: DURABILITY_GROUP, GroupCommitMs: -1},
+	} {
+		if _, err := newStorePolicy(bs); err == nil {
+			t.Errorf("expected policy for %#v to fail", bs)
+		}
+	}
+}
+
+func TestSeqnoPersistence(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: 1,
+			Durability:    DURABILITY_GROUP,
+			GroupCommitMs: 50,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	persist := func(cas uint64) *gomemcached.MCResponse {
+		req := &gomemcached.MCRequest{Opcode: SEQNO_PERSISTENCE}
+		if cas > 0 {
+			req.Extras = make([]byte, 8)
+			binary.BigEndian.PutUint64(req.Extras, cas)
+		}
+		return r0.HandleMessage(nil, nil, req)
+	}
+
+	var lastCas uint64
+	set := func() {
+		for i := 0; i < 5; i++ {
+			res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+				Opcode: gomemcached.SET,
+				Key:    []byte(strconv.Itoa(i)),
+				Body:   []byte("v"),
+			})
+			if res.Status != gomemcached.SUCCESS {
+				t.Fatalf("expected set to work, got: %v", res)
+			}
+			lastCas = res.Cas
+		}
+	}
+
+	// Mutations are group committed without any waiters.
+	set()
+	bs := b0.GetBucketStore(0)
+	vb, _ := b0.GetVBucket(0)
+	for i := 0; i < 100 && atomic.LoadUint64(&vb.ps.persistedCas) < lastCas; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&vb.ps.persistedCas) < lastCas {
+		t.Errorf("expected mutations to be group committed")
+	}
+	syncs := atomic.LoadInt64(&bs.stats.Syncs)
+	if syncs < 1 {
+		t.Errorf("expected an fsync'ed flush, got: %v", syncs)
+	}
+
+	// Concurrent waiters share the group commit.
+	set()
+	ress := make(chan *gomemcached.MCResponse, 3)
+	for i := 0; i < 3; i++ {
+		go func() { ress <- persist(lastCas) }()
+	}
+	for i := 0; i < 3; i++ {
+		if res := <-ress; res.Status != gomemcached.SUCCESS || res.Cas < lastCas {
+			t.Errorf("expected persistence of %v, got: %v", lastCas, res)
+		}
+	}
+	if n := atomic.LoadInt64(&bs.stats.Syncs) - syncs; n < 1 || n > 3 {
+		t.Errorf("expected fsync'ed flushes, got: %v", n)
+	}
+	if d := atomic.LoadInt64(&bs.dirtiness); d != 0 {
+		t.Errorf("expected no dirty items, got: %v", d)
+	}
+
+	if res := persist(0); res.Status != gomemcached.SUCCESS || res.Cas != lastCas {
+		t.Errorf("expected persistence of everything, got: %v", res)
+	}
+
+	res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("0"),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected delete to work, got: %v", res)
+	}
+	if res = persist(0); res.Status != gomemcached.SUCCESS || res.Cas <= lastCas {
+		t.Errorf("expected persistence of the delete, got: %v", res)
+	}
+
+	if res = persist(res.Cas + 100); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected an unknown cas to fail, got: %v", res)
+	}
+	res = r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+		Opcode: SEQNO_PERSISTENCE,
+		Extras: []byte{1},
+	})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected bad extras to fail, got: %v", res)
+	}
+}
+
+func TestStorePolicyFlush(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:   1,
+			FlushDirtyItems: 5,
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	for i := 0; i < 5; i++ {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(strconv.Itoa(i)),
+			Body:   []byte("v"),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+	}
+	bs := b0.GetBucketStore(0)
+	for i := 0; i < 100 && (atomic.LoadInt32(&bs.flushing) != 0 ||
+		atomic.LoadInt64(&bs.dirtiness) > 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := atomic.LoadInt64(&bs.dirtiness); d != 0 {
+		t.Errorf("expected the dirty items to be flushed, got: %v", d)
+	}
+	tasks := bs.Tasks()
+	if len(tasks) != 1 || tasks[0].Type != "flush" ||
+		tasks[0].Reason != "5 dirty items" {
+		t.Errorf("expected a flush task, got: %#v", tasks)
+	}
+	logs := b0.Logs()
+	if !strings.Contains(strings.Join(logs, "\n"), "flushing, due to 5 dirty items") {
+		t.Errorf("expected a flush log, got: %v", logs)
+	}
+}
+
+func TestStorePolicyCompact(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+
+	b0, err := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions:           1,
+			CompactFragmentationPct: 10,
+			CompactWindow:           "01:00-02:00",
+		})
+	if err != nil {
+		t.Fatalf("expected NewBucket to work, got: %v", err)
+	}
+	defer b0.Close()
+	b0.CreateVBucket(0)
+	b0.SetVBState(0, VBActive)
+
+	r0 := &reqHandler{currentBucket: b0}
+	for i := 0; i < 20; i++ {
+		res := r0.HandleMessage(nil, nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte("overwritten"),
+			Body:   []byte(strconv.Itoa(i)),
+		})
+		if res.Status != gomemcached.SUCCESS {
+			t.Fatalf("expected set to work, got: %v", res)
+		}
+		if err = b0.Flush(); err != nil {
+			t.Fatalf("expected Flush to work, got: %v", err)
+		}
+	}
+
+	defer func(n int64) { minCompactFileSize = n }(minCompactFileSize)
+	minCompactFileSize = 0
+
+	bs := b0.GetBucketStore(0)
+	outside := time.Date(2013, 5, 1, 12, 0, 0, 0, time.Local)
+	if bs.maybeCompact(outside) {
+		t.Errorf("expected no compaction outside the window")
+	}
+	inside := time.Date(2013, 5, 1, 1, 30, 0, 0, time.Local)
+	if !bs.maybeCompact(inside) {
+		t.Fatalf("expected a fragmented file to be compacted")
+	}
+	if bs.stats.Compacts != 1 {
+		t.Errorf("expected a compaction, got: %#v", bs.stats)
+	}
+	tasks := bs.Tasks()
+	if len(tasks) != 1 || tasks[0].Type != "bucket_compaction" ||
+		tasks[0].Status != "completed" ||
+		!strings.HasSuffix(tasks[0].Reason, "% fragmentation") {
+		t.Errorf("expected a compaction task, got: %#v", tasks)
+	}
+}
@@ -20,11 +20,29 @@ type BucketStoreStats struct {
 	StatErrors    int64 `json:"statErrors"`
 	CompactErrors int64 `json:"compactErrors"`
 
+	// Flushes that were fsync'ed, for the bucket's durability.
+	Syncs      int64 `json:"syncs"`
+	SyncErrors int64 `json:"syncErrors"`
+
 	ReadBytes  int64 `json:"readBytes"`
 	WriteBytes int64 `json:"writeBytes"`
 
 	FileSize   int64 `json:"fileSize"`
 	NodeAllocs int64 `json:"nodeAllocs"`
+
+	// Values that were compressed when persisted, and their bytes
+	// before and after, whose ratio is the CompressionRatio.
+	CompressedValues int64   `json:"compressedValues"`
+	CompressInBytes  int64   `json:"compressInBytes"`
+	CompressOutBytes int64   `json:"compressOutBytes"`
+	CompressionRatio float64 `json:"compressionRatio"`
+
+	// Dictionaries trained by compaction, and the values that it
+	// recompressed with them, with their bytes before and after.
+	DictTrainings      int64 `json:"dictTrainings"`
+	RecompressedValues int64 `json:"recompressedValues"`
+	RecompressInBytes  int64 `json:"recompressInBytes"`
+	RecompressOutBytes int64 `json:"recompressOutBytes"`
 }
 
 func (bss *BucketStoreStats) Add(in *BucketStoreStats) {
@@ -46,10 +64,23 @@ func (bss *BucketStoreStats) Op(in *BucketStoreStats, op func(int64, int64) int6
 	bss.WriteErrors = op(bss.WriteErrors, atomic.LoadInt64(&in.WriteErrors))
 	bss.StatErrors = op(bss.StatErrors, atomic.LoadInt64(&in.StatErrors))
 	bss.CompactErrors = op(bss.CompactErrors, atomic.LoadInt64(&in.CompactErrors))
+	bss.Syncs = op(bss.Syncs, atomic.LoadInt64(&in.Syncs))
+	bss.SyncErrors = op(bss.SyncErrors, atomic.LoadInt64(&in.SyncErrors))
 	bss.ReadBytes = op(bss.ReadBytes, atomic.LoadInt64(&in.ReadBytes))
 	bss.WriteBytes = op(bss.WriteBytes, atomic.LoadInt64(&in.WriteBytes))
 	bss.FileSize = op(bss.FileSize, atomic.LoadInt64(&in.FileSize))
 	bss.NodeAllocs = op(bss.NodeAllocs, atomic.LoadInt64(&in.NodeAllocs))
+	bss.CompressedValues = op(bss.CompressedValues, atomic.LoadInt64(&in.CompressedValues))
+	bss.CompressInBytes = op(bss.CompressInBytes, atomic.LoadInt64(&in.CompressInBytes))
+	bss.CompressOutBytes = op(bss.CompressOutBytes, atomic.LoadInt64(&in.CompressOutBytes))
+	bss.DictTrainings = op(bss.DictTrainings, atomic.LoadInt64(&in.DictTrainings))
+	bss.RecompressedValues = op(bss.RecompressedValues, atomic.LoadInt64(&in.RecompressedValues))
+	bss.RecompressInBytes = op(bss.RecompressInBytes, atomic.LoadInt64(&in.RecompressInBytes))
+	bss.RecompressOutBytes = op(bss.RecompressOutBytes, atomic.LoadInt64(&in.RecompressOutBytes))
+	bss.CompressionRatio = 0
+	if bss.CompressOutBytes > 0 {
+		bss.CompressionRatio = float64(bss.CompressInBytes) / float64(bss.CompressOutBytes)
+	}
 }
 
 func (bss *BucketStoreStats) Aggregate(in Aggregatable) {
@@ -70,8 +101,17 @@ func (bss *BucketStoreStats) Equal(in *BucketStoreStats) bool {
 		bss.WriteErrors == atomic.LoadInt64(&in.WriteErrors) &&
 		bss.StatErrors == atomic.LoadInt64(&in.StatErrors) &&
 		bss.CompactErrors == atomic.LoadInt64(&in.CompactErrors) &&
+		bss.Syncs == atomic.LoadInt64(&in.Syncs) &&
+		bss.SyncErrors == atomic.LoadInt64(&in.SyncErrors) &&
 		bss.ReadBytes == atomic.LoadInt64(&in.ReadBytes) &&
 		bss.WriteBytes == atomic.LoadInt64(&in.WriteBytes) &&
 		bss.FileSize == atomic.LoadInt64(&in.FileSize) &&
-		bss.NodeAllocs == atomic.LoadInt64(&in.NodeAllocs)
+		bss.NodeAllocs == atomic.LoadInt64(&in.NodeAllocs) &&
+		bss.CompressedValues == atomic.LoadInt64(&in.CompressedValues) &&
+		bss.CompressInBytes == atomic.LoadInt64(&in.CompressInBytes) &&
+		bss.CompressOutBytes == atomic.LoadInt64(&in.CompressOutBytes) &&
+		bss.DictTrainings == atomic.LoadInt64(&in.DictTrainings) &&
+		bss.RecompressedValues == atomic.LoadInt64(&in.RecompressedValues) &&
+		bss.RecompressInBytes == atomic.LoadInt64(&in.RecompressInBytes) &&
+		bss.RecompressOutBytes == atomic.LoadInt64(&in.RecompressOutBytes)
 }
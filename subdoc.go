@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Limits of sub-document paths and documents, like Couchbase's.
+const (
+	SUBDOC_MAX_PATH_LEN   = 1024
+	SUBDOC_MAX_PATH_COMPS = 32
+	SUBDOC_MAX_DEPTH      = 32
+	SUBDOC_MAX_SPECS      = 16
+)
+
+// Flags of a sub-document spec.
+const (
+	// Creates the missing parents of a mutation's path as objects,
+	// and the array of an array push.
+	SUBDOC_FLAG_MKDIR_P = uint8(0x01)
+)
+
+var subdocOpNames = map[string]gomemcached.CommandCode{
+	"get":              SUBDOC_GET,
+	"exists":           SUBDOC_EXISTS,
+	"dict_add":         SUBDOC_DICT_ADD,
+	"dict_upsert":      SUBDOC_DICT_UPSERT,
+	"delete":           SUBDOC_DELETE,
+	"replace":          SUBDOC_REPLACE,
+	"array_push_last":  SUBDOC_ARRAY_PUSH_LAST,
+	"array_push_first": SUBDOC_ARRAY_PUSH_FIRST,
+	"array_insert":     SUBDOC_ARRAY_INSERT,
+	"counter":          SUBDOC_COUNTER,
+}
+
+var subdocStatusNames = map[gomemcached.Status]string{
+	gomemcached.SUCCESS:       "success",
+	SUBDOC_PATH_ENOENT:        "path_enoent",
+	SUBDOC_PATH_MISMATCH:      "path_mismatch",
+	SUBDOC_PATH_EINVAL:        "path_einval",
+	SUBDOC_PATH_E2BIG:         "path_e2big",
+	SUBDOC_DOC_E2DEEP:         "doc_e2deep",
+	SUBDOC_VALUE_CANTINSERT:   "value_cantinsert",
+	SUBDOC_DOC_NOTJSON:        "doc_notjson",
+	SUBDOC_NUM_ERANGE:         "num_erange",
+	SUBDOC_DELTA_EINVAL:       "delta_einval",
+	SUBDOC_PATH_EEXISTS:       "path_eexists",
+	SUBDOC_VALUE_ETOODEEP:     "value_etoodeep",
+	SUBDOC_INVALID_COMBO:      "invalid_combo",
+	SUBDOC_MULTI_PATH_FAILURE: "multi_path_failure",
+}
+
+func isSubdocLookup(op gomemcached.CommandCode) bool {
+	return op == SUBDOC_GET || op == SUBDOC_EXISTS
+}
+
+func isSubdocMutation(op gomemcached.CommandCode) bool {
+	switch op {
+	case SUBDOC_DICT_ADD, SUBDOC_DICT_UPSERT, SUBDOC_DELETE,
+		SUBDOC_REPLACE, SUBDOC_ARRAY_PUSH_LAST, SUBDOC_ARRAY_PUSH_FIRST,
+		SUBDOC_ARRAY_INSERT, SUBDOC_COUNTER:
+		return true
+	}
+	return false
+}
+
+// A lookup or mutation of one path of a document.
+type subdocSpec struct {
+	op    gomemcached.CommandCode
+	flags uint8
+	path  string
+	value []byte
+}
+
+type subdocResult struct {
+	status gomemcached.Status
+	value  []byte
+}
+
+// The failure of a spec, with the index of the spec in its request.
+type subdocError struct {
+	index  int
+	status gomemcached.Status
+	msg    string
+}
+
+func (e *subdocError) Error() string {
+	return fmt.Sprintf("%v: %v", subdocStatusNames[e.status], e.msg)
+}
+
+func subdocErr(status gomemcached.Status, format string,
+	args ...interface{}) *subdocError {
+	return &subdocError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// A component of a path, either an object key or an array index,
+// where an index of -1 is an array's last element.
+type subdocPathComp struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// Parses a path like "a.b[2].c", where keys with special characters
+// are quoted with backticks, like "`a.b`", and two backticks in a
+// quoted key are a backtick.  The empty path is the document itself.
+func parseSubdocPath(s string) ([]subdocPathComp, *subdocError) {
+	if len(s) > SUBDOC_MAX_PATH_LEN {
+		return nil, subdocErr(SUBDOC_PATH_E2BIG, "path too long: %v", len(s))
+	}
+	var rv []subdocPathComp
+	i := 0
+	for i < len(s) {
+		if len(rv) >= SUBDOC_MAX_PATH_COMPS {
+			return nil, subdocErr(SUBDOC_PATH_E2BIG,
+				"path has too many components: %q", s)
+		}
+		switch s[i] {
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, subdocErr(SUBDOC_PATH_EINVAL, "unclosed index: %q", s)
+			}
+			index, err := parseSubdocIndex(s[i+1 : i+end])
+			if err != nil {
+				return nil, subdocErr(SUBDOC_PATH_EINVAL, "bad index: %q", s)
+			}
+			rv = append(rv, subdocPathComp{index: index, isIndex: true})
+			i += end + 1
+		case '`':
+			var key []byte
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, subdocErr(SUBDOC_PATH_EINVAL, "unclosed quote: %q", s)
+				}
+				if s[i] == '`' {
+					if i+1 < len(s) && s[i+1] == '`' {
+						i++
+					} else {
+						break
+					}
+				}
+				key = append(key, s[i])
+			}
+			rv = append(rv, subdocPathComp{key: string(key)})
+			i++
+		default:
+			end := strings.IndexAny(s[i:], ".[")
+			if end < 0 {
+				end = len(s) - i
+			}
+			key := s[i : i+end]
+			if key == "" || strings.ContainsAny(key, "]`") {
+				return nil, subdocErr(SUBDOC_PATH_EINVAL, "bad key: %q", s)
+			}
+			rv = append(rv, subdocPathComp{key: key})
+			i += end
+		}
+		if i < len(s) {
+			switch s[i] {
+			case '.':
+				i++
+				if i >= len(s) || s[i] == '[' {
+					return nil, subdocErr(SUBDOC_PATH_EINVAL, "missing key: %q", s)
+				}
+			case '[':
+			default:
+				return nil, subdocErr(SUBDOC_PATH_EINVAL, "bad path: %q", s)
+			}
+		}
+	}
+	return rv, nil
+}
+
+func parseSubdocIndex(s string) (int, error) {
+	if s == "-1" {
+		return -1, nil
+	}
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, fmt.Errorf("bad index: %q", s)
+	}
+	index, err := strconv.ParseUint(s, 10, 31)
+	return int(index), err
+}
+
+// A JSON object that keeps its keys in order, so that documents keep
+// their shape when a path is mutated.
+type subdocObject struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+func newSubdocObject() *subdocObject {
+	return &subdocObject{vals: map[string]interface{}{}}
+}
+
+func (o *subdocObject) set(key string, val interface{}) {
+	if _, exists := o.vals[key]; !exists {
+		o.keys = append(o.keys, key)
+	}
+	o.vals[key] = val
+}
+
+func (o *subdocObject) del(key string) {
+	delete(o.vals, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+type subdocArray struct {
+	elems []interface{}
+}
+
+// Parses a document or value into a tree of *subdocObject,
+// *subdocArray, string, json.Number, bool and nil.
+func parseSubdocJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	rv, err := parseSubdocValue(dec, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return rv, nil
+}
+
+func parseSubdocValue(dec *json.Decoder, depth int) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := t.(json.Delim)
+	if !ok {
+		return t, nil
+	}
+	if depth >= SUBDOC_MAX_DEPTH {
+		return nil, errSubdocTooDeep
+	}
+	switch d {
+	case '{':
+		o := newSubdocObject()
+		for dec.More() {
+			t, err = dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("bad object key: %v", t)
+			}
+			val, err := parseSubdocValue(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key, val)
+		}
+		_, err = dec.Token()
+		return o, err
+	case '[':
+		a := &subdocArray{}
+		for dec.More() {
+			val, err := parseSubdocValue(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			a.elems = append(a.elems, val)
+		}
+		_, err = dec.Token()
+		return a, err
+	}
+	return nil, fmt.Errorf("unexpected delimiter: %v", d)
+}
+
+var errSubdocTooDeep = fmt.Errorf("JSON nested too deeply")
+
+// Parses a document, failing with DOC_NOTJSON unless it's a JSON
+// object or array.
+func parseSubdocDoc(data []byte) (interface{}, *subdocError) {
+	doc, err := parseSubdocJSON(data)
+	if err == errSubdocTooDeep {
+		return nil, subdocErr(SUBDOC_DOC_E2DEEP, "document nested too deeply")
+	}
+	if err != nil {
+		return nil, subdocErr(SUBDOC_DOC_NOTJSON, "document is not JSON: %v", err)
+	}
+	switch doc.(type) {
+	case *subdocObject, *subdocArray:
+		return doc, nil
+	}
+	return nil, subdocErr(SUBDOC_DOC_NOTJSON, "document is not a JSON object or array")
+}
+
+// Parses a mutation's value, which for array pushes and inserts may
+// be several comma separated values.
+func parseSubdocSpecValue(spec *subdocSpec, multi bool) ([]interface{}, *subdocError) {
+	data := spec.value
+	if multi {
+		data = make([]byte, 0, len(spec.value)+2)
+		data = append(append(append(data, '['), spec.value...), ']')
+	}
+	val, err := parseSubdocJSON(data)
+	if err == errSubdocTooDeep {
+		return nil, subdocErr(SUBDOC_VALUE_ETOODEEP, "value nested too deeply")
+	}
+	if err != nil || len(bytes.TrimSpace(spec.value)) == 0 {
+		return nil, subdocErr(SUBDOC_VALUE_CANTINSERT, "value is not JSON")
+	}
+	if multi {
+		return val.(*subdocArray).elems, nil
+	}
+	return []interface{}{val}, nil
+}
+
+func subdocDepth(val interface{}) int {
+	rv := 0
+	switch x := val.(type) {
+	case *subdocObject:
+		for _, v := range x.vals {
+			if d := subdocDepth(v); d > rv {
+				rv = d
+			}
+		}
+		rv++
+	case *subdocArray:
+		for _, v := range x.elems {
+			if d := subdocDepth(v); d > rv {
+				rv = d
+			}
+		}
+		rv++
+	}
+	return rv
+}
+
+func encodeSubdocJSON(val interface{}) []byte {
+	buf := &bytes.Buffer{}
+	writeSubdocJSON(buf, val)
+	return buf.Bytes()
+}
+
+func writeSubdocJSON(buf *bytes.Buffer, val interface{}) {
+	switch x := val.(type) {
+	case *subdocObject:
+		buf.WriteByte('{')
+		for i, k := range x.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeSubdocString(buf, k)
+			buf.WriteByte(':')
+			writeSubdocJSON(buf, x.vals[k])
+		}
+		buf.WriteByte('}')
+	case *subdocArray:
+		buf.WriteByte('[')
+		for i, v := range x.elems {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeSubdocJSON(buf, v)
+		}
+		buf.WriteByte(']')
+	case string:
+		writeSubdocString(buf, x)
+	case json.Number:
+		buf.WriteString(string(x))
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case nil:
+		buf.WriteString("null")
+	}
+}
+
+func writeSubdocString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	buf.Truncate(buf.Len() - 1) // The newline that Encode() adds.
+}
+
+// Returns the value at a path.
+func subdocFind(doc interface{}, path []subdocPathComp) (interface{}, *subdocError) {
+	cur := doc
+	for _, c := range path {
+		var ok bool
+		if cur, ok = subdocChild(cur, c); !ok {
+			if !subdocIsContainer(cur, c) {
+				return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path crosses a %v",
+					subdocTypeName(cur))
+			}
+			return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+		}
+	}
+	return cur, nil
+}
+
+// Returns the container of a path's last component, creating missing
+// objects along the way when mkdirP.
+func subdocParent(doc interface{}, path []subdocPathComp,
+	mkdirP bool) (interface{}, *subdocError) {
+	cur := doc
+	for i, c := range path[:len(path)-1] {
+		child, ok := subdocChild(cur, c)
+		if !ok {
+			if !subdocIsContainer(cur, c) {
+				return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path crosses a %v",
+					subdocTypeName(cur))
+			}
+			if !mkdirP || c.isIndex || path[i+1].isIndex {
+				return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+			}
+			child = newSubdocObject()
+			cur.(*subdocObject).set(c.key, child)
+		}
+		cur = child
+	}
+	return cur, nil
+}
+
+// Returns the child of a container, with an ok of false when the
+// container isn't the right type or doesn't have the child.
+func subdocChild(cur interface{}, c subdocPathComp) (interface{}, bool) {
+	if c.isIndex {
+		a, ok := cur.(*subdocArray)
+		if !ok {
+			return cur, false
+		}
+		i := c.index
+		if i < 0 {
+			i = len(a.elems) - 1
+		}
+		if i < 0 || i >= len(a.elems) {
+			return cur, false
+		}
+		return a.elems[i], true
+	}
+	o, ok := cur.(*subdocObject)
+	if !ok {
+		return cur, false
+	}
+	child, ok := o.vals[c.key]
+	if !ok {
+		return cur, false
+	}
+	return child, true
+}
+
+func subdocIsContainer(cur interface{}, c subdocPathComp) bool {
+	if c.isIndex {
+		_, ok := cur.(*subdocArray)
+		return ok
+	}
+	_, ok := cur.(*subdocObject)
+	return ok
+}
+
+func subdocTypeName(val interface{}) string {
+	switch val.(type) {
+	case *subdocObject:
+		return "object"
+	case *subdocArray:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+// Looks up a spec's path in a document, returning the value at the
+// path for a SUBDOC_GET.
+func subdocLookupDoc(doc interface{}, spec *subdocSpec) ([]byte, *subdocError) {
+	path, serr := parseSubdocPath(spec.path)
+	if serr != nil {
+		return nil, serr
+	}
+	val, serr := subdocFind(doc, path)
+	if serr != nil {
+		return nil, serr
+	}
+	if spec.op == SUBDOC_GET {
+		return encodeSubdocJSON(val), nil
+	}
+	return nil, nil
+}
+
+// Applies a spec's mutation to a document in place, returning the
+// value that a SUBDOC_COUNTER results in.
+func subdocMutateDoc(doc interface{}, spec *subdocSpec) ([]byte, *subdocError) {
+	path, serr := parseSubdocPath(spec.path)
+	if serr != nil {
+		return nil, serr
+	}
+	mkdirP := spec.flags&SUBDOC_FLAG_MKDIR_P != 0
+
+	switch spec.op {
+	case SUBDOC_ARRAY_PUSH_LAST, SUBDOC_ARRAY_PUSH_FIRST:
+		vals, serr := parseSubdocSpecValue(spec, true)
+		if serr != nil {
+			return nil, serr
+		}
+		if serr = subdocCheckDepth(path, vals); serr != nil {
+			return nil, serr
+		}
+		var target interface{} = doc
+		if len(path) > 0 {
+			parent, serr := subdocParent(doc, path, mkdirP)
+			if serr != nil {
+				return nil, serr
+			}
+			var ok bool
+			if target, ok = subdocChild(parent, path[len(path)-1]); !ok {
+				if !subdocIsContainer(parent, path[len(path)-1]) {
+					return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path crosses a %v",
+						subdocTypeName(parent))
+				}
+				if !mkdirP || path[len(path)-1].isIndex {
+					return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+				}
+				target = &subdocArray{}
+				parent.(*subdocObject).set(path[len(path)-1].key, target)
+			}
+		}
+		a, ok := target.(*subdocArray)
+		if !ok {
+			return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path is a %v, not an array",
+				subdocTypeName(target))
+		}
+		if spec.op == SUBDOC_ARRAY_PUSH_LAST {
+			a.elems = append(a.elems, vals...)
+		} else {
+			a.elems = append(append([]interface{}{}, vals...), a.elems...)
+		}
+		return nil, nil
+	}
+
+	if len(path) == 0 {
+		return nil, subdocErr(SUBDOC_PATH_EINVAL, "path must not be empty")
+	}
+	last := path[len(path)-1]
+	parent, serr := subdocParent(doc, path, mkdirP)
+	if serr != nil {
+		return nil, serr
+	}
+	if !subdocIsContainer(parent, last) {
+		return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path crosses a %v",
+			subdocTypeName(parent))
+	}
+	_, exists := subdocChild(parent, last)
+
+	switch spec.op {
+	case SUBDOC_DICT_ADD, SUBDOC_DICT_UPSERT:
+		if last.isIndex {
+			return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path must end with a key")
+		}
+		if exists && spec.op == SUBDOC_DICT_ADD {
+			return nil, subdocErr(SUBDOC_PATH_EEXISTS, "path exists")
+		}
+		vals, serr := parseSubdocSpecValue(spec, false)
+		if serr != nil {
+			return nil, serr
+		}
+		if serr = subdocCheckDepth(path, vals); serr != nil {
+			return nil, serr
+		}
+		parent.(*subdocObject).set(last.key, vals[0])
+		return nil, nil
+
+	case SUBDOC_REPLACE:
+		if !exists {
+			return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+		}
+		vals, serr := parseSubdocSpecValue(spec, false)
+		if serr != nil {
+			return nil, serr
+		}
+		if serr = subdocCheckDepth(path, vals); serr != nil {
+			return nil, serr
+		}
+		if last.isIndex {
+			a := parent.(*subdocArray)
+			a.elems[subdocIndex(a, last)] = vals[0]
+		} else {
+			parent.(*subdocObject).set(last.key, vals[0])
+		}
+		return nil, nil
+
+	case SUBDOC_DELETE:
+		if !exists {
+			return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+		}
+		if last.isIndex {
+			a := parent.(*subdocArray)
+			i := subdocIndex(a, last)
+			a.elems = append(a.elems[:i], a.elems[i+1:]...)
+		} else {
+			parent.(*subdocObject).del(last.key)
+		}
+		return nil, nil
+
+	case SUBDOC_ARRAY_INSERT:
+		if !last.isIndex || last.index < 0 {
+			return nil, subdocErr(SUBDOC_PATH_EINVAL,
+				"path must end with a non-negative index")
+		}
+		a := parent.(*subdocArray)
+		if last.index > len(a.elems) {
+			return nil, subdocErr(SUBDOC_PATH_ENOENT, "index past the array's end")
+		}
+		vals, serr := parseSubdocSpecValue(spec, true)
+		if serr != nil {
+			return nil, serr
+		}
+		if serr = subdocCheckDepth(path[:len(path)-1], vals); serr != nil {
+			return nil, serr
+		}
+		elems := make([]interface{}, 0, len(a.elems)+len(vals))
+		elems = append(elems, a.elems[:last.index]...)
+		elems = append(elems, vals...)
+		a.elems = append(elems, a.elems[last.index:]...)
+		return nil, nil
+
+	case SUBDOC_COUNTER:
+		delta, err := strconv.ParseInt(string(bytes.TrimSpace(spec.value)), 10, 64)
+		if err != nil || delta == 0 {
+			return nil, subdocErr(SUBDOC_DELTA_EINVAL, "bad delta: %q", spec.value)
+		}
+		var n int64
+		if exists {
+			cur, _ := subdocChild(parent, last)
+			num, ok := cur.(json.Number)
+			if !ok {
+				return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path is a %v, not a number",
+					subdocTypeName(cur))
+			}
+			if n, err = strconv.ParseInt(string(num), 10, 64); err != nil {
+				if strings.ContainsAny(string(num), ".eE") {
+					return nil, subdocErr(SUBDOC_PATH_MISMATCH, "path is not an integer")
+				}
+				return nil, subdocErr(SUBDOC_NUM_ERANGE, "number out of range")
+			}
+		} else if last.isIndex {
+			return nil, subdocErr(SUBDOC_PATH_ENOENT, "path not found")
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) ||
+			(delta < 0 && n < math.MinInt64-delta) {
+			return nil, subdocErr(SUBDOC_NUM_ERANGE, "counter would overflow")
+		}
+		result := json.Number(strconv.FormatInt(n+delta, 10))
+		if last.isIndex {
+			a := parent.(*subdocArray)
+			a.elems[subdocIndex(a, last)] = result
+		} else {
+			parent.(*subdocObject).set(last.key, result)
+		}
+		return []byte(result), nil
+	}
+
+	return nil, subdocErr(SUBDOC_INVALID_COMBO, "not a mutation: %v", spec.op)
+}
+
+// Returns the position of an index component that's in the array.
+func subdocIndex(a *subdocArray, c subdocPathComp) int {
+	if c.index < 0 {
+		return len(a.elems) - 1
+	}
+	return c.index
+}
+
+func subdocCheckDepth(path []subdocPathComp, vals []interface{}) *subdocError {
+	for _, v := range vals {
+		if len(path)+subdocDepth(v) > SUBDOC_MAX_DEPTH {
+			return subdocErr(SUBDOC_VALUE_ETOODEEP, "value would nest too deeply")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestParseSubdocPath(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  []subdocPathComp
+	}{
+		{"", nil},
+		{"a", []subdocPathComp{{key: "a"}}},
+		{"a.b", []subdocPathComp{{key: "a"}, {key: "b"}}},
+		{"a[2].c", []subdocPathComp{{key: "a"},
+			{index: 2, isIndex: true}, {key: "c"}}},
+		{"[0][-1]", []subdocPathComp{{index: 0, isIndex: true},
+			{index: -1, isIndex: true}}},
+		{"`a.b`.c", []subdocPathComp{{key: "a.b"}, {key: "c"}}},
+		{"`a``b`[1]", []subdocPathComp{{key: "a`b"}, {index: 1, isIndex: true}}},
+	}
+	for _, x := range tests {
+		got, serr := parseSubdocPath(x.path)
+		if serr != nil || !reflect.DeepEqual(got, x.exp) {
+			t.Errorf("expected path %q to parse to %v, got: %v, %v",
+				x.path, x.exp, got, serr)
+		}
+	}
+
+	for _, path := range []string{"a.", ".a", "a..b", "a.[0]", "a[", "a[x]",
+		"a[-2]", "a[]", "a]", "`a", "`a`b", "a[0]b"} {
+		if _, serr := parseSubdocPath(path); serr == nil ||
+			serr.status != SUBDOC_PATH_EINVAL {
+			t.Errorf("expected path %q to be invalid, got: %v", path, serr)
+		}
+	}
+	if _, serr := parseSubdocPath(strings.Repeat("a", SUBDOC_MAX_PATH_LEN+1)); serr == nil ||
+		serr.status != SUBDOC_PATH_E2BIG {
+		t.Errorf("expected a long path to be too big, got: %v", serr)
+	}
+	if _, serr := parseSubdocPath(strings.Repeat("[0]", SUBDOC_MAX_PATH_COMPS+1)); serr == nil ||
+		serr.status != SUBDOC_PATH_E2BIG {
+		t.Errorf("expected a deep path to be too big, got: %v", serr)
+	}
+}
+
+func TestSubdocJSON(t *testing.T) {
+	for _, s := range []string{
+		`{}`, `[]`, `{"b":1,"a":[true,false,null],"c":{"d":"<&>é"}}`,
+		`[1.5e3,-2,"x\"y"]`,
+	} {
+		val, err := parseSubdocJSON([]byte(s))
+		if err != nil {
+			t.Errorf("expected %v to parse, got: %v", s, err)
+			continue
+		}
+		var exp, got interface{}
+		json.Unmarshal([]byte(s), &exp)
+		json.Unmarshal(encodeSubdocJSON(val), &got)
+		if !reflect.DeepEqual(exp, got) {
+			t.Errorf("expected %v to round trip, got: %s", s, encodeSubdocJSON(val))
+		}
+	}
+	val, _ := parseSubdocJSON([]byte(` { "z" : 1, "a" : "<" } `))
+	if s := string(encodeSubdocJSON(val)); s != `{"z":1,"a":"<"}` {
+		t.Errorf("expected keys to keep their order, got: %v", s)
+	}
+
+	for _, s := range []string{``, `{`, `{"a" 1}`, `{"a":1}}`, `[1,]`, `{} {}`, `nope`} {
+		if _, err := parseSubdocJSON([]byte(s)); err == nil {
+			t.Errorf("expected %q not to parse", s)
+		}
+	}
+	if _, serr := parseSubdocDoc([]byte(`"str"`)); serr == nil ||
+		serr.status != SUBDOC_DOC_NOTJSON {
+		t.Errorf("expected a scalar doc to fail, got: %v", serr)
+	}
+	deep := strings.Repeat("[", SUBDOC_MAX_DEPTH+1) + strings.Repeat("]", SUBDOC_MAX_DEPTH+1)
+	if _, serr := parseSubdocDoc([]byte(deep)); serr == nil ||
+		serr.status != SUBDOC_DOC_E2DEEP {
+		t.Errorf("expected a deep doc to fail, got: %v", serr)
+	}
+}
+
+func TestSubdocMutateDoc(t *testing.T) {
+	const doc = `{"a":{"b":[1,2,3],"n":5},"s":"x"}`
+
+	tests := []struct {
+		op     gomemcached.CommandCode
+		flags  uint8
+		path   string
+		value  string
+		status gomemcached.Status
+		result string
+		exp    string
+	}{
+		{SUBDOC_DICT_ADD, 0, "c", `{"d":1}`, 0, "",
+			`{"a":{"b":[1,2,3],"n":5},"s":"x","c":{"d":1}}`},
+		{SUBDOC_DICT_ADD, 0, "s", `1`, SUBDOC_PATH_EEXISTS, "", doc},
+		{SUBDOC_DICT_ADD, 0, "x.y", `1`, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_DICT_ADD, SUBDOC_FLAG_MKDIR_P, "x.y.z", `1`, 0, "",
+			`{"a":{"b":[1,2,3],"n":5},"s":"x","x":{"y":{"z":1}}}`},
+		{SUBDOC_DICT_ADD, 0, "a.b[0]", `1`, SUBDOC_PATH_MISMATCH, "", doc},
+		{SUBDOC_DICT_ADD, 0, "c", `{nope`, SUBDOC_VALUE_CANTINSERT, "", doc},
+		{SUBDOC_DICT_ADD, 0, "c", ``, SUBDOC_VALUE_CANTINSERT, "", doc},
+		{SUBDOC_DICT_UPSERT, 0, "s", `"y"`, 0, "",
+			`{"a":{"b":[1,2,3],"n":5},"s":"y"}`},
+		{SUBDOC_DICT_UPSERT, 0, "s.t", `1`, SUBDOC_PATH_MISMATCH, "", doc},
+		{SUBDOC_DICT_UPSERT, 0, "", `1`, SUBDOC_PATH_EINVAL, "", doc},
+		{SUBDOC_REPLACE, 0, "a.b[-1]", `"z"`, 0, "",
+			`{"a":{"b":[1,2,"z"],"n":5},"s":"x"}`},
+		{SUBDOC_REPLACE, 0, "a.b[3]", `4`, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_REPLACE, 0, "q", `4`, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_DELETE, 0, "a.b[1]", ``, 0, "",
+			`{"a":{"b":[1,3],"n":5},"s":"x"}`},
+		{SUBDOC_DELETE, 0, "a", ``, 0, "", `{"s":"x"}`},
+		{SUBDOC_DELETE, 0, "a.q", ``, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_ARRAY_PUSH_LAST, 0, "a.b", `4,5`, 0, "",
+			`{"a":{"b":[1,2,3,4,5],"n":5},"s":"x"}`},
+		{SUBDOC_ARRAY_PUSH_FIRST, 0, "a.b", `0`, 0, "",
+			`{"a":{"b":[0,1,2,3],"n":5},"s":"x"}`},
+		{SUBDOC_ARRAY_PUSH_LAST, 0, "s", `0`, SUBDOC_PATH_MISMATCH, "", doc},
+		{SUBDOC_ARRAY_PUSH_LAST, 0, "l", `0`, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_ARRAY_PUSH_LAST, SUBDOC_FLAG_MKDIR_P, "l", `0`, 0, "",
+			`{"a":{"b":[1,2,3],"n":5},"s":"x","l":[0]}`},
+		{SUBDOC_ARRAY_PUSH_LAST, 0, "", `0`, SUBDOC_PATH_MISMATCH, "", doc},
+		{SUBDOC_ARRAY_INSERT, 0, "a.b[1]", `"i"`, 0, "",
+			`{"a":{"b":[1,"i",2,3],"n":5},"s":"x"}`},
+		{SUBDOC_ARRAY_INSERT, 0, "a.b[3]", `4`, 0, "",
+			`{"a":{"b":[1,2,3,4],"n":5},"s":"x"}`},
+		{SUBDOC_ARRAY_INSERT, 0, "a.b[4]", `4`, SUBDOC_PATH_ENOENT, "", doc},
+		{SUBDOC_ARRAY_INSERT, 0, "a.b[-1]", `4`, SUBDOC_PATH_EINVAL, "", doc},
+		{SUBDOC_ARRAY_INSERT, 0, "a.n", `4`, SUBDOC_PATH_EINVAL, "", doc},
+		{SUBDOC_COUNTER, 0, "a.n", `10`, 0, "15",
+			`{"a":{"b":[1,2,3],"n":15},"s":"x"}`},
+		{SUBDOC_COUNTER, 0, "a.b[0]", `-3`, 0, "-2",
+			`{"a":{"b":[-2,2,3],"n":5},"s":"x"}`},
+		{SUBDOC_COUNTER, 0, "a.m", `1`, 0, "1",
+			`{"a":{"b":[1,2,3],"n":5,"m":1},"s":"x"}`},
+		{SUBDOC_COUNTER, 0, "s", `1`, SUBDOC_PATH_MISMATCH, "", doc},
+		{SUBDOC_COUNTER, 0, "a.n", `0`, SUBDOC_DELTA_EINVAL, "", doc},
+		{SUBDOC_COUNTER, 0, "a.n", `x`, SUBDOC_DELTA_EINVAL, "", doc},
+		{SUBDOC_COUNTER, 0, "a.n", `9223372036854775807`, SUBDOC_NUM_ERANGE, "", doc},
+	}
+	for i, x := range tests {
+		d, serr := parseSubdocDoc([]byte(doc))
+		if serr != nil {
+			t.Fatalf("expected doc to parse, got: %v", serr)
+		}
+		spec := &subdocSpec{op: x.op, flags: x.flags, path: x.path,
+			value: []byte(x.value)}
+		result, serr := subdocMutateDoc(d, spec)
+		status := gomemcached.SUCCESS
+		if serr != nil {
+			status = serr.status
+		}
+		if status != x.status || string(result) != x.result {
+			t.Errorf("test #%v, %v %q: expected %v, %q, got: %v, %q",
+				i, x.op, x.path, x.status, x.result, serr, result)
+			continue
+		}
+		if serr == nil && string(encodeSubdocJSON(d)) != x.exp {
+			t.Errorf("test #%v, %v %q: expected doc %v, got: %s",
+				i, x.op, x.path, x.exp, encodeSubdocJSON(d))
+		}
+	}
+}
+
+func TestSubdocOps(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	rh := reqHandler{currentBucket: testBucket}
+	testBucket.CreateVBucket(3)
+	testBucket.SetVBState(3, VBActive)
+
+	do := func(op gomemcached.CommandCode, cas uint64, flags uint8,
+		path, value string) *gomemcached.MCResponse {
+		req := &gomemcached.MCRequest{
+			Opcode:  op,
+			VBucket: 3,
+			Key:     []byte("doc"),
+			Cas:     cas,
+			Extras:  []byte{0, 0, flags},
+			Body:    []byte(path + value),
+		}
+		binary.BigEndian.PutUint16(req.Extras, uint16(len(path)))
+		return rh.HandleMessage(ioutil.Discard, nil, req)
+	}
+
+	if res := do(SUBDOC_GET, 0, 0, "a", ""); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected a missing doc to fail, got: %v", res)
+	}
+	if res := do(SUBDOC_COUNTER, 0, 0, "a", "1"); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected a missing doc to fail, got: %v", res)
+	}
+
+	res := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("doc"),
+		Extras:  []byte{0, 0, 0, 42, 0, 0, 0, 0},
+		Body:    []byte(`{"n":1,"tags":["x"]}`),
+	})
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+	setCas := res.Cas
+
+	res = do(SUBDOC_GET, 0, 0, "tags[0]", "")
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != `"x"` ||
+		res.Cas != setCas {
+		t.Errorf("expected subdoc get to work, got: %v", res)
+	}
+	if res = do(SUBDOC_EXISTS, 0, 0, "nope", ""); res.Status != SUBDOC_PATH_ENOENT {
+		t.Errorf("expected exists of a missing path to fail, got: %v", res)
+	}
+
+	res = do(SUBDOC_COUNTER, 0, 0, "n", "41")
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "42" ||
+		res.Cas <= setCas {
+		t.Fatalf("expected counter to work with a new cas, got: %v", res)
+	}
+	counterCas := res.Cas
+	if res = do(SUBDOC_DICT_UPSERT, setCas, 0, "n", "0"); res.Status !=
+		gomemcached.KEY_EEXISTS {
+		t.Errorf("expected a stale cas to fail, got: %v", res)
+	}
+	if res = do(SUBDOC_DICT_UPSERT, counterCas, 0, "m", `"y"`); res.Status !=
+		gomemcached.SUCCESS {
+		t.Errorf("expected a matching cas to work, got: %v", res)
+	}
+	if res = do(SUBDOC_DELETE, 0, 0, "q", ""); res.Status != SUBDOC_PATH_ENOENT {
+		t.Errorf("expected delete of a missing path to fail, got: %v", res)
+	}
+	if res = do(SUBDOC_GET, 0, 0, "a", "x"); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected a lookup with a value to fail, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: 3,
+		Key:     []byte("doc"),
+	})
+	if res.Status != gomemcached.SUCCESS ||
+		string(res.Body) != `{"n":42,"tags":["x"],"m":"y"}` ||
+		binary.BigEndian.Uint32(res.Extras) != 42 {
+		t.Errorf("expected the doc to keep its flags, got: %v, %s", res, res.Body)
+	}
+
+	// Multi-path lookups report each path.
+	lookup := func(op gomemcached.CommandCode, path string) []byte {
+		b := []byte{byte(op), 0, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(len(path)))
+		return append(b, path...)
+	}
+	body := append(lookup(SUBDOC_GET, "n"), lookup(SUBDOC_EXISTS, "q")...)
+	res = rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  SUBDOC_MULTI_LOOKUP,
+		VBucket: 3,
+		Key:     []byte("doc"),
+		Body:    body,
+	})
+	if res.Status != SUBDOC_MULTI_PATH_FAILURE || len(res.Body) < 8 ||
+		binary.BigEndian.Uint16(res.Body) != 0 ||
+		binary.BigEndian.Uint32(res.Body[2:]) != 2 ||
+		string(res.Body[6:8]) != "42" ||
+		binary.BigEndian.Uint16(res.Body[8:]) != uint16(SUBDOC_PATH_ENOENT) {
+		t.Errorf("expected multi lookup results, got: %v, %v", res, res.Body)
+	}
+
+	// Multi-path mutations are all or nothing.
+	mutation := func(op gomemcached.CommandCode, path, value string) []byte {
+		b := []byte{byte(op), 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(len(path)))
+		binary.BigEndian.PutUint32(b[4:], uint32(len(value)))
+		return append(append(b, path...), value...)
+	}
+	multi := func(body []byte) *gomemcached.MCResponse {
+		return rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+			Opcode:  SUBDOC_MULTI_MUTATION,
+			VBucket: 3,
+			Key:     []byte("doc"),
+			Body:    body,
+		})
+	}
+	res = multi(append(mutation(SUBDOC_COUNTER, "n", "1"),
+		mutation(SUBDOC_ARRAY_PUSH_LAST, "nope", "1")...))
+	if res.Status != SUBDOC_MULTI_PATH_FAILURE || len(res.Body) != 3 ||
+		res.Body[0] != 1 ||
+		binary.BigEndian.Uint16(res.Body[1:]) != uint16(SUBDOC_PATH_ENOENT) {
+		t.Errorf("expected multi mutation to fail at spec 1, got: %v, %v",
+			res, res.Body)
+	}
+	if res = do(SUBDOC_GET, 0, 0, "n", ""); string(res.Body) != "42" {
+		t.Errorf("expected a failed multi mutation to change nothing, got: %v", res)
+	}
+	res = multi(append(mutation(SUBDOC_ARRAY_PUSH_LAST, "tags", `"y"`),
+		mutation(SUBDOC_COUNTER, "n", "-2")...))
+	if res.Status != gomemcached.SUCCESS || len(res.Body) != 9 ||
+		res.Body[0] != 1 || binary.BigEndian.Uint32(res.Body[3:]) != 2 ||
+		string(res.Body[7:]) != "40" {
+		t.Errorf("expected multi mutation to work, got: %v, %v", res, res.Body)
+	}
+	if res = multi(mutation(SUBDOC_GET, "n", "")); res.Status != SUBDOC_INVALID_COMBO {
+		t.Errorf("expected a lookup in a multi mutation to fail, got: %v", res)
+	}
+
+	// Locked docs only take mutations with the lock's cas.
+	lockCas := rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  GET_LOCKED,
+		VBucket: 3,
+		Key:     []byte("doc"),
+	}).Cas
+	if res = do(SUBDOC_GET, 0, 0, "n", ""); res.Cas != LOCKED_CAS {
+		t.Errorf("expected a lookup of a locked doc to hide the cas, got: %v", res)
+	}
+	if res = do(SUBDOC_COUNTER, 0, 0, "n", "1"); res.Status != LOCKED {
+		t.Errorf("expected a locked doc to fail, got: %v", res)
+	}
+	if res = do(SUBDOC_COUNTER, lockCas, 0, "n", "1"); res.Status !=
+		gomemcached.SUCCESS {
+		t.Errorf("expected the lock cas to work, got: %v", res)
+	}
+
+	rh.HandleMessage(ioutil.Discard, nil, &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 3,
+		Key:     []byte("doc"),
+		Extras:  make([]byte, 8),
+		Body:    []byte("not json"),
+	})
+	if res = do(SUBDOC_GET, 0, 0, "n", ""); res.Status != SUBDOC_DOC_NOTJSON {
+		t.Errorf("expected a non-JSON doc to fail, got: %v", res)
+	}
+}
+
+func TestCouchSubdoc(t *testing.T) {
+	// "hello" hash is 528 with 1024 vbuckets.
+	d, _, bucket := testSetupDefaultBucket(t, 1024, uint16(528))
+	defer os.RemoveAll(d)
+	mr := testSetupMux(d)
+
+	post := func(url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "http://127.0.0.1/default/hello"+url,
+			strings.NewReader(body))
+		mr.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := post("/_subdoc/lookup", `{"specs":[{"op":"get","path":"a"}]}`)
+	if rr.Code != 404 {
+		t.Errorf("expected a missing doc to 404, got: %v, %v", rr.Code, rr.Body)
+	}
+
+	SetItem(bucket, []byte("hello"), []byte(`{"a":{"hits":1}}`), VBActive)
+
+	rr = post("/_subdoc/mutate",
+		`{"specs":[{"op":"counter","path":"a.hits","value":2},`+
+			`{"op":"dict_upsert","path":"b.c","value":[1],"createParents":true}]}`)
+	var mres struct {
+		Cas     uint64
+		Results []SubdocResult
+	}
+	if rr.Code != 200 || json.Unmarshal(rr.Body.Bytes(), &mres) != nil ||
+		mres.Cas == 0 || len(mres.Results) != 2 ||
+		string(mres.Results[0].Value) != "3" {
+		t.Fatalf("expected mutate to work, got: %v, %v", rr.Code, rr.Body)
+	}
+
+	rr = post("/_subdoc/lookup",
+		`{"specs":[{"op":"get","path":"b"},{"op":"exists","path":"x"}]}`)
+	var lres struct {
+		Cas     uint64
+		Results []SubdocResult
+	}
+	if rr.Code != 200 || json.Unmarshal(rr.Body.Bytes(), &lres) != nil ||
+		lres.Cas != mres.Cas || len(lres.Results) != 2 ||
+		string(lres.Results[0].Value) != `{"c":[1]}` ||
+		lres.Results[1].Status != "path_enoent" {
+		t.Errorf("expected lookup to work, got: %v, %v", rr.Code, rr.Body)
+	}
+
+	rr = post("/_subdoc/mutate",
+		`{"cas":1,"specs":[{"op":"delete","path":"a"}]}`)
+	if rr.Code != 409 {
+		t.Errorf("expected a stale cas to 409, got: %v, %v", rr.Code, rr.Body)
+	}
+	rr = post("/_subdoc/mutate", `{"specs":[{"op":"delete","path":"x"}]}`)
+	if rr.Code != 400 || !strings.Contains(rr.Body.String(), "path_enoent") {
+		t.Errorf("expected a missing path to 400, got: %v, %v", rr.Code, rr.Body)
+	}
+	rr = post("/_subdoc/mutate", `{"specs":[{"op":"get","path":"a"}]}`)
+	if rr.Code != 400 {
+		t.Errorf("expected a lookup op to 400, got: %v, %v", rr.Code, rr.Body)
+	}
+	rr = post("/_subdoc/lookup", `{"specs":[]}`)
+	if rr.Code != 400 {
+		t.Errorf("expected no specs to 400, got: %v, %v", rr.Code, rr.Body)
+	}
+}
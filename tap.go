@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/gomemcached"
-	"github.com/dustin/gomemcached/server"
 )
 
 // Message sent on object change
@@ -17,11 +18,14 @@ type mutation struct {
 	key     []byte
 	cas     uint64
 	deleted bool
+	evicted bool // A deletion by quota eviction, not by a client.
 }
 
 func (m mutation) String() string {
 	sym := "M"
-	if m.deleted {
+	if m.evicted {
+		sym = "E"
+	} else if m.deleted {
 		sym = "D"
 	}
 	return fmt.Sprintf("%v: vb:%v %s -> %v", sym, m.vb, m.key, m.cas)
@@ -30,6 +34,44 @@ func (m mutation) String() string {
 // How often to send opaque "heartbeats" on tap streams.
 var tapTickFreq = time.Second
 
+// The TAP-specific flags in the extras of TAP packets.
+const TAP_FLAG_ACK = uint16(0x01)
+
+// The TAP_MUTATION extras are engine-private length (2), TAP flags
+// (2), ttl (1), reserved (3), item flags (4) and item exp (4).  TAP
+// has no way to negotiate compressed values, so they're decompressed.
+func tapMutationPkt(vbid uint16, i *item) (*gomemcached.MCRequest, error) {
+	data, err := i.value()
+	if err != nil {
+		return nil, err
+	}
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: vbid,
+		Key:     i.key,
+		Cas:     i.cas,
+		Extras:  make([]byte, 16),
+		Body:    data,
+	}
+	binary.BigEndian.PutUint32(pkt.Extras[8:], i.flag)
+	binary.BigEndian.PutUint32(pkt.Extras[12:], i.exp)
+	return pkt, nil
+}
+
+func tapDeletePkt(vbid uint16, key []byte, cas uint64) *gomemcached.MCRequest {
+	return &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_DELETE,
+		Key:     key,
+		VBucket: vbid,
+		Cas:     cas,
+		Extras:  make([]byte, 8),
+	}
+}
+
+// How many catch-up passes a takeover makes over a partition's
+// changes before switching the partition to pending.
+var tapTakeoverRounds = 10
+
 func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
 	tc, err := req.ParseTapCommands()
@@ -40,14 +82,31 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: TAP of a vbucket list.
+	vbids, res := tapVBucketList(&tc)
+	if res != nil {
+		return res
+	}
+
+	res, yesTakeover := tapFlagBool(&tc, gomemcached.TAKEOVER_VBUCKETS)
+	if res != nil {
+		return res
+	}
+	if yesTakeover {
+		return doTapTakeover(b, req, r, chpkt, cherr, vbids)
+	}
 
 	res, yesDump := tapFlagBool(&tc, gomemcached.DUMP)
 	if res != nil {
 		return res
 	}
+
+	ts := newTapStream()
+	defer ts.unregisterAll(b)
+
 	if yesDump || tapFlagExists(&tc, gomemcached.BACKFILL) {
-		res := doTapBackFill(b, req, r, chpkt, cherr, tc)
+		ts.startDrain()
+		res := doTapBackFill(b, req, r, chpkt, cherr, tc, vbids, ts)
+		ts.stopDrain()
 		if res != nil {
 			return res
 		}
@@ -57,9 +116,170 @@ func doTap(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: There's probably a mutation gap between backfill and tap-forward.
+	return doTapForward(b, req, r, chpkt, cherr, tc, vbids, ts)
+}
+
+// The forwarding state of a TAP stream.  A backfill registers for
+// forwarded mutations before it scans a vbucket, so there's no gap
+// between the backfill and tap-forward, and remembers enough for
+// tap-forward to skip the mutations that the backfill already sent.
+type tapStream struct {
+	mch        chan interface{}
+	registered map[uint16]bool
+
+	// Per-vbucket mutations observed while the backfill runs, kept
+	// at the latest CAS per key.  Draining mch into them keeps a long
+	// backfill from filling mch and stalling the writers.
+	pending   map[uint16]map[string]mutation
+	drainStop chan bool
+	drainDone chan bool
+
+	// Per-vbucket LastCas from just before the backfill scan, so the
+	// scan includes every mutation at or below it.
+	highCas map[uint16]uint64
+
+	// Per-vbucket keys that the backfill scan sent with a CAS
+	// above the highCas, so they might also be forwarded.
+	sent map[uint16]map[string]uint64
+
+	// Per-vbucket CAS up to which every change has been sent, for
+	// the receiver to acknowledge as a replica.
+	sentCas map[uint16]uint64
+}
+
+func newTapStream() *tapStream {
+	return &tapStream{
+		mch:        make(chan interface{}, 1000),
+		registered: map[uint16]bool{},
+		pending:    map[uint16]map[string]mutation{},
+		highCas:    map[uint16]uint64{},
+		sent:       map[uint16]map[string]uint64{},
+		sentCas:    map[uint16]uint64{},
+	}
+}
+
+func (ts *tapStream) register(vb *VBucket) {
+	vb.observer.Register(ts.mch)
+	ts.registered[vb.vbid] = true
+}
+
+func (ts *tapStream) unregister(vb *VBucket) {
+	vb.observer.Unregister(ts.mch)
+	delete(ts.registered, vb.vbid)
+	delete(ts.highCas, vb.vbid)
+	delete(ts.sent, vb.vbid)
+	delete(ts.sentCas, vb.vbid)
+}
+
+func (ts *tapStream) unregisterAll(b Bucket) {
+	for vbid := range ts.registered {
+		vb, _ := b.GetVBucket(vbid)
+		if vb != nil {
+			vb.observer.Unregister(ts.mch)
+		}
+	}
+}
+
+// Drains mch into the pending mutations until stopDrain.
+func (ts *tapStream) startDrain() {
+	ts.drainStop = make(chan bool)
+	ts.drainDone = make(chan bool)
+	go func() {
+		defer close(ts.drainDone)
+		for {
+			select {
+			case mi := <-ts.mch:
+				ts.addPending(mi.(mutation))
+			case <-ts.drainStop:
+				for {
+					select {
+					case mi := <-ts.mch:
+						ts.addPending(mi.(mutation))
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (ts *tapStream) stopDrain() {
+	close(ts.drainStop)
+	<-ts.drainDone
+}
+
+func (ts *tapStream) addPending(m mutation) {
+	p := ts.pending[m.vb]
+	if p == nil {
+		p = map[string]mutation{}
+		ts.pending[m.vb] = p
+	}
+	if prev, ok := p[string(m.key)]; !ok || m.cas > prev.cas {
+		p[string(m.key)] = m
+	}
+}
+
+type mutationsByCas []mutation
+
+func (a mutationsByCas) Len() int           { return len(a) }
+func (a mutationsByCas) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a mutationsByCas) Less(i, j int) bool { return a[i].cas < a[j].cas }
+
+// Returns and clears the pending mutations, in CAS order.
+func (ts *tapStream) takePending() []mutation {
+	var rv mutationsByCas
+	for _, p := range ts.pending {
+		for _, m := range p {
+			rv = append(rv, m)
+		}
+	}
+	ts.pending = map[uint16]map[string]mutation{}
+	sort.Sort(rv)
+	return rv
+}
+
+// Notes that a mutation was forwarded.  Only backfilled vbuckets
+// are tracked, as otherwise the receiver misses the earlier changes.
+func (ts *tapStream) noteSent(m mutation) {
+	if cas, ok := ts.sentCas[m.vb]; ok && m.cas > cas {
+		ts.sentCas[m.vb] = m.cas
+	}
+}
 
-	return doTapForward(b, req, r, chpkt, cherr, tc)
+// Returns true if the backfill already sent the mutation, or a
+// later version of its item.
+func (ts *tapStream) backfilled(m mutation) bool {
+	if highCas, ok := ts.highCas[m.vb]; ok && m.cas <= highCas {
+		return true
+	}
+	cas, ok := ts.sent[m.vb][string(m.key)]
+	return ok && m.cas <= cas
+}
+
+// Returns the set of vbuckets from a LIST_VBUCKETS tap flag, or nil
+// when the tap is for all vbuckets.
+func tapVBucketList(tc *gomemcached.TapConnect) (
+	map[uint16]bool, *gomemcached.MCResponse) {
+	v, ok := tc.Flags[gomemcached.LIST_VBUCKETS]
+	if !ok {
+		return nil, nil
+	}
+	l, ok := v.([]uint16)
+	if !ok {
+		return nil, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("invalid tap vbucket list: %v", v)),
+		}
+	}
+	if len(l) == 0 {
+		return nil, nil
+	}
+	vbids := make(map[uint16]bool, len(l))
+	for _, vbid := range l {
+		vbids[vbid] = true
+	}
+	return vbids, nil
 }
 
 func tapFlagBool(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag) (
@@ -81,9 +301,9 @@ func tapFlagExists(tc *gomemcached.TapConnect, flag gomemcached.TapConnectFlag)
 
 func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
+	tc gomemcached.TapConnect, vbids map[uint16]bool,
+	ts *tapStream) *gomemcached.MCResponse {
 	bch := make(chan interface{})
-	mch := make(chan interface{}, 1000)
 
 	b.Subscribe(bch)
 	defer b.Unsubscribe(bch)
@@ -91,82 +311,140 @@ func doTapForward(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	ticker := time.NewTicker(tapTickFreq)
 	defer ticker.Stop()
 
-	// defer cleanup vbucket mchs
-	registered := map[uint16]bool{}
-	defer func() {
-		for vbid := range registered {
-			vb, _ := b.GetVBucket(vbid)
-			if vb != nil {
-				vb.observer.Unregister(mch)
+	for _, m := range ts.takePending() {
+		if pkt := tapForwardPkt(b, ts, m); pkt != nil {
+			select {
+			case chpkt <- pkt:
+				ts.noteSent(m)
+			case <-cherr:
+				return &gomemcached.MCResponse{Fatal: true}
 			}
 		}
-	}()
+	}
+
+	// A noop asks the receiver for an ack when there's no ack
+	// outstanding, and the ack means the receiver, as a replica, has
+	// every change sent before the noop.
+	name := string(req.Key)
+	ackch := make(chan uint32)
+	donech := make(chan bool)
+	defer close(donech)
+	if r != nil {
+		go readTapAcks(r, ackch, donech)
+	}
+	var ackOpaque uint32
+	var ackCas map[uint16]uint64
 
 	for {
 		select {
 		case ci := <-bch:
 			// VBucket state change, so update registrations
 			c := ci.(vbucketChange)
+			if vbids != nil && !vbids[c.vbid] {
+				continue
+			}
 			if vb := c.getVBucket(); vb != nil {
 				if c.newState == VBActive {
-					vb.observer.Register(mch)
-					registered[vb.vbid] = true
-				} else if vb != nil {
-					vb.observer.Unregister(mch)
-					delete(registered, vb.vbid)
+					ts.register(vb)
+				} else {
+					ts.unregister(vb)
 				}
 			}
-		case mi := <-mch:
+		case mi := <-ts.mch:
 			// Send a change
 			m := mi.(mutation)
-			pkt := &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				Key:     m.key,
-				VBucket: m.vb,
-			}
-			if m.deleted {
-				pkt.Opcode = gomemcached.TAP_DELETE
-				pkt.Extras = make([]byte, 8) // TODO: fill
-			} else {
-				pkt.Extras = make([]byte, 16) // TODO: fill
-
-				vb, _ := b.GetVBucket(m.vb)
-				if vb != nil {
-					// TODO: if vb is suspended, the get() will freeze
-					// the TAP stream until vb is resumed; that may be
-					// or may not be what we want.
-					res := vb.get(m.key)
-					if res.Status != gomemcached.SUCCESS {
-						log.Printf("tapped a missing item, skipping key: %s, res: %#v",
-							m.key, res)
-						continue
-					}
-					pkt.Body = res.Body
-				} else {
-					log.Printf("tapping a missing partition: %v", m.vb)
-					continue
-				}
+			if pkt := tapForwardPkt(b, ts, m); pkt != nil {
+				chpkt <- pkt
+				ts.noteSent(m)
 			}
-			chpkt <- pkt
 		case <-ticker.C:
 			// Send a noop
-			chpkt <- &gomemcached.MCRequest{
+			pkt := &gomemcached.MCRequest{
 				Opcode: gomemcached.TAP_OPAQUE,
 				Extras: make([]byte, 8),
 			}
+			if ackCas == nil {
+				ackOpaque++
+				ackCas = make(map[uint16]uint64, len(ts.sentCas))
+				for vbid, cas := range ts.sentCas {
+					ackCas[vbid] = cas
+				}
+				pkt.Opaque = ackOpaque
+				binary.BigEndian.PutUint16(pkt.Extras[2:], TAP_FLAG_ACK)
+			}
+			chpkt <- pkt
+		case opaque := <-ackch:
+			if ackCas == nil || opaque != ackOpaque {
+				continue
+			}
+			for vbid, cas := range ackCas {
+				if vb, _ := b.GetVBucket(vbid); vb != nil {
+					vb.noteReplicaCas(name, cas)
+				}
+			}
+			ackCas = nil
 		case <-cherr:
 			return &gomemcached.MCResponse{Fatal: true}
 		}
 	}
 }
 
+// Relays the opaques of a TAP receiver's acks until there's an error
+// or the stream is done.
+func readTapAcks(r io.Reader, ackch chan<- uint32, donech <-chan bool) {
+	for {
+		res, err := readTapAck(r)
+		if err != nil {
+			return
+		}
+		select {
+		case ackch <- res.Opaque:
+		case <-donech:
+			return
+		}
+	}
+}
+
+// Returns the packet that forwards a mutation, or nil if it should
+// be skipped.
+func tapForwardPkt(b Bucket, ts *tapStream, m mutation) *gomemcached.MCRequest {
+	if ts.backfilled(m) {
+		return nil
+	}
+	if m.deleted { // Including evictions, so replicas keep the same items.
+		return tapDeletePkt(m.vb, m.key, m.cas)
+	}
+	vb, _ := b.GetVBucket(m.vb)
+	if vb == nil {
+		log.Printf("tapping a missing partition: %v", m.vb)
+		return nil
+	}
+	i, err := vb.getUnexpired(m.key, time.Now())
+	if err != nil || i == nil {
+		log.Printf("tapped a missing item, skipping key: %s, err: %v",
+			m.key, err)
+		return nil
+	}
+	pkt, err := tapMutationPkt(m.vb, i)
+	if err != nil {
+		log.Printf("tapped a bad item, skipping key: %s, err: %v",
+			m.key, err)
+		return nil
+	}
+	return pkt
+}
+
 func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 	chpkt chan<- transmissible, cherr <-chan error,
-	tc gomemcached.TapConnect) *gomemcached.MCResponse {
+	tc gomemcached.TapConnect, vbids map[uint16]bool,
+	ts *tapStream) *gomemcached.MCResponse {
 	var err error
 
 	np := b.GetBucketSettings().NumPartitions
 	for vbid := 0; vbid < np; vbid++ {
+		if vbids != nil && !vbids[uint16(vbid)] {
+			continue
+		}
 		vb, _ := b.GetVBucket(uint16(vbid))
 		if vb == nil {
 			continue
@@ -175,16 +453,30 @@ func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 			continue
 		}
 
+		// Register before reading the high-water CAS, so every
+		// mutation above it will be forwarded.  Reading it while
+		// holding the vbucket lock means every mutation at or below
+		// it has reached the partitionstore before the scan.
+		ts.register(vb)
+		var highCas uint64
+		vb.Apply(func() {
+			highCas = atomic.LoadUint64(&vb.Meta().LastCas)
+		})
+		ts.highCas[vb.vbid] = highCas
+		ts.sentCas[vb.vbid] = highCas
+		sent := map[string]uint64{}
+		ts.sent[vb.vbid] = sent
+
 		errVisit := vb.ps.visitItems(nil, true, func(i *item) bool {
 			// TODO: Need to occasionally send TAP_ACK's.
-			chpkt <- &gomemcached.MCRequest{
-				Opcode:  gomemcached.TAP_MUTATION,
-				VBucket: uint16(vbid),
-				Key:     i.key,
-				Cas:     i.cas,
-				Extras:  make([]byte, 16),
-				Body:    i.data,
+			if i.cas > highCas {
+				sent[string(i.key)] = i.cas
 			}
+			var pkt *gomemcached.MCRequest
+			if pkt, err = tapMutationPkt(uint16(vbid), i); err != nil {
+				return false
+			}
+			chpkt <- pkt
 			select {
 			case err = <-cherr:
 				return false
@@ -202,34 +494,347 @@ func doTapBackFill(b Bucket, req *gomemcached.MCRequest, r io.Reader,
 		}
 	}
 
-	// TODO: Skipping error handling for now, as it always errors
-	// since the memcached.ReadPacket() is expecting a REQ instead of
-	// RES for the ACK's header magic.  The fix involves exposing more
-	// helper functions in gomemcached to help us flip the REQ/RES
-	// stream direction.
-	doTapAck(r, chpkt, cherr)
+	if err = doTapAck(r, chpkt, cherr); err != nil {
+		close(chpkt)
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+	for vbid, highCas := range ts.highCas {
+		if vb, _ := b.GetVBucket(vbid); vb != nil {
+			vb.noteReplicaCas(string(req.Key), highCas)
+		}
+	}
 
 	return nil
 }
 
 func doTapAck(r io.Reader, chpkt chan<- transmissible, cherr <-chan error) error {
-	ackReq := &gomemcached.MCRequest{
+	_, err := doTapAckPkt(r, chpkt, cherr, &gomemcached.MCRequest{
 		Opcode: gomemcached.TAP_OPAQUE,
 		Extras: make([]byte, 8),
-	}
-	TAP_FLAG_ACK := uint16(0x01)
-	binary.BigEndian.PutUint16(ackReq.Extras[2:], TAP_FLAG_ACK)
+	})
+	return err
+}
+
+// Sends a TAP packet with the ACK flag set and waits for the
+// receiver's response.
+func doTapAckPkt(r io.Reader, chpkt chan<- transmissible, cherr <-chan error,
+	pkt *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+	binary.BigEndian.PutUint16(pkt.Extras[2:], TAP_FLAG_ACK)
 
-	chpkt <- ackReq
+	chpkt <- pkt
 	select {
 	case err := <-cherr:
-		return err
+		return nil, err
 	default:
 	}
 
-	// TODO: Validate that the response matches the ACK that we expect.
-	_, err := memcached.ReadPacket(r)
-	return err
+	res, err := readTapAck(r)
+	if err != nil {
+		return nil, err
+	}
+	if res.Opcode != pkt.Opcode {
+		return nil, fmt.Errorf("unexpected tap ack opcode: %v, wanted: %v",
+			res.Opcode, pkt.Opcode)
+	}
+	return res, nil
+}
+
+// Reads a TAP receiver's response.  The stream direction is flipped
+// from a normal connection, so memcached.ReadPacket(), which expects
+// a REQ header magic, can't be used.
+func readTapAck(r io.Reader) (*gomemcached.MCResponse, error) {
+	hdr := make([]byte, gomemcached.HDR_LEN)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != gomemcached.RES_MAGIC {
+		return nil, fmt.Errorf("bad tap ack magic: %x", hdr[0])
+	}
+	res := &gomemcached.MCResponse{
+		Opcode: gomemcached.CommandCode(hdr[1]),
+		Status: gomemcached.Status(binary.BigEndian.Uint16(hdr[6:])),
+		Opaque: binary.BigEndian.Uint32(hdr[12:]),
+		Cas:    binary.BigEndian.Uint64(hdr[16:]),
+	}
+	bodyLen := binary.BigEndian.Uint32(hdr[8:])
+	if bodyLen > 0 {
+		res.Body = make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, res.Body); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Hands off the listed vbuckets to the TAP receiver, one at a time.
+// Each vbucket's changes are streamed until the receiver has nearly
+// caught up, then the vbucket is switched to pending, the remaining
+// changes are drained, the receiver is told to make the vbucket
+// active, and finally our copy is marked dead.  The stream ends
+// when the takeover is done.
+func doTapTakeover(b Bucket, req *gomemcached.MCRequest, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error,
+	vbids map[uint16]bool) *gomemcached.MCResponse {
+	if len(vbids) == 0 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("tap takeover needs a vbucket list"),
+		}
+	}
+	l := make([]int, 0, len(vbids))
+	for vbid := range vbids {
+		vb, _ := b.GetVBucket(vbid)
+		if vb == nil || vb.GetVBState() != VBActive {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.NOT_MY_VBUCKET,
+				Body:   []byte(fmt.Sprintf("tap takeover of inactive partition: %v", vbid)),
+			}
+		}
+		l = append(l, int(vbid))
+	}
+	sort.Ints(l)
+
+	for _, vbid := range l {
+		if err := doTapTakeoverVBucket(b, uint16(vbid), r, chpkt, cherr); err != nil {
+			log.Printf("tap takeover of partition: %v, err: %v", vbid, err)
+			break
+		}
+	}
+	close(chpkt)
+	return &gomemcached.MCResponse{Fatal: true}
+}
+
+func doTapTakeoverVBucket(b Bucket, vbid uint16, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) (err error) {
+	vb, err := b.GetVBucket(vbid)
+	if vb == nil {
+		return fmt.Errorf("missing partition, err: %v", err)
+	}
+
+	var lastCas uint64
+	for round := 0; round < tapTakeoverRounds; round++ {
+		var n int
+		lastCas, n, err = tapSendChanges(vb, lastCas, chpkt, cherr)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	// A pending partition refuses client mutations, so the drain
+	// below sends the last of its changes.
+	if err = b.SetVBState(vbid, VBPending); err != nil {
+		return err
+	}
+	handedOver := false
+	defer func() {
+		// Until the receiver takes over, a failure hands the
+		// partition back to its clients.
+		if err != nil && !handedOver {
+			if errActive := b.SetVBState(vbid, VBActive); errActive != nil {
+				log.Printf("tap takeover: could not reactivate vbucket: %v,"+
+					" err: %v", vbid, errActive)
+			}
+		}
+	}()
+	if _, _, err = tapSendChanges(vb, lastCas, chpkt, cherr); err != nil {
+		return err
+	}
+
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_VBUCKET_SET,
+		VBucket: vbid,
+		Extras:  make([]byte, 8),
+		Body:    make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(pkt.Body, uint32(VBActive))
+	res, err := doTapAckPkt(r, chpkt, cherr, pkt)
+	if err != nil {
+		return err
+	}
+	if res.Status != gomemcached.SUCCESS {
+		return fmt.Errorf("receiver refused partition, status: %v, body: %s",
+			res.Status, res.Body)
+	}
+
+	// The receiver is active now, so the partition mustn't go back
+	// to active here, even if it can't be marked dead.
+	handedOver = true
+	if errDead := b.SetVBState(vbid, VBDead); errDead != nil {
+		return fmt.Errorf("could not mark partition dead, err: %v", errDead)
+	}
+	return nil
+}
+
+// Sends a vbucket's changes that are newer than fromCas, returning
+// the highest CAS seen and how many items were sent.
+func tapSendChanges(vb *VBucket, fromCas uint64,
+	chpkt chan<- transmissible, cherr <-chan error) (
+	lastCas uint64, n int, err error) {
+	lastCas = fromCas
+	var start []byte
+	if fromCas > 0 {
+		start = casBytes(fromCas + 1)
+	}
+	errVisit := vb.ps.visitChanges(start, true, func(i *item) bool {
+		if i.cas > lastCas {
+			lastCas = i.cas
+		}
+		if len(i.key) == 0 { // An empty key == metadata change.
+			return true
+		}
+		if i.isDeletion() {
+			chpkt <- tapDeletePkt(vb.vbid, i.key, i.cas)
+		} else {
+			pkt, errPkt := tapMutationPkt(vb.vbid, i)
+			if errPkt != nil {
+				err = errPkt
+				return false
+			}
+			chpkt <- pkt
+		}
+		n++
+		select {
+		case err = <-cherr:
+			return false
+		default:
+		}
+		return true
+	})
+	if errVisit != nil {
+		return lastCas, n, errVisit
+	}
+	return lastCas, n, err
+}
+
+// Applies a TAP packet sent to us by an upstream TAP source, so that
+// cbgb can act as a TAP receiver (such as for a replica).  Mutations
+// and deletions are applied with *_WITH_META semantics, preserving
+// the upstream's CAS, flags and exp.  A response is only sent if the
+// upstream asked for an ACK or if there was an error.  The connection
+// must have authenticated as the bucket, which the caller checks.
+func doTapReceive(b Bucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) < 8 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("wrong extras size for tap: %v", len(req.Extras))),
+		}
+	}
+	engineLen := int(binary.BigEndian.Uint16(req.Extras))
+	tapFlags := binary.BigEndian.Uint16(req.Extras[2:])
+
+	var res *gomemcached.MCResponse
+	switch req.Opcode {
+	case gomemcached.TAP_MUTATION, gomemcached.TAP_DELETE:
+		res = doTapReceiveItem(b, w, req, engineLen)
+	case gomemcached.TAP_VBUCKET_SET:
+		res = doTapReceiveVBucketSet(b, req, engineLen)
+	default: // Like TAP_OPAQUE, which we only need to ACK.
+		res = &gomemcached.MCResponse{}
+	}
+	if res.Status == gomemcached.SUCCESS && tapFlags&TAP_FLAG_ACK == 0 {
+		return nil
+	}
+	return res
+}
+
+func doTapReceiveItem(b Bucket, w io.Writer,
+	req *gomemcached.MCRequest, engineLen int) *gomemcached.MCResponse {
+	vb, _ := b.GetVBucket(req.VBucket)
+	if vb == nil {
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+	}
+	if s := vb.GetVBState(); s != VBReplica && s != VBPending {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+			Body:   []byte(fmt.Sprintf("tap receive into %v partition", s)),
+		}
+	}
+	if len(req.Body) < engineLen {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("tap engine-private length exceeds body"),
+		}
+	}
+
+	mreq := &gomemcached.MCRequest{
+		Opcode:  SET_WITH_META,
+		VBucket: req.VBucket,
+		Key:     req.Key,
+		Body:    req.Body[engineLen:],
+		Extras:  make([]byte, withMetaExtrasLen),
+	}
+	if req.Opcode == gomemcached.TAP_DELETE {
+		mreq.Opcode = DELETE_WITH_META
+		mreq.Body = nil
+	} else if len(req.Extras) >= 16 {
+		copy(mreq.Extras[0:8], req.Extras[8:16]) // Item flags & exp.
+	}
+	binary.BigEndian.PutUint64(mreq.Extras[16:], req.Cas)
+	if req.Cas == 0 {
+		// The upstream didn't provide a CAS, so fall back to
+		// regular semantics and generate a local CAS.
+		mreq.Opcode = gomemcached.SET
+		if req.Opcode == gomemcached.TAP_DELETE {
+			mreq.Opcode = gomemcached.DELETE
+		}
+		mreq.Extras = mreq.Extras[0:8]
+	}
+
+	res := vb.dispatch(w, mreq)
+	if res == nil {
+		return &gomemcached.MCResponse{}
+	}
+	switch res.Status {
+	case gomemcached.KEY_EEXISTS:
+		// A replayed or older mutation, as TAP is at-least-once.
+		return &gomemcached.MCResponse{}
+	case gomemcached.KEY_ENOENT:
+		if req.Opcode == gomemcached.TAP_DELETE {
+			return &gomemcached.MCResponse{}
+		}
+	}
+	return res
+}
+
+func doTapReceiveVBucketSet(b Bucket, req *gomemcached.MCRequest,
+	engineLen int) *gomemcached.MCResponse {
+	if len(req.Body) < engineLen+4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("missing tap vbucket state"),
+		}
+	}
+	s := binary.BigEndian.Uint32(req.Body[engineLen:])
+	if s < uint32(VBActive) || s > uint32(VBDead) {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("invalid tap vbucket state: %v", s)),
+		}
+	}
+	state := VBState(s)
+	vb, _ := b.GetVBucket(req.VBucket)
+	if vb == nil {
+		if int(req.VBucket) >= b.GetBucketSettings().NumPartitions {
+			return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+		}
+		if _, err := b.CreateVBucket(req.VBucket); err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("tap vbucket create err: %v", err)),
+			}
+		}
+	}
+	if err := b.SetVBState(req.VBucket, state); err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("tap vbucket set err: %v", err)),
+		}
+	}
+	return &gomemcached.MCResponse{}
 }
 
 func MutationLogger(ch chan interface{}) {
@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 	"unsafe"
@@ -191,11 +194,25 @@ func TestTapChanges(t *testing.T) {
 	vb0.observer.Submit(mutation{key: testKey})
 	mustNotTransmit("negative set")
 
-	// Verify we *don't* get a set on a pending vbucket.
+	// Verify we *don't* get a set on a pending vbucket, which
+	// refuses client mutations.
 	testBucket.SetVBState(0, VBPending)
 	time.Sleep(100 * time.Millisecond) // Let the state change settle
 	req.Opcode = gomemcached.SET
-	sendReq(req)
+	if res := rh.HandleMessage(ioutil.Discard, nil, req); res.Status !=
+		gomemcached.TMPFAIL {
+		t.Errorf("expected a set on a pending vbucket to fail, got: %v", res)
+	}
+	req.Opcode = SET_WITH_META
+	if res := rh.HandleMessage(ioutil.Discard, nil, req); res.Status !=
+		gomemcached.TMPFAIL {
+		t.Errorf("expected a set with meta on a pending vbucket to fail,"+
+			" got: %v", res)
+	}
+	if res := SetItem(testBucket, testKey, []byte("x"), VBPending); res == nil ||
+		res.Status != gomemcached.TMPFAIL {
+		t.Errorf("expected SetItem on a pending vbucket to fail, got: %v", res)
+	}
 	mustNotTransmit("negative set")
 
 	// Verify a change without a valid vbucket at all doesn't transmit
@@ -448,7 +465,461 @@ func TestTapBackFillBucket(t *testing.T) {
 	mustTransmit("post-DUMP-mutation", gomemcached.TAP_MUTATION)
 }
 
+func TestTapBackFillGapStress(t *testing.T) {
+	srcDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(srcDir)
+	src, _ := NewBucket("src", srcDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer src.Close()
+	src.CreateVBucket(0)
+	src.SetVBState(0, VBActive)
+	dstDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(dstDir)
+	dst, _ := NewBucket("dst", dstDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer dst.Close()
+	dst.CreateVBucket(0)
+	dst.SetVBState(0, VBReplica)
+
+	srcVB, _ := src.GetVBucket(0)
+	dstVB, _ := dst.GetVBucket(0)
+
+	numKeys := 1000
+	for i := 0; i < numKeys; i++ {
+		srcVB.Dispatch(nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(fmt.Sprintf("k%d", i)),
+			Body:   []byte("initial"),
+		})
+	}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	started := make(chan bool)
+	go func() {
+		first := true
+		for m := range chpkt {
+			req := m.(*gomemcached.MCRequest)
+			if first {
+				close(started)
+				first = false
+			}
+			res := doTapReceive(dst, ioutil.Discard, req)
+			if res != nil && res.Status != gomemcached.SUCCESS &&
+				req.Opcode != gomemcached.TAP_OPAQUE {
+				t.Errorf("expected tap receive to work, got: %v, for: %v",
+					res, req)
+			}
+		}
+	}()
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(treq.Extras, uint32(gomemcached.BACKFILL))
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	go doTap(src, treq, bytes.NewBuffer(ackRes.Bytes()), chpkt, cherr)
+
+	// Mutate heavily while the backfill runs, which has started once
+	// its first packet arrives.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-started
+			for i := 0; i < 2000; i++ {
+				k := []byte(fmt.Sprintf("k%d", (i*7+w*13)%numKeys))
+				op := gomemcached.SET
+				if i%5 == 0 {
+					op = gomemcached.DELETE
+				}
+				srcVB.Dispatch(nil, &gomemcached.MCRequest{
+					Opcode: op,
+					Key:    k,
+					Body:   []byte(fmt.Sprintf("w%d-%d", w, i)),
+				})
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	items := func(vb *VBucket) map[string]string {
+		m := map[string]string{}
+		vb.ps.visitItems(nil, true, func(i *item) bool {
+			m[string(i.key)] = fmt.Sprintf("%s/%d", i.data, i.cas)
+			return true
+		})
+		return m
+	}
+
+	var srcItems, dstItems map[string]string
+	for i := 0; i < 200; i++ {
+		srcItems, dstItems = items(srcVB), items(dstVB)
+		if reflect.DeepEqual(srcItems, dstItems) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(srcItems, dstItems) {
+		t.Errorf("expected identical datasets, got %v src items vs %v dst items",
+			len(srcItems), len(dstItems))
+	}
+	cherr <- io.EOF
+}
+
+func testTapVBucketListBody(vbids ...uint16) []byte {
+	b := make([]byte, 2+2*len(vbids))
+	binary.BigEndian.PutUint16(b, uint16(len(vbids)))
+	for i, vbid := range vbids {
+		binary.BigEndian.PutUint16(b[2+2*i:], vbid)
+	}
+	return b
+}
+
+func TestTapVBucketList(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	testBucket.CreateVBucket(1)
+	testBucket.SetVBState(1, VBActive)
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	sendReq(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 0,
+		Key:     []byte("a"),
+		Body:    []byte("0"),
+	})
+	sendReq(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 1,
+		Key:     []byte("b"),
+		Body:    []byte("1"),
+	})
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   append(make([]byte, 8), testTapVBucketListBody(1)...),
+	}
+	binary.BigEndian.PutUint32(treq.Extras,
+		uint32(gomemcached.BACKFILL|gomemcached.LIST_VBUCKETS))
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_OPAQUE,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, treq, ackBuf, chpkt, cherr)
+
+	req := mustTransmit("backfill", gomemcached.TAP_MUTATION)
+	if req.VBucket != 1 || string(req.Key) != "b" {
+		t.Fatalf("expected only vbucket 1 backfilled, got: %#v", req)
+	}
+	mustBeTapAck(mustTransmit("ack-wanted", gomemcached.TAP_OPAQUE))
+
+	time.Sleep(10 * time.Millisecond) // Let TAP get to new mutation.
+
+	sendReq(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 0,
+		Key:     []byte("not-listed"),
+		Body:    []byte("0"),
+	})
+	sendReq(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: 1,
+		Key:     []byte("listed"),
+		Body:    []byte("1"),
+	})
+	req = mustTransmit("forward", gomemcached.TAP_MUTATION)
+	if req.VBucket != 1 || string(req.Key) != "listed" {
+		t.Fatalf("expected only vbucket 1 forwarded, got: %#v", req)
+	}
+}
+
+func TestTapTakeover(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	testBucket.CreateVBucket(1)
+	testBucket.SetVBState(1, VBReplica)
+	rh := reqHandler{currentBucket: testBucket}
+
+	mkTakeover := func(vbids ...uint16) *gomemcached.MCRequest {
+		treq := &gomemcached.MCRequest{
+			Opcode: gomemcached.TAP_CONNECT,
+			Extras: make([]byte, 4),
+			Body:   testTapVBucketListBody(vbids...),
+		}
+		binary.BigEndian.PutUint32(treq.Extras,
+			uint32(gomemcached.TAKEOVER_VBUCKETS|gomemcached.LIST_VBUCKETS))
+		return treq
+	}
+
+	res := doTap(testBucket, mkTakeover(), nil, nil, nil)
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL on takeover without vbuckets, got: %v", res)
+	}
+	res = doTap(testBucket, mkTakeover(1), nil, nil, nil)
+	if res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("expected NOT_MY_VBUCKET on takeover of replica, got: %v", res)
+	}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	sendReq, mustTransmit, mustBeTapAck := makeMustTapFuncs(t, &rh, chpkt)
+
+	for _, k := range []string{"a", "b", "c"} {
+		sendReq(&gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte(k),
+			Body:   []byte(k),
+		})
+	}
+	sendReq(&gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("c"),
+	})
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_VBUCKET_SET,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, mkTakeover(0), ackBuf, chpkt, cherr)
+
+	mustTransmit("a", gomemcached.TAP_MUTATION)
+	mustTransmit("b", gomemcached.TAP_MUTATION)
+	req := mustTransmit("c", gomemcached.TAP_DELETE)
+	if string(req.Key) != "c" || req.Cas == 0 {
+		t.Errorf("expected delete of c with a cas, got: %#v", req)
+	}
+	req = mustTransmit("vbucket set", gomemcached.TAP_VBUCKET_SET)
+	mustBeTapAck(req)
+	if req.VBucket != 0 ||
+		VBState(binary.BigEndian.Uint32(req.Body)) != VBActive {
+		t.Errorf("expected vbucket 0 set to active, got: %#v", req)
+	}
+
+	select {
+	case m, ok := <-chpkt:
+		if ok {
+			t.Fatalf("expected tap stream to end, got: %v", m)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("expected tap stream to end after takeover")
+	}
+	vb, _ := testBucket.GetVBucket(0)
+	if vb.GetVBState() != VBDead {
+		t.Errorf("expected taken over partition to be dead, got: %v",
+			vb.GetVBState())
+	}
+}
+
+func TestTapTakeoverRefused(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBActive)
+	rh := reqHandler{currentBucket: testBucket}
+
+	chpkt := make(chan transmissible, 128)
+	cherr := make(chan error, 1)
+	_, mustTransmit, _ := makeMustTapFuncs(t, &rh, chpkt)
+
+	treq := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_CONNECT,
+		Extras: make([]byte, 4),
+		Body:   testTapVBucketListBody(0),
+	}
+	binary.BigEndian.PutUint32(treq.Extras,
+		uint32(gomemcached.TAKEOVER_VBUCKETS|gomemcached.LIST_VBUCKETS))
+
+	ackRes := &gomemcached.MCResponse{
+		Opcode: gomemcached.TAP_VBUCKET_SET,
+		Status: gomemcached.NOT_MY_VBUCKET,
+	}
+	ackBuf := bytes.NewBuffer(ackRes.Bytes())
+
+	go doTap(rh.currentBucket, treq, ackBuf, chpkt, cherr)
+
+	mustTransmit("vbucket set", gomemcached.TAP_VBUCKET_SET)
+	select {
+	case <-chpkt:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("expected tap stream to end after refused takeover")
+	}
+	vb, _ := testBucket.GetVBucket(0)
+	if vb.GetVBState() != VBActive {
+		t.Errorf("expected refused partition to be active again, got: %v",
+			vb.GetVBState())
+	}
+}
+
+func TestTapReceive(t *testing.T) {
+	testBucketDir, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(testBucketDir)
+	testBucket, _ := NewBucket("test", testBucketDir,
+		&BucketSettings{
+			NumPartitions: MAX_VBUCKETS,
+		})
+	defer testBucket.Close()
+	testBucket.CreateVBucket(0)
+	testBucket.SetVBState(0, VBReplica)
+	rh := reqHandler{currentBucket: testBucket}
+
+	mkTapReq := func(op gomemcached.CommandCode, key string, cas uint64,
+		ack bool) *gomemcached.MCRequest {
+		req := &gomemcached.MCRequest{
+			Opcode: op,
+			Key:    []byte(key),
+			Cas:    cas,
+			Extras: make([]byte, 8),
+		}
+		if op == gomemcached.TAP_MUTATION {
+			req.Extras = make([]byte, 16)
+			binary.BigEndian.PutUint32(req.Extras[8:], 0x1234)
+			binary.BigEndian.PutUint32(req.Extras[12:], 0)
+			req.Body = []byte("val-" + key)
+		}
+		if ack {
+			binary.BigEndian.PutUint16(req.Extras[2:], TAP_FLAG_ACK)
+		}
+		return req
+	}
+
+	// Receiving needs the connection to have authenticated as the bucket.
+	for _, op := range []gomemcached.CommandCode{gomemcached.TAP_MUTATION,
+		gomemcached.TAP_DELETE, gomemcached.TAP_VBUCKET_SET} {
+		res := rh.HandleMessage(ioutil.Discard, nil, mkTapReq(op, "a", 1000, true))
+		if res == nil || res.Status != AUTH_ERROR {
+			t.Fatalf("expected AUTH_ERROR for unauthenticated %v, got: %v", op, res)
+		}
+	}
+	rh.currentBucketName = "test"
+	rh.sasl.user = "test"
+
+	res := rh.HandleMessage(ioutil.Discard, nil,
+		mkTapReq(gomemcached.TAP_MUTATION, "a", 1000, false))
+	if res != nil {
+		t.Fatalf("expected no response without ACK, got: %v", res)
+	}
+	res = testGet(&rh, 0, "a")
+	if res.Status != gomemcached.SUCCESS || res.Cas != 1000 ||
+		!bytes.Equal(res.Body, []byte("val-a")) ||
+		binary.BigEndian.Uint32(res.Extras) != 0x1234 {
+		t.Fatalf("expected tap received item with preserved meta, got: %v", res)
+	}
+
+	// A replayed mutation is ACK'ed but not re-applied.
+	res = rh.HandleMessage(ioutil.Discard, nil,
+		mkTapReq(gomemcached.TAP_MUTATION, "a", 1000, true))
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected ACK of replayed mutation, got: %v", res)
+	}
+
+	// Local CAS's must stay ahead of received CAS's.
+	vb, _ := testBucket.GetVBucket(0)
+	if vb.Meta().LastCas < 1000 {
+		t.Fatalf("expected LastCas to be bumped, got: %v", vb.Meta().LastCas)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil,
+		mkTapReq(gomemcached.TAP_DELETE, "a", 1001, true))
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected ACK of tap delete, got: %v", res)
+	}
+	res = testGet(&rh, 0, "a")
+	if res.Status != gomemcached.KEY_ENOENT {
+		t.Fatalf("expected tap deleted item to be gone, got: %v", res)
+	}
+
+	res = rh.HandleMessage(ioutil.Discard, nil,
+		mkTapReq(gomemcached.TAP_OPAQUE, "", 0, true))
+	if res == nil || res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected ACK of tap opaque, got: %v", res)
+	}
+
+	vbsetReq := mkTapReq(gomemcached.TAP_VBUCKET_SET, "", 0, false)
+	vbsetReq.VBucket = 1
+	vbsetReq.Body = make([]byte, 4)
+	binary.BigEndian.PutUint32(vbsetReq.Body, uint32(VBActive))
+	res = rh.HandleMessage(ioutil.Discard, nil, vbsetReq)
+	if res != nil {
+		t.Fatalf("expected no response for tap vbucket set, got: %v", res)
+	}
+	vb1, _ := testBucket.GetVBucket(1)
+	if vb1 == nil || vb1.GetVBState() != VBActive {
+		t.Fatalf("expected tap vbucket set to create active vbucket 1")
+	}
+
+	// Active partitions don't accept tap mutations.
+	req := mkTapReq(gomemcached.TAP_MUTATION, "b", 2000, false)
+	req.VBucket = 1
+	res = rh.HandleMessage(ioutil.Discard, nil, req)
+	if res == nil || res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Fatalf("expected NOT_MY_VBUCKET for tap into active, got: %v", res)
+	}
+}
+
 func TestSizeOfMutation(t *testing.T) {
 	t.Logf("sizeof various structs and types, in bytes...")
 	t.Logf("  Sizeof(mutation{}): %v", unsafe.Sizeof(mutation{}))
 }
+
+func TestTapStreamDrain(t *testing.T) {
+	ts := newTapStream()
+	ts.startDrain()
+	for i := 0; i < 3000; i++ {
+		ts.mch <- mutation{
+			vb:  uint16(i % 2),
+			key: []byte(fmt.Sprintf("k%d", i%10)),
+			cas: uint64(i + 1),
+		}
+	}
+	ts.stopDrain()
+	ms := ts.takePending()
+	if len(ms) != 10 {
+		t.Fatalf("expected 10 pending mutations, got: %v", len(ms))
+	}
+	for i, m := range ms {
+		if m.cas != uint64(2990+i+1) {
+			t.Errorf("expected the latest cas in order, got: %v", m)
+		}
+	}
+	if len(ts.takePending()) != 0 {
+		t.Errorf("expected no pending mutations after take")
+	}
+}
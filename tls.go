@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you
+// may not use this file except in compliance with the License. You
+// may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+)
+
+// Loads the server's certificate and key.  With a client CA file,
+// clients may also present a certificate signed by that CA, whose
+// common name (CN) then authenticates them as that bucket.
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls cert: %v, key: %v, err: %v",
+			certFile, keyFile, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certs in tls client CA file: %v",
+				clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func StartTLSServer(addr string, maxConns int, buckets *Buckets,
+	defaultBucketName string, config *tls.Config) (net.Listener, error) {
+	ls, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go waitForConnections(ls, maxConns, buckets, defaultBucketName,
+		sessionLoop)
+	return ls, nil
+}
+
+// Returns the common name of a verified client certificate, or "".
+func tlsCertUser(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 ||
+		len(cs.PeerCertificates) == 0 {
+		return ""
+	}
+	return cs.PeerCertificates[0].Subject.CommonName
+}
+
+// Completes a TLS connection's handshake, and authenticates the
+// connection as the bucket named by the client certificate, if any.
+// Plain connections are left as is.
+func (rh *reqHandler) doTLSAuth(s io.ReadWriteCloser) error {
+	tc, ok := s.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	cs := tc.ConnectionState()
+	user := tlsCertUser(&cs)
+	if user == "" {
+		return nil
+	}
+	b := rh.buckets.Get(user)
+	if b == nil {
+		return nil
+	}
+	rh.sasl.user = user
+	rh.currentBucket = b
+	rh.currentBucketName = user
+	return nil
+}
+
+// Serves http, or https when there's a tls config.
+func restServe(addr string, config *tls.Config, h http.Handler) error {
+	if config == nil {
+		return http.ListenAndServe(addr, h)
+	}
+	ls, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	return (&http.Server{Addr: addr, Handler: h, TLSConfig: config}).Serve(ls)
+}
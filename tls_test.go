@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Makes a certificate signed by parent, or a self-signed CA when
+// parent is nil.
+func testMakeCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("expected key generation to work, err: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("expected cert creation to work, err: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	tc, _ := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	return tc
+}
+
+// Writes a CA and a server cert, returning their file names.
+func testWriteTLSFiles(t *testing.T, d string) (*testCert, string, string, string) {
+	ca := testMakeCert(t, "cbgb test CA", nil)
+	server := testMakeCert(t, "127.0.0.1", ca)
+	files := map[string][]byte{
+		"cert.pem": server.certPEM,
+		"key.pem":  server.keyPEM,
+		"ca.pem":   ca.certPEM,
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(d, name), b, 0600); err != nil {
+			t.Fatalf("expected write to work, err: %v", err)
+		}
+	}
+	return ca, filepath.Join(d, "cert.pem"), filepath.Join(d, "key.pem"),
+		filepath.Join(d, "ca.pem")
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	_, certFile, keyFile, caFile := testWriteTLSFiles(t, d)
+
+	config, err := LoadTLSConfig(certFile, keyFile, "")
+	if err != nil || len(config.Certificates) != 1 ||
+		config.ClientAuth != tls.NoClientCert {
+		t.Errorf("expected tls config without client auth, got: %v, %v",
+			config, err)
+	}
+	config, err = LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil || config.ClientCAs == nil ||
+		config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("expected tls config with client auth, got: %v, %v",
+			config, err)
+	}
+
+	if _, err = LoadTLSConfig(certFile, caFile, ""); err == nil {
+		t.Errorf("expected mismatched key to fail")
+	}
+	if _, err = LoadTLSConfig(certFile, keyFile, filepath.Join(d, "nope")); err == nil {
+		t.Errorf("expected missing client CA to fail")
+	}
+	if _, err = LoadTLSConfig(certFile, keyFile, keyFile); err == nil {
+		t.Errorf("expected client CA without certs to fail")
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	d, _ := ioutil.TempDir("./tmp", "test")
+	defer os.RemoveAll(d)
+	ca, certFile, keyFile, caFile := testWriteTLSFiles(t, d)
+
+	b, err := NewBuckets(d, &BucketSettings{NumPartitions: 1})
+	if err != nil {
+		t.Fatalf("Error with NewBuckets: %v", err)
+	}
+	defer b.CloseAll()
+	foo, err := b.New("foo", &BucketSettings{NumPartitions: 1,
+		PasswordHash: "secret"})
+	if err != nil {
+		t.Fatalf("Error with New bucket: %v", err)
+	}
+	foo.CreateVBucket(0)
+	foo.SetVBState(0, VBActive)
+
+	config, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Error loading tls config: %v", err)
+	}
+	l, err := StartTLSServer("127.0.0.1:0", 100, b, "", config)
+	if err != nil {
+		t.Fatalf("Error starting tls listener: %v", err)
+	}
+	defer l.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(certs []tls.Certificate) *gomemcached.MCResponse {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			t.Fatalf("Error connecting to %v: %v", l.Addr(), err)
+		}
+		defer c.Close()
+		req := &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}
+		if _, err = c.Write(req.Bytes()); err != nil {
+			t.Fatalf("Error sending get: %v", err)
+		}
+		res, err := readTapAck(c)
+		if err != nil {
+			t.Fatalf("Error reading get response: %v", err)
+		}
+		return res
+	}
+
+	// Without a default bucket, an unauthenticated get has no bucket.
+	if res := get(nil); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected no bucket without a client cert, got: %v", res)
+	}
+	client := testMakeCert(t, "foo", ca)
+	if res := get([]tls.Certificate{client.tlsCertificate()}); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected client cert to auth as foo, got: %v", res)
+	}
+	other := testMakeCert(t, "notabucket", ca)
+	if res := get([]tls.Certificate{other.tlsCertificate()}); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected client cert for a missing bucket to not auth, got: %v", res)
+	}
+}
+
+func TestTLSCertUser(t *testing.T) {
+	ca := testMakeCert(t, "cbgb test CA", nil)
+	client := testMakeCert(t, "foo", ca)
+
+	if u := tlsCertUser(nil); u != "" {
+		t.Errorf("expected no user without tls, got: %v", u)
+	}
+	cs := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}}
+	if u := tlsCertUser(cs); u != "" {
+		t.Errorf("expected no user for an unverified cert, got: %v", u)
+	}
+	cs.VerifiedChains = [][]*x509.Certificate{{client.cert, ca.cert}}
+	if u := tlsCertUser(cs); u != "foo" {
+		t.Errorf("expected user foo, got: %v", u)
+	}
+}
+
+func TestTLSCertHTTPAuth(t *testing.T) {
+	origUser := adminUser
+	defer func() { adminUser = origUser }()
+	admin := "admin"
+	adminUser = &admin
+
+	d, _ := testSetupBuckets(t, 1)
+	defer os.RemoveAll(d)
+	b, _ := buckets.New("foo", &BucketSettings{PasswordHash: "bar"})
+	defer b.Close()
+
+	ca := testMakeCert(t, "cbgb test CA", nil)
+
+	var got httpUser
+	h := authenticationFilter{http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = currentUser(r)
+		})}
+
+	for _, cn := range []string{"foo", "admin", "notabucket"} {
+		cert := testMakeCert(t, cn, ca).cert
+		r, _ := http.NewRequest("GET", "https://127.0.0.1/pools", nil)
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert, ca.cert}},
+		}
+		got = ""
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		exp := httpUser("")
+		if cn == "foo" {
+			exp = "foo"
+		}
+		if got != exp {
+			t.Errorf("expected client cert %v to auth as %q, got: %q",
+				cn, exp, got)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/server"
+)
+
+// UPR is a sequence number based change stream protocol, where a
+// vbucket's sequence numbers are its CAS's, as the changes collection
+// is keyed by CAS.  A client sends UPR_OPEN, which turns the
+// connection into a UPR connection, and then opens per-vbucket
+// streams with UPR_STREAM_REQ.  Each stream sends snapshot markers,
+// followed by the mutations, deletions and expirations in the
+// snapshot, and finally a stream end once the requested end sequence
+// number is reached.  A client resumes after a disconnect by
+// requesting a stream that starts from the last sequence number it
+// processed.  A consumer that's a replica acknowledges the changes it
+// has applied with UPR_SEQNO_ACK, which is only accepted for seqnos
+// that were sent on the connection.  UPR_OPEN needs the connection to
+// have authenticated as the bucket, as the connection's name becomes
+// a replica of it.
+const (
+	// TODO: Graduate these to gomemcached one day.
+	UPR_OPEN            = gomemcached.CommandCode(0x50)
+	UPR_CLOSE_STREAM    = gomemcached.CommandCode(0x52)
+	UPR_STREAM_REQ      = gomemcached.CommandCode(0x53)
+	UPR_STREAM_END      = gomemcached.CommandCode(0x55)
+	UPR_SNAPSHOT_MARKER = gomemcached.CommandCode(0x56)
+	UPR_MUTATION        = gomemcached.CommandCode(0x57)
+	UPR_DELETION        = gomemcached.CommandCode(0x58)
+	UPR_EXPIRATION      = gomemcached.CommandCode(0x59)
+	UPR_NOOP            = gomemcached.CommandCode(0x5c)
+	UPR_BUFFER_ACK      = gomemcached.CommandCode(0x5d)
+	UPR_CONTROL         = gomemcached.CommandCode(0x5e)
+	UPR_SEQNO_ACK       = gomemcached.CommandCode(0x65)
+
+	UPR_ROLLBACK = gomemcached.Status(0x23)
+)
+
+// The reasons in the extras of a UPR_STREAM_END.
+const (
+	UPR_STREAM_END_OK            = uint32(0x00)
+	UPR_STREAM_END_STATE_CHANGED = uint32(0x02)
+)
+
+// The flags in the extras of a UPR_SNAPSHOT_MARKER.
+const (
+	UPR_SNAPSHOT_MEMORY = uint32(0x01)
+	UPR_SNAPSHOT_DISK   = uint32(0x02)
+)
+
+// The UPR_STREAM_REQ extras are flags (4), reserved (4), start seqno
+// (8), end seqno (8), vbucket uuid (8), snapshot start seqno (8) and
+// snapshot end seqno (8).
+const uprStreamReqExtrasLen = 48
+
+// How often a stream double-checks its vbucket's state.
+var uprTickFreq = time.Second
+
+type uprConn struct {
+	b     Bucket
+	name  string
+	chpkt chan<- transmissible
+	wg    sync.WaitGroup
+
+	lock       sync.Mutex
+	cond       *sync.Cond
+	streams    map[uint16]*uprStream
+	bufferSize uint32 // Zero means no flow control.
+	unacked    uint32 // Stream bytes sent but not yet buffer-ack'ed.
+	compressed bool   // Whether snappy compressed values may be sent.
+
+	// Per vbucket, the highest seqno sent on any of the connection's
+	// streams, which bounds the seqnos the consumer may ack.
+	sent map[uint16]uint64
+}
+
+type uprStream struct {
+	vbid     uint16
+	opaque   uint32
+	start    uint64
+	end      uint64
+	mch      chan interface{}
+	closech  chan bool
+	isClosed bool // Protected by uprConn.lock.
+}
+
+func doUpr(b Bucket, req *gomemcached.MCRequest, r io.Reader,
+	chpkt chan<- transmissible, cherr <-chan error) *gomemcached.MCResponse {
+	c := &uprConn{
+		b:       b,
+		name:    string(req.Key),
+		chpkt:   chpkt,
+		streams: map[uint16]*uprStream{},
+		sent:    map[uint16]uint64{},
+	}
+	c.cond = sync.NewCond(&c.lock)
+
+	chpkt <- &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+
+	for {
+		creq, err := memcached.ReadPacket(r)
+		if err != nil {
+			break
+		}
+		res := c.handle(&creq)
+		if res != nil {
+			res.Opcode = creq.Opcode
+			res.Opaque = creq.Opaque
+			chpkt <- res
+		}
+	}
+
+	c.lock.Lock()
+	for _, s := range c.streams {
+		c.closeStreamLOCKED(s)
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	c.wg.Wait()
+	close(chpkt)
+	return &gomemcached.MCResponse{Fatal: true}
+}
+
+func (c *uprConn) handle(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case UPR_STREAM_REQ:
+		return c.streamReq(req)
+	case UPR_CLOSE_STREAM:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		s := c.streams[req.VBucket]
+		if s == nil {
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		}
+		c.closeStreamLOCKED(s)
+		return &gomemcached.MCResponse{}
+	case UPR_BUFFER_ACK:
+		if len(req.Extras) < 4 {
+			return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+		}
+		n := binary.BigEndian.Uint32(req.Extras)
+		c.lock.Lock()
+		if n > c.unacked {
+			n = c.unacked
+		}
+		c.unacked -= n
+		c.cond.Broadcast()
+		c.lock.Unlock()
+		return nil
+	case UPR_CONTROL:
+		return c.control(string(req.Key), string(req.Body))
+	case UPR_SEQNO_ACK:
+		// The consumer has applied every change up to the seqno (8)
+		// in the extras, so the connection's name is a replica.
+		if len(req.Extras) < 8 {
+			return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+		}
+		seqno := binary.BigEndian.Uint64(req.Extras)
+		c.lock.Lock()
+		sent := c.sent[req.VBucket]
+		c.lock.Unlock()
+		if seqno > sent {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("ack of unsent seqno: %v", seqno)),
+			}
+		}
+		if vb, _ := c.b.GetVBucket(req.VBucket); vb != nil {
+			vb.noteReplicaCas(c.name, seqno)
+		}
+		return nil
+	case UPR_NOOP:
+		return &gomemcached.MCResponse{}
+	}
+	return &gomemcached.MCResponse{
+		Status: gomemcached.UNKNOWN_COMMAND,
+		Body:   []byte(fmt.Sprintf("Unknown upr command %v", req.Opcode)),
+	}
+}
+
+func (c *uprConn) control(key, val string) *gomemcached.MCResponse {
+	switch key {
+	case "connection_buffer_size":
+		n, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("invalid buffer size: %v", val)),
+			}
+		}
+		c.lock.Lock()
+		c.bufferSize = uint32(n)
+		c.cond.Broadcast()
+		c.lock.Unlock()
+		return &gomemcached.MCResponse{}
+	case "enable_value_compression":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("invalid value compression: %v", val)),
+			}
+		}
+		c.lock.Lock()
+		c.compressed = b
+		c.lock.Unlock()
+		return &gomemcached.MCResponse{}
+	}
+	return &gomemcached.MCResponse{
+		Status: gomemcached.EINVAL,
+		Body:   []byte(fmt.Sprintf("unknown upr control: %v", key)),
+	}
+}
+
+func (c *uprConn) streamReq(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) < uprStreamReqExtrasLen {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("wrong extras size for stream req: %v", len(req.Extras))),
+		}
+	}
+	start := binary.BigEndian.Uint64(req.Extras[8:])
+	end := binary.BigEndian.Uint64(req.Extras[16:])
+	if start > end {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("stream start %v > end %v", start, end)),
+		}
+	}
+
+	vb, _ := c.b.GetVBucket(req.VBucket)
+	if vb == nil || vb.GetVBState() != VBActive {
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+	}
+
+	// Streams are only added by this connection's reader goroutine.
+	c.lock.Lock()
+	exists := c.streams[req.VBucket] != nil
+	c.lock.Unlock()
+	if exists {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte("stream already open for vbucket"),
+		}
+	}
+
+	s := &uprStream{
+		vbid:    req.VBucket,
+		opaque:  req.Opaque,
+		start:   start,
+		end:     end,
+		mch:     make(chan interface{}, 100),
+		closech: make(chan bool),
+	}
+
+	// Register before reading the high seqno, so any mutation after
+	// it wakes up the stream.
+	vb.observer.Register(s.mch)
+	high := uprHighSeqno(vb)
+	if start > high {
+		vb.observer.Unregister(s.mch)
+		res := &gomemcached.MCResponse{Status: UPR_ROLLBACK, Body: make([]byte, 8)}
+		binary.BigEndian.PutUint64(res.Body, high)
+		return res
+	}
+
+	c.lock.Lock()
+	c.streams[s.vbid] = s
+	c.lock.Unlock()
+
+	// The response has to go out before the stream's first message.
+	c.chpkt <- &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+
+	c.wg.Add(1)
+	go c.runStream(s, vb)
+	return nil
+}
+
+// Returns the highest seqno (CAS) where every mutation at or below
+// it has reached the changes collection.
+func uprHighSeqno(vb *VBucket) (high uint64) {
+	vb.Apply(func() {
+		high = atomic.LoadUint64(&vb.Meta().LastCas)
+	})
+	return high
+}
+
+func (c *uprConn) closeStreamLOCKED(s *uprStream) {
+	if !s.isClosed {
+		s.isClosed = true
+		close(s.closech)
+		delete(c.streams, s.vbid)
+		c.cond.Broadcast()
+	}
+}
+
+func (c *uprConn) runStream(s *uprStream, vb *VBucket) {
+	defer c.wg.Done()
+
+	// Relay mutations into coalesced wakeups, so a stream that's
+	// waiting on flow control never blocks the vbucket's observer.
+	wakech := make(chan bool, 1)
+	relaydone := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-s.mch:
+				select {
+				case wakech <- true:
+				default:
+				}
+			case <-relaydone:
+				return
+			}
+		}
+	}()
+	defer close(relaydone)
+	defer vb.observer.Unregister(s.mch)
+
+	ticker := time.NewTicker(uprTickFreq)
+	defer ticker.Stop()
+
+	flags := UPR_SNAPSHOT_DISK
+	lastSent := s.start
+	for {
+		if vb.GetVBState() != VBActive {
+			c.endStream(s, UPR_STREAM_END_STATE_CHANGED)
+			return
+		}
+		high := uprHighSeqno(vb)
+		if high > s.end {
+			high = s.end
+		}
+		if high > lastSent {
+			if !c.sendSnapshot(s, vb, lastSent, high, flags) {
+				return
+			}
+			c.noteSent(s.vbid, high)
+			lastSent = high
+			flags = UPR_SNAPSHOT_MEMORY
+		}
+		if lastSent >= s.end {
+			c.endStream(s, UPR_STREAM_END_OK)
+			return
+		}
+
+		select {
+		case <-wakech: // The mutations are in the changes collection.
+		case <-ticker.C:
+		case <-s.closech:
+			return
+		}
+	}
+}
+
+// Sends a snapshot marker and the changes in (from, to].
+func (c *uprConn) sendSnapshot(s *uprStream, vb *VBucket,
+	from, to uint64, flags uint32) bool {
+	marker := &gomemcached.MCRequest{
+		Opcode:  UPR_SNAPSHOT_MARKER,
+		VBucket: s.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 20),
+	}
+	binary.BigEndian.PutUint64(marker.Extras, from+1)
+	binary.BigEndian.PutUint64(marker.Extras[8:], to)
+	binary.BigEndian.PutUint32(marker.Extras[16:], flags)
+	if !c.send(s, marker, 0) {
+		return false
+	}
+
+	c.lock.Lock()
+	compressed := c.compressed
+	c.lock.Unlock()
+
+	ok := true
+	now := time.Now()
+	var pktErr error
+	err := vb.ps.visitChanges(casBytes(from+1), true, func(i *item) bool {
+		if i.cas > to {
+			return false
+		}
+		if len(i.key) == 0 { // An empty key == metadata change.
+			return true
+		}
+		var pkt *gomemcached.MCRequest
+		var datatype uint8
+		pkt, datatype, pktErr = uprItemPkt(s, i, now, compressed)
+		if pktErr != nil {
+			return false
+		}
+		ok = c.send(s, pkt, datatype)
+		return ok
+	})
+	if err != nil || pktErr != nil {
+		c.endStream(s, UPR_STREAM_END_STATE_CHANGED)
+		return false
+	}
+	return ok
+}
+
+// Returns a stream message for an item, along with the datatype for
+// its header.  Snappy compressed values are sent as is when the client
+// enabled value compression, and other values are decompressed.
+func uprItemPkt(s *uprStream, i *item, now time.Time, compressed bool) (
+	*gomemcached.MCRequest, uint8, error) {
+	pkt := &gomemcached.MCRequest{
+		VBucket: s.vbid,
+		Opaque:  s.opaque,
+		Key:     i.key,
+		Cas:     i.cas,
+	}
+	var datatype uint8
+	if i.isDeletion() || i.isExpired(now) {
+		// Extras are by seqno (8), rev seqno (8) and meta length (2).
+		pkt.Opcode = UPR_DELETION
+		if !i.isDeletion() {
+			pkt.Opcode = UPR_EXPIRATION
+		}
+		pkt.Extras = make([]byte, 18)
+	} else {
+		// Extras are by seqno (8), rev seqno (8), flags (4), exp
+		// (4), lock time (4), meta length (2) and nru (1).
+		pkt.Opcode = UPR_MUTATION
+		pkt.Extras = make([]byte, 31)
+		binary.BigEndian.PutUint32(pkt.Extras[16:], i.flag)
+		binary.BigEndian.PutUint32(pkt.Extras[20:], i.exp)
+		if compressed && i.datatype == DATATYPE_SNAPPY {
+			pkt.Body = i.data
+			datatype = PROTOCOL_DATATYPE_SNAPPY
+		} else {
+			data, err := i.value()
+			if err != nil {
+				return nil, 0, err
+			}
+			pkt.Body = data
+		}
+	}
+	binary.BigEndian.PutUint64(pkt.Extras, i.cas)
+	binary.BigEndian.PutUint64(pkt.Extras[8:], i.cas)
+	return pkt, datatype, nil
+}
+
+// A request whose header has a datatype, which gomemcached's
+// MCRequest doesn't have a field for.
+type datatypeRequest struct {
+	*gomemcached.MCRequest
+	datatype uint8
+}
+
+func (r datatypeRequest) Transmit(w io.Writer) error {
+	b := r.Bytes()
+	b[5] = r.datatype // After the magic, opcode, key length and extras length.
+	_, err := w.Write(b)
+	return err
+}
+
+func (c *uprConn) endStream(s *uprStream, reason uint32) {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_END,
+		VBucket: s.vbid,
+		Opaque:  s.opaque,
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(pkt.Extras, reason)
+	if c.send(s, pkt, 0) {
+		c.lock.Lock()
+		c.closeStreamLOCKED(s)
+		c.lock.Unlock()
+	}
+}
+
+// Sends a stream message with the given header datatype, first
+// waiting for buffer-acks if the client's flow control buffer is
+// full.  Returns false if the stream or connection was closed.
+// Records that a stream's snapshot up to a seqno has been sent, even
+// if its last changes were metadata changes that aren't streamed.
+func (c *uprConn) noteSent(vbid uint16, seqno uint64) {
+	c.lock.Lock()
+	if seqno > c.sent[vbid] {
+		c.sent[vbid] = seqno
+	}
+	c.lock.Unlock()
+}
+
+func (c *uprConn) send(s *uprStream, pkt *gomemcached.MCRequest,
+	datatype uint8) bool {
+	n := uint32(gomemcached.HDR_LEN + len(pkt.Extras) + len(pkt.Key) + len(pkt.Body))
+
+	c.lock.Lock()
+	for !s.isClosed && c.bufferSize > 0 &&
+		c.unacked > 0 && c.unacked+n > c.bufferSize {
+		c.cond.Wait()
+	}
+	if s.isClosed {
+		c.lock.Unlock()
+		return false
+	}
+	if c.bufferSize > 0 {
+		c.unacked += n
+	}
+	if pkt.Opcode != UPR_SNAPSHOT_MARKER && pkt.Cas > c.sent[s.vbid] {
+		c.sent[s.vbid] = pkt.Cas
+	}
+	c.lock.Unlock()
+
+	if datatype != 0 {
+		c.chpkt <- datatypeRequest{pkt, datatype}
+	} else {
+		c.chpkt <- pkt
+	}
+	return true
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/server"
+)
+
+type uprTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func testUprConn(t *testing.T, numItems int) (*uprTestConn, Bucket, func()) {
+	d, bs, b := testReplicationBuckets(t)
+	b.CreateVBucket(0)
+	b.SetVBState(0, VBActive)
+	for i := 0; i < numItems; i++ {
+		SetItem(b, []byte(strconv.Itoa(i)), []byte("v"), VBActive)
+	}
+	l, err := StartServer("127.0.0.1:0", 100, bs, DEFAULT_BUCKET_NAME)
+	if err != nil {
+		t.Fatalf("Error starting listener: %v", err)
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v", l.Addr(), err)
+	}
+	c := &uprTestConn{t, conn, bufio.NewReader(conn)}
+	c.send(&gomemcached.MCRequest{Opcode: UPR_OPEN, Key: []byte("test")})
+	if res := c.mustRes(UPR_OPEN); res.Status != AUTH_ERROR {
+		t.Fatalf("expected UPR_OPEN without SASL auth to fail, got: %v", res)
+	}
+	c.send(&gomemcached.MCRequest{Opcode: gomemcached.SASL_AUTH,
+		Key: []byte("PLAIN"), Body: []byte("\x00" + DEFAULT_BUCKET_NAME + "\x00")})
+	if res := c.mustRes(gomemcached.SASL_AUTH); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected SASL_AUTH to work, got: %v", res)
+	}
+	c.send(&gomemcached.MCRequest{Opcode: UPR_OPEN, Key: []byte("test")})
+	if res := c.mustRes(UPR_OPEN); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected UPR_OPEN to work, got: %v", res)
+	}
+	return c, b, func() {
+		conn.Close()
+		l.Close()
+		bs.CloseAll()
+		os.RemoveAll(d)
+	}
+}
+
+func (c *uprTestConn) send(req *gomemcached.MCRequest) {
+	if err := req.Transmit(c.conn); err != nil {
+		c.t.Fatalf("expected send to work, err: %v", err)
+	}
+}
+
+// Returns the next server message, or nils if there isn't one soon.
+func (c *uprTestConn) read(wait time.Duration) (
+	*gomemcached.MCRequest, *gomemcached.MCResponse) {
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	magic, err := c.br.Peek(1)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, nil
+		}
+		c.t.Fatalf("expected read to work, err: %v", err)
+	}
+	if magic[0] == gomemcached.RES_MAGIC {
+		res, err := readTapAck(c.br)
+		if err != nil {
+			c.t.Fatalf("expected res read to work, err: %v", err)
+		}
+		return nil, res
+	}
+	req, err := memcached.ReadPacket(c.br)
+	if err != nil {
+		c.t.Fatalf("expected req read to work, err: %v", err)
+	}
+	return &req, nil
+}
+
+func (c *uprTestConn) mustRes(op gomemcached.CommandCode) *gomemcached.MCResponse {
+	req, res := c.read(time.Second)
+	if res == nil || res.Opcode != op {
+		c.t.Fatalf("expected %v response, got: %v, %v", op, req, res)
+	}
+	return res
+}
+
+func (c *uprTestConn) mustReq(op gomemcached.CommandCode) *gomemcached.MCRequest {
+	req, res := c.read(time.Second)
+	if req == nil || req.Opcode != op {
+		c.t.Fatalf("expected %v, got: %v, %v", op, req, res)
+	}
+	return req
+}
+
+func (c *uprTestConn) mustNothing() {
+	if req, res := c.read(50 * time.Millisecond); req != nil || res != nil {
+		c.t.Fatalf("expected nothing, got: %v, %v", req, res)
+	}
+}
+
+func uprStreamReq(vbid uint16, start, end uint64) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode:  UPR_STREAM_REQ,
+		VBucket: vbid,
+		Opaque:  0x1234,
+		Extras:  make([]byte, uprStreamReqExtrasLen),
+	}
+	binary.BigEndian.PutUint64(req.Extras[8:], start)
+	binary.BigEndian.PutUint64(req.Extras[16:], end)
+	return req
+}
+
+func uprSeqno(req *gomemcached.MCRequest) uint64 {
+	return binary.BigEndian.Uint64(req.Extras)
+}
+
+func TestUprStream(t *testing.T) {
+	c, b, done := testUprConn(t, 3)
+	defer done()
+
+	c.send(uprStreamReq(0, 0, math.MaxUint64))
+	if res := c.mustRes(UPR_STREAM_REQ); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected stream req to work, got: %v", res)
+	}
+	marker := c.mustReq(UPR_SNAPSHOT_MARKER)
+	if marker.Opaque != 0x1234 ||
+		binary.BigEndian.Uint32(marker.Extras[16:]) != UPR_SNAPSHOT_DISK {
+		t.Errorf("expected disk snapshot marker, got: %#v", marker)
+	}
+	var lastSeqno uint64
+	for i := 0; i < 3; i++ {
+		m := c.mustReq(UPR_MUTATION)
+		if uprSeqno(m) <= lastSeqno || string(m.Body) != "v" {
+			t.Errorf("expected increasing seqnos, got: %#v", m)
+		}
+		lastSeqno = uprSeqno(m)
+	}
+	if lastSeqno > binary.BigEndian.Uint64(marker.Extras[8:]) {
+		t.Errorf("expected mutations within snapshot, got: %v", lastSeqno)
+	}
+	c.mustNothing()
+
+	SetItem(b, []byte("live"), []byte("x"), VBActive)
+	marker = c.mustReq(UPR_SNAPSHOT_MARKER)
+	if binary.BigEndian.Uint32(marker.Extras[16:]) != UPR_SNAPSHOT_MEMORY {
+		t.Errorf("expected memory snapshot marker, got: %#v", marker)
+	}
+	m := c.mustReq(UPR_MUTATION)
+	if string(m.Key) != "live" || uprSeqno(m) <= lastSeqno {
+		t.Errorf("expected live mutation, got: %#v", m)
+	}
+
+	vb, _ := b.GetVBucket(0)
+	vb.Dispatch(nil, &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    []byte("live"),
+	})
+	c.mustReq(UPR_SNAPSHOT_MARKER)
+	if d := c.mustReq(UPR_DELETION); string(d.Key) != "live" {
+		t.Errorf("expected deletion, got: %#v", d)
+	}
+
+	c.send(uprStreamReq(0, 0, math.MaxUint64))
+	if res := c.mustRes(UPR_STREAM_REQ); res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("expected 2nd stream on vbucket to fail, got: %v", res)
+	}
+
+	c.send(&gomemcached.MCRequest{Opcode: UPR_CLOSE_STREAM})
+	if res := c.mustRes(UPR_CLOSE_STREAM); res.Status != gomemcached.SUCCESS {
+		t.Errorf("expected close stream to work, got: %v", res)
+	}
+	SetItem(b, []byte("closed"), []byte("x"), VBActive)
+	c.mustNothing()
+
+	c.send(&gomemcached.MCRequest{Opcode: UPR_CLOSE_STREAM})
+	if res := c.mustRes(UPR_CLOSE_STREAM); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected 2nd close stream to fail, got: %v", res)
+	}
+}
+
+func TestUprStreamResumeAndEnd(t *testing.T) {
+	c, b, done := testUprConn(t, 3)
+	defer done()
+
+	vb, _ := b.GetVBucket(0)
+	high := uprHighSeqno(vb)
+
+	c.send(uprStreamReq(0, 0, high))
+	c.mustRes(UPR_STREAM_REQ)
+	c.mustReq(UPR_SNAPSHOT_MARKER)
+	first := c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_MUTATION)
+	end := c.mustReq(UPR_STREAM_END)
+	if binary.BigEndian.Uint32(end.Extras) != UPR_STREAM_END_OK {
+		t.Errorf("expected ok stream end, got: %#v", end)
+	}
+
+	// Resume after the first mutation.
+	c.send(uprStreamReq(0, uprSeqno(first), high))
+	c.mustRes(UPR_STREAM_REQ)
+	marker := c.mustReq(UPR_SNAPSHOT_MARKER)
+	if binary.BigEndian.Uint64(marker.Extras) != uprSeqno(first)+1 {
+		t.Errorf("expected snapshot to start after resume point, got: %#v",
+			marker)
+	}
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_STREAM_END)
+
+	c.send(uprStreamReq(0, high+100, high+200))
+	res := c.mustRes(UPR_STREAM_REQ)
+	if res.Status != UPR_ROLLBACK || binary.BigEndian.Uint64(res.Body) != high {
+		t.Errorf("expected rollback to %v, got: %v", high, res)
+	}
+
+	c.send(uprStreamReq(0, 10, 5))
+	if res = c.mustRes(UPR_STREAM_REQ); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected EINVAL on start > end, got: %v", res)
+	}
+	c.send(uprStreamReq(1, 0, 5))
+	if res = c.mustRes(UPR_STREAM_REQ); res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("expected NOT_MY_VBUCKET, got: %v", res)
+	}
+}
+
+func TestUprSeqnoAck(t *testing.T) {
+	c, b, done := testUprConn(t, 3)
+	defer done()
+
+	vb, _ := b.GetVBucket(0)
+	high := uprHighSeqno(vb)
+
+	// Nothing's been sent yet, so there's nothing to ack.
+	c.send(uprSeqnoAckPkt(0, high))
+	if res := c.mustRes(UPR_SEQNO_ACK); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected ack of an unsent seqno to fail, got: %v", res)
+	}
+
+	c.send(uprStreamReq(0, 0, high))
+	c.mustRes(UPR_STREAM_REQ)
+	c.mustReq(UPR_SNAPSHOT_MARKER)
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_MUTATION)
+	c.mustReq(UPR_STREAM_END)
+	if seqnos := vb.replicaSeqnos(); len(seqnos) != 0 {
+		t.Errorf("expected sent changes to not count as replicated, got: %v",
+			seqnos)
+	}
+
+	c.send(uprSeqnoAckPkt(0, high+1))
+	if res := c.mustRes(UPR_SEQNO_ACK); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected ack past the sent seqnos to fail, got: %v", res)
+	}
+	c.send(uprSeqnoAckPkt(0, high))
+	c.send(&gomemcached.MCRequest{Opcode: UPR_NOOP})
+	c.mustRes(UPR_NOOP)
+	res := vbGetReplicaSeqnos(vb, nil, &gomemcached.MCRequest{})
+	if len(res.Body) != 8 || binary.BigEndian.Uint64(res.Body) != high {
+		t.Errorf("expected the acked seqno, got: %v", res)
+	}
+}
+
+func TestUprStreamStateChange(t *testing.T) {
+	origFreq := uprTickFreq
+	uprTickFreq = 10 * time.Millisecond
+	defer func() { uprTickFreq = origFreq }()
+
+	c, b, done := testUprConn(t, 0)
+	defer done()
+
+	c.send(uprStreamReq(0, 0, math.MaxUint64))
+	c.mustRes(UPR_STREAM_REQ)
+	c.mustReq(UPR_SNAPSHOT_MARKER)
+
+	b.SetVBState(0, VBReplica)
+	end := c.mustReq(UPR_STREAM_END)
+	if binary.BigEndian.Uint32(end.Extras) != UPR_STREAM_END_STATE_CHANGED {
+		t.Errorf("expected state changed stream end, got: %#v", end)
+	}
+}
+
+func TestUprExpiration(t *testing.T) {
+	c, b, done := testUprConn(t, 0)
+	defer done()
+
+	vb, _ := b.GetVBucket(0)
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("expired"),
+		Extras: make([]byte, 8),
+		Body:   []byte("x"),
+	}
+	binary.BigEndian.PutUint32(req.Extras[4:], 1000000000) // Long ago.
+	if res := vb.Dispatch(nil, req); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected set to work, got: %v", res)
+	}
+
+	c.send(uprStreamReq(0, 0, math.MaxUint64))
+	c.mustRes(UPR_STREAM_REQ)
+	c.mustReq(UPR_SNAPSHOT_MARKER)
+	if m := c.mustReq(UPR_EXPIRATION); string(m.Key) != "expired" {
+		t.Errorf("expected expiration, got: %#v", m)
+	}
+}
+
+func TestUprFlowControl(t *testing.T) {
+	c, _, done := testUprConn(t, 2)
+	defer done()
+
+	c.send(&gomemcached.MCRequest{
+		Opcode: UPR_CONTROL,
+		Key:    []byte("connection_buffer_size"),
+		Body:   []byte("not-a-number"),
+	})
+	if res := c.mustRes(UPR_CONTROL); res.Status != gomemcached.EINVAL {
+		t.Errorf("expected bad buffer size to fail, got: %v", res)
+	}
+	c.send(&gomemcached.MCRequest{
+		Opcode: UPR_CONTROL,
+		Key:    []byte("connection_buffer_size"),
+		Body:   []byte("50"),
+	})
+	if res := c.mustRes(UPR_CONTROL); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("expected buffer size control to work, got: %v", res)
+	}
+
+	c.send(uprStreamReq(0, 0, math.MaxUint64))
+	c.mustRes(UPR_STREAM_REQ)
+	marker := c.mustReq(UPR_SNAPSHOT_MARKER)
+	c.mustNothing() // The buffer is full.
+
+	ack := &gomemcached.MCRequest{Opcode: UPR_BUFFER_ACK, Extras: make([]byte, 4)}
+	binary.BigEndian.PutUint32(ack.Extras,
+		uint32(gomemcached.HDR_LEN+len(marker.Extras)))
+	c.send(ack)
+	m := c.mustReq(UPR_MUTATION)
+	c.mustNothing()
+
+	binary.BigEndian.PutUint32(ack.Extras,
+		uint32(gomemcached.HDR_LEN+len(m.Extras)+len(m.Key)+len(m.Body)))
+	c.send(ack)
+	c.mustReq(UPR_MUTATION)
+}
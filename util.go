@@ -96,7 +96,11 @@ func dumpCollAsItems(printf func(format string, a ...interface{}) (n int, err er
 			return false
 		}
 		n++
-		printf("%v%#v, data: %v\n", prefix, i, string(i.data))
+		data, err := i.value()
+		if err != nil {
+			data = i.data
+		}
+		printf("%v%#v, data: %v\n", prefix, i, string(data))
 		return true
 	})
 	if vErr != nil {
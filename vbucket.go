@@ -20,6 +20,7 @@ import (
 const (
 	GET_VBMETA           = gomemcached.CommandCode(0x61)
 	SET_VBMETA           = gomemcached.CommandCode(0x62)
+	GET_REPLICA_SEQNOS   = gomemcached.CommandCode(0x63)
 	COLL_SUFFIX_KEYS     = ".k" // This suffix sorts before CHANGES suffix.
 	COLL_SUFFIX_CHANGES  = ".s" // The changes is like a "sequence" stream.
 	COLL_VBMETA          = "vbm"
@@ -39,6 +40,43 @@ const (
 	ADDQ_WITH_META = gomemcached.CommandCode(0xa5)
 	DELETE_WITH_META = gomemcached.CommandCode(0xa8)
 	DELETEQ_WITH_META = gomemcached.CommandCode(0xa9)
+	TOUCH = gomemcached.CommandCode(0x1c)
+	GAT = gomemcached.CommandCode(0x1d)
+	GATQ = gomemcached.CommandCode(0x1e)
+	GET_LOCKED = gomemcached.CommandCode(0x94)
+	UNLOCK_KEY = gomemcached.CommandCode(0x95)
+
+	SEQNO_PERSISTENCE = gomemcached.CommandCode(0xb7)
+	OBSERVE_SEQNO     = gomemcached.CommandCode(0x91)
+
+	SUBDOC_GET              = gomemcached.CommandCode(0xc5)
+	SUBDOC_EXISTS           = gomemcached.CommandCode(0xc6)
+	SUBDOC_DICT_ADD         = gomemcached.CommandCode(0xc7)
+	SUBDOC_DICT_UPSERT      = gomemcached.CommandCode(0xc8)
+	SUBDOC_DELETE           = gomemcached.CommandCode(0xc9)
+	SUBDOC_REPLACE          = gomemcached.CommandCode(0xca)
+	SUBDOC_ARRAY_PUSH_LAST  = gomemcached.CommandCode(0xcb)
+	SUBDOC_ARRAY_PUSH_FIRST = gomemcached.CommandCode(0xcc)
+	SUBDOC_ARRAY_INSERT     = gomemcached.CommandCode(0xcd)
+	SUBDOC_COUNTER          = gomemcached.CommandCode(0xcf)
+	SUBDOC_MULTI_LOOKUP     = gomemcached.CommandCode(0xd0)
+	SUBDOC_MULTI_MUTATION   = gomemcached.CommandCode(0xd1)
+
+	LOCKED = gomemcached.Status(0x09)
+
+	SUBDOC_PATH_ENOENT        = gomemcached.Status(0xc0)
+	SUBDOC_PATH_MISMATCH      = gomemcached.Status(0xc1)
+	SUBDOC_PATH_EINVAL        = gomemcached.Status(0xc2)
+	SUBDOC_PATH_E2BIG         = gomemcached.Status(0xc3)
+	SUBDOC_DOC_E2DEEP         = gomemcached.Status(0xc4)
+	SUBDOC_VALUE_CANTINSERT   = gomemcached.Status(0xc5)
+	SUBDOC_DOC_NOTJSON        = gomemcached.Status(0xc6)
+	SUBDOC_NUM_ERANGE         = gomemcached.Status(0xc7)
+	SUBDOC_DELTA_EINVAL       = gomemcached.Status(0xc8)
+	SUBDOC_PATH_EEXISTS       = gomemcached.Status(0xc9)
+	SUBDOC_VALUE_ETOODEEP     = gomemcached.Status(0xca)
+	SUBDOC_INVALID_COMBO      = gomemcached.Status(0xcb)
+	SUBDOC_MULTI_PATH_FAILURE = gomemcached.Status(0xcc)
 )
 
 var ignore = errors.New("not-an-error/sentinel")
@@ -54,15 +92,26 @@ type VBucket struct {
 	ps       *partitionstore
 	lock     sync.Mutex
 	observer broadcast.Broadcaster
+	locks    itemLocks
 
 	bucketItemBytes *int64
 	staleness       int64 // To track view freshness.
 
+	// Per replica stream name, the CAS up to which the replica has
+	// acknowledged receiving every change.
+	replicaLock sync.Mutex
+	replicaCas  map[string]uint64
+
 	stats BucketStats
 
 	viewsStore *bucketstore
 	viewsLock  sync.Mutex
 
+	// Read locked by client mutations and write locked by vbucket
+	// state changes, so no client mutation lands after a vbucket
+	// becomes pending.
+	stateLock sync.RWMutex
+
 	available chan bool
 	vbid      uint16
 }
@@ -109,11 +158,35 @@ var dispatchTable = [256]dispatchFun{
 	ADD_WITH_META: vbMutate,
 	ADDQ_WITH_META: vbMutate,
 
+	TOUCH: vbTouch,
+	GAT:   vbTouch,
+	GATQ:  vbTouch,
+
+	GET_LOCKED: vbGetLocked,
+	UNLOCK_KEY: vbUnlock,
+
+	SEQNO_PERSISTENCE: vbSeqnoPersistence,
+	OBSERVE_SEQNO:     vbObserveSeqno,
+
+	SUBDOC_GET:              vbSubdocLookup,
+	SUBDOC_EXISTS:           vbSubdocLookup,
+	SUBDOC_DICT_ADD:         vbSubdocMutate,
+	SUBDOC_DICT_UPSERT:      vbSubdocMutate,
+	SUBDOC_DELETE:           vbSubdocMutate,
+	SUBDOC_REPLACE:          vbSubdocMutate,
+	SUBDOC_ARRAY_PUSH_LAST:  vbSubdocMutate,
+	SUBDOC_ARRAY_PUSH_FIRST: vbSubdocMutate,
+	SUBDOC_ARRAY_INSERT:     vbSubdocMutate,
+	SUBDOC_COUNTER:          vbSubdocMutate,
+	SUBDOC_MULTI_LOOKUP:     vbSubdocMultiLookup,
+	SUBDOC_MULTI_MUTATION:   vbSubdocMultiMutation,
+
 	gomemcached.RGET: vbRGet,
 
 	// TODO: Move new command codes to gomemcached one day.
 	GET_VBMETA: vbGetVBMeta,
 	SET_VBMETA: vbSetVBMeta,
+	GET_REPLICA_SEQNOS: vbGetReplicaSeqnos,
 }
 
 func newVBucket(parent Bucket, vbid uint16, bs *bucketstore,
@@ -128,6 +201,8 @@ func newVBucket(parent Bucket, vbid uint16, bs *bucketstore,
 		available:       make(chan bool),
 		bucketItemBytes: bucketItemBytes,
 	}
+	rv.ps.stats = &rv.stats
+	rv.ps.bucketItemBytes = bucketItemBytes
 
 	return rv, nil
 }
@@ -144,7 +219,45 @@ func (v *VBucket) Close() error {
 	return v.observer.Close()
 }
 
+// Dispatches a client request, where mutations are refused by a
+// pending vbucket, as with clientMutation().
 func (v *VBucket) Dispatch(w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if isClientMutation(req.Opcode) {
+		return v.clientMutation(0, func() *gomemcached.MCResponse {
+			return v.dispatch(w, req)
+		})
+	}
+	return v.dispatch(w, req)
+}
+
+// Runs a client mutation while holding the stateLock, so the vbucket
+// can't change state underneath it.  A pending vbucket is being taken
+// over by another server, so it refuses client mutations with a
+// TMPFAIL, as they'd otherwise be lost to the new owner.  A non-zero
+// vbs is the state the vbucket must still be in.
+func (v *VBucket) clientMutation(vbs VBState,
+	f func() *gomemcached.MCResponse) *gomemcached.MCResponse {
+	v.stateLock.RLock()
+	defer v.stateLock.RUnlock()
+	state := v.GetVBState()
+	if state == VBPending {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte("vbucket is pending"),
+		}
+	}
+	if vbs != 0 && state != vbs {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.NOT_MY_VBUCKET,
+		}
+	}
+	return f()
+}
+
+// Dispatches a request, such as one from a replication stream, which
+// may change a pending vbucket.
+func (v *VBucket) dispatch(w io.Writer,
 	req *gomemcached.MCRequest) *gomemcached.MCResponse {
 	atomic.AddInt64(&v.stats.Ops, 1)
 	f := dispatchTable[req.Opcode]
@@ -172,12 +285,28 @@ func (v *VBucket) Apply(fun func()) {
 	fun()
 }
 
+// Ensures the vbucket's LastCas is at least the given cas, such as
+// when applying a mutation that arrived with its own CAS.
+func (v *VBucket) bumpLastCas(cas uint64) {
+	meta := v.Meta()
+	for {
+		lastCas := atomic.LoadUint64(&meta.LastCas)
+		if lastCas >= cas ||
+			atomic.CompareAndSwapUint64(&meta.LastCas, lastCas, cas) {
+			return
+		}
+	}
+}
+
 func (v *VBucket) GetVBState() (res VBState) {
 	return parseVBState(v.Meta().State)
 }
 
 func (v *VBucket) SetVBState(newState VBState,
 	cb func(prevState VBState)) (prevState VBState, err error) {
+	v.stateLock.Lock()
+	defer v.stateLock.Unlock()
+
 	prevState = VBDead
 	// The bs.apply() ensures we're not compacting/flushing while
 	// changing vbstate, which is good for atomicity and to avoid
@@ -227,7 +356,10 @@ func (v *VBucket) setVBMeta(newMeta *VBMeta) (err error) {
 	if err = v.bs.collMeta(COLL_VBMETA).Set(k, j); err != nil {
 		return err
 	}
-	atomic.StorePointer(&v.meta, unsafe.Pointer(newMeta))
+	prevMeta := (*VBMeta)(atomic.SwapPointer(&v.meta, unsafe.Pointer(newMeta)))
+	if prevMeta.State != newMeta.State {
+		v.locks.clear()
+	}
 
 	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
 	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
@@ -266,6 +398,9 @@ func (v *VBucket) load() (err error) {
 			if meta.LastCas < lastCas {
 				meta.LastCas = lastCas
 			}
+			// What's loaded was persisted.
+			v.ps.noteCas(lastCas)
+			atomic.StoreUint64(&v.ps.persistedCas, lastCas)
 		}
 
 		atomic.StorePointer(&v.meta, unsafe.Pointer(meta))
@@ -307,11 +442,21 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 		}
 		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
 	}
+	data, err := i.value()
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+		}
+	}
 
 	res = &gomemcached.MCResponse{
 		Cas:    i.cas,
 		Extras: make([]byte, 4),
-		Body:   i.data,
+		Body:   data,
+	}
+	if _, locked := v.locks.lockedCas(req.Key, time.Now()); locked {
+		res.Cas = LOCKED_CAS
 	}
 	binary.BigEndian.PutUint32(res.Extras, i.flag)
 	wantsKey := (req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ)
@@ -319,7 +464,7 @@ func vbGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 		res.Key = req.Key
 	}
 
-	atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(i.data)))
+	atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(data)))
 
 	return res
 }
@@ -416,21 +561,26 @@ func vbRGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 	visitor := func(i *item) bool {
 		if bytes.Compare(i.key, req.Key) >= 0 {
 			// TODO: Need to hide expired items from range scan.
+			data, err := i.value()
+			if err != nil {
+				res = &gomemcached.MCResponse{Fatal: true}
+				return false
+			}
 			binary.BigEndian.PutUint32(extras, i.flag)
 			r := gomemcached.MCResponse{
 				Opcode: req.Opcode,
 				Key:    i.key,
 				Cas:    i.cas,
 				Extras: extras,
-				Body:   i.data,
+				Body:   data,
 			}
-			err := r.Transmit(w)
+			err = r.Transmit(w)
 			if err != nil {
 				res = &gomemcached.MCResponse{Fatal: true}
 				return false
 			}
 			visitRGetResults++
-			visitOutgoingValueBytes += int64(len(i.data))
+			visitOutgoingValueBytes += int64(len(data))
 		}
 		return true
 	}
@@ -448,12 +598,51 @@ func vbRGet(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
 
 func (v *VBucket) Visit(start []byte,
 	visitor func(key []byte, data []byte) bool) error {
-	return v.ps.visitItems(start, true, func(i *item) bool {
-		return visitor(i.key, i.data)
+	return v.VisitItems(start, func(i *item, data []byte) bool {
+		return visitor(i.key, data)
 	})
 }
 
+// Like Visit, but also provides the item, for its metadata.
+func (v *VBucket) VisitItems(start []byte,
+	visitor func(i *item, data []byte) bool) error {
+	var vErr error
+	err := v.ps.visitItems(start, true, func(i *item) bool {
+		var data []byte
+		if data, vErr = i.value(); vErr != nil {
+			return false
+		}
+		return visitor(i, data)
+	})
+	if err != nil {
+		return err
+	}
+	return vErr
+}
+
+// Returns whether a command from a client changes an item.  Changes
+// from replication streams skip Dispatch(), so a client's *_WITH_META
+// commands are client mutations, too.
+func isClientMutation(c gomemcached.CommandCode) bool {
+	switch c {
+	case gomemcached.SET, gomemcached.SETQ,
+		gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ,
+		gomemcached.APPEND, gomemcached.APPENDQ,
+		gomemcached.PREPEND, gomemcached.PREPENDQ,
+		gomemcached.INCREMENT, gomemcached.INCREMENTQ,
+		gomemcached.DECREMENT, gomemcached.DECREMENTQ,
+		gomemcached.DELETE, gomemcached.DELETEQ,
+		TOUCH, GAT, GATQ, GET_LOCKED, UNLOCK_KEY, SUBDOC_MULTI_MUTATION,
+		SET_WITH_META, SETQ_WITH_META, ADD_WITH_META, ADDQ_WITH_META,
+		DELETE_WITH_META, DELETEQ_WITH_META:
+		return true
+	}
+	return isSubdocMutation(c)
+}
+
 func IsQuietEx(c gomemcached.CommandCode) bool {
 	return c.IsQuiet() ||
-		c == GETQ_META || c == SETQ_WITH_META || c == ADDQ_WITH_META || c == DELETEQ_WITH_META
+		c == GETQ_META || c == SETQ_WITH_META || c == ADDQ_WITH_META || c == DELETEQ_WITH_META ||
+		c == GATQ
 }
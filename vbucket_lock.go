@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Lock durations for GET_LOCKED, like Couchbase, where a requested
+// lock time of 0 or beyond the max gets the default.
+var defaultLockTime = 15 * time.Second
+var maxLockTime = 30 * time.Second
+
+// The CAS that a plain GET reports for a locked item, so that only
+// the lock holder can mutate it.
+const LOCKED_CAS = ^uint64(0)
+
+// Like ignore, a sentinel for a request refused as its item is locked,
+// which is counted as neither a miss nor a store error.
+var errLocked = errors.New("not-an-error/locked")
+
+type itemLock struct {
+	cas   uint64
+	until time.Time
+}
+
+// The pessimistic locks of a vbucket's items, which live only in
+// memory.  An item is unlocked by a mutation with the lock's CAS, an
+// UNLOCK_KEY, the lock timing out, or the vbucket changing state.
+type itemLocks struct {
+	m     sync.Mutex
+	locks map[string]*itemLock
+}
+
+// Returns the CAS of an item's unexpired lock.
+func (l *itemLocks) lockedCas(key []byte, now time.Time) (uint64, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	il, ok := l.locks[string(key)]
+	if !ok {
+		return 0, false
+	}
+	if !now.Before(il.until) {
+		delete(l.locks, string(key))
+		return 0, false
+	}
+	return il.cas, true
+}
+
+func (l *itemLocks) lock(key []byte, cas uint64, until time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]*itemLock{}
+	}
+	l.locks[string(key)] = &itemLock{cas: cas, until: until}
+}
+
+func (l *itemLocks) unlock(key []byte) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	delete(l.locks, string(key))
+}
+
+func (l *itemLocks) clear() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.locks = nil
+}
+
+// Checks a mutation's CAS against any lock on the item, returning a
+// LOCKED response unless the CAS is the lock's.  Must be invoked
+// while holding the vbucket's Apply() lock.
+func (v *VBucket) checkLock(req *gomemcached.MCRequest, now time.Time) (
+	locked bool, res *gomemcached.MCResponse) {
+	lockCas, locked := v.locks.lockedCas(req.Key, now)
+	if locked && req.Cas != lockCas {
+		atomic.AddInt64(&v.stats.LockedErrors, 1)
+		return true, &gomemcached.MCResponse{
+			Status: LOCKED,
+			Body:   []byte("item is locked"),
+		}
+	}
+	return locked, nil
+}
+
+func vbGetLocked(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.Gets, 1)
+
+	if v.GetVBState() != VBActive {
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_MY_VBUCKET}
+	}
+
+	lockTime := defaultLockTime
+	switch len(req.Extras) {
+	case 0:
+	case 4:
+		d := time.Duration(binary.BigEndian.Uint32(req.Extras)) * time.Second
+		if d > 0 && d <= maxLockTime {
+			lockTime = d
+		}
+	default:
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for get locked: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			atomic.AddInt64(&v.stats.GetMisses, 1)
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		if _, locked := v.locks.lockedCas(req.Key, now); locked {
+			atomic.AddInt64(&v.stats.LockedErrors, 1)
+			res = &gomemcached.MCResponse{
+				Status: LOCKED,
+				Body:   []byte("item is already locked"),
+			}
+			return
+		}
+
+		data, err := i.value()
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+			}
+			return
+		}
+
+		cas := atomic.AddUint64(&v.Meta().LastCas, 1)
+		v.locks.lock(req.Key, cas, now.Add(lockTime))
+
+		res = &gomemcached.MCResponse{
+			Cas:    cas,
+			Extras: make([]byte, 4),
+			Body:   data,
+		}
+		binary.BigEndian.PutUint32(res.Extras, i.flag)
+		atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(data)))
+	})
+
+	return res
+}
+
+func vbUnlock(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (
+	res *gomemcached.MCResponse) {
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		lockCas, locked := v.locks.lockedCas(req.Key, now)
+		if !locked {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte("item is not locked"),
+			}
+			return
+		}
+		if req.Cas != lockCas {
+			res = &gomemcached.MCResponse{
+				Status: LOCKED,
+				Body:   []byte("lock CAS mismatch"),
+			}
+			return
+		}
+		v.locks.unlock(req.Key)
+		res = &gomemcached.MCResponse{}
+	})
+
+	return res
+}
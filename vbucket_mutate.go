@@ -35,6 +35,20 @@ func vbMutate(v *VBucket, w io.Writer,
 		}
 	}
 
+	// Buckets that evict whole items, like a cache, make room for the
+	// mutation up front instead of failing it.
+	if settings := v.parent.GetBucketSettings(); settings.fullEviction() &&
+		evictionEnabled(settings) {
+		nbItem := int64(len(req.Key)+len(req.Body)) + itemHdrLen + 8
+		_, high := settings.watermarks()
+		if nbItem < settings.QuotaBytes &&
+			atomic.LoadInt64(v.bucketItemBytes)+nbItem >= high {
+			if _, err := v.parent.Evict(); err != nil {
+				v.parent.PushErr(fmt.Errorf("evict: %v", err))
+			}
+		}
+	}
+
 	var deltaItemBytes int64
 	var itemOld, itemNew *item
 	var itemCas uint64
@@ -57,28 +71,22 @@ func vbMutate(v *VBucket, w io.Writer,
 			return
 		}
 
-		itemCas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		if isWithMeta(req.Opcode) {
+			itemCas, res, err = vbMetaCas(v, req, itemOld)
+			if err != nil {
+				return
+			}
+		} else {
+			itemCas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		}
 
 		res, itemNew, aval, err = vbMutateItemNew(v, w, req, cmd, itemCas, itemOld)
 		if err != nil {
 			return
 		}
 
-		quotaBytes := v.parent.GetBucketSettings().QuotaBytes
-		if quotaBytes > 0 {
-			nb := atomic.LoadInt64(v.bucketItemBytes)
-			nb = nb + itemNew.NumBytes()
-			if itemOld != nil {
-				nb = nb - itemOld.NumBytes()
-			}
-			if nb >= quotaBytes {
-				res = &gomemcached.MCResponse{
-					Status: gomemcached.E2BIG,
-					Body: []byte(fmt.Sprintf("quota reached: %v, key: %v",
-						quotaBytes, req.Key)),
-				}
-				return
-			}
+		if res = v.checkQuota(req.Key, itemNew, itemOld); res != nil {
+			return
 		}
 
 		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
@@ -88,6 +96,7 @@ func vbMutate(v *VBucket, w io.Writer,
 				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
 			}
 		} else {
+			v.locks.unlock(req.Key)
 			if !IsQuietEx(req.Opcode) {
 				res = &gomemcached.MCResponse{Cas: itemCas}
 				if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
@@ -114,7 +123,7 @@ func vbMutate(v *VBucket, w io.Writer,
 		atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
 
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, req.Key, itemCas, false})
+		v.observer.Submit(mutation{v.vbid, req.Key, itemCas, false, false})
 	}
 
 	return res
@@ -134,7 +143,11 @@ func vbMutateValidate(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 			Body:   []byte("REPLACE error because item does not exist"),
 		}, ignore
 	}
-	if req.Cas != 0 && (itemOld == nil || itemOld.cas != req.Cas) {
+	locked, res := v.checkLock(req, time.Now())
+	if res != nil {
+		return res, ignore
+	}
+	if !locked && req.Cas != 0 && (itemOld == nil || itemOld.cas != req.Cas) {
 		return &gomemcached.MCResponse{
 			Status: gomemcached.KEY_EEXISTS,
 			Body:   []byte("CAS mismatch"),
@@ -149,7 +162,6 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 
 	var flag, exp uint32
 	var aval uint64
-	var err error
 
 	if cmd == gomemcached.INCREMENT || cmd == gomemcached.DECREMENT {
 		if len(req.Extras) != 8+8+4 { // amount, initial, exp
@@ -179,7 +191,14 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 		initial := binary.BigEndian.Uint64(req.Extras[8:])
 
 		if itemOld != nil {
-			aval, err = strconv.ParseUint(string(itemOld.data), 10, 64)
+			oldData, err := itemOld.value()
+			if err != nil {
+				return &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+				}, nil, 0, err
+			}
+			aval, err = strconv.ParseUint(string(oldData), 10, 64)
 			if err != nil {
 				return &gomemcached.MCResponse{
 					Status: gomemcached.EINVAL,
@@ -207,26 +226,182 @@ func vbMutateItemNew(v *VBucket, w io.Writer, req *gomemcached.MCRequest,
 		itemNew.data = req.Body
 		if itemOld != nil &&
 			(cmd == gomemcached.APPEND || cmd == gomemcached.PREPEND) {
-			itemNewLen := len(req.Body) + len(itemOld.data)
+			oldData, err := itemOld.value()
+			if err != nil {
+				return &gomemcached.MCResponse{
+					Status: gomemcached.TMPFAIL,
+					Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+				}, nil, 0, err
+			}
+			itemNewLen := len(req.Body) + len(oldData)
 			itemNew.data = make([]byte, itemNewLen)
 			if cmd == gomemcached.APPEND {
-				copy(itemNew.data[0:len(itemOld.data)], itemOld.data)
-				copy(itemNew.data[len(itemOld.data):itemNewLen], req.Body)
+				copy(itemNew.data[0:len(oldData)], oldData)
+				copy(itemNew.data[len(oldData):itemNewLen], req.Body)
 			} else {
 				copy(itemNew.data[0:len(req.Body)], req.Body)
-				copy(itemNew.data[len(req.Body):itemNewLen], itemOld.data)
+				copy(itemNew.data[len(req.Body):itemNewLen], oldData)
 			}
 		}
 	}
 
-	if itemNew.exp != 0 {
+	v.trackExpirable(itemNew)
+
+	return nil, itemNew, aval, nil
+}
+
+func (v *VBucket) trackExpirable(i *item) {
+	if i.exp != 0 {
 		expirable := atomic.AddInt64(&v.stats.Expirable, 1)
 		if expirable == 1 {
 			expirePeriodic.Register(v.available, v.mkVBucketSweeper())
 		}
 	}
+}
 
-	return nil, itemNew, aval, nil
+// Checks that replacing itemOld with itemNew keeps the bucket under
+// its quota, kicking eviction as the bucket nears it.  Must be invoked
+// while holding the vbucket's Apply() lock.
+func (v *VBucket) checkQuota(key []byte, itemNew, itemOld *item) *gomemcached.MCResponse {
+	settings := v.parent.GetBucketSettings()
+	quotaBytes := settings.QuotaBytes
+	if quotaBytes <= 0 {
+		return nil
+	}
+	nb := atomic.LoadInt64(v.bucketItemBytes)
+	nb = nb + itemNew.NumBytes()
+	if itemOld != nil {
+		nb = nb - itemOld.NumBytes()
+	}
+	if nb >= quotaBytes {
+		// Eviction may make room, unless the item alone is
+		// over the quota.
+		if evictionEnabled(settings) && itemNew.NumBytes() < quotaBytes {
+			v.kickEviction()
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body: []byte(fmt.Sprintf("quota reached: %v, evicting, key: %v",
+					quotaBytes, key)),
+			}
+		}
+		return &gomemcached.MCResponse{
+			Status: gomemcached.E2BIG,
+			Body: []byte(fmt.Sprintf("quota reached: %v, key: %v",
+				quotaBytes, key)),
+		}
+	}
+	if _, high := settings.watermarks(); nb >= high &&
+		evictionEnabled(settings) && !settings.fullEviction() {
+		v.kickEviction()
+	}
+	return nil
+}
+
+// Handles TOUCH, GAT and GATQ, which update an item's expiration
+// without changing its value, but otherwise act like a mutation with
+// a new CAS.  GAT and GATQ also return the item like a GET.
+func vbTouch(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
+	atomic.AddInt64(&v.stats.Mutations, 1)
+	if req.Opcode == TOUCH {
+		atomic.AddInt64(&v.stats.Touches, 1)
+	} else {
+		atomic.AddInt64(&v.stats.Gats, 1)
+	}
+
+	if len(req.Extras) != 4 {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for touch: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	exp := binary.BigEndian.Uint32(req.Extras)
+
+	var deltaItemBytes int64
+	var itemOld, itemNew *item
+	var err error
+	now := time.Now()
+
+	v.Apply(func() {
+		itemOld, err = v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get itemOld error %v", err)),
+			}
+			return
+		}
+		if itemOld == nil {
+			err = ignore
+			if !IsQuietEx(req.Opcode) {
+				res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			}
+			return
+		}
+		if _, locked := v.locks.lockedCas(req.Key, now); locked {
+			err = errLocked
+			res = &gomemcached.MCResponse{
+				Status: LOCKED,
+				Body:   []byte("item is locked"),
+			}
+			return
+		}
+
+		itemNew = &item{
+			key:  req.Key,
+			flag: itemOld.flag,
+			exp:  computeExp(exp, time.Now),
+			cas:  atomic.AddUint64(&v.Meta().LastCas, 1),
+			data: itemOld.data,
+			// The data is kept as is, even if compressed.
+			datatype: itemOld.datatype,
+		}
+
+		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+			}
+			return
+		}
+		v.trackExpirable(itemNew)
+	})
+
+	if err != nil {
+		switch {
+		case err == errLocked:
+			atomic.AddInt64(&v.stats.LockedErrors, 1)
+		case err != ignore:
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		case req.Opcode != TOUCH:
+			atomic.AddInt64(&v.stats.GetMisses, 1)
+		}
+		return res
+	}
+
+	atomic.AddInt64(&v.stats.Updates, 1)
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+	v.markStale()
+	v.observer.Submit(mutation{v.vbid, req.Key, itemNew.cas, false, false})
+
+	res = &gomemcached.MCResponse{Cas: itemNew.cas}
+	if req.Opcode != TOUCH {
+		data, err := itemNew.value()
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+			}
+		}
+		res.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(res.Extras, itemNew.flag)
+		res.Body = data
+		atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(data)))
+	}
+	return res
 }
 
 func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemcached.MCResponse) {
@@ -247,7 +422,12 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 			}
 			return
 		}
-		if req.Cas != 0 && (prevItem == nil || prevItem.cas != req.Cas) {
+		var locked bool
+		if locked, res = v.checkLock(req, now); res != nil {
+			err = ignore
+			return
+		}
+		if !locked && req.Cas != 0 && (prevItem == nil || prevItem.cas != req.Cas) {
 			status := gomemcached.KEY_EEXISTS
 			if prevItem == nil {
 				status = gomemcached.KEY_ENOENT
@@ -266,7 +446,14 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 			return
 		}
 
-		cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		if isWithMeta(req.Opcode) {
+			cas, res, err = vbMetaCas(v, req, prevItem)
+			if err != nil {
+				return
+			}
+		} else {
+			cas = atomic.AddUint64(&v.Meta().LastCas, 1)
+		}
 
 		deltaItemBytes, err = v.ps.del(req.Key, cas, prevItem)
 		if err != nil {
@@ -275,6 +462,7 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 				Body:   []byte(fmt.Sprintf("Store del error %v", err)),
 			}
 		} else {
+			v.locks.unlock(req.Key)
 			if !IsQuietEx(req.Opcode) {
 				res = &gomemcached.MCResponse{Cas: cas}
 			}
@@ -282,7 +470,9 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 	})
 
 	if err != nil {
-		atomic.AddInt64(&v.stats.StoreErrors, 1)
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
 	} else if prevItem != nil {
 		atomic.AddInt64(&v.stats.Items, -1)
 		atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
@@ -291,12 +481,53 @@ func vbDelete(v *VBucket, w io.Writer, req *gomemcached.MCRequest) (res *gomemca
 
 	if err == nil && prevItem != nil {
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, req.Key, cas, true})
+		v.observer.Submit(mutation{v.vbid, req.Key, cas, true, false})
 	}
 
 	return res
 }
 
+// The *_WITH_META commands carry the item's metadata in their extras
+// (flags, exp, seqno, cas), which is preserved instead of regenerated,
+// such as when applying mutations replicated from elsewhere.
+const withMetaExtrasLen = 4 + 4 + 8 + 8
+
+func isWithMeta(c gomemcached.CommandCode) bool {
+	return c == SET_WITH_META || c == SETQ_WITH_META ||
+		c == ADD_WITH_META || c == ADDQ_WITH_META ||
+		c == DELETE_WITH_META || c == DELETEQ_WITH_META
+}
+
+// Returns the CAS carried by a *_WITH_META request, and bumps the
+// vbucket's LastCas so later local mutations stay ahead of it.  Must
+// be invoked while holding the vbucket's Apply() lock.
+func vbMetaCas(v *VBucket, req *gomemcached.MCRequest, itemOld *item) (
+	uint64, *gomemcached.MCResponse, error) {
+	if len(req.Extras) < withMetaExtrasLen {
+		return 0, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for with-meta: %v on key %v",
+				len(req.Extras), req.Key)),
+		}, ignore
+	}
+	cas := binary.BigEndian.Uint64(req.Extras[16:])
+	if cas == 0 {
+		return 0, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("with-meta CAS should be non-zero"),
+		}, ignore
+	}
+	if itemOld != nil && itemOld.cas >= cas {
+		// We already have this mutation or a newer one.
+		return 0, &gomemcached.MCResponse{
+			Status: gomemcached.KEY_EEXISTS,
+			Body:   []byte("with-meta CAS is stale"),
+		}, ignore
+	}
+	v.bumpLastCas(cas)
+	return cas, nil, nil
+}
+
 func (v *VBucket) mkVBucketSweeper() func(time.Time) bool {
 	return func(time.Time) bool {
 		return v.expirationScan()
@@ -307,6 +538,9 @@ func (v *VBucket) expirationScan() bool {
 	now := time.Now()
 	var cleaned int64
 	err := v.ps.visitItems(nil, false, func(i *item) bool {
+		if _, locked := v.locks.lockedCas(i.key, now); locked {
+			return true // Locked items expire once unlocked.
+		}
 		if i.isExpired(now) {
 			err := v.expire(i.key, now)
 			if err != nil {
@@ -342,7 +576,11 @@ func (v *VBucket) getUnexpired(key []byte, now time.Time) (*item, error) {
 	if err != nil || i == nil {
 		return nil, err
 	}
+	atomic.StoreInt32(&i.ref, 1)
 	if i.isExpired(now) {
+		if _, locked := v.locks.lockedCas(key, now); locked {
+			return i, nil
+		}
 		go v.expire(key, now)
 		return nil, nil
 	}
@@ -361,6 +599,9 @@ func (v *VBucket) expire(key []byte, now time.Time) (err error) {
 		if err != nil || i == nil {
 			return
 		}
+		if _, locked := v.locks.lockedCas(key, now); locked {
+			return
+		}
 		if i.isExpired(now) {
 			expireCas = atomic.AddUint64(&v.Meta().LastCas, 1)
 			deltaItemBytes, err = v.ps.del(key, expireCas, i)
@@ -372,7 +613,7 @@ func (v *VBucket) expire(key []byte, now time.Time) (err error) {
 
 	if err == nil && expireCas != 0 {
 		v.markStale()
-		v.observer.Submit(mutation{v.vbid, key, expireCas, true})
+		v.observer.Submit(mutation{v.vbid, key, expireCas, true, false})
 	}
 
 	return err
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// How long a SEQNO_PERSISTENCE waits before it fails with a TMPFAIL.
+var persistWaitTimeout = 30 * time.Second
+
+// Blocks until the vbucket's changes, up to the CAS in the 8 byte
+// extras, as returned by a mutation, or up to all its changes so far
+// without extras, are persisted as the bucket's durability setting
+// defines.  The response's CAS is the vbucket's persisted CAS.
+func vbSeqnoPersistence(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if !v.bs.persistsData() {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("bucket does not persist data"),
+		}
+	}
+	lastCas := atomic.LoadUint64(&v.ps.lastCas)
+	cas := lastCas
+	switch len(req.Extras) {
+	case 0:
+	case 8:
+		cas = binary.BigEndian.Uint64(req.Extras)
+		if cas > lastCas {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(fmt.Sprintf("unknown cas: %v", cas)),
+			}
+		}
+	default:
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte("extras must be a cas"),
+		}
+	}
+	persistedCas, err := v.bs.waitPersisted(v.ps, cas, persistWaitTimeout)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(err.Error()),
+		}
+	}
+	return &gomemcached.MCResponse{Cas: persistedCas}
+}
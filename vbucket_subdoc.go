@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Handles SUBDOC_GET and SUBDOC_EXISTS, whose extras are the path's
+// length (2 bytes) and the spec's flags (1 byte), and whose body is
+// the path.
+func vbSubdocLookup(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	spec, res := parseSubdocSingle(req, false)
+	if res != nil {
+		return res
+	}
+	res, results := subdocLookup(v, req, []subdocSpec{spec})
+	if res.Status != gomemcached.SUCCESS {
+		return res
+	}
+	if results[0].status != gomemcached.SUCCESS {
+		return &gomemcached.MCResponse{
+			Status: results[0].status,
+			Body:   results[0].value,
+		}
+	}
+	res.Body = results[0].value
+	return res
+}
+
+// Handles the single path mutations, whose extras are the path's
+// length (2 bytes), the spec's flags (1 byte) and an optional
+// expiration (4 bytes), and whose body is the path then the value.
+func vbSubdocMutate(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	spec, res := parseSubdocSingle(req, true)
+	if res != nil {
+		return res
+	}
+	var exp *uint32
+	if len(req.Extras) == 7 {
+		e := binary.BigEndian.Uint32(req.Extras[3:])
+		exp = &e
+	}
+	res, results, serr := subdocMutate(v, req, []subdocSpec{spec}, exp)
+	if serr != nil {
+		return &gomemcached.MCResponse{
+			Status: serr.status,
+			Body:   []byte(serr.msg),
+		}
+	}
+	if res.Status == gomemcached.SUCCESS {
+		res.Body = results[0].value
+	}
+	return res
+}
+
+// Handles SUBDOC_MULTI_LOOKUP, whose body is a sequence of specs,
+// each an opcode (1 byte), flags (1 byte), path length (2 bytes) and
+// path.  The response body has each spec's status (2 bytes), value
+// length (4 bytes) and value, with a status of MULTI_PATH_FAILURE if
+// any spec failed.
+func vbSubdocMultiLookup(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	specs, res := parseSubdocMulti(req, false)
+	if res != nil {
+		return res
+	}
+	res, results := subdocLookup(v, req, specs)
+	if res.Status != gomemcached.SUCCESS {
+		return res
+	}
+	for _, r := range results {
+		value := r.value
+		if r.status != gomemcached.SUCCESS {
+			res.Status = SUBDOC_MULTI_PATH_FAILURE
+			value = nil // Only the REST API reports the reason.
+		}
+		b := make([]byte, 6, 6+len(value))
+		binary.BigEndian.PutUint16(b, uint16(r.status))
+		binary.BigEndian.PutUint32(b[2:], uint32(len(value)))
+		res.Body = append(res.Body, append(b, value...)...)
+	}
+	return res
+}
+
+// Handles SUBDOC_MULTI_MUTATION, whose extras are an optional
+// expiration (4 bytes), and whose body is a sequence of specs, each
+// an opcode (1 byte), flags (1 byte), path length (2 bytes), value
+// length (4 bytes), path and value.  The specs are applied all or
+// nothing.  On success, the response body has the index (1 byte),
+// status (2 bytes), value length (4 bytes) and value of each spec
+// that results in a value, like a counter.  Otherwise, the status is
+// MULTI_PATH_FAILURE, with the index and status of the failed spec.
+func vbSubdocMultiMutation(v *VBucket, w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	specs, res := parseSubdocMulti(req, true)
+	if res != nil {
+		return res
+	}
+	var exp *uint32
+	if len(req.Extras) == 4 {
+		e := binary.BigEndian.Uint32(req.Extras)
+		exp = &e
+	}
+	res, results, serr := subdocMutate(v, req, specs, exp)
+	if serr != nil {
+		res = &gomemcached.MCResponse{
+			Status: SUBDOC_MULTI_PATH_FAILURE,
+			Body:   make([]byte, 3),
+		}
+		res.Body[0] = uint8(serr.index)
+		binary.BigEndian.PutUint16(res.Body[1:], uint16(serr.status))
+		return res
+	}
+	if res.Status != gomemcached.SUCCESS {
+		return res
+	}
+	for i, r := range results {
+		if r.value == nil {
+			continue
+		}
+		b := make([]byte, 7, 7+len(r.value))
+		b[0] = uint8(i)
+		binary.BigEndian.PutUint16(b[1:], uint16(r.status))
+		binary.BigEndian.PutUint32(b[3:], uint32(len(r.value)))
+		res.Body = append(res.Body, append(b, r.value...)...)
+	}
+	return res
+}
+
+func parseSubdocSingle(req *gomemcached.MCRequest,
+	mutation bool) (subdocSpec, *gomemcached.MCResponse) {
+	if len(req.Extras) != 3 && (!mutation || len(req.Extras) != 7) {
+		return subdocSpec{}, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for subdoc: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	pathLen := int(binary.BigEndian.Uint16(req.Extras))
+	if pathLen > len(req.Body) || (!mutation && pathLen != len(req.Body)) {
+		return subdocSpec{}, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(fmt.Sprintf("wrong path length: %v", pathLen)),
+		}
+	}
+	return subdocSpec{
+		op:    req.Opcode,
+		flags: req.Extras[2],
+		path:  string(req.Body[:pathLen]),
+		value: req.Body[pathLen:],
+	}, nil
+}
+
+func parseSubdocMulti(req *gomemcached.MCRequest,
+	mutation bool) ([]subdocSpec, *gomemcached.MCResponse) {
+	if len(req.Extras) != 0 && (!mutation || len(req.Extras) != 4) {
+		return nil, &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body: []byte(fmt.Sprintf("wrong extras size for subdoc: %v on key %v",
+				len(req.Extras), req.Key)),
+		}
+	}
+	hdrLen := 4
+	if mutation {
+		hdrLen = 8
+	}
+	var specs []subdocSpec
+	for b := req.Body; len(b) > 0; {
+		if len(b) < hdrLen {
+			return nil, &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("truncated subdoc spec"),
+			}
+		}
+		spec := subdocSpec{op: gomemcached.CommandCode(b[0]), flags: b[1]}
+		pathLen := int(binary.BigEndian.Uint16(b[2:]))
+		valLen := 0
+		if mutation {
+			valLen = int(binary.BigEndian.Uint32(b[4:]))
+		}
+		b = b[hdrLen:]
+		if pathLen+valLen > len(b) || pathLen+valLen < 0 {
+			return nil, &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte("truncated subdoc spec"),
+			}
+		}
+		spec.path = string(b[:pathLen])
+		spec.value = b[pathLen : pathLen+valLen]
+		b = b[pathLen+valLen:]
+		if (mutation && !isSubdocMutation(spec.op)) ||
+			(!mutation && !isSubdocLookup(spec.op)) {
+			return nil, &gomemcached.MCResponse{
+				Status: SUBDOC_INVALID_COMBO,
+				Body:   []byte(fmt.Sprintf("opcode not allowed: %v", spec.op)),
+			}
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 || len(specs) > SUBDOC_MAX_SPECS {
+		return nil, &gomemcached.MCResponse{
+			Status: SUBDOC_INVALID_COMBO,
+			Body:   []byte(fmt.Sprintf("wrong number of specs: %v", len(specs))),
+		}
+	}
+	return specs, nil
+}
+
+// Looks up the specs in a document, returning the per-spec results,
+// with a successful response that has the document's CAS.
+func subdocLookup(v *VBucket, req *gomemcached.MCRequest,
+	specs []subdocSpec) (res *gomemcached.MCResponse, results []subdocResult) {
+	atomic.AddInt64(&v.stats.Gets, 1)
+
+	now := time.Now()
+
+	v.Apply(func() {
+		i, err := v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get error %v", err)),
+			}
+			return
+		}
+		if i == nil {
+			atomic.AddInt64(&v.stats.GetMisses, 1)
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+		data, err := i.value()
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+			}
+			return
+		}
+		doc, serr := parseSubdocDoc(data)
+		if serr != nil {
+			res = &gomemcached.MCResponse{
+				Status: serr.status,
+				Body:   []byte(serr.msg),
+			}
+			return
+		}
+
+		results = make([]subdocResult, len(specs))
+		for j := range specs {
+			value, serr := subdocLookupDoc(doc, &specs[j])
+			if serr != nil {
+				results[j] = subdocResult{status: serr.status, value: []byte(serr.msg)}
+				continue
+			}
+			results[j] = subdocResult{value: value}
+			atomic.AddInt64(&v.stats.OutgoingValueBytes, int64(len(value)))
+		}
+
+		res = &gomemcached.MCResponse{Cas: i.cas}
+		if _, locked := v.locks.lockedCas(req.Key, now); locked {
+			res.Cas = LOCKED_CAS
+		}
+	})
+
+	return res, results
+}
+
+// Applies the specs to a document, all or nothing, as one mutation
+// with a new CAS, keeping the item's flags, and its expiration unless
+// exp is given.  A spec that fails is returned as a subdocError,
+// otherwise the response is the mutation's.
+func subdocMutate(v *VBucket, req *gomemcached.MCRequest, specs []subdocSpec,
+	exp *uint32) (res *gomemcached.MCResponse, results []subdocResult,
+	serr *subdocError) {
+	atomic.AddInt64(&v.stats.Mutations, 1)
+
+	var deltaItemBytes int64
+	var itemOld, itemNew *item
+	var err error
+	now := time.Now()
+
+	v.Apply(func() {
+		itemOld, err = v.getUnexpired(req.Key, now)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store get itemOld error %v", err)),
+			}
+			return
+		}
+		if itemOld == nil {
+			err = ignore
+			res = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			return
+		}
+
+		res, err = vbMutateValidate(v, nil, req, req.Opcode, itemOld)
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = itemOld.value()
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store value error %v", err)),
+			}
+			return
+		}
+		doc, derr := parseSubdocDoc(data)
+		if derr != nil {
+			err = ignore
+			res = &gomemcached.MCResponse{
+				Status: derr.status,
+				Body:   []byte(derr.msg),
+			}
+			return
+		}
+
+		results = make([]subdocResult, len(specs))
+		for i := range specs {
+			value, e := subdocMutateDoc(doc, &specs[i])
+			if e != nil {
+				e.index = i
+				err, serr = ignore, e
+				return
+			}
+			results[i] = subdocResult{value: value}
+		}
+
+		itemNew = &item{
+			key:  req.Key,
+			flag: itemOld.flag,
+			exp:  itemOld.exp,
+			cas:  atomic.AddUint64(&v.Meta().LastCas, 1),
+			data: encodeSubdocJSON(doc),
+		}
+		if exp != nil {
+			itemNew.exp = computeExp(*exp, time.Now)
+		}
+		if len(itemNew.data) > MAX_ITEM_DATA_LENGTH {
+			err = ignore
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.E2BIG,
+				Body: []byte(fmt.Sprintf("data too big: %v, key: %v",
+					len(itemNew.data), req.Key)),
+			}
+			return
+		}
+		if res = v.checkQuota(req.Key, itemNew, itemOld); res != nil {
+			err = ignore
+			return
+		}
+
+		deltaItemBytes, err = v.ps.set(itemNew, itemOld)
+		if err != nil {
+			res = &gomemcached.MCResponse{
+				Status: gomemcached.TMPFAIL,
+				Body:   []byte(fmt.Sprintf("Store set error %v", err)),
+			}
+			return
+		}
+		v.locks.unlock(req.Key)
+		v.trackExpirable(itemNew)
+	})
+
+	if err != nil {
+		if err != ignore {
+			atomic.AddInt64(&v.stats.StoreErrors, 1)
+		}
+		return res, nil, serr
+	}
+
+	atomic.AddInt64(&v.stats.Updates, 1)
+	atomic.AddInt64(&v.stats.IncomingValueBytes, int64(len(req.Body)))
+	atomic.AddInt64(&v.stats.ItemBytes, deltaItemBytes)
+	atomic.AddInt64(v.bucketItemBytes, deltaItemBytes)
+
+	v.markStale()
+	v.observer.Submit(mutation{v.vbid, req.Key, itemNew.cas, false, false})
+
+	return &gomemcached.MCResponse{Cas: itemNew.cas}, results, nil
+}
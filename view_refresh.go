@@ -137,7 +137,11 @@ func (v *VBucket) viewsRefreshItem(ddocs *DDocs,
 		func() {
 			if oldBackIndexItem != nil {
 				var viewEmitsOld map[string]ViewRows
-				err = jsonUnmarshal(oldBackIndexItem.data, &viewEmitsOld)
+				var oldData []byte
+				if oldData, err = oldBackIndexItem.value(); err != nil {
+					return
+				}
+				err = jsonUnmarshal(oldData, &viewEmitsOld)
 				if err != nil {
 					return
 				}
@@ -162,11 +166,15 @@ func (v *VBucket) execViewMapFunction(ddocId string, ddoc *DDoc,
 		return nil, err
 	}
 	docId := string(i.key)
+	data, err := i.value()
+	if err != nil {
+		return nil, err
+	}
 	docType := "json"
 	var doc interface{}
-	err = jsonUnmarshal(i.data, &doc)
+	err = jsonUnmarshal(data, &doc)
 	if err != nil {
-		doc = base64.StdEncoding.EncodeToString(i.data)
+		doc = base64.StdEncoding.EncodeToString(data)
 		docType = "base64"
 	}
 	odoc, err := OttoFromGo(pvmf.otto, doc)